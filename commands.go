@@ -0,0 +1,199 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"sort"
+
+	"github.com/dtylman/gitmoo-goog/downloader"
+)
+
+// command an operation on the backup folder, selected by the first argument
+// after the global flags
+type command struct {
+	usage string
+	run   func(downloader *downloader.Downloader, args []string) error
+}
+
+var commands = map[string]command{
+	"checksums": {
+		usage: "rewrite the SHA256SUMS files of all folders",
+		run:   runChecksums,
+	},
+	"dedupe": {
+		usage: "find items with identical content and apply -dedupe to them",
+		run:   runDedupe,
+	},
+	"duplicates": {
+		usage: "report groups of near-identical images, such as resized copies",
+		run:   runDuplicates,
+	},
+	"import-locations": {
+		usage: "store the locations of Google Takeout metadata in the matching items",
+		run:   runImportLocations,
+	},
+	"import-takeout": {
+		usage: "import the media of Google Takeout archives with their metadata",
+		run:   runImportTakeout,
+	},
+	"migrate": {
+		usage: "move existing items to the paths given by the current naming flags",
+		run:   runMigrate,
+	},
+	"pack": {
+		usage: "pack the files of finished folders into archives, as given by -pack",
+		run:   runPack,
+	},
+	"restore": {
+		usage: "write all items to a folder as loose files, unpacking packed folders and decrypting encrypted files",
+		run:   runRestore,
+	},
+	"verify": {
+		usage: "check the media files of all items and find files without items",
+		run:   runVerify,
+	},
+}
+
+// usage prints the global flags and the commands
+func usage() {
+	out := flag.CommandLine.Output()
+	fmt.Fprintf(out, "Usage of %v: [flags] [command [command flags]]\n", os.Args[0])
+	flag.PrintDefaults()
+	fmt.Fprintf(out, "Commands (default is to download):\n")
+	names := make([]string, 0, len(commands))
+	for name := range commands {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		fmt.Fprintf(out, "  %v\n    \t%v\n", name, commands[name].usage)
+	}
+}
+
+// commandFlags creates the flag set of a command
+func commandFlags(name string) *flag.FlagSet {
+	flags := flag.NewFlagSet(name, flag.ExitOnError)
+	flags.Usage = func() {
+		fmt.Fprintf(flags.Output(), "Usage of %v [flags] %v:\n", os.Args[0], name)
+		flags.PrintDefaults()
+	}
+	return flags
+}
+
+func runMigrate(downloader *downloader.Downloader, args []string) error {
+	flags := commandFlags("migrate")
+	dryRun := flags.Bool("dry-run", false, "only print the moves")
+	flags.Parse(args)
+	return downloader.Migrate(*dryRun)
+}
+
+func runDedupe(downloader *downloader.Downloader, args []string) error {
+	flags := commandFlags("dedupe")
+	dryRun := flags.Bool("dry-run", false, "only report the duplicates")
+	flags.Parse(args)
+	return downloader.Dedupe(*dryRun)
+}
+
+func runChecksums(downloader *downloader.Downloader, args []string) error {
+	flags := commandFlags("checksums")
+	flags.Parse(args)
+	return downloader.WriteChecksums()
+}
+
+func runDuplicates(downloader *downloader.Downloader, args []string) error {
+	flags := commandFlags("duplicates")
+	format := flags.String("format", "json", "report format: json or csv")
+	distance := flags.Int("distance", 6, "largest Hamming distance, out of 64 bits, between perceptual hashes of near-identical images")
+	output := flags.String("output", "", "write the report to this file (default standard output)")
+	flags.Parse(args)
+
+	w := os.Stdout
+	if *output != "" {
+		file, err := os.Create(*output)
+		if err != nil {
+			return err
+		}
+		defer file.Close()
+		w = file
+	}
+	return downloader.Duplicates(w, *format, *distance)
+}
+
+func runImportTakeout(downloader *downloader.Downloader, args []string) error {
+	flags := commandFlags("import-takeout")
+	flags.Usage = func() {
+		fmt.Fprintf(flags.Output(), "Usage of %v [flags] import-takeout archive...:\n", os.Args[0])
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+	if flags.NArg() == 0 {
+		flags.Usage()
+		return fmt.Errorf("missing Takeout archives")
+	}
+	return downloader.ImportTakeout(flags.Args())
+}
+
+func runImportLocations(downloader *downloader.Downloader, args []string) error {
+	flags := commandFlags("import-locations")
+	flags.Usage = func() {
+		fmt.Fprintf(flags.Output(), "Usage of %v [flags] import-locations [flags] archive...:\n", os.Args[0])
+		flags.PrintDefaults()
+	}
+	exif := flags.Bool("exif", false, "also write the locations as EXIF GPS tags of JPEG files")
+	output := flags.String("output", "", "write the report of unmatched locations to this file (default standard output)")
+	flags.Parse(args)
+	if flags.NArg() == 0 {
+		flags.Usage()
+		return fmt.Errorf("missing Takeout archives")
+	}
+
+	w := os.Stdout
+	if *output != "" {
+		file, err := os.Create(*output)
+		if err != nil {
+			return err
+		}
+		defer file.Close()
+		w = file
+	}
+	return downloader.ImportLocations(w, flags.Args(), *exif)
+}
+
+func runVerify(downloader *downloader.Downloader, args []string) error {
+	flags := commandFlags("verify")
+	repair := flags.Bool("repair", false, "queue items with bad or missing media files to be downloaded again on the next run")
+	output := flags.String("output", "", "write the report to this file (default standard output)")
+	flags.Parse(args)
+
+	w := os.Stdout
+	if *output != "" {
+		file, err := os.Create(*output)
+		if err != nil {
+			return err
+		}
+		defer file.Close()
+		w = file
+	}
+	return downloader.Verify(w, *repair)
+}
+
+func runPack(downloader *downloader.Downloader, args []string) error {
+	flags := commandFlags("pack")
+	flags.Parse(args)
+	return downloader.Pack()
+}
+
+func runRestore(downloader *downloader.Downloader, args []string) error {
+	flags := commandFlags("restore")
+	flags.Usage = func() {
+		fmt.Fprintf(flags.Output(), "Usage of %v [flags] restore folder:\n", os.Args[0])
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+	if flags.NArg() != 1 {
+		flags.Usage()
+		return fmt.Errorf("missing restore folder")
+	}
+	return downloader.Restore(flags.Arg(0))
+}
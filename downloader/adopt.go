@@ -0,0 +1,347 @@
+package downloader
+
+import (
+	"encoding/json"
+	"fmt"
+	"image"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	photoslibrary "github.com/gphotosuploader/googlemirror/api/photoslibrary/v1"
+)
+
+const (
+	//AdoptCopy copy adopted files into the backup folder
+	AdoptCopy = "copy"
+	//AdoptMove move adopted files into the backup folder
+	AdoptMove = "move"
+	//AdoptHardlink hard link adopted files into the backup folder, which must be on the same file system
+	AdoptHardlink = "hardlink"
+	//AdoptReflink clone adopted files into the backup folder, on file systems supporting copy-on-write clones
+	AdoptReflink = "reflink"
+)
+
+// adoptIndexFileName file in the backup folder caching the index of the adopt
+// folder, so unchanged files are not read again
+const adoptIndexFileName = ".gitmoo-adopt.json"
+
+// adoptTimeTolerance largest difference between the time of an adopted file
+// and the creation time of an item, some file systems keep 2 second times
+const adoptTimeTolerance = 2 * time.Second
+
+// adoptConflictSuffix suffix tools add to names of different files with the
+// same name, e.g. `IMG_1234 (1).jpg` or `IMG_1234(1).jpg`
+var adoptConflictSuffix = regexp.MustCompile(` ?\(\d+\)$`)
+
+// ValidateAdoptMode returns an error for unknown adopt modes
+func ValidateAdoptMode(mode string) error {
+	switch mode {
+	case "", AdoptCopy, AdoptMove, AdoptHardlink, AdoptReflink:
+		return nil
+	}
+	return fmt.Errorf("unknown adopt mode '%v', use %v, %v, %v or %v", mode, AdoptCopy, AdoptMove, AdoptHardlink, AdoptReflink)
+}
+
+// adoptFile a file in the adopt folder
+type adoptFile struct {
+	Path    string
+	Size    int64
+	ModTime time.Time
+	//Taken capture time read from the EXIF data, RFC3339
+	Taken  string `json:",omitempty"`
+	Width  int    `json:",omitempty"`
+	Height int    `json:",omitempty"`
+	SHA256 string `json:",omitempty"`
+}
+
+// adoptIndex the files of the adopt folder by normalized name
+type adoptIndex struct {
+	files map[string][]*adoptFile
+}
+
+// adoptName the name of a file without conflict suffixes and ignoring the
+// case, files are matched to items by it
+func adoptName(fileName string) string {
+	ext := filepath.Ext(fileName)
+	base := adoptConflictSuffix.ReplaceAllString(strings.TrimSuffix(fileName, ext), "")
+	return strings.ToLower(base + ext)
+}
+
+// readAdoptFile Read the capture time, dimensions and optionally the hash of a
+// file
+func (d *Downloader) readAdoptFile(file *adoptFile) error {
+	mimeType := mimeTypeByExtension(file.Path)
+	if mimeType == "image/jpeg" {
+		x, err := readEXIFFile(file.Path)
+		if err == nil {
+			taken := findEXIFEntry(x.exif, exifTagDateTimeOriginal).ascii()
+			location, err := d.timeZone()
+			if err != nil {
+				return err
+			}
+			if offset := x.offsetTimeOriginal(); offset != "" {
+				zone, err := parseUTCOffset(offset)
+				if err == nil {
+					location = zone
+				}
+			}
+			t, err := time.ParseInLocation("2006:01:02 15:04:05", taken, location)
+			if err == nil {
+				file.Taken = t.UTC().Format(time.RFC3339)
+			}
+		}
+	}
+	if strings.HasPrefix(mimeType, "image/") {
+		input, err := os.Open(file.Path)
+		if err != nil {
+			return err
+		}
+		config, _, err := image.DecodeConfig(input)
+		input.Close()
+		if err == nil {
+			file.Width = config.Width
+			file.Height = config.Height
+		}
+	}
+	if d.Options.AdoptHash {
+		hash, err := hashFile(file.Path)
+		if err != nil {
+			return err
+		}
+		file.SHA256 = hash
+	}
+	return nil
+}
+
+// loadAdoptIndex Index the media files of the adopt folder. Files with the
+// same size and modification time as in the cached index are not read again.
+func (d *Downloader) loadAdoptIndex() (*adoptIndex, error) {
+	cachePath := filepath.Join(d.Options.BackupFolder, adoptIndexFileName)
+	cached := make(map[string]*adoptFile)
+	bytes, err := ioutil.ReadFile(cachePath)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	if err == nil {
+		var files []*adoptFile
+		err = json.Unmarshal(bytes, &files)
+		if err != nil {
+			return nil, err
+		}
+		for _, file := range files {
+			cached[file.Path] = file
+		}
+	}
+
+	backupFolder, err := filepath.Abs(d.Options.BackupFolder)
+	if err != nil {
+		return nil, err
+	}
+	var files []*adoptFile
+	err = filepath.Walk(d.Options.AdoptFolder, func(filePath string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.IsDir() {
+			absolute, err := filepath.Abs(filePath)
+			if err == nil && absolute == backupFolder {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		mimeType := mimeTypeByExtension(info.Name())
+		if !info.Mode().IsRegular() || (!strings.HasPrefix(mimeType, "image/") && !strings.HasPrefix(mimeType, "video/")) {
+			return nil
+		}
+		file := cached[filePath]
+		if file == nil || file.Size != info.Size() || !file.ModTime.Equal(info.ModTime()) || (d.Options.AdoptHash && file.SHA256 == "") {
+			file = &adoptFile{Path: filePath, Size: info.Size(), ModTime: info.ModTime()}
+			err = d.readAdoptFile(file)
+			if err != nil {
+				return err
+			}
+		}
+		files = append(files, file)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	index := &adoptIndex{files: make(map[string][]*adoptFile)}
+	for _, file := range files {
+		name := adoptName(filepath.Base(file.Path))
+		index.files[name] = append(index.files[name], file)
+	}
+	log.Printf("Indexed %v files to adopt in '%v'", len(files), d.Options.AdoptFolder)
+
+	bytes, err = json.MarshalIndent(files, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+	return index, ioutil.WriteFile(cachePath, bytes, 0644)
+}
+
+// matches returns true if a file can be the content of an item, by its time
+// and dimensions
+func (f *adoptFile) matches(item *photoslibrary.MediaItem, created time.Time) bool {
+	if item.MediaMetadata.Width != 0 && f.Width != 0 && (item.MediaMetadata.Width != int64(f.Width) || item.MediaMetadata.Height != int64(f.Height)) {
+		return false
+	}
+	if taken, err := time.Parse(time.RFC3339, f.Taken); err == nil && taken.Equal(created) {
+		return true
+	}
+	difference := f.ModTime.Sub(created)
+	return difference <= adoptTimeTolerance && difference >= -adoptTimeTolerance
+}
+
+// match Find and remove the file holding the content of an item. Matching
+// files of different sizes or hashes are ambiguous and none is returned.
+func (a *adoptIndex) match(item *photoslibrary.MediaItem) *adoptFile {
+	if item.MediaMetadata == nil {
+		return nil
+	}
+	created, err := time.Parse(time.RFC3339, item.MediaMetadata.CreationTime)
+	if err != nil {
+		return nil
+	}
+	name := adoptName(item.Filename)
+	var matches []*adoptFile
+	for _, file := range a.files[name] {
+		if file.matches(item, created) {
+			matches = append(matches, file)
+		}
+	}
+	if len(matches) == 0 {
+		return nil
+	}
+	sort.Slice(matches, func(i, j int) bool { return matches[i].Path < matches[j].Path })
+	for _, file := range matches[1:] {
+		if file.Size != matches[0].Size || file.SHA256 != matches[0].SHA256 {
+			log.Printf("Not adopting '%v' [id %v], ambiguous: '%v' and '%v'", item.Filename, item.Id, matches[0].Path, file.Path)
+			return nil
+		}
+	}
+
+	files := a.files[name]
+	for i, file := range files {
+		if file == matches[0] {
+			a.files[name] = append(files[:i], files[i+1:]...)
+			break
+		}
+	}
+	return matches[0]
+}
+
+// copyFile Copy a file, through a temporary file so target is never partial
+func copyFile(source string, target string) error {
+	input, err := os.Open(source)
+	if err != nil {
+		return err
+	}
+	defer input.Close()
+	temp := target + ".adopt"
+	output, err := os.Create(temp)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(output, input)
+	closeErr := output.Close()
+	if err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(temp, target)
+	}
+	if err != nil {
+		os.Remove(temp)
+	}
+	return err
+}
+
+// placeAdoptFile Put an adopted file at target according to the adopt mode
+func placeAdoptFile(source string, target string, mode string) error {
+	switch mode {
+	case AdoptMove:
+		err := os.Rename(source, target)
+		if err == nil {
+			return nil
+		}
+		//Moving across file systems
+		err = copyFile(source, target)
+		if err != nil {
+			return err
+		}
+		return os.Remove(source)
+	case AdoptHardlink:
+		return os.Link(source, target)
+	case AdoptReflink:
+		return reflink(source, target)
+	}
+	return copyFile(source, target)
+}
+
+// adoptLocal Store the matching file of the adopt folder as the media file of
+// an item, instead of downloading it. Returns true if a file was adopted.
+func (d *Downloader) adoptLocal(item *LibraryItem, filePath string) (bool, error) {
+	if d.adopt == nil {
+		return false, nil
+	}
+	file := d.adopt.match(&item.MediaItem)
+	if file == nil {
+		return false, nil
+	}
+	err := os.MkdirAll(filepath.Dir(filePath), 0700)
+	if err != nil {
+		return false, err
+	}
+	err = placeAdoptFile(file.Path, filePath, d.Options.AdoptMode)
+	if err != nil {
+		return false, err
+	}
+	d.names.add(filePath)
+	err = d.finishAdopt(item, file, filePath)
+	if err != nil {
+		//Never leave a link to the adopted file where the download goes
+		if d.Options.AdoptMode == AdoptMove {
+			os.Rename(filePath, file.Path)
+		} else {
+			os.Remove(filePath)
+		}
+		return false, err
+	}
+	d.stats.UpdateStatsAdopted(1)
+	return true, nil
+}
+
+// finishAdopt Update an item from its adopted file and save its sidecar
+func (d *Downloader) finishAdopt(item *LibraryItem, file *adoptFile, filePath string) error {
+	if d.Options.AdoptMode != AdoptHardlink {
+		//A hard link shares the time of the file in the adopt folder
+		t, err := time.Parse(time.RFC3339, item.MediaMetadata.CreationTime)
+		if err == nil {
+			err = os.Chtimes(filePath, time.Now(), t)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	log.Printf("Adopted '%v' [saved as '%v'] from '%v'", item.Filename, item.UsedFileName, file.Path)
+
+	item.SHA256 = file.SHA256
+	if item.SHA256 == "" {
+		var err error
+		item.SHA256, err = hashFile(filePath)
+		if err != nil {
+			return err
+		}
+	}
+	return d.finishDownload(item, filePath)
+}
@@ -0,0 +1,125 @@
+package downloader
+
+import (
+	"bytes"
+	"image/jpeg"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	photoslibrary "github.com/gphotosuploader/googlemirror/api/photoslibrary/v1"
+)
+
+// adoptTestItem an item created at 2019-10-13T17:33:43Z
+func adoptTestItem(id string, filename string) *LibraryItem {
+	item := new(LibraryItem)
+	item.Id = id
+	item.Filename = filename
+	item.MimeType = "image/jpeg"
+	item.MediaMetadata = &photoslibrary.MediaMetadata{CreationTime: "2019-10-13T17:33:43Z", Width: 64, Height: 48}
+	return item
+}
+
+func TestAdoptName(t *testing.T) {
+	names := map[string]string{
+		"IMG_1234.JPG":     "img_1234.jpg",
+		"IMG_1234 (1).jpg": "img_1234.jpg",
+		"IMG_1234(12).jpg": "img_1234.jpg",
+		"Trip (Day 1).mp4": "trip (day 1).mp4",
+	}
+	for name, want := range names {
+		if got := adoptName(name); got != want {
+			t.Errorf("adoptName(%v) = %v; want %v", name, got, want)
+		}
+	}
+}
+
+func TestAdopt(t *testing.T) {
+	downloader := NewDownloader()
+	downloader.Options.BackupFolder = tempPath()
+	defer os.RemoveAll(downloader.Options.BackupFolder)
+	downloader.Options.AdoptFolder = tempPath()
+	downloader.Options.AdoptHash = true
+	defer os.RemoveAll(downloader.Options.AdoptFolder)
+
+	created, _ := time.Parse(time.RFC3339, "2019-10-13T17:33:43Z")
+	encoded := new(bytes.Buffer)
+	jpeg.Encode(encoded, testImage(64, 48, false), nil)
+	writeFile := func(name string, data []byte, modTime time.Time) string {
+		filePath := filepath.Join(downloader.Options.AdoptFolder, name)
+		os.MkdirAll(filepath.Dir(filePath), 0700)
+		ioutil.WriteFile(filePath, data, 0644)
+		os.Chtimes(filePath, modTime, modTime)
+		return filePath
+	}
+	copied := writeFile("2019/IMG_1.jpg", encoded.Bytes(), created)
+	moved := writeFile("2019/IMG_2 (1).jpg", encoded.Bytes(), created.Add(time.Second))
+	//Matched by the capture time in the EXIF data
+	exif := writeFile("phone/IMG_3.jpg", testJPEG("-08:00"), time.Now())
+	embedEXIF(exif, []*exifTag{asciiTag(exifIFDExif, exifTagDateTimeOriginal, "2019:10:13 09:33:43")})
+	writeFile("2019/IMG_4.jpg", encoded.Bytes(), created)
+	writeFile("copy/IMG_4.jpg", append(encoded.Bytes(), 0), created)
+	writeFile("2019/IMG_5.jpg", encoded.Bytes(), created.Add(time.Hour))
+
+	var err error
+	downloader.adopt, err = downloader.loadAdoptIndex()
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	if _, err := os.Stat(filepath.Join(downloader.Options.BackupFolder, adoptIndexFileName)); err != nil {
+		t.Errorf("the index should be cached: %v", err)
+	}
+
+	adopt := func(item *LibraryItem) bool {
+		item.UsedFileName = downloader.createFileName(item, 0)
+		adopted, err := downloader.adoptLocal(item, downloader.getImageFilePath(item))
+		if err != nil {
+			t.Fatalf("%v", err)
+		}
+		return adopted
+	}
+
+	item := adoptTestItem("ABCDEFGHIJKLMNOPQRSTUVW1", "IMG_1.jpg")
+	if !adopt(item) {
+		t.Fatalf("IMG_1.jpg should be adopted")
+	}
+	data, _ := ioutil.ReadFile(downloader.getImageFilePath(item))
+	if !bytes.Equal(data, encoded.Bytes()) {
+		t.Errorf("adopted content differs")
+	}
+	if _, err := os.Stat(copied); err != nil {
+		t.Errorf("copied file should be kept: %v", err)
+	}
+	stored, err := loadSidecar(downloader.storage, downloader.getJSONFilePath(&item.MediaItem))
+	if err != nil || stored == nil || stored.SHA256 == "" {
+		t.Errorf("sidecar with SHA256 should be written, got %v, %v", stored, err)
+	}
+	if adopt(adoptTestItem("ABCDEFGHIJKLMNOPQRSTUVW0", "IMG_1.jpg")) {
+		t.Errorf("a file should only be adopted once")
+	}
+
+	downloader.Options.AdoptMode = AdoptMove
+	if !adopt(adoptTestItem("ABCDEFGHIJKLMNOPQRSTUVW2", "img_2.JPG")) {
+		t.Errorf("IMG_2 (1).jpg should be adopted")
+	}
+	if _, err := os.Stat(moved); !os.IsNotExist(err) {
+		t.Errorf("moved file should be removed")
+	}
+
+	exifItem := adoptTestItem("ABCDEFGHIJKLMNOPQRSTUVW3", "IMG_3.jpg")
+	exifItem.MediaMetadata.Width = 0
+	if !adopt(exifItem) {
+		t.Errorf("IMG_3.jpg should be adopted by its EXIF capture time")
+	}
+	if adopt(adoptTestItem("ABCDEFGHIJKLMNOPQRSTUVW4", "IMG_4.jpg")) {
+		t.Errorf("files with different content are ambiguous")
+	}
+	if adopt(adoptTestItem("ABCDEFGHIJKLMNOPQRSTUVW5", "IMG_5.jpg")) {
+		t.Errorf("IMG_5.jpg has another time")
+	}
+	if downloader.stats.Adopted != 3 {
+		t.Errorf("Adopted = %v; want 3", downloader.stats.Adopted)
+	}
+}
@@ -0,0 +1,321 @@
+package downloader
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/dustin/go-humanize"
+	"golang.org/x/time/rate"
+)
+
+// bandwidthBurst is the largest chunk (in bytes) a download stream may take
+// from the shared limiter at once
+const bandwidthBurst = 32 * 1024
+
+// bandwidthCheckInterval how often the shared limiter re-evaluates the schedule
+const bandwidthCheckInterval = time.Minute
+
+var weekDays = []string{"sun", "mon", "tue", "wed", "thu", "fri", "sat"}
+
+// bandwidthRule a single window of a bandwidth schedule
+type bandwidthRule struct {
+	//days the rule applies to, indexed by time.Weekday
+	days [7]bool
+	//from, to minutes since midnight, from == to means all day
+	from int
+	to   int
+	//rate in bytes/sec, 0 means unlimited
+	rate float64
+}
+
+// matches returns true if the rule applies at the given time
+func (r *bandwidthRule) matches(t time.Time) bool {
+	minute := t.Hour()*60 + t.Minute()
+	day := t.Weekday()
+	if r.from == r.to {
+		return r.days[day]
+	}
+	if r.from < r.to {
+		return r.days[day] && minute >= r.from && minute < r.to
+	}
+	//Window wraps past midnight, the early part belongs to the previous day
+	if minute >= r.from {
+		return r.days[day]
+	}
+	if minute < r.to {
+		return r.days[(day+6)%7]
+	}
+	return false
+}
+
+// BandwidthSchedule a list of time-of-day windows with a download rate each,
+// for example `Mon-Fri 08:00-18:00=200KB, *=unlimited`. The first matching
+// rule wins.
+type BandwidthSchedule struct {
+	rules []bandwidthRule
+}
+
+// ParseBandwidthSchedule parses a comma separated list of rules in the form
+// `[days] [HH:MM-HH:MM]=rate`. Days is `*`, a day (`Sat`) or a range of days
+// (`Mon-Fri`). Rate is a number with an optional B, KB, MB or GB unit (per
+// second, KB is the default as in -download-throttle), or `unlimited`.
+func ParseBandwidthSchedule(schedule string) (*BandwidthSchedule, error) {
+	s := new(BandwidthSchedule)
+	for _, text := range strings.Split(schedule, ",") {
+		text = strings.TrimSpace(text)
+		if text == "" {
+			continue
+		}
+		rule, err := parseBandwidthRule(text)
+		if err != nil {
+			return nil, fmt.Errorf("invalid bandwidth rule '%v': %v", text, err)
+		}
+		s.rules = append(s.rules, rule)
+	}
+	if len(s.rules) == 0 {
+		return nil, fmt.Errorf("bandwidth schedule '%v' has no rules", schedule)
+	}
+	return s, nil
+}
+
+// parseBandwidthRule parses a single schedule rule
+func parseBandwidthRule(text string) (bandwidthRule, error) {
+	var rule bandwidthRule
+
+	index := strings.LastIndex(text, "=")
+	if index < 0 {
+		return rule, fmt.Errorf("missing '=rate'")
+	}
+	var err error
+	rule.rate, err = parseBandwidthRate(text[index+1:])
+	if err != nil {
+		return rule, err
+	}
+
+	days := "*"
+	window := ""
+	fields := strings.Fields(text[:index])
+	switch len(fields) {
+	case 0:
+	case 1:
+		if strings.Contains(fields[0], ":") {
+			window = fields[0]
+		} else {
+			days = fields[0]
+		}
+	case 2:
+		days = fields[0]
+		window = fields[1]
+	default:
+		return rule, fmt.Errorf("expected '[days] [HH:MM-HH:MM]'")
+	}
+
+	rule.days, err = parseWeekDays(days)
+	if err != nil {
+		return rule, err
+	}
+	if window != "" {
+		parts := strings.Split(window, "-")
+		if len(parts) != 2 {
+			return rule, fmt.Errorf("invalid time window '%v'", window)
+		}
+		rule.from, err = parseClock(parts[0])
+		if err != nil {
+			return rule, err
+		}
+		rule.to, err = parseClock(parts[1])
+		if err != nil {
+			return rule, err
+		}
+	}
+	return rule, nil
+}
+
+// parseWeekDays parses `*`, `Mon` or `Mon-Fri`
+func parseWeekDays(text string) ([7]bool, error) {
+	var days [7]bool
+	if text == "*" {
+		for i := range days {
+			days[i] = true
+		}
+		return days, nil
+	}
+	parts := strings.Split(strings.ToLower(text), "-")
+	if len(parts) > 2 {
+		return days, fmt.Errorf("invalid days '%v'", text)
+	}
+	var bounds []int
+	for _, part := range parts {
+		day := -1
+		for i, name := range weekDays {
+			if strings.HasPrefix(part, name) {
+				day = i
+			}
+		}
+		if day < 0 {
+			return days, fmt.Errorf("invalid day '%v'", part)
+		}
+		bounds = append(bounds, day)
+	}
+	from, to := bounds[0], bounds[len(bounds)-1]
+	for day := from; ; day = (day + 1) % 7 {
+		days[day] = true
+		if day == to {
+			break
+		}
+	}
+	return days, nil
+}
+
+// parseClock parses HH:MM into minutes since midnight
+func parseClock(text string) (int, error) {
+	t, err := time.Parse("15:04", strings.TrimSpace(text))
+	if err != nil {
+		if strings.TrimSpace(text) == "24:00" {
+			return 0, nil
+		}
+		return 0, fmt.Errorf("invalid time '%v'", text)
+	}
+	return t.Hour()*60 + t.Minute(), nil
+}
+
+// parseBandwidthRate parses a rate such as `200KB` into bytes/sec, 0 is unlimited
+func parseBandwidthRate(text string) (float64, error) {
+	text = strings.ToUpper(strings.TrimSpace(text))
+	text = strings.TrimSuffix(strings.TrimSuffix(text, "/S"), "PS")
+	if text == "UNLIMITED" || text == "*" {
+		return 0, nil
+	}
+	multiplier := 1024.0
+	for _, unit := range []struct {
+		suffix     string
+		multiplier float64
+	}{{"GB", 1024 * 1024 * 1024}, {"MB", 1024 * 1024}, {"KB", 1024}, {"K", 1024}, {"B", 1}} {
+		if strings.HasSuffix(text, unit.suffix) {
+			text = strings.TrimSuffix(text, unit.suffix)
+			multiplier = unit.multiplier
+			break
+		}
+	}
+	value, err := strconv.ParseFloat(strings.TrimSpace(text), 64)
+	if err != nil || value < 0 {
+		return 0, fmt.Errorf("invalid rate '%v'", text)
+	}
+	return value * multiplier, nil
+}
+
+// RateAt returns the rate in bytes/sec at the given time, 0 means unlimited,
+// a negative value means no rule matched
+func (s *BandwidthSchedule) RateAt(t time.Time) float64 {
+	for i := range s.rules {
+		if s.rules[i].matches(t) {
+			return s.rules[i].rate
+		}
+	}
+	return -1
+}
+
+// bandwidthLimiter a process wide rate limiter shared by all download streams.
+// Streams take small chunks from a single token bucket, so capacity not used by
+// idle or finished downloads is available to the active ones.
+type bandwidthLimiter struct {
+	limiter  *rate.Limiter
+	schedule *BandwidthSchedule
+	//fallback rate in bytes/sec when the schedule does not match
+	fallback float64
+	checked  time.Time
+	current  float64
+	mutex    sync.Mutex
+	//now returns the current time, sleep waits for the tokens of a read
+	now   func() time.Time
+	sleep func(d time.Duration)
+}
+
+// newBandwidthLimiter creates a shared limiter following the given schedule
+func newBandwidthLimiter(schedule *BandwidthSchedule, fallback float64) *bandwidthLimiter {
+	b := new(bandwidthLimiter)
+	b.limiter = rate.NewLimiter(rate.Inf, bandwidthBurst)
+	b.schedule = schedule
+	b.fallback = fallback
+	b.now = time.Now
+	b.sleep = time.Sleep
+	b.refresh(b.now())
+	return b
+}
+
+// refresh re-evaluates the schedule and updates the shared rate if needed
+func (b *bandwidthLimiter) refresh(now time.Time) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	if !b.checked.IsZero() && now.Sub(b.checked) < bandwidthCheckInterval {
+		return
+	}
+	b.checked = now
+
+	bytesPerSec := b.fallback
+	if b.schedule != nil {
+		if scheduled := b.schedule.RateAt(now); scheduled >= 0 {
+			bytesPerSec = scheduled
+		}
+	}
+	if bytesPerSec == b.current {
+		return
+	}
+	b.current = bytesPerSec
+	if bytesPerSec <= 0 {
+		log.Printf("Download bandwidth limit: unlimited")
+		b.limiter.SetLimitAt(now, rate.Inf)
+	} else {
+		log.Printf("Download bandwidth limit: %v/s", humanize.IBytes(uint64(bytesPerSec)))
+		b.limiter.SetLimitAt(now, rate.Limit(bytesPerSec))
+	}
+}
+
+// wait blocks until n bytes may be read, n must not exceed bandwidthBurst
+func (b *bandwidthLimiter) wait(n int) error {
+	now := b.now()
+	b.refresh(now)
+	reservation := b.limiter.ReserveN(now, n)
+	if !reservation.OK() {
+		return fmt.Errorf("read of %v bytes exceeds the bandwidth burst of %v", n, bandwidthBurst)
+	}
+	b.sleep(reservation.DelayFrom(now))
+	return nil
+}
+
+// Reader wraps r so reads are limited by the shared rate, a nil limiter does not
+// limit
+func (b *bandwidthLimiter) Reader(r io.Reader) io.Reader {
+	if b == nil {
+		return r
+	}
+	return &limitedReader{reader: r, limiter: b}
+}
+
+// limitedReader a reader drawing from a shared bandwidthLimiter
+type limitedReader struct {
+	reader  io.Reader
+	limiter *bandwidthLimiter
+}
+
+// Read reads at most bandwidthBurst bytes at a time, so that concurrent
+// streams take turns on the shared limiter
+func (l *limitedReader) Read(p []byte) (int, error) {
+	if len(p) > bandwidthBurst {
+		p = p[:bandwidthBurst]
+	}
+	n, err := l.reader.Read(p)
+	if n > 0 {
+		waitErr := l.limiter.wait(n)
+		if err == nil {
+			err = waitErr
+		}
+	}
+	return n, err
+}
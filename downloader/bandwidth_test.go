@@ -0,0 +1,115 @@
+package downloader
+
+import (
+	"bytes"
+	"io"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseBandwidthSchedule(t *testing.T) {
+	schedule, err := ParseBandwidthSchedule("Mon-Fri 08:00-18:00=200KB, Sat 22:00-06:00=1MB, *=unlimited")
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+
+	tests := []struct {
+		name string
+		time string
+		want float64
+	}{
+		{"Work Hours", "2019-10-14T09:30:00Z", 200 * 1024},
+		{"Evening", "2019-10-14T18:00:00Z", 0},
+		{"Saturday Night", "2019-10-19T23:00:00Z", 1024 * 1024},
+		{"Sunday Morning", "2019-10-20T05:59:00Z", 1024 * 1024},
+		{"Sunday Noon", "2019-10-20T12:00:00Z", 0},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			at, _ := time.Parse(time.RFC3339, test.time)
+			have := schedule.RateAt(at)
+			if have != test.want {
+				t.Errorf("BandwidthSchedule.RateAt(%v) = %v; want %v", test.time, have, test.want)
+			}
+		})
+	}
+
+	t.Run("No Match", func(t *testing.T) {
+		schedule, err := ParseBandwidthSchedule("Sat-Sun=50")
+		if err != nil {
+			t.Fatalf("%v", err)
+		}
+		at, _ := time.Parse(time.RFC3339, "2019-10-14T09:30:00Z")
+		if have := schedule.RateAt(at); have >= 0 {
+			t.Errorf("BandwidthSchedule.RateAt() = %v; want no match", have)
+		}
+	})
+
+	t.Run("Invalid", func(t *testing.T) {
+		for _, text := range []string{"", "Mon-Fri", "Foo=1MB", "Mon 8-18=1MB", "*=fast"} {
+			_, err := ParseBandwidthSchedule(text)
+			if err == nil {
+				t.Errorf("ParseBandwidthSchedule(%v) should fail", text)
+			}
+		}
+	})
+}
+
+func TestSharedBandwidthLimiter(t *testing.T) {
+	t.Run("Unlimited", func(t *testing.T) {
+		var limiter *bandwidthLimiter
+		reader := strings.NewReader("abc")
+		if limiter.Reader(reader) != reader {
+			t.Errorf("nil bandwidthLimiter.Reader() should not wrap the reader")
+		}
+	})
+
+	t.Run("Shared", func(t *testing.T) {
+		//Two streams of 48KB at 64KB/sec total, the limiter starts without
+		//tokens so every 16KB waits 250ms
+		start := time.Now()
+		limiter := newBandwidthLimiter(nil, 64*1024)
+		clock := start
+		var waits []time.Duration
+		limiter.now = func() time.Time {
+			return clock
+		}
+		limiter.sleep = func(d time.Duration) {
+			waits = append(waits, d)
+			clock = clock.Add(d)
+		}
+		stats := new(Stats)
+		readers := []io.Reader{
+			stats.Reader(limiter.Reader(bytes.NewReader(make([]byte, 48*1024)))),
+			stats.Reader(limiter.Reader(bytes.NewReader(make([]byte, 48*1024)))),
+		}
+		//The streams take turns reading 16KB
+		buffer := make([]byte, 16*1024)
+		for i := 0; i < 6; i++ {
+			n, err := io.ReadFull(readers[i%2], buffer)
+			if err != nil || n != len(buffer) {
+				t.Fatalf("Read() = %v, %v", n, err)
+			}
+		}
+		if len(waits) != 6 {
+			t.Errorf("waits = %v; want one per read", waits)
+		}
+		for _, wait := range waits {
+			if wait < 249*time.Millisecond || wait > 251*time.Millisecond {
+				t.Errorf("waits = %v; want 250ms for each 16KB", waits)
+				break
+			}
+		}
+		if elapsed := clock.Sub(start); elapsed < 1499*time.Millisecond || elapsed > 1501*time.Millisecond {
+			t.Errorf("shared download of 96KB at 64KB/sec took %v; want 1.5s", elapsed)
+		}
+		if have := stats.Throughput(); have != 96*1024.0/throughputWindow {
+			t.Errorf("Stats.Throughput() = %v; want %v", have, 96*1024.0/throughputWindow)
+		}
+
+		if err := limiter.wait(bandwidthBurst + 1); err == nil {
+			t.Errorf("wait() over the burst should fail")
+		}
+	})
+}
@@ -0,0 +1,144 @@
+package downloader
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// trashFolder folder inside the backup folder holding items deleted from
+// Google Photos
+const trashFolder = ".trash"
+
+// catalogEntry a LibraryItem found in the backup folder
+type catalogEntry struct {
+	Item *LibraryItem
+	//JSONFilePath path of the sidecar the item was loaded from
+	JSONFilePath string
+	//pack index of the packed folder holding the sidecar, nil for loose sidecars
+	pack *packIndex
+}
+
+// MediaFilePath path of the media file, which is always stored next to the
+// sidecar
+func (c *catalogEntry) MediaFilePath() string {
+	return filepath.Join(filepath.Dir(c.JSONFilePath), c.Item.UsedFileName)
+}
+
+// isPacked returns true if the media file of the item is packed, or the
+// sidecar of an alias is
+func (c *catalogEntry) isPacked() bool {
+	if c.pack == nil {
+		return false
+	}
+	return c.Item.AliasOf != "" || c.pack.Files[c.Item.UsedFileName] != nil
+}
+
+// Catalog index of the LibraryItem sidecars in the backup folder, by item id
+type Catalog struct {
+	items map[string]*catalogEntry
+	//packs indexes of the packed folders, by folder
+	packs map[string]*packIndex
+}
+
+// loadSidecar Load a JSON file only if it is a LibraryItem sidecar, returns
+// nil otherwise (for example credentials or token files)
+func loadSidecar(storage Storage, filePath string) (*LibraryItem, error) {
+	bytes, err := readStorageFile(storage, filePath)
+	if err != nil {
+		return nil, err
+	}
+	var fields map[string]json.RawMessage
+	if json.Unmarshal(bytes, &fields) != nil {
+		return nil, nil
+	}
+	if _, ok := fields["UsedFileName"]; !ok {
+		return nil, nil
+	}
+	if _, ok := fields["id"]; !ok {
+		return nil, nil
+	}
+	item := new(LibraryItem)
+	err = json.Unmarshal(bytes, item)
+	if err != nil {
+		return nil, err
+	}
+	return item, nil
+}
+
+// isTrashFolder returns true for the trash folder, for skipping it when
+// walking the backup folder
+func isTrashFolder(path string) bool {
+	return filepath.Base(path) == trashFolder
+}
+
+// walkSidecars calls fn for every LibraryItem sidecar under root, skipping
+// the trash folder unless root is the trash folder itself
+func (d *Downloader) walkSidecars(root string, fn func(item *LibraryItem, jsonFilePath string) error) error {
+	return d.storage.Walk(root, isTrashFolder, func(path string, info os.FileInfo) error {
+		return d.walkSidecar(path, info, fn)
+	})
+}
+
+// walkSidecar calls fn if a walked file is a LibraryItem sidecar
+func (d *Downloader) walkSidecar(path string, info os.FileInfo, fn func(item *LibraryItem, jsonFilePath string) error) error {
+	if !strings.HasSuffix(info.Name(), ".json") || isPackFile(info.Name()) {
+		return nil
+	}
+	item, err := loadSidecar(d.storage, path)
+	if err != nil {
+		//Files removed while walking
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	if item == nil {
+		return nil
+	}
+	return fn(item, path)
+}
+
+// loadCatalog Index all sidecars in the backup folder, the capture-local
+// offsets of the items are remembered for computing their paths. Sidecars of
+// packed folders are taken from their index, unless updated by a loose one.
+func (d *Downloader) loadCatalog() (*Catalog, error) {
+	catalog := &Catalog{items: make(map[string]*catalogEntry), packs: make(map[string]*packIndex)}
+	add := func(item *LibraryItem, jsonFilePath string) error {
+		catalog.items[item.Id] = &catalogEntry{Item: item, JSONFilePath: jsonFilePath}
+		d.setCaptureOffset(item.Id, item.CaptureOffset)
+		return nil
+	}
+	err := d.storage.Walk(d.Options.BackupFolder, isTrashFolder, func(path string, info os.FileInfo) error {
+		if info.Name() != packIndexFileName {
+			return d.walkSidecar(path, info, add)
+		}
+		index, err := d.loadPackIndex(filepath.Dir(path))
+		if err != nil {
+			return err
+		}
+		if index != nil {
+			catalog.packs[index.folder] = index
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	for folder, index := range catalog.packs {
+		for name, item := range index.Sidecars {
+			jsonFilePath := filepath.Join(folder, name)
+			entry := catalog.items[item.Id]
+			if entry == nil {
+				add(item, jsonFilePath)
+				entry = catalog.items[item.Id]
+			}
+			if entry.JSONFilePath == jsonFilePath {
+				entry.pack = index
+			}
+		}
+	}
+	d.packs = catalog.packs
+	return catalog, nil
+}
@@ -0,0 +1,345 @@
+package downloader
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/sha512"
+	"encoding/base64"
+	"encoding/binary"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// checksumsFileName manifest of the media files in a folder, in the format of
+// `sha256sum`, so it can be checked with `sha256sum -c`
+const checksumsFileName = "SHA256SUMS"
+
+// checksumsSignatureFileName signify signature of the manifest, checked with
+// `signify -V -p key.pub -m SHA256SUMS`
+const checksumsSignatureFileName = checksumsFileName + ".sig"
+
+// signifyKey an Ed25519 secret key in the format of OpenBSD signify
+type signifyKey struct {
+	//keyNumber random number identifying the key pair, stored in signatures
+	keyNumber  []byte
+	privateKey ed25519.PrivateKey
+	//publicKeyName name of the public key file, for the signature comment
+	publicKeyName string
+}
+
+// loadSignifyKey Load a signify secret key created without a passphrase
+// (`signify -G -n`)
+func loadSignifyKey(filePath string) (*signifyKey, error) {
+	data, err := ioutil.ReadFile(filePath)
+	if err != nil {
+		return nil, err
+	}
+	lines := strings.Split(strings.TrimSpace(string(data)), "\n")
+	if len(lines) != 2 || !strings.HasPrefix(lines[0], "untrusted comment:") {
+		return nil, fmt.Errorf("'%v' is not a signify secret key", filePath)
+	}
+	key, err := base64.StdEncoding.DecodeString(strings.TrimSpace(lines[1]))
+	if err != nil {
+		return nil, err
+	}
+	//Algorithms, KDF rounds, salt, checksum, key number and secret key
+	if len(key) != 104 || string(key[:4]) != "EdBK" {
+		return nil, fmt.Errorf("'%v' is not a signify Ed25519 secret key", filePath)
+	}
+	if binary.BigEndian.Uint32(key[4:8]) != 0 {
+		return nil, fmt.Errorf("'%v' is protected by a passphrase, create the key with `signify -G -n`", filePath)
+	}
+	privateKey := ed25519.PrivateKey(key[40:104])
+	checksum := sha512.Sum512(privateKey)
+	if !bytes.Equal(checksum[:8], key[24:32]) {
+		return nil, fmt.Errorf("'%v' has an invalid checksum", filePath)
+	}
+	publicKeyName := strings.TrimSuffix(filepath.Base(filePath), ".sec") + ".pub"
+	return &signifyKey{keyNumber: key[32:40], privateKey: privateKey, publicKeyName: publicKeyName}, nil
+}
+
+// sign the signify signature file of a message
+func (k *signifyKey) sign(message []byte) []byte {
+	signature := append([]byte("Ed"), k.keyNumber...)
+	signature = append(signature, ed25519.Sign(k.privateKey, message)...)
+	return []byte(fmt.Sprintf("untrusted comment: verify with %v\n%v\n", k.publicKeyName, base64.StdEncoding.EncodeToString(signature)))
+}
+
+// escapeChecksumName escape a file name as `sha256sum` does, returns true if
+// the line needs the escape prefix
+func escapeChecksumName(name string) (string, bool) {
+	if !strings.ContainsAny(name, "\\\n\r") {
+		return name, false
+	}
+	replacer := strings.NewReplacer("\\", "\\\\", "\n", "\\n", "\r", "\\r")
+	return replacer.Replace(name), true
+}
+
+// parseChecksums Parse a manifest into hashes by file name
+func parseChecksums(data []byte) map[string]string {
+	checksums := make(map[string]string)
+	unescaper := strings.NewReplacer("\\\\", "\\", "\\n", "\n", "\\r", "\r")
+	for _, line := range strings.Split(string(data), "\n") {
+		escaped := strings.HasPrefix(line, "\\")
+		line = strings.TrimPrefix(line, "\\")
+		//The hash, a space, and a space or `*` for binary mode
+		if len(line) < 67 || line[64] != ' ' {
+			continue
+		}
+		name := line[66:]
+		if escaped {
+			name = unescaper.Replace(name)
+		}
+		checksums[name] = line[:64]
+	}
+	return checksums
+}
+
+// formatChecksums Format hashes by file name as a manifest, sorted by name
+func formatChecksums(checksums map[string]string) []byte {
+	names := make([]string, 0, len(checksums))
+	for name := range checksums {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	manifest := new(bytes.Buffer)
+	for _, name := range names {
+		escapedName, escaped := escapeChecksumName(name)
+		if escaped {
+			manifest.WriteString("\\")
+		}
+		fmt.Fprintf(manifest, "%v  %v\n", checksums[name], escapedName)
+	}
+	return manifest.Bytes()
+}
+
+// writeFileAtomic write a file through a temporary file, so readers never see
+// it partially written
+func writeFileAtomic(storage Storage, filePath string, data []byte) error {
+	temp := filePath + ".tmp"
+	err := writeStorageFile(storage, temp, data)
+	if err == nil {
+		err = storage.Rename(temp, filePath)
+	}
+	if err != nil {
+		storage.Remove(temp)
+	}
+	return err
+}
+
+// writeChecksums Replace the manifest of a folder, and its signature when a
+// key is set. An empty manifest is removed.
+func (d *Downloader) writeChecksums(folder string, checksums map[string]string) error {
+	manifestPath := filepath.Join(folder, checksumsFileName)
+	signaturePath := filepath.Join(folder, checksumsSignatureFileName)
+	if len(checksums) == 0 {
+		for _, filePath := range []string{manifestPath, signaturePath} {
+			err := d.storage.Remove(filePath)
+			if err != nil && !os.IsNotExist(err) {
+				return err
+			}
+		}
+		return nil
+	}
+	if d.Options.ChecksumsKey != "" && d.checksumsKey == nil {
+		var err error
+		d.checksumsKey, err = loadSignifyKey(d.Options.ChecksumsKey)
+		if err != nil {
+			return err
+		}
+	}
+	manifest := formatChecksums(checksums)
+	err := writeFileAtomic(d.storage, manifestPath, manifest)
+	if err != nil {
+		return err
+	}
+	if d.checksumsKey == nil {
+		return nil
+	}
+	return writeFileAtomic(d.storage, signaturePath, d.checksumsKey.sign(manifest))
+}
+
+// setChecksum Set the hash of a file in the manifest of its folder, an empty
+// hash removes the file from the manifest. Changes are kept in memory until
+// flushChecksums writes them.
+func (d *Downloader) setChecksum(filePath string, hash string) error {
+	if !d.Options.Checksums {
+		return nil
+	}
+	//Downloads finish concurrently
+	d.checksumsLock.Lock()
+	defer d.checksumsLock.Unlock()
+
+	folder, name := filepath.Split(filePath)
+	if d.pendingChecksums == nil {
+		d.pendingChecksums = make(map[string]map[string]string)
+	}
+	if d.pendingChecksums[folder] == nil {
+		d.pendingChecksums[folder] = make(map[string]string)
+	}
+	d.pendingChecksums[folder][name] = hash
+	return nil
+}
+
+// flushChecksums Write the manifests of the folders with changed hashes,
+// once per folder
+func (d *Downloader) flushChecksums() error {
+	d.checksumsLock.Lock()
+	defer d.checksumsLock.Unlock()
+
+	folders := make([]string, 0, len(d.pendingChecksums))
+	for folder := range d.pendingChecksums {
+		folders = append(folders, folder)
+	}
+	sort.Strings(folders)
+	for _, folder := range folders {
+		data, err := readStorageFile(d.storage, filepath.Join(folder, checksumsFileName))
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		checksums := parseChecksums(data)
+		changed := false
+		for name, hash := range d.pendingChecksums[folder] {
+			if checksums[name] == hash {
+				continue
+			}
+			changed = true
+			if hash == "" {
+				delete(checksums, name)
+			} else {
+				checksums[name] = hash
+			}
+		}
+		if changed {
+			err = d.writeChecksums(folder, checksums)
+			if err != nil {
+				return err
+			}
+		}
+		delete(d.pendingChecksums, folder)
+	}
+	return nil
+}
+
+// updateChecksum Record the media file of an item in the manifest of its
+// folder, aliases have no media file and are removed from it
+func (d *Downloader) updateChecksum(item *LibraryItem, filePath string) error {
+	if !d.Options.Checksums {
+		return nil
+	}
+	if item.AliasOf != "" {
+		return d.setChecksum(filePath, "")
+	}
+	hash := item.storedSHA256()
+	if hash == "" && d.isLocal() {
+		var err error
+		hash, err = hashFile(filePath)
+		if os.IsNotExist(err) {
+			return d.setChecksum(filePath, "")
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return d.setChecksum(filePath, hash)
+}
+
+// moveChecksum Move the media file of an item from the manifest of one folder
+// to another
+func (d *Downloader) moveChecksum(item *LibraryItem, from string, to string) error {
+	if from == to {
+		return d.updateChecksum(item, to)
+	}
+	err := d.setChecksum(from, "")
+	if err != nil {
+		return err
+	}
+	return d.updateChecksum(item, to)
+}
+
+// WriteChecksums Rewrite the manifests of all folders in the backup folder
+// from the hashes kept in the JSON files and the pack indexes. Items
+// downloaded before hashes were kept are hashed first, manifests of folders
+// without items are removed.
+func (d *Downloader) WriteChecksums() error {
+	err := d.requireLocal("checksums")
+	if err != nil {
+		return err
+	}
+	_, err = d.compileTemplates()
+	if err != nil {
+		return err
+	}
+	catalog, err := d.loadCatalog()
+	if err != nil {
+		return err
+	}
+	folders := make(map[string]map[string]string)
+	//Packed media files are covered by the hashes of their archives
+	for folder, index := range catalog.packs {
+		checksums := make(map[string]string)
+		for _, segment := range index.Segments {
+			checksums[segment.Name] = segment.SHA256
+		}
+		folders[folder+string(filepath.Separator)] = checksums
+	}
+	for _, entry := range catalog.items {
+		if entry.Item.AliasOf != "" || entry.isPacked() {
+			continue
+		}
+		mediaFilePath := entry.MediaFilePath()
+		if entry.Item.storedSHA256() == "" {
+			entry.Item.SHA256, err = hashFile(mediaFilePath)
+			if os.IsNotExist(err) {
+				continue
+			}
+			if err != nil {
+				return err
+			}
+			err = d.writeJSON(entry.Item, entry.JSONFilePath)
+			if err != nil {
+				return err
+			}
+		}
+		folder, name := filepath.Split(mediaFilePath)
+		if folders[folder] == nil {
+			folders[folder] = make(map[string]string)
+		}
+		folders[folder][name] = entry.Item.storedSHA256()
+	}
+
+	//Folders which no longer hold items
+	err = filepath.Walk(d.Options.BackupFolder, func(filePath string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.IsDir() {
+			if filePath != d.Options.BackupFolder && info.Name() == trashFolder {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		folder := filepath.Dir(filePath) + string(filepath.Separator)
+		if info.Name() == checksumsFileName && folders[folder] == nil {
+			folders[folder] = make(map[string]string)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	for folder, checksums := range folders {
+		err = d.writeChecksums(folder, checksums)
+		if err != nil {
+			return err
+		}
+	}
+	log.Printf("Wrote checksums of %v folders", len(folders))
+	return nil
+}
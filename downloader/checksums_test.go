@@ -0,0 +1,169 @@
+package downloader
+
+import (
+	"crypto/ed25519"
+	"crypto/sha512"
+	"encoding/base64"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// writeSignifyKey Write a signify secret key without a passphrase, returns
+// the public key
+func writeSignifyKey(t *testing.T, filePath string) ed25519.PublicKey {
+	publicKey, privateKey, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	checksum := sha512.Sum512(privateKey)
+	key := append([]byte("EdBK"), make([]byte, 4+16)...)
+	key = append(key, checksum[:8]...)
+	key = append(key, "keynum01"...)
+	key = append(key, privateKey...)
+	data := "untrusted comment: signify secret key\n" + base64.StdEncoding.EncodeToString(key) + "\n"
+	err = ioutil.WriteFile(filePath, []byte(data), 0600)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	return publicKey
+}
+
+func TestParseChecksums(t *testing.T) {
+	checksums := map[string]string{
+		"IMG_1.jpg":     strings.Repeat("a", 64),
+		"back\\sl.jpg":  strings.Repeat("b", 64),
+		"new\nline.jpg": strings.Repeat("c", 64),
+	}
+	manifest := formatChecksums(checksums)
+	if !strings.Contains(string(manifest), "\n\\"+strings.Repeat("b", 64)+"  back\\\\sl.jpg\n") {
+		t.Errorf("formatChecksums() = %q", manifest)
+	}
+	parsed := parseChecksums(manifest)
+	if len(parsed) != len(checksums) {
+		t.Fatalf("parseChecksums() = %v", parsed)
+	}
+	for name, hash := range checksums {
+		if parsed[name] != hash {
+			t.Errorf("parseChecksums()[%q] = %v; want %v", name, parsed[name], hash)
+		}
+	}
+	//Binary mode lines written by sha256sum -b
+	parsed = parseChecksums([]byte(strings.Repeat("d", 64) + " *IMG_2.jpg\n"))
+	if parsed["IMG_2.jpg"] != strings.Repeat("d", 64) {
+		t.Errorf("parseChecksums() = %v", parsed)
+	}
+}
+
+func TestChecksums(t *testing.T) {
+	downloader := NewDownloader()
+	downloader.Options.BackupFolder = tempPath()
+	defer os.RemoveAll(downloader.Options.BackupFolder)
+	downloader.Options.Checksums = true
+	keyFolder := tempPath()
+	os.MkdirAll(keyFolder, 0700)
+	defer os.RemoveAll(keyFolder)
+	downloader.Options.ChecksumsKey = filepath.Join(keyFolder, "gitmoo.sec")
+	publicKey := writeSignifyKey(t, downloader.Options.ChecksumsKey)
+
+	folder := filepath.Join(downloader.Options.BackupFolder, "2019", "October")
+	os.MkdirAll(folder, 0700)
+	first := adoptTestItem("ABCDEFGHIJKLMNOPQRSTUVW1", "IMG_1.jpg")
+	firstPath := filepath.Join(folder, "IMG_1.jpg")
+	ioutil.WriteFile(firstPath, []byte("first"), 0644)
+	second := adoptTestItem("ABCDEFGHIJKLMNOPQRSTUVW2", "IMG_2.jpg")
+	second.SHA256 = strings.Repeat("0", 64)
+	second.FileSHA256 = strings.Repeat("1", 64)
+	secondPath := filepath.Join(folder, "IMG_2.jpg")
+
+	err := downloader.updateChecksum(first, firstPath)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	err = downloader.updateChecksum(second, secondPath)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	//Manifests are written once per folder when flushed
+	manifestPath := filepath.Join(folder, checksumsFileName)
+	if _, err := os.Stat(manifestPath); !os.IsNotExist(err) {
+		t.Errorf("manifest should be written when flushed: %v", err)
+	}
+	err = downloader.flushChecksums()
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	manifest, err := ioutil.ReadFile(manifestPath)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	firstHash, _ := hashFile(firstPath)
+	want := firstHash + "  IMG_1.jpg\n" + second.FileSHA256 + "  IMG_2.jpg\n"
+	if string(manifest) != want {
+		t.Errorf("manifest = %q; want %q", manifest, want)
+	}
+
+	signature, err := ioutil.ReadFile(filepath.Join(folder, checksumsSignatureFileName))
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	lines := strings.Split(strings.TrimSpace(string(signature)), "\n")
+	if len(lines) != 2 || lines[0] != "untrusted comment: verify with gitmoo.pub" {
+		t.Fatalf("signature = %q", signature)
+	}
+	decoded, _ := base64.StdEncoding.DecodeString(lines[1])
+	if len(decoded) != 74 || string(decoded[:10]) != "Edkeynum01" || !ed25519.Verify(publicKey, manifest, decoded[10:]) {
+		t.Errorf("invalid signature %q", signature)
+	}
+
+	//Aliases have no media file
+	second.AliasOf = first.Id
+	err = downloader.updateChecksum(second, secondPath)
+	if err == nil {
+		err = downloader.flushChecksums()
+	}
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	manifest, _ = ioutil.ReadFile(manifestPath)
+	if string(manifest) != firstHash+"  IMG_1.jpg\n" {
+		t.Errorf("manifest = %q", manifest)
+	}
+
+	movedPath := filepath.Join(downloader.Options.BackupFolder, "IMG_1.jpg")
+	os.Rename(firstPath, movedPath)
+	err = downloader.moveChecksum(first, firstPath, movedPath)
+	if err == nil {
+		err = downloader.flushChecksums()
+	}
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	if _, err := os.Stat(manifestPath); !os.IsNotExist(err) {
+		t.Errorf("empty manifest should be removed")
+	}
+	if _, err := os.Stat(filepath.Join(downloader.Options.BackupFolder, checksumsFileName)); err != nil {
+		t.Errorf("moved file should be in the manifest of its new folder: %v", err)
+	}
+
+	//Finished downloads are recorded when others on the page failed
+	ioutil.WriteFile(firstPath, []byte("first"), 0644)
+	err = downloader.updateChecksum(first, firstPath)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	downloader.waitGroup.Go(func() error {
+		return errors.New("download failed")
+	})
+	err = downloader.finishPage()
+	if err == nil || err.Error() != "download failed" {
+		t.Errorf("finishPage() = %v; want the download error", err)
+	}
+	manifest, _ = ioutil.ReadFile(manifestPath)
+	if string(manifest) != firstHash+"  IMG_1.jpg\n" {
+		t.Errorf("manifest = %q; want the finished download", manifest)
+	}
+}
@@ -0,0 +1,283 @@
+package downloader
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"sort"
+	"sync"
+
+	"github.com/dustin/go-humanize"
+)
+
+const (
+	//DedupeHardlink replace duplicate files with hard links
+	DedupeHardlink = "hardlink"
+	//DedupeReflink replace duplicate files with copy-on-write clones, on file systems supporting them
+	DedupeReflink = "reflink"
+	//DedupeAlias remove duplicate files, their sidecar records the item holding the content
+	DedupeAlias = "alias"
+)
+
+// ValidateDedupeMode returns an error for unknown dedupe modes
+func ValidateDedupeMode(mode string) error {
+	switch mode {
+	case "", DedupeHardlink, DedupeReflink, DedupeAlias:
+		return nil
+	}
+	return fmt.Errorf("unknown dedupe mode '%v', use %v, %v or %v", mode, DedupeHardlink, DedupeReflink, DedupeAlias)
+}
+
+// hashIndex the stored items by the SHA-256 of their content
+type hashIndex struct {
+	mutex   sync.Mutex
+	entries map[string]*catalogEntry
+}
+
+// newHashIndex Index the items of a catalog which hold their content
+func newHashIndex(catalog *Catalog) *hashIndex {
+	index := &hashIndex{entries: make(map[string]*catalogEntry)}
+	ids := make([]string, 0, len(catalog.items))
+	for id := range catalog.items {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	for _, id := range ids {
+		entry := catalog.items[id]
+		//Packed media files cannot be linked to
+		if entry.Item.SHA256 != "" && entry.Item.AliasOf == "" && !entry.isPacked() && index.entries[entry.Item.SHA256] == nil {
+			index.entries[entry.Item.SHA256] = entry
+		}
+	}
+	return index
+}
+
+// claim returns the entry already holding the content of entry, or adds entry
+// as the holder and returns nil
+func (h *hashIndex) claim(entry *catalogEntry) *catalogEntry {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	original := h.entries[entry.Item.SHA256]
+	if original != nil && original.Item.Id != entry.Item.Id {
+		_, err := os.Stat(original.MediaFilePath())
+		if err == nil {
+			return original
+		}
+	}
+	h.entries[entry.Item.SHA256] = entry
+	return nil
+}
+
+// hashFile SHA-256 of a file, hex encoded
+func hashFile(filePath string) (string, error) {
+	file, err := os.Open(filePath)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+	hasher := sha256.New()
+	_, err = io.Copy(hasher, file)
+	if err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(hasher.Sum(nil)), nil
+}
+
+// replaceWithLink Replace a file with a hard link or a reflink to another file
+func replaceWithLink(original string, duplicate string, mode string) error {
+	temp := duplicate + ".dedupe"
+	os.Remove(temp)
+	var err error
+	if mode == DedupeReflink {
+		err = reflink(original, temp)
+	} else {
+		err = os.Link(original, temp)
+	}
+	if err != nil {
+		return err
+	}
+	err = os.Rename(temp, duplicate)
+	if err != nil {
+		os.Remove(temp)
+	}
+	return err
+}
+
+// dedupeEntry Apply the dedupe mode to an item whose content is identical to
+// original. The sidecar is updated by the caller. Returns the bytes saved.
+func (d *Downloader) dedupeEntry(original *catalogEntry, duplicate *catalogEntry) (int64, error) {
+	if !d.isLocal() {
+		//Only aliases are allowed, the content is known by the hash recorded
+		//when downloading, as stored files can not be read back cheaply
+		return 0, d.aliasDuplicate(original, duplicate)
+	}
+	originalPath := original.MediaFilePath()
+	duplicatePath := duplicate.MediaFilePath()
+	duplicateInfo, err := os.Stat(duplicatePath)
+	if err != nil {
+		return 0, err
+	}
+	if sameFile(originalPath, duplicateInfo) {
+		duplicate.Item.FileSHA256 = original.Item.FileSHA256
+		return 0, nil
+	}
+	//The stored hash could be stale, the original file must still match
+	hash, err := hashFile(originalPath)
+	if err != nil {
+		return 0, err
+	}
+	if hash != original.Item.storedSHA256() {
+		return 0, fmt.Errorf("'%v' changed since it was hashed", originalPath)
+	}
+
+	switch d.Options.Dedupe {
+	case DedupeHardlink, DedupeReflink:
+		//Files with embedded metadata are only linked when the metadata is
+		//the same too, a link shares the metadata of the original
+		if duplicate.Item.storedSHA256() != original.Item.storedSHA256() {
+			return 0, fmt.Errorf("'%v' holds other embedded metadata than '%v'", duplicatePath, originalPath)
+		}
+		log.Printf("Replacing duplicate '%v' with a %v to '%v'", duplicatePath, d.Options.Dedupe, originalPath)
+		err = replaceWithLink(originalPath, duplicatePath, d.Options.Dedupe)
+		if err == nil {
+			duplicate.Item.FileSHA256 = original.Item.FileSHA256
+		}
+	case DedupeAlias:
+		err = d.aliasDuplicate(original, duplicate)
+	}
+	if err != nil {
+		return 0, err
+	}
+	return duplicateInfo.Size(), nil
+}
+
+// aliasDuplicate Remove the media file of a duplicate, recording the item
+// holding its content
+func (d *Downloader) aliasDuplicate(original *catalogEntry, duplicate *catalogEntry) error {
+	duplicatePath := duplicate.MediaFilePath()
+	log.Printf("Removing duplicate '%v', alias of '%v' [id %v]", duplicatePath, original.MediaFilePath(), original.Item.Id)
+	err := d.storage.Remove(duplicatePath)
+	if err != nil {
+		return err
+	}
+	duplicate.Item.AliasOf = original.Item.Id
+	d.storage.Remove(xmpFilePath(duplicatePath))
+	return d.setChecksum(duplicatePath, "")
+}
+
+// dedupeDownloaded Index a downloaded item by its content and apply the dedupe
+// mode if another item has the same content, returns true if it was applied
+func (d *Downloader) dedupeDownloaded(item *LibraryItem) (bool, error) {
+	if d.hashes == nil || item.SHA256 == "" {
+		return false, nil
+	}
+	if d.Options.EmbedMetadata && d.Options.Dedupe != DedupeAlias {
+		//The metadata embedded next makes the file differ from the original
+		return false, nil
+	}
+	entry := &catalogEntry{Item: item, JSONFilePath: d.getJSONFilePath(&item.MediaItem)}
+	original := d.hashes.claim(entry)
+	if original == nil {
+		return false, nil
+	}
+	_, err := d.dedupeEntry(original, entry)
+	return err == nil, err
+}
+
+// Dedupe Find items in the backup folder with identical content and apply the
+// dedupe mode to them, hashing items downloaded before hashes were stored.
+// Without a dedupe mode, or with dryRun, duplicates are only reported.
+func (d *Downloader) Dedupe(dryRun bool) error {
+	err := d.requireLocal("dedupe")
+	if err != nil {
+		return err
+	}
+	_, err = d.compileTemplates()
+	if err != nil {
+		return err
+	}
+	err = ValidateDedupeMode(d.Options.Dedupe)
+	if err != nil {
+		return err
+	}
+	catalog, err := d.loadCatalog()
+	if err != nil {
+		return err
+	}
+	ids := make([]string, 0, len(catalog.items))
+	for id := range catalog.items {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+
+	for _, id := range ids {
+		entry := catalog.items[id]
+		if entry.Item.SHA256 != "" || entry.Item.AliasOf != "" || entry.isPacked() {
+			continue
+		}
+		entry.Item.SHA256, err = hashFile(entry.MediaFilePath())
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		if !dryRun {
+			err = d.writeJSON(entry.Item, entry.JSONFilePath)
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	index := newHashIndex(catalog)
+	var duplicates int
+	var saved int64
+	for _, id := range ids {
+		entry := catalog.items[id]
+		if entry.Item.SHA256 == "" || entry.Item.AliasOf != "" || entry.isPacked() {
+			continue
+		}
+		original := index.entries[entry.Item.SHA256]
+		if original == entry {
+			continue
+		}
+		info, err := os.Stat(entry.MediaFilePath())
+		if err != nil || sameFile(original.MediaFilePath(), info) {
+			//Missing or already linked
+			continue
+		}
+		duplicates++
+		if dryRun || d.Options.Dedupe == "" {
+			log.Printf("Duplicate '%v' of '%v' [id %v]", entry.MediaFilePath(), original.MediaFilePath(), original.Item.Id)
+			saved += info.Size()
+			continue
+		}
+		n, err := d.dedupeEntry(original, entry)
+		if err != nil {
+			log.Printf("Failed to dedupe '%v': %v", entry.MediaFilePath(), err)
+			continue
+		}
+		saved += n
+		err = d.writeJSON(entry.Item, entry.JSONFilePath)
+		if err != nil {
+			return err
+		}
+	}
+
+	if dryRun || d.Options.Dedupe == "" {
+		log.Printf("Found %v duplicate items, %v can be reclaimed", duplicates, humanize.Bytes(uint64(saved)))
+	} else {
+		log.Printf("Deduplicated %v items, %v reclaimed", duplicates, humanize.Bytes(uint64(saved)))
+	}
+	return d.flushChecksums()
+}
+
+// sameFile returns true if filePath is the file described by info
+func sameFile(filePath string, info os.FileInfo) bool {
+	other, err := os.Stat(filePath)
+	return err == nil && os.SameFile(other, info)
+}
@@ -0,0 +1,154 @@
+package downloader
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+func TestDedupe(t *testing.T) {
+	t.Run("Report", func(t *testing.T) {
+		downloader := NewDownloader()
+		downloader.Options.BackupFolder = tempPath()
+		defer os.RemoveAll(downloader.Options.BackupFolder)
+
+		first := createTestItem(t, downloader, "12345678901234567890")
+		second := createTestItem(t, downloader, "09876543210987654321")
+
+		err := downloader.Dedupe(false)
+		if err != nil {
+			t.Fatalf("%v", err)
+		}
+		stored, _ := downloader.loadJSON(downloader.getJSONFilePath(&second.MediaItem))
+		if stored.SHA256 == "" {
+			t.Errorf("dedupe should store the hash of existing items")
+		}
+		firstInfo, _ := os.Stat(downloader.getImageFilePath(first))
+		if sameFile(downloader.getImageFilePath(second), firstInfo) {
+			t.Errorf("dedupe without a mode should only report")
+		}
+	})
+
+	t.Run("Hardlink", func(t *testing.T) {
+		downloader := NewDownloader()
+		downloader.Options.BackupFolder = tempPath()
+		downloader.Options.Dedupe = DedupeHardlink
+		defer os.RemoveAll(downloader.Options.BackupFolder)
+
+		first := createTestItem(t, downloader, "12345678901234567890")
+		second := createTestItem(t, downloader, "09876543210987654321")
+		other := createTestItem(t, downloader, "11111111112222222222")
+		err := ioutil.WriteFile(downloader.getImageFilePath(other), []byte("other image"), 0644)
+		if err != nil {
+			t.Fatalf("%v", err)
+		}
+
+		err = downloader.Dedupe(false)
+		if err != nil {
+			t.Fatalf("%v", err)
+		}
+		secondInfo, _ := os.Stat(downloader.getImageFilePath(second))
+		if !sameFile(downloader.getImageFilePath(first), secondInfo) {
+			t.Errorf("identical items should be hard linked")
+		}
+		if sameFile(downloader.getImageFilePath(other), secondInfo) {
+			t.Errorf("different items should not be linked")
+		}
+	})
+
+	t.Run("Alias", func(t *testing.T) {
+		downloader := NewDownloader()
+		downloader.Options.BackupFolder = tempPath()
+		downloader.Options.Dedupe = DedupeAlias
+		defer os.RemoveAll(downloader.Options.BackupFolder)
+
+		first := createTestItem(t, downloader, "12345678901234567890")
+		second := createTestItem(t, downloader, "09876543210987654321")
+
+		err := downloader.Dedupe(false)
+		if err != nil {
+			t.Fatalf("%v", err)
+		}
+		//Ids are sorted, the first id holds the content
+		stored, _ := downloader.loadJSON(downloader.getJSONFilePath(&first.MediaItem))
+		if stored.AliasOf != second.Id {
+			t.Errorf("AliasOf = %v; want %v", stored.AliasOf, second.Id)
+		}
+		if _, err := os.Stat(downloader.getImageFilePath(first)); !os.IsNotExist(err) {
+			t.Errorf("alias media should be removed")
+		}
+		if _, err := os.Stat(downloader.getImageFilePath(second)); err != nil {
+			t.Errorf("original media should be kept: %v", err)
+		}
+	})
+
+	t.Run("Download", func(t *testing.T) {
+		downloader := NewDownloader()
+		downloader.Options.BackupFolder = tempPath()
+		downloader.Options.Dedupe = DedupeHardlink
+		defer os.RemoveAll(downloader.Options.BackupFolder)
+
+		first := createTestItem(t, downloader, "12345678901234567890")
+		first.SHA256, _ = hashFile(downloader.getImageFilePath(first))
+		downloader.writeJSON(first, downloader.getJSONFilePath(&first.MediaItem))
+		catalog, err := downloader.loadCatalog()
+		if err != nil {
+			t.Fatalf("%v", err)
+		}
+		downloader.hashes = newHashIndex(catalog)
+
+		second := createTestItem(t, downloader, "09876543210987654321")
+		second.SHA256 = first.SHA256
+		err = downloader.finishDownload(second, downloader.getImageFilePath(second))
+		if err != nil {
+			t.Fatalf("%v", err)
+		}
+		secondInfo, _ := os.Stat(downloader.getImageFilePath(second))
+		if !sameFile(downloader.getImageFilePath(first), secondInfo) {
+			t.Errorf("downloaded duplicate should be hard linked")
+		}
+	})
+
+	t.Run("Embedded Metadata", func(t *testing.T) {
+		downloader := NewDownloader()
+		downloader.Options.BackupFolder = tempPath()
+		downloader.Options.Dedupe = DedupeHardlink
+		defer os.RemoveAll(downloader.Options.BackupFolder)
+
+		//Links would share the metadata embedded in the original
+		first := createTestItem(t, downloader, "12345678901234567890")
+		first.SHA256, _ = hashFile(downloader.getImageFilePath(first))
+		first.FileSHA256 = "embedded"
+		downloader.writeJSON(first, downloader.getJSONFilePath(&first.MediaItem))
+		second := createTestItem(t, downloader, "09876543210987654321")
+		err := downloader.Dedupe(false)
+		if err != nil {
+			t.Fatalf("%v", err)
+		}
+		secondInfo, _ := os.Stat(downloader.getImageFilePath(second))
+		if sameFile(downloader.getImageFilePath(first), secondInfo) {
+			t.Errorf("files with other embedded metadata should not be linked")
+		}
+
+		catalog, err := downloader.loadCatalog()
+		if err != nil {
+			t.Fatalf("%v", err)
+		}
+		downloader.hashes = newHashIndex(catalog)
+		downloader.Options.EmbedMetadata = true
+		third := createTestItem(t, downloader, "33333333334444444444")
+		third.SHA256 = first.SHA256
+		err = downloader.finishDownload(third, downloader.getImageFilePath(third))
+		if err != nil {
+			t.Fatalf("%v", err)
+		}
+		thirdInfo, _ := os.Stat(downloader.getImageFilePath(third))
+		if sameFile(downloader.getImageFilePath(first), thirdInfo) || sameFile(downloader.getImageFilePath(second), thirdInfo) {
+			t.Errorf("downloads should not be linked with -embed-metadata")
+		}
+	})
+
+	if ValidateDedupeMode("copy") == nil {
+		t.Errorf("ValidateDedupeMode(copy) should fail")
+	}
+}
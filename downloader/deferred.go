@@ -0,0 +1,183 @@
+package downloader
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	photoslibrary "github.com/gphotosuploader/googlemirror/api/photoslibrary/v1"
+	"google.golang.org/api/googleapi"
+)
+
+// deferredFileName file in the backup folder holding the deferred queue
+const deferredFileName = ".gitmoo-deferred.json"
+
+// videoStatusReady status of a video which finished processing
+const videoStatusReady = "READY"
+
+// deferredItem a media item which can not be downloaded yet
+type deferredItem struct {
+	ID       string
+	Filename string
+	//Status the video processing status when last checked
+	Status string
+	//Deferred time (RFC3339) the item was first deferred
+	Deferred string
+	//Retry time (RFC3339) after which the item is fetched again
+	Retry string
+	//Attempts number of times the item was found not ready
+	Attempts int
+}
+
+// deferredQueue items to retry on later passes, persisted in the backup folder
+type deferredQueue struct {
+	items    map[string]*deferredItem
+	storage  Storage
+	filePath string
+}
+
+// newDeferredQueue creates an empty queue which is not persisted until loaded
+func newDeferredQueue() *deferredQueue {
+	return &deferredQueue{items: make(map[string]*deferredItem)}
+}
+
+// load Load the queue from filePath, later saves go to the same file
+func (q *deferredQueue) load(storage Storage, filePath string) error {
+	q.storage = storage
+	q.filePath = filePath
+	q.items = make(map[string]*deferredItem)
+
+	bytes, err := readStorageFile(storage, filePath)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	var items []*deferredItem
+	err = json.Unmarshal(bytes, &items)
+	if err != nil {
+		return err
+	}
+	for _, item := range items {
+		q.items[item.ID] = item
+	}
+	return nil
+}
+
+// save Save the queue, removing the file when the queue is empty
+func (q *deferredQueue) save() error {
+	if q.filePath == "" {
+		return nil
+	}
+	if len(q.items) == 0 {
+		err := q.storage.Remove(q.filePath)
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	items := make([]*deferredItem, 0, len(q.items))
+	for _, item := range q.items {
+		items = append(items, item)
+	}
+	sort.Slice(items, func(i, j int) bool { return items[i].Deferred < items[j].Deferred })
+	bytes, err := json.MarshalIndent(items, "", "  ")
+	if err != nil {
+		return err
+	}
+	return writeStorageFile(q.storage, q.filePath, bytes)
+}
+
+// add Add or update an item, it will be due for retry after delay
+func (q *deferredQueue) add(item *photoslibrary.MediaItem, status string, delay time.Duration) {
+	now := time.Now().UTC()
+	deferred, ok := q.items[item.Id]
+	if !ok {
+		deferred = &deferredItem{ID: item.Id, Deferred: now.Format(time.RFC3339)}
+		q.items[item.Id] = deferred
+	}
+	deferred.Filename = item.Filename
+	deferred.Status = status
+	deferred.Retry = now.Add(delay).Format(time.RFC3339)
+	deferred.Attempts++
+}
+
+// remove Remove an item, returns true if it was queued
+func (q *deferredQueue) remove(id string) bool {
+	_, ok := q.items[id]
+	delete(q.items, id)
+	return ok
+}
+
+// due returns the ids of items to retry at the given time
+func (q *deferredQueue) due(now time.Time) []string {
+	var ids []string
+	for id, item := range q.items {
+		retry, err := time.Parse(time.RFC3339, item.Retry)
+		if err != nil || !now.Before(retry) {
+			ids = append(ids, id)
+		}
+	}
+	sort.Strings(ids)
+	return ids
+}
+
+// videoStatus returns the processing status of a video which is not ready to
+// be downloaded, or an empty string
+func videoStatus(item *photoslibrary.MediaItem) string {
+	if !strings.HasPrefix(strings.ToLower(item.MimeType), "video") {
+		return ""
+	}
+	if item.MediaMetadata == nil || item.MediaMetadata.Video == nil {
+		return ""
+	}
+	status := item.MediaMetadata.Video.Status
+	if status == "" || status == videoStatusReady {
+		return ""
+	}
+	return status
+}
+
+// deferItem Put an item in the deferred queue instead of downloading it
+func (d *Downloader) deferItem(item *photoslibrary.MediaItem, status string) {
+	log.Printf("Deferring '%v' [id %v], video status is %v", item.Filename, item.Id, status)
+	d.deferred.add(item, status, time.Duration(d.Options.DeferredRetryDelay)*time.Minute)
+}
+
+// retryDeferred Fetch and download deferred items which are due, items seen
+// in this pass were already retried
+func (d *Downloader) retryDeferred(svc *photoslibrary.Service) error {
+	for _, id := range d.deferred.due(time.Now()) {
+		if d.seen[id] {
+			continue
+		}
+		item, err := svc.MediaItems.Get(id).Do()
+		if err != nil {
+			if apiErr, ok := err.(*googleapi.Error); ok && apiErr.Code == http.StatusNotFound {
+				log.Printf("Deferred item '%v' no longer exists", d.deferred.items[id].Filename)
+				d.deferred.remove(id)
+				continue
+			}
+			d.finishPage()
+			return err
+		}
+		d.seen[id] = true
+		err = d.downloadItem(svc, item)
+		if err != nil {
+			log.Printf("Failed to download '%v' [id %v]: %v", item.Filename, item.Id, err)
+			d.stats.UpdateStatsError(1)
+		}
+	}
+	return d.finishPage()
+}
+
+// saveDeferred Save the deferred queue and update the pending items stats
+func (d *Downloader) saveDeferred() error {
+	d.stats.SetStatsPending(len(d.deferred.items))
+	return d.deferred.save()
+}
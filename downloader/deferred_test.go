@@ -0,0 +1,79 @@
+package downloader
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	photoslibrary "github.com/gphotosuploader/googlemirror/api/photoslibrary/v1"
+)
+
+func TestDeferredVideo(t *testing.T) {
+	downloader := NewDownloader()
+	downloader.Options.BackupFolder = tempPath()
+	defer os.RemoveAll(downloader.Options.BackupFolder)
+	downloader.Options.DeferredRetryDelay = 60
+
+	filePath := filepath.Join(downloader.Options.BackupFolder, deferredFileName)
+	err := downloader.deferred.load(downloader.storage, filePath)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+
+	item := new(photoslibrary.MediaItem)
+	item.Id = "12345678901234567890"
+	item.Filename = "VID_1234.mp4"
+	item.MimeType = "video/mp4"
+	item.MediaMetadata = new(photoslibrary.MediaMetadata)
+	item.MediaMetadata.CreationTime = "2019-10-13T17:33:43Z"
+	item.MediaMetadata.Video = &photoslibrary.Video{Status: "PROCESSING"}
+
+	err = downloader.downloadItem(nil, item)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	if _, err := os.Stat(downloader.getJSONFilePath(item)); !os.IsNotExist(err) {
+		t.Errorf("processing video should not be saved")
+	}
+	err = downloader.saveDeferred()
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	if downloader.stats.Pending != 1 {
+		t.Errorf("Stats.Pending = %v; want 1", downloader.stats.Pending)
+	}
+
+	//Reload from the backup folder
+	queue := newDeferredQueue()
+	err = queue.load(downloader.storage, filePath)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	deferred, ok := queue.items[item.Id]
+	if !ok || deferred.Status != "PROCESSING" || deferred.Attempts != 1 {
+		t.Fatalf("deferredQueue.load() = %v; want the deferred video", queue.items)
+	}
+	if due := queue.due(time.Now()); len(due) != 0 {
+		t.Errorf("deferredQueue.due() = %v; want none before the retry delay", due)
+	}
+	if due := queue.due(time.Now().Add(2 * time.Hour)); len(due) != 1 {
+		t.Errorf("deferredQueue.due() = %v; want the deferred video after the retry delay", due)
+	}
+
+	//Ready videos leave the queue
+	item.MediaMetadata.Video.Status = videoStatusReady
+	if status := videoStatus(item); status != "" {
+		t.Errorf("videoStatus() = %v; want ready", status)
+	}
+	if !downloader.deferred.remove(item.Id) {
+		t.Errorf("deferredQueue.remove() = false; want true")
+	}
+	err = downloader.saveDeferred()
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	if _, err := os.Stat(filePath); !os.IsNotExist(err) {
+		t.Errorf("empty deferred queue should not be persisted")
+	}
+}
@@ -2,22 +2,20 @@ package downloader
 
 import (
 	"crypto/md5"
+	"crypto/sha256"
 	"encoding/hex"
 	"encoding/json"
-	"errors"
 	"fmt"
 	"io"
-	"io/ioutil"
 	"log"
-	"mime"
 	"net/http"
 	"os"
 	"path/filepath"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/dustin/go-humanize"
-	"github.com/fujiwara/shapeio"
 	photoslibrary "github.com/gphotosuploader/googlemirror/api/photoslibrary/v1"
 	errgroup "golang.org/x/sync/errgroup"
 )
@@ -28,6 +26,24 @@ type Downloader struct {
 	waitGroup                  *errgroup.Group
 	concurrentDownloadRoutines chan struct{}
 	stats                      *Stats
+	bandwidth                  *bandwidthLimiter
+	space                      *spaceGuard
+	paused                     string
+	seen                       map[string]bool
+	deferred                   *deferredQueue
+	albumTitle                 string
+	timeZones                  timeZones
+	naming                     *namingTemplates
+	names                      *nameCache
+	hashes                     *hashIndex
+	provisional                *provisionalIndex
+	adopt                      *adoptIndex
+	storage                    Storage
+	packs                      map[string]*packIndex
+	packed                     map[string]*catalogEntry
+	checksumsLock              sync.Mutex
+	pendingChecksums           map[string]map[string]string
+	checksumsKey               *signifyKey
 	Options                    *Options
 }
 
@@ -36,25 +52,28 @@ func NewDownloader() *Downloader {
 	downloader := new(Downloader)
 	downloader.waitGroup = new(errgroup.Group)
 	downloader.stats = new(Stats)
+	downloader.deferred = newDeferredQueue()
+	downloader.storage = localStorage{}
+	downloader.packs = make(map[string]*packIndex)
 
 	downloader.Options = new(Options)
 	downloader.Options.BackupFolder, _ = os.Getwd()
 	downloader.Options.FolderFormat = filepath.Join("2006", "January")
 	downloader.Options.ConcurrentDownloads = 1
+	//The default options use the legacy naming, which always compiles
+	downloader.compileTemplates()
 
 	return downloader
 }
 
 // getFolderPath Path of the to store JSON and image files for the particular MediaItem
 func (d *Downloader) getFolderPath(item *photoslibrary.MediaItem) string {
-	//TODO Check that item.MediaMetadata exists
-	t, err := time.Parse(time.RFC3339, item.MediaMetadata.CreationTime)
-	if err != nil {
-		//Default to an epoch if cannot parse time
-		t, err = time.Parse(time.RFC3339, "1970-01-01T00:00:00Z")
+	folder := d.templates().folder
+	if folder != nil {
+		return filepath.Join(d.Options.BackupFolder, folder.render(d.templateContext(item)))
 	}
 
-	return filepath.Join(d.Options.BackupFolder, t.Format(d.Options.FolderFormat))
+	return filepath.Join(d.Options.BackupFolder, d.creationTime(item).Format(d.Options.FolderFormat))
 }
 
 // createFileName Get the full path to the image file including what conflict position we are at
@@ -69,11 +88,11 @@ func (d *Downloader) createFileName(item *LibraryItem, conflict int) string {
 	return filepath.Base(fileName)
 }
 
-// isConflictingFilePath Check if the image file already exists
+// isConflictingFilePath Check if the image file already exists, ignoring the
+// case for case insensitive sanitize profiles
 func (d *Downloader) isConflictingFilePath(item *LibraryItem) bool {
-	_, err := os.Stat(d.getImageFilePath(item))
-
-	return err == nil
+	filePath := d.getImageFilePath(item)
+	return d.pathExists(filePath) || d.isPackedPath(filePath)
 }
 
 // getLegacyPrefixFilePathByTime Build a file path based on the image creation
@@ -85,7 +104,7 @@ func (d *Downloader) getLegacyPrefixFilePathByTime(item *photoslibrary.MediaItem
 		return "", err
 	}
 	//TODO Assuming item.Id is over a certain length without checking
-	name := fmt.Sprintf("%v_%v", t.Day(), item.Id[len(item.Id)-8:])
+	name := fmt.Sprintf("%v_%v", t.In(d.location(item)).Day(), item.Id[len(item.Id)-8:])
 	return filepath.Join(d.getFolderPath(item), name), nil
 }
 
@@ -116,10 +135,10 @@ func (d *Downloader) getLegacyPrefixFilePath(item *photoslibrary.MediaItem) stri
 func (d *Downloader) getImageFilePath(item *LibraryItem) string {
 	var fileName string
 
-	if d.Options.UseFileName {
+	if d.templates().file != nil {
 		fileName = item.UsedFileName
 		if fileName == "" {
-			fileName = item.Filename
+			fileName = d.renderFileName(&item.MediaItem)
 		}
 
 		fileName = filepath.Join(d.getFolderPath(&item.MediaItem), fileName)
@@ -127,10 +146,7 @@ func (d *Downloader) getImageFilePath(item *LibraryItem) string {
 		fileName = d.getLegacyPrefixFilePath(&item.MediaItem)
 
 		//Append the file extension based on the mime type
-		ext, _ := mime.ExtensionsByType(item.MimeType)
-		if len(ext) > 0 {
-			fileName += ext[0]
-		}
+		fileName += mimeExtension(item.MimeType)
 	}
 
 	return fileName
@@ -138,7 +154,7 @@ func (d *Downloader) getImageFilePath(item *LibraryItem) string {
 
 // getJSONFilePath Get the full path to the JSON file representing the MediaItem
 func (d *Downloader) getJSONFilePath(item *photoslibrary.MediaItem) string {
-	if d.Options.UseFileName {
+	if d.templates().file != nil {
 		//TODO item.Id could be missing
 		return filepath.Join(d.getFolderPath(item), "."+item.Id+".json")
 	}
@@ -148,10 +164,10 @@ func (d *Downloader) getJSONFilePath(item *photoslibrary.MediaItem) string {
 
 // loadJSON Load the JSON file into LibraryItem
 func (d *Downloader) loadJSON(filePath string) (*LibraryItem, error) {
-	info, err := os.Stat(filePath)
+	info, err := d.storage.Stat(filePath)
 
 	if err == nil && info != nil {
-		bytes, err := ioutil.ReadFile(filePath)
+		bytes, err := readStorageFile(d.storage, filePath)
 		if err != nil {
 			return nil, err
 		}
@@ -167,20 +183,21 @@ func (d *Downloader) loadJSON(filePath string) (*LibraryItem, error) {
 	return nil, nil
 }
 
+// writeJSON write the JSON file, replacing it if it exists
+func (d *Downloader) writeJSON(item *LibraryItem, filePath string) error {
+	bytes, err := item.MarshalJSON()
+	if err != nil {
+		return err
+	}
+	return writeStorageFile(d.storage, filePath, bytes)
+}
+
 // createJSON create a JSON file if it does not already exist
 func (d *Downloader) createJSON(item *LibraryItem, filePath string) error {
-	_, err := os.Stat(filePath)
+	_, err := d.storage.Stat(filePath)
 	if os.IsNotExist(err) {
 		log.Printf("Creating JSON for '%v' ", item.UsedFileName)
-		bytes, err := item.MarshalJSON()
-		if err != nil {
-			return err
-		}
-		err = os.MkdirAll(filepath.Dir(filePath), 0700)
-		if err != nil {
-			return err
-		}
-		return ioutil.WriteFile(filePath, bytes, 0644)
+		return d.writeJSON(item, filePath)
 	}
 	return nil
 }
@@ -198,65 +215,146 @@ func (d *Downloader) downloadImage(item *LibraryItem, filePath string) error {
 			url = fmt.Sprintf("%v=w%v-h%v", item.MediaItem.BaseUrl, item.MediaItem.MediaMetadata.Width, item.MediaItem.MediaMetadata.Height)
 		}
 	}
-	output, err := os.Create(filePath)
+	//If timestamp is available, set modified time to the time the item was first created (not when it was uploaded to Google Photos)
+	var modTime time.Time
+	t, err := time.Parse(time.RFC3339, item.MediaMetadata.CreationTime)
+	if err == nil {
+		modTime = t
+	}
+	output, err := d.storage.Create(filePath, modTime)
 	if err != nil {
 		return err
 	}
-	defer output.Close()
 
 	response, err := http.Get(url)
 	if err != nil {
+		output.Abort()
 		return err
 	}
 	defer response.Body.Close()
-
-	//Limit download rate
-	rateLimitedReader := shapeio.NewReader(response.Body)
-	if d.Options.DownloadThrottle > 0.0 {
-		rateLimitedReader.SetRateLimit((d.Options.DownloadThrottle * 1024) / float64(d.Options.ConcurrentDownloads))
+	if response.StatusCode != http.StatusOK {
+		//An expired URL returns an error page, which must not be stored
+		output.Abort()
+		return fmt.Errorf("failed to download '%v': %v", item.Filename, response.Status)
 	}
 
-	n, err := io.Copy(output, rateLimitedReader)
+	//Limit download rate, the limit is shared by all concurrent downloads
+	rateLimitedReader := d.stats.Reader(d.bandwidth.Reader(response.Body))
+
+	hasher := sha256.New()
+	n, err := io.Copy(io.MultiWriter(output, hasher), rateLimitedReader)
 	if err != nil {
+		output.Abort()
 		return err
 	}
-
-	// close file to prevent conflicts with writing new timestamp in next step
-	output.Close()
-
-	//If timestamp is available, set access time to current timestamp and set modified time to the time the item was first created (not when it was uploaded to Google Photos)
-	t, err := time.Parse(time.RFC3339, item.MediaMetadata.CreationTime)
-	if err == nil {
-		err = os.Chtimes(filePath, time.Now(), t)
-		if err != nil {
-			return errors.New("failed writing timestamp to file: " + err.Error())
-		}
+	err = output.Close()
+	if err != nil {
+		return err
 	}
 
 	log.Printf("Downloaded '%v' [saved as '%v'] (%v)", item.Filename, item.UsedFileName, humanize.Bytes(uint64(n)))
 
+	item.SHA256 = hex.EncodeToString(hasher.Sum(nil))
+	err = d.finishDownload(item, filePath)
+	if err != nil {
+		return err
+	}
+
 	d.stats.UpdateStatsDownloaded(uint64(n), 1)
+	return nil
+}
 
-	//Inform channel download is complete
-	<-d.concurrentDownloadRoutines
+// finishDownload Update the item from the downloaded file and save its sidecar
+func (d *Downloader) finishDownload(item *LibraryItem, filePath string) error {
+	jsonFilePath := d.getJSONFilePath(&item.MediaItem)
 
-	return nil
+	//The capture-local offset is only known once the file is downloaded
+	err := d.applyCaptureOffset(item, filePath)
+	if err != nil {
+		log.Printf("Failed to apply the capture time zone of '%v': %v", item.Filename, err)
+	}
+	if d.isLocal() {
+		_, err = updatePerceptualHash(item, d.getImageFilePath(item))
+		if err != nil {
+			log.Printf("Failed to compute the perceptual hash of '%v': %v", item.Filename, err)
+		}
+	}
+	deduped, err := d.dedupeDownloaded(item)
+	if err != nil {
+		log.Printf("Failed to dedupe '%v': %v", item.Filename, err)
+	}
+	if !deduped {
+		//Aliases have no media file, and duplicates are not linked when
+		//metadata is embedded
+		changed, err := d.embedMetadata(item, d.getImageFilePath(item))
+		if err != nil {
+			log.Printf("Failed to embed metadata in '%v': %v", item.Filename, err)
+		}
+		if changed {
+			item.FileSHA256, err = hashFile(d.getImageFilePath(item))
+			if err != nil {
+				return err
+			}
+		}
+	}
+	if item.AliasOf == "" {
+		err = d.updateSize(item, d.getImageFilePath(item))
+		if err != nil {
+			return err
+		}
+	}
+
+	err = d.writeXMP(item, true)
+	if err != nil {
+		return err
+	}
+	newJSONFilePath := d.getJSONFilePath(&item.MediaItem)
+	err = d.writeJSON(item, newJSONFilePath)
+	if err != nil {
+		return err
+	}
+	if newJSONFilePath != jsonFilePath {
+		err = d.storage.Remove(jsonFilePath)
+		if err != nil {
+			return err
+		}
+	}
+	return d.updateChecksum(item, d.getImageFilePath(item))
 }
 
 // createImage Download the image file if it does not already exist
 func (d *Downloader) createImage(item *LibraryItem, filePath string) error {
-	_, err := os.Stat(filePath)
+	_, err := d.storage.Stat(filePath)
 	if os.IsNotExist(err) {
+		adopted, err := d.adoptLocal(item, filePath)
+		if err != nil {
+			log.Printf("Failed to adopt '%v': %v", item.Filename, err)
+		}
+		if adopted {
+			return nil
+		}
+		//Check there is room for the download before starting it
+		estimate, err := d.space.reserve(item)
+		if err != nil {
+			return err
+		}
+
 		//Touch file before downloading (to avoid file name conflicts)
-		err := ioutil.WriteFile(filePath, []byte{}, 0644)
+		err = writeStorageFile(d.storage, filePath, nil)
 		if err != nil {
+			d.space.release(estimate, 0)
 			return err
 		}
+		d.names.add(filePath)
 
 		//Wait till room on channel to start download
 		d.concurrentDownloadRoutines <- struct{}{}
 		d.waitGroup.Go(func() error {
-			return d.downloadImage(item, filePath)
+			//Inform channel download is complete, failed or not
+			defer func() { <-d.concurrentDownloadRoutines }()
+			err := d.downloadImage(item, filePath)
+			d.space.release(estimate, uint64(item.Size))
+			return err
 		})
 	} else {
 		log.Printf("Skipping '%v' [saved as '%v']", item.Filename, item.UsedFileName)
@@ -265,17 +363,68 @@ func (d *Downloader) createImage(item *LibraryItem, filePath string) error {
 	return nil
 }
 
+// refreshMetadata Update the stored item from a freshly listed one, keeping
+// the previous version in the history if requested. The base URL is always
+// refreshed since stored URLs expire. Returns true if the metadata changed.
+func (d *Downloader) refreshMetadata(libraryItem *LibraryItem, item *photoslibrary.MediaItem) bool {
+	if !metadataChanged(&libraryItem.MediaItem, item) {
+		libraryItem.BaseUrl = item.BaseUrl
+		return false
+	}
+
+	log.Printf("Updating metadata for '%v' [saved as '%v']", item.Filename, libraryItem.UsedFileName)
+	if d.Options.KeepMetadataHistory {
+		previous := libraryItem.MediaItem
+		previous.BaseUrl = ""
+		libraryItem.MetadataHistory = append(libraryItem.MetadataHistory, &MetadataVersion{
+			Replaced: time.Now().UTC().Format(time.RFC3339),
+			Item:     &previous,
+		})
+	}
+	libraryItem.MediaItem = *item
+	d.stats.UpdateStatsUpdated(1)
+	return true
+}
+
 // downloadItem TODO
 func (d *Downloader) downloadItem(svc *photoslibrary.Service, item *photoslibrary.MediaItem) error {
+	//Videos still processing would download as a placeholder, retry them later
+	status := videoStatus(item)
+	if status != "" {
+		d.deferItem(item, status)
+		return nil
+	}
+	if d.deferred.remove(item.Id) {
+		log.Printf("Deferred '%v' [id %v] is ready", item.Filename, item.Id)
+	}
+
+	//Packed media files are not downloaded again
+	packed := d.packed[item.Id]
+	if packed != nil && packed.isPacked() {
+		return d.refreshPacked(packed, item)
+	}
+
 	jsonFilePath := d.getJSONFilePath(item)
 
 	libraryItem, err := d.loadJSON(jsonFilePath)
 	if err != nil {
 		return err
 	}
+	if libraryItem == nil && packed != nil {
+		libraryItem = packed.Item
+	}
 	if libraryItem == nil {
+		//An imported copy saves downloading the item again
+		libraryItem, err = d.linkImported(item)
+		if err != nil {
+			return err
+		}
+	}
+	isNew := libraryItem == nil
+	if isNew {
 		libraryItem = new(LibraryItem)
 		libraryItem.MediaItem = *item
+		libraryItem.addAlbum(d.albumTitle)
 
 		//Create non-conflicting file name
 		for conflict := 0; true; conflict++ {
@@ -284,23 +433,134 @@ func (d *Downloader) downloadItem(svc *photoslibrary.Service, item *photoslibrar
 				break
 			}
 		}
+		d.recordFileNameMapping(libraryItem)
+	} else {
+		changed := d.refreshMetadata(libraryItem, item)
+		if libraryItem.DeletedUpstream != "" {
+			log.Printf("'%v' [id %v] is back in Google Photos", item.Filename, item.Id)
+			libraryItem.DeletedUpstream = ""
+			changed = true
+		}
+		if libraryItem.addAlbum(d.albumTitle) {
+			changed = true
+		}
+		if changed {
+			err = d.writeJSON(libraryItem, jsonFilePath)
+			if err != nil {
+				return err
+			}
+		}
+		err = d.writeXMP(libraryItem, changed)
+		if err != nil {
+			return err
+		}
 	}
 
 	err = d.createJSON(libraryItem, jsonFilePath)
 	if err != nil {
 		return err
 	}
+	if libraryItem.AliasOf != "" {
+		log.Printf("Skipping '%v' [duplicate of id %v]", item.Filename, libraryItem.AliasOf)
+		d.stats.UpdateStatsSkipped(1)
+		return nil
+	}
 	return d.createImage(libraryItem, d.getImageFilePath(libraryItem))
 }
 
 // DownloadAll downloads all files
 func (d *Downloader) DownloadAll(svc *photoslibrary.Service) error {
 	hasMore := true
+	//complete is true when all items in the library were listed
+	complete := d.Options.AlbumID == ""
+	d.seen = make(map[string]bool)
 	sleepTime := time.Duration(time.Second * time.Duration(d.Options.Throttle))
 
+	_, err := d.compileTemplates()
+	if err != nil {
+		return err
+	}
+	_, err = d.timeZone()
+	if err != nil {
+		return err
+	}
+	err = ValidateDedupeMode(d.Options.Dedupe)
+	if err != nil {
+		return err
+	}
+	err = ValidateAdoptMode(d.Options.AdoptMode)
+	if err != nil {
+		return err
+	}
+	err = ValidateDeletedPolicy(d.Options.DeletedPolicy)
+	if err != nil {
+		return err
+	}
+	err = d.validateStorageOptions()
+	if err != nil {
+		return err
+	}
+	err = ValidatePackFormat(d.Options.Pack)
+	if err != nil {
+		return err
+	}
+	//Paths of items already moved to their capture-local folder depend on the
+	//offsets stored in their sidecars, and imported items wait to be linked
+	catalog, err := d.loadCatalog()
+	if err != nil {
+		return err
+	}
+	if d.Options.Dedupe != "" {
+		d.hashes = newHashIndex(catalog)
+	}
+	d.provisional = newProvisionalIndex(catalog)
+	d.paused = ""
+	d.names = newNameCache()
+	d.space, err = d.newSpaceGuard(catalog)
+	if err != nil {
+		return err
+	}
+	d.packed = make(map[string]*catalogEntry)
+	for id, entry := range catalog.items {
+		if entry.pack != nil {
+			d.packed[id] = entry
+		}
+	}
+	if d.Options.AdoptFolder != "" {
+		d.adopt, err = d.loadAdoptIndex()
+		if err != nil {
+			return err
+		}
+	}
+	if d.Options.AlbumID != "" {
+		album, err := svc.Albums.Get(d.Options.AlbumID).Do()
+		if err != nil {
+			return err
+		}
+		d.albumTitle = album.Title
+	}
+
+	err = d.deferred.load(d.storage, filepath.Join(d.Options.BackupFolder, deferredFileName))
+	if err != nil {
+		return err
+	}
+
 	//Setup channel buffer to limit downloads
 	d.concurrentDownloadRoutines = make(chan struct{}, d.Options.ConcurrentDownloads)
 
+	//Setup the bandwidth limiter shared by all downloads
+	if d.bandwidth == nil {
+		var schedule *BandwidthSchedule
+		if d.Options.BandwidthSchedule != "" {
+			var err error
+			schedule, err = ParseBandwidthSchedule(d.Options.BandwidthSchedule)
+			if err != nil {
+				return err
+			}
+		}
+		d.bandwidth = newBandwidthLimiter(schedule, d.Options.DownloadThrottle*1024)
+	}
+
 	req := &photoslibrary.SearchMediaItemsRequest{PageSize: int64(d.Options.PageSize), AlbumId: d.Options.AlbumID}
 	for hasMore {
 		items, err := svc.MediaItems.Search(req).Do()
@@ -309,7 +569,16 @@ func (d *Downloader) DownloadAll(svc *photoslibrary.Service) error {
 		}
 		for _, m := range items.MediaItems {
 			d.stats.UpdateStatsTotal(1)
+			d.seen[m.Id] = true
 			err = d.downloadItem(svc, m)
+			if isSpaceLimit(err) {
+				//Downloads would fail one after the other, stop the pass instead
+				log.Printf("Downloads paused: %v", err)
+				d.paused = err.Error()
+				hasMore = false
+				complete = false
+				break
+			}
 			if err != nil {
 				log.Printf("Failed to download '%v' [id %v]: %v", m.Filename, m.Id, err)
 				d.stats.UpdateStatsError(1)
@@ -317,6 +586,7 @@ func (d *Downloader) DownloadAll(svc *photoslibrary.Service) error {
 
 			if d.stats.Total >= d.Options.MaxItems {
 				hasMore = false
+				complete = false
 				break
 			}
 		}
@@ -326,17 +596,73 @@ func (d *Downloader) DownloadAll(svc *photoslibrary.Service) error {
 		}
 
 		//Wait for all downloads in group to complete, return if any errors
-		err = d.waitGroup.Wait()
+		err = d.finishPage()
 		if err != nil {
 			return err
 		}
 
 		if hasMore {
-			log.Printf("Processed: %v, Downloaded: %v, Skipped: %v, Errors: %v, Total Size: %v", d.stats.Total, d.stats.Downloaded, d.stats.Skipped, d.stats.Errors, humanize.Bytes(d.stats.TotalSize))
+			log.Printf("Processed: %v, Downloaded: %v, Skipped: %v, Updated: %v, Pending: %v, Errors: %v, Total Size: %v, Throughput: %v/s", d.stats.Total, d.stats.Downloaded, d.stats.Skipped, d.stats.Updated, d.stats.Pending, d.stats.Errors, humanize.Bytes(d.stats.TotalSize), humanize.Bytes(uint64(d.stats.Throughput())))
 			time.Sleep(sleepTime)
 		}
 	}
 
-	log.Printf("Finished: %v, Downloaded: %v, Skipped: %v, Errors: %v, Total Size: %v", d.stats.Total, d.stats.Downloaded, d.stats.Skipped, d.stats.Errors, humanize.Bytes(d.stats.TotalSize))
+	//Retry deferred items not listed in this pass
+	if d.paused == "" {
+		err = d.retryDeferred(svc)
+		if err != nil {
+			return err
+		}
+	}
+	err = d.saveDeferred()
+	if err != nil {
+		return err
+	}
+
+	//Items not seen during a complete pass were deleted from Google Photos
+	if complete {
+		err := d.reconcile()
+		if err != nil {
+			return err
+		}
+		//Finished folders are packed once all their items are downloaded
+		if d.Options.Pack != "" {
+			err = d.Pack()
+			if err != nil {
+				return err
+			}
+		}
+	}
+	err = d.flushChecksums()
+	if err != nil {
+		return err
+	}
+
+	log.Printf("Finished: %v, Downloaded: %v, Skipped: %v, Updated: %v, Linked: %v, Adopted: %v, Pending: %v, Errors: %v, Deleted: %v, Total Size: %v, Throughput: %v/s", d.stats.Total, d.stats.Downloaded, d.stats.Skipped, d.stats.Updated, d.stats.Linked, d.stats.Adopted, d.stats.Pending, d.stats.Errors, d.stats.Deleted, humanize.Bytes(d.stats.TotalSize), humanize.Bytes(uint64(d.stats.Throughput())))
+	if d.paused != "" {
+		log.Printf("Paused: %v. Free some space or raise the limits to download the remaining items", d.paused)
+	}
 	return nil
 }
+
+// finishPage Wait for the downloads in progress, then write the changed
+// checksum manifests and the deferred queue. They are written when downloads
+// failed too, so the finished ones are recorded.
+func (d *Downloader) finishPage() error {
+	err := d.waitGroup.Wait()
+	flushErr := d.flushChecksums()
+	if err == nil {
+		err = flushErr
+	}
+	saveErr := d.saveDeferred()
+	if err == nil {
+		err = saveErr
+	}
+	return err
+}
+
+// Paused returns why downloads were paused during the last pass, empty when
+// they were not
+func (d *Downloader) Paused() string {
+	return d.paused
+}
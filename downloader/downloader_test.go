@@ -2,11 +2,16 @@ package downloader
 
 import (
 	"encoding/json"
+	"fmt"
 	"io/ioutil"
 	"mime"
+	"net/http"
+	"net/http/httptest"
 	"os"
 	"path/filepath"
+	"strings"
 	"testing"
+	"time"
 
 	photoslibrary "github.com/gphotosuploader/googlemirror/api/photoslibrary/v1"
 )
@@ -137,6 +142,7 @@ func TestCreateFileName(t *testing.T) {
 	t.Run("Use File Name", func(t *testing.T) {
 		downloader := NewDownloader()
 		downloader.Options.UseFileName = true
+		downloader.compileTemplates()
 
 		item := new(LibraryItem)
 		item.MediaMetadata = new(photoslibrary.MediaMetadata)
@@ -153,6 +159,7 @@ func TestCreateFileName(t *testing.T) {
 	t.Run("Use File Name Uses UsedFileName", func(t *testing.T) {
 		downloader := NewDownloader()
 		downloader.Options.UseFileName = true
+		downloader.compileTemplates()
 
 		item := new(LibraryItem)
 		item.MediaMetadata = new(photoslibrary.MediaMetadata)
@@ -170,6 +177,7 @@ func TestCreateFileName(t *testing.T) {
 	t.Run("Conflict", func(t *testing.T) {
 		downloader := NewDownloader()
 		downloader.Options.UseFileName = true
+		downloader.compileTemplates()
 
 		item := new(LibraryItem)
 		item.MediaMetadata = new(photoslibrary.MediaMetadata)
@@ -188,6 +196,7 @@ func TestIsConflictingFilePath(t *testing.T) {
 	t.Run("Conflicting", func(t *testing.T) {
 		downloader := NewDownloader()
 		downloader.Options.UseFileName = true
+		downloader.compileTemplates()
 		downloader.Options.BackupFolder = tempPath()
 		defer os.RemoveAll(downloader.Options.BackupFolder)
 
@@ -214,6 +223,7 @@ func TestIsConflictingFilePath(t *testing.T) {
 	t.Run("Not Conflicting", func(t *testing.T) {
 		downloader := NewDownloader()
 		downloader.Options.UseFileName = true
+		downloader.compileTemplates()
 		downloader.Options.BackupFolder = tempPath()
 		defer os.RemoveAll(downloader.Options.BackupFolder)
 
@@ -266,6 +276,7 @@ func TestGetJSONFilePath(t *testing.T) {
 	t.Run("Use File Name", func(t *testing.T) {
 		downloader := NewDownloader()
 		downloader.Options.UseFileName = true
+		downloader.compileTemplates()
 		downloader.Options.BackupFolder = tempPath()
 		defer os.RemoveAll(downloader.Options.BackupFolder)
 
@@ -288,6 +299,7 @@ func TestCreateAndLoadJSON(t *testing.T) {
 	downloader.Options.BackupFolder = tempPath()
 	defer os.RemoveAll(downloader.Options.BackupFolder)
 	downloader.Options.UseFileName = true
+	downloader.compileTemplates()
 
 	item := new(LibraryItem)
 	item.Id = "12345678901234567890"
@@ -341,3 +353,100 @@ func TestMediaItemFileName(t *testing.T) {
 		t.Errorf("photoslibrary.MediaItem.FileName = %v; want \"IMG_1234.jpg\"", item.Filename)
 	}
 }
+
+func TestRefreshMetadata(t *testing.T) {
+	stored := new(LibraryItem)
+	stored.Id = "12345678901234567890"
+	stored.BaseUrl = "https://lh3.googleusercontent.com/old"
+	stored.MediaMetadata = new(photoslibrary.MediaMetadata)
+	stored.MediaMetadata.CreationTime = "2019-10-13T17:33:43Z"
+	stored.UsedFileName = "test.jpg"
+
+	t.Run("Unchanged", func(t *testing.T) {
+		downloader := NewDownloader()
+		libraryItem := *stored
+
+		fresh := stored.MediaItem
+		fresh.BaseUrl = "https://lh3.googleusercontent.com/new"
+
+		if downloader.refreshMetadata(&libraryItem, &fresh) {
+			t.Errorf("downloader.refreshMetadata() = true; want false")
+		}
+		if libraryItem.BaseUrl != fresh.BaseUrl {
+			t.Errorf("LibraryItem.BaseUrl = %v; want %v", libraryItem.BaseUrl, fresh.BaseUrl)
+		}
+	})
+
+	t.Run("Changed With History", func(t *testing.T) {
+		downloader := NewDownloader()
+		downloader.Options.KeepMetadataHistory = true
+		libraryItem := *stored
+
+		fresh := stored.MediaItem
+		fresh.Description = "At the beach"
+
+		if !downloader.refreshMetadata(&libraryItem, &fresh) {
+			t.Errorf("downloader.refreshMetadata() = false; want true")
+		}
+		if libraryItem.Description != fresh.Description || libraryItem.UsedFileName != stored.UsedFileName {
+			t.Errorf("downloader.refreshMetadata() = %v; want description %v", libraryItem, fresh.Description)
+		}
+		if len(libraryItem.MetadataHistory) != 1 || libraryItem.MetadataHistory[0].Item.Description != "" {
+			t.Errorf("LibraryItem.MetadataHistory = %v; want the previous version", libraryItem.MetadataHistory)
+		}
+
+		bytes, err := libraryItem.MarshalJSON()
+		if err != nil {
+			t.Fatalf("%v", err)
+		}
+		loaded := new(LibraryItem)
+		err = json.Unmarshal(bytes, loaded)
+		if err != nil {
+			t.Fatalf("%v", err)
+		}
+		if len(loaded.MetadataHistory) != 1 || loaded.MetadataHistory[0].Item.Id != stored.Id {
+			t.Errorf("LibraryItem.MetadataHistory = %v after loading; want the previous version", loaded.MetadataHistory)
+		}
+	})
+}
+
+func TestDownloadImage(t *testing.T) {
+	//Expired base URLs return an error page
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "expired", http.StatusForbidden)
+	}))
+	defer server.Close()
+	downloader := NewDownloader()
+	downloader.Options.BackupFolder = tempPath()
+	defer os.RemoveAll(downloader.Options.BackupFolder)
+	downloader.concurrentDownloadRoutines = make(chan struct{}, 1)
+
+	//Failed downloads free their slot, so the next ones start
+	done := make(chan error)
+	go func() {
+		for i := 0; i < 3; i++ {
+			item := adoptTestItem(fmt.Sprintf("ABCDEFGHIJKLMNOPQRSTUVW%v", i), fmt.Sprintf("IMG_%v.jpg", i))
+			item.BaseUrl = server.URL + "/photo"
+			item.UsedFileName = item.Filename
+			err := downloader.createImage(item, filepath.Join(downloader.Options.BackupFolder, item.Filename))
+			if err != nil {
+				done <- err
+				return
+			}
+		}
+		done <- downloader.waitGroup.Wait()
+	}()
+	select {
+	case err := <-done:
+		if err == nil || !strings.Contains(err.Error(), "403") {
+			t.Errorf("download error = %v; want the status", err)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatalf("failed downloads should not block the next ones")
+	}
+	for i := 0; i < 3; i++ {
+		if _, err := os.Stat(filepath.Join(downloader.Options.BackupFolder, fmt.Sprintf("IMG_%v.jpg", i))); !os.IsNotExist(err) {
+			t.Errorf("error pages should not be stored: %v", err)
+		}
+	}
+}
@@ -0,0 +1,219 @@
+package downloader
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"math/bits"
+	"os"
+	"sort"
+	"strconv"
+)
+
+const (
+	//DuplicatesJSON duplicates report as a JSON array of groups
+	DuplicatesJSON = "json"
+	//DuplicatesCSV duplicates report as CSV, one line per item
+	DuplicatesCSV = "csv"
+)
+
+// DuplicateItem an item in a group of near-identical images
+type DuplicateItem struct {
+	ID             string `json:"id"`
+	Filename       string `json:"filename"`
+	Path           string `json:"path"`
+	PerceptualHash string `json:"perceptualHash"`
+	//Distance Hamming distance to the perceptual hash of the first item in the group
+	Distance int `json:"distance"`
+}
+
+// DuplicateGroup near-identical images
+type DuplicateGroup struct {
+	Items []*DuplicateItem `json:"items"`
+}
+
+// updatePerceptualHash Compute the perceptual hash of a stored JPEG or PNG
+// item if missing, returns true if it was computed
+func updatePerceptualHash(item *LibraryItem, filePath string) (bool, error) {
+	if item.PerceptualHash != "" || !hasPerceptualHash(item.MimeType) {
+		return false, nil
+	}
+	hash, err := perceptualHashFile(filePath)
+	if err != nil {
+		return false, err
+	}
+	item.PerceptualHash = hash
+	return true, nil
+}
+
+// perceptualBands masks splitting 64 bits hashes into maxDistance+1 bands,
+// hashes at most maxDistance apart are equal in at least one of them
+func perceptualBands(maxDistance int) []uint64 {
+	if maxDistance < 0 {
+		return nil
+	}
+	if maxDistance >= 63 {
+		//Bands of a bit would miss hashes differing in all bits
+		return []uint64{0}
+	}
+	count := maxDistance + 1
+	masks := make([]uint64, count)
+	offset := 0
+	for i := range masks {
+		width := 64 / count
+		if i < 64%count {
+			width++
+		}
+		masks[i] = (uint64(1)<<uint(width) - 1) << uint(offset)
+		offset += width
+	}
+	return masks
+}
+
+// findDuplicates Group the entries whose perceptual hashes are at most
+// maxDistance apart, groups of a single entry are dropped. Only hashes equal
+// in a band are compared, instead of all pairs.
+func findDuplicates(entries []*catalogEntry, maxDistance int) ([]*DuplicateGroup, error) {
+	hashes := make([]uint64, len(entries))
+	for i, entry := range entries {
+		hash, err := strconv.ParseUint(entry.Item.PerceptualHash, 16, 64)
+		if err != nil {
+			return nil, err
+		}
+		hashes[i] = hash
+	}
+
+	//Union-find over the pairs of each band
+	parents := make([]int, len(entries))
+	for i := range parents {
+		parents[i] = i
+	}
+	var root func(i int) int
+	root = func(i int) int {
+		if parents[i] != i {
+			parents[i] = root(parents[i])
+		}
+		return parents[i]
+	}
+	for _, mask := range perceptualBands(maxDistance) {
+		buckets := make(map[uint64][]int)
+		for i, hash := range hashes {
+			buckets[hash&mask] = append(buckets[hash&mask], i)
+		}
+		for _, bucket := range buckets {
+			for a, i := range bucket {
+				for _, j := range bucket[a+1:] {
+					if root(i) != root(j) && bits.OnesCount64(hashes[i]^hashes[j]) <= maxDistance {
+						parents[root(j)] = root(i)
+					}
+				}
+			}
+		}
+	}
+
+	members := make(map[int][]int)
+	var roots []int
+	for i := range entries {
+		r := root(i)
+		if members[r] == nil {
+			roots = append(roots, r)
+		}
+		members[r] = append(members[r], i)
+	}
+
+	var groups []*DuplicateGroup
+	for _, r := range roots {
+		if len(members[r]) < 2 {
+			continue
+		}
+		group := new(DuplicateGroup)
+		first := hashes[members[r][0]]
+		for _, i := range members[r] {
+			entry := entries[i]
+			group.Items = append(group.Items, &DuplicateItem{
+				ID:             entry.Item.Id,
+				Filename:       entry.Item.Filename,
+				Path:           entry.MediaFilePath(),
+				PerceptualHash: entry.Item.PerceptualHash,
+				Distance:       bits.OnesCount64(first ^ hashes[i]),
+			})
+		}
+		groups = append(groups, group)
+	}
+	return groups, nil
+}
+
+// Duplicates Report groups of near-identical images in the backup folder,
+// such as resized or re-compressed copies of the same shot, to w in JSON or
+// CSV format. Perceptual hashes missing from items downloaded before they
+// were computed are added to their JSON files.
+func (d *Downloader) Duplicates(w io.Writer, format string, maxDistance int) error {
+	err := d.requireLocal("duplicates")
+	if err != nil {
+		return err
+	}
+	_, err = d.compileTemplates()
+	if err != nil {
+		return err
+	}
+	if format != DuplicatesJSON && format != DuplicatesCSV {
+		return fmt.Errorf("unknown duplicates format '%v', use %v or %v", format, DuplicatesJSON, DuplicatesCSV)
+	}
+	catalog, err := d.loadCatalog()
+	if err != nil {
+		return err
+	}
+
+	var entries []*catalogEntry
+	for _, entry := range catalog.items {
+		if entry.Item.AliasOf != "" {
+			continue
+		}
+		updated, err := updatePerceptualHash(entry.Item, entry.MediaFilePath())
+		if err != nil {
+			if !os.IsNotExist(err) {
+				log.Printf("Failed to hash '%v': %v", entry.MediaFilePath(), err)
+			}
+			continue
+		}
+		if updated {
+			err = d.writeJSON(entry.Item, entry.JSONFilePath)
+			if err != nil {
+				return err
+			}
+		}
+		if entry.Item.PerceptualHash != "" {
+			entries = append(entries, entry)
+		}
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].MediaFilePath() < entries[j].MediaFilePath()
+	})
+
+	groups, err := findDuplicates(entries, maxDistance)
+	if err != nil {
+		return err
+	}
+	log.Printf("Found %v groups of near-identical images in %v images", len(groups), len(entries))
+
+	if format == DuplicatesJSON {
+		if groups == nil {
+			groups = []*DuplicateGroup{}
+		}
+		encoder := json.NewEncoder(w)
+		encoder.SetIndent("", "  ")
+		return encoder.Encode(groups)
+	}
+
+	writer := csv.NewWriter(w)
+	writer.Write([]string{"group", "id", "filename", "path", "perceptualHash", "distance"})
+	for i, group := range groups {
+		for _, item := range group.Items {
+			writer.Write([]string{strconv.Itoa(i + 1), item.ID, item.Filename, item.Path, item.PerceptualHash, strconv.Itoa(item.Distance)})
+		}
+	}
+	writer.Flush()
+	return writer.Error()
+}
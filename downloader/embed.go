@@ -0,0 +1,81 @@
+package downloader
+
+import (
+	"log"
+	"strings"
+	"time"
+)
+
+// exifTags the EXIF tags holding the Google Photos metadata of an item. The
+// creation time is written in zone, or the location of the item when nil,
+// with its UTC offset, as readers take EXIF dates as local time.
+func (d *Downloader) exifTags(item *LibraryItem, zone *time.Location) []*exifTag {
+	var tags []*exifTag
+	if item.MediaMetadata != nil {
+		_, err := time.Parse(time.RFC3339, item.MediaMetadata.CreationTime)
+		if err == nil {
+			created := d.creationTime(&item.MediaItem)
+			if zone != nil {
+				created = created.In(zone)
+			}
+			tags = append(tags, asciiTag(exifIFDExif, exifTagDateTimeOriginal, created.Format("2006:01:02 15:04:05")),
+				asciiTag(exifIFDExif, exifTagOffsetTimeOriginal, created.Format("-07:00")))
+		}
+	}
+	if item.Description != "" {
+		tags = append(tags, asciiTag(exifIFD0, exifTagImageDescription, item.Description))
+	}
+	if value := cameraMake(&item.MediaItem); value != "" {
+		tags = append(tags, asciiTag(exifIFD0, exifTagMake, value))
+	}
+	if value := cameraModel(&item.MediaItem); value != "" {
+		tags = append(tags, asciiTag(exifIFD0, exifTagModel, value))
+	}
+	if item.GeoData != nil {
+		tags = append(tags, gpsTags(item.GeoData)...)
+	}
+	tags = append(tags, userCommentTag("Google Photos ID: "+item.Id))
+	return tags
+}
+
+// embedMetadata Write the Google Photos metadata missing from a downloaded
+// file into it, without re-encoding. Returns true if the file changed.
+func (d *Downloader) embedMetadata(item *LibraryItem, filePath string) (bool, error) {
+	if !d.Options.EmbedMetadata {
+		return false, nil
+	}
+	var changed bool
+	var err error
+	if strings.EqualFold(item.MimeType, "image/jpeg") {
+		//A date added to a file with a UTC offset is written in that offset
+		var zone *time.Location
+		x, readErr := readEXIFFile(filePath)
+		if readErr == nil && x.offsetTimeOriginal() != "" {
+			zone, _ = parseUTCOffset(x.offsetTimeOriginal())
+		}
+		changed, err = embedEXIF(filePath, d.exifTags(item, zone))
+	} else if isMP4(item.MimeType) && item.MediaMetadata != nil {
+		var created time.Time
+		created, err = time.Parse(time.RFC3339, item.MediaMetadata.CreationTime)
+		if err != nil {
+			return false, nil
+		}
+		changed, err = embedMP4(filePath, created, d.mp4UserData(item))
+	}
+	if changed {
+		log.Printf("Embedded metadata in '%v'", item.UsedFileName)
+	}
+	return changed, err
+}
+
+// mp4UserData the user data text boxes holding the Google Photos metadata of
+// a video, when enabled
+func (d *Downloader) mp4UserData(item *LibraryItem) map[string]string {
+	if !d.Options.EmbedVideoTags {
+		return nil
+	}
+	return map[string]string{
+		mp4UserDataDay:         d.creationTime(&item.MediaItem).Format(time.RFC3339),
+		mp4UserDataDescription: item.Description,
+	}
+}
@@ -0,0 +1,483 @@
+package downloader
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"filippo.io/age"
+	"filippo.io/age/armor"
+	"golang.org/x/crypto/hkdf"
+)
+
+const (
+	//EncryptAge encrypt stored files with age to the X25519 recipient of an identity
+	EncryptAge = "age"
+	//EncryptAESGCM encrypt stored files with AES-256-GCM with a key file
+	EncryptAESGCM = "aes-gcm"
+)
+
+// passphraseVariable environment variable holding the passphrase of an
+// identity file encrypted with `age -p`
+const passphraseVariable = "GITMOO_PASSPHRASE"
+
+// encryptedChunkSize size of the plaintext chunks of age and AES-GCM files,
+// each chunk is followed by a 16 bytes tag
+const encryptedChunkSize = 64 * 1024
+
+// encryptedTagSize size of the authentication tag of every chunk
+const encryptedTagSize = 16
+
+// encryption how the files of an encrypted storage are encrypted
+type encryption interface {
+	//extension suffix of the encrypted files
+	extension() string
+	//encrypt starts encrypting a file to w, the file is complete once closed
+	encrypt(w io.Writer) (io.WriteCloser, error)
+	//decrypt starts decrypting a file, reads fail if the file was changed
+	decrypt(r io.Reader) (io.Reader, error)
+	//payloadOffset reads the header of a file, returns where its chunks start
+	payloadOffset(r io.Reader) (int64, error)
+}
+
+// ValidateEncryptMode returns an error for unknown encryption modes
+func ValidateEncryptMode(mode string) error {
+	switch mode {
+	case "", EncryptAge, EncryptAESGCM:
+		return nil
+	}
+	return fmt.Errorf("unknown encryption '%v', use %v or %v", mode, EncryptAge, EncryptAESGCM)
+}
+
+// newEncryption Load the keys of the encryption of options, returns nil
+// without encryption
+func newEncryption(options *Options) (encryption, error) {
+	err := ValidateEncryptMode(options.Encrypt)
+	if err != nil {
+		return nil, err
+	}
+	if options.Encrypt == "" {
+		return nil, nil
+	}
+	if options.EncryptKey == "" {
+		return nil, fmt.Errorf("-encrypt %v needs -encrypt-key", options.Encrypt)
+	}
+	data, err := ioutil.ReadFile(options.EncryptKey)
+	if err != nil {
+		return nil, err
+	}
+	if options.Encrypt == EncryptAESGCM {
+		if options.EncryptTo != "" {
+			return nil, fmt.Errorf("-encrypt-to needs -encrypt %v", EncryptAge)
+		}
+		key, err := hex.DecodeString(strings.TrimSpace(string(data)))
+		if err != nil || len(key) != 32 {
+			return nil, fmt.Errorf("'%v' should hold a 256 bits key in hex, such as made by 'openssl rand -hex 32'", options.EncryptKey)
+		}
+		return &aesGCMEncryption{key: key}, nil
+	}
+	return newAgeEncryption(options, data)
+}
+
+// ageEncryption files encrypted with age, readable by the identities
+type ageEncryption struct {
+	identities []age.Identity
+	recipients []age.Recipient
+}
+
+// newAgeEncryption Load an identity file, which may be encrypted with a
+// passphrase, and the recipients of options.EncryptTo
+func newAgeEncryption(options *Options, data []byte) (*ageEncryption, error) {
+	var identityFile io.Reader = bytes.NewReader(data)
+	if bytes.HasPrefix(data, []byte(armor.Header)) {
+		identityFile = armor.NewReader(identityFile)
+	}
+	if bytes.HasPrefix(data, []byte(armor.Header)) || bytes.HasPrefix(data, []byte("age-encryption.org/")) {
+		passphrase := os.Getenv(passphraseVariable)
+		if passphrase == "" {
+			return nil, fmt.Errorf("'%v' is encrypted, set its passphrase in %v", options.EncryptKey, passphraseVariable)
+		}
+		identity, err := age.NewScryptIdentity(passphrase)
+		if err != nil {
+			return nil, err
+		}
+		identityFile, err = age.Decrypt(identityFile, identity)
+		if err != nil {
+			return nil, fmt.Errorf("failed decrypting '%v': %v", options.EncryptKey, err)
+		}
+	}
+	identities, err := age.ParseIdentities(identityFile)
+	if err != nil {
+		return nil, fmt.Errorf("failed reading '%v': %v", options.EncryptKey, err)
+	}
+	encryption := &ageEncryption{identities: identities}
+	for _, identity := range identities {
+		if x25519, ok := identity.(*age.X25519Identity); ok {
+			encryption.recipients = append(encryption.recipients, x25519.Recipient())
+		}
+	}
+	if options.EncryptTo != "" {
+		file, err := os.Open(options.EncryptTo)
+		if err != nil {
+			return nil, err
+		}
+		defer file.Close()
+		recipients, err := age.ParseRecipients(file)
+		if err != nil {
+			return nil, fmt.Errorf("failed reading '%v': %v", options.EncryptTo, err)
+		}
+		encryption.recipients = append(encryption.recipients, recipients...)
+	}
+	return encryption, nil
+}
+
+func (a *ageEncryption) extension() string {
+	return ".age"
+}
+
+func (a *ageEncryption) encrypt(w io.Writer) (io.WriteCloser, error) {
+	return age.Encrypt(w, a.recipients...)
+}
+
+func (a *ageEncryption) decrypt(r io.Reader) (io.Reader, error) {
+	return age.Decrypt(r, a.identities...)
+}
+
+// payloadOffset The age header is text ending with a `---` line, followed by
+// a 16 bytes nonce
+func (a *ageEncryption) payloadOffset(r io.Reader) (int64, error) {
+	reader := bufio.NewReader(io.LimitReader(r, encryptedChunkSize))
+	var offset int64
+	for {
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			return 0, errors.New("invalid age header")
+		}
+		offset += int64(len(line))
+		if strings.HasPrefix(line, "--- ") {
+			return offset + 16, nil
+		}
+	}
+}
+
+// aesGCMMagic start of files encrypted with AES-GCM, followed by a 32 bytes
+// salt deriving the key of the file
+const aesGCMMagic = "gitmoo-aes-gcm/v1\n"
+
+// aesGCMEncryption files encrypted with AES-256-GCM in chunks, as age does,
+// with a key derived from the key file and the salt of every file
+type aesGCMEncryption struct {
+	key []byte
+}
+
+// extension is not `.age`, the files are not in the age format and the age
+// tool would fail on them
+func (a *aesGCMEncryption) extension() string {
+	return ".aesgcm"
+}
+
+// aead the cipher of a file with salt
+func (a *aesGCMEncryption) aead(salt []byte) (cipher.AEAD, error) {
+	key := make([]byte, 32)
+	_, err := io.ReadFull(hkdf.New(sha256.New, a.key, salt, []byte("payload")), key)
+	if err != nil {
+		return nil, err
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+func (a *aesGCMEncryption) encrypt(w io.Writer) (io.WriteCloser, error) {
+	salt := make([]byte, 32)
+	_, err := rand.Read(salt)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := a.aead(salt)
+	if err != nil {
+		return nil, err
+	}
+	_, err = w.Write(append([]byte(aesGCMMagic), salt...))
+	if err != nil {
+		return nil, err
+	}
+	return &aesGCMWriter{w: w, aead: aead, buffer: make([]byte, 0, encryptedChunkSize)}, nil
+}
+
+func (a *aesGCMEncryption) decrypt(r io.Reader) (io.Reader, error) {
+	header := make([]byte, len(aesGCMMagic)+32)
+	_, err := io.ReadFull(r, header)
+	if err != nil || string(header[:len(aesGCMMagic)]) != aesGCMMagic {
+		return nil, errors.New("invalid AES-GCM header")
+	}
+	aead, err := a.aead(header[len(aesGCMMagic):])
+	if err != nil {
+		return nil, err
+	}
+	return &aesGCMReader{r: bufio.NewReader(r), aead: aead, sealed: make([]byte, encryptedChunkSize+encryptedTagSize)}, nil
+}
+
+func (a *aesGCMEncryption) payloadOffset(r io.Reader) (int64, error) {
+	return int64(len(aesGCMMagic) + 32), nil
+}
+
+// chunkNonce the nonce of a chunk: its counter, and 1 for the last chunk so
+// truncated files are found
+func chunkNonce(counter uint64, last bool) []byte {
+	nonce := make([]byte, 12)
+	binary.BigEndian.PutUint64(nonce[3:11], counter)
+	if last {
+		nonce[11] = 1
+	}
+	return nonce
+}
+
+// aesGCMWriter encrypts full chunks as they are written, the last chunk when
+// closed
+type aesGCMWriter struct {
+	w       io.Writer
+	aead    cipher.AEAD
+	buffer  []byte
+	counter uint64
+}
+
+func (w *aesGCMWriter) seal(last bool) error {
+	_, err := w.w.Write(w.aead.Seal(nil, chunkNonce(w.counter, last), w.buffer, nil))
+	w.counter++
+	w.buffer = w.buffer[:0]
+	return err
+}
+
+func (w *aesGCMWriter) Write(data []byte) (int, error) {
+	written := 0
+	for len(data) > 0 {
+		if len(w.buffer) == encryptedChunkSize {
+			err := w.seal(false)
+			if err != nil {
+				return written, err
+			}
+		}
+		n := copy(w.buffer[len(w.buffer):cap(w.buffer)], data)
+		w.buffer = w.buffer[:len(w.buffer)+n]
+		data = data[n:]
+		written += n
+	}
+	return written, nil
+}
+
+func (w *aesGCMWriter) Close() error {
+	return w.seal(true)
+}
+
+// aesGCMReader decrypts a chunk at a time, a chunk is the last one when
+// nothing follows it
+type aesGCMReader struct {
+	r       *bufio.Reader
+	aead    cipher.AEAD
+	sealed  []byte
+	plain   []byte
+	counter uint64
+	done    bool
+}
+
+func (r *aesGCMReader) Read(data []byte) (int, error) {
+	for len(r.plain) == 0 {
+		if r.done {
+			return 0, io.EOF
+		}
+		n, err := io.ReadFull(r.r, r.sealed[:cap(r.sealed)])
+		last := err == io.EOF || err == io.ErrUnexpectedEOF
+		if err != nil && !last {
+			return 0, err
+		}
+		if !last {
+			_, err = r.r.Peek(1)
+			last = err == io.EOF
+			if err != nil && !last {
+				return 0, err
+			}
+		}
+		r.plain, err = r.aead.Open(r.sealed[:0], chunkNonce(r.counter, last), r.sealed[:n], nil)
+		if err != nil {
+			return 0, errors.New("failed decrypting, the file is damaged or truncated")
+		}
+		r.counter++
+		r.done = last
+	}
+	n := copy(data, r.plain)
+	r.plain = r.plain[n:]
+	return n, nil
+}
+
+// plaintextSize the size of the content of a file of chunks starting at offset
+func plaintextSize(size int64, offset int64) int64 {
+	payload := size - offset
+	if payload < encryptedTagSize {
+		return -1
+	}
+	chunks := (payload + encryptedChunkSize + encryptedTagSize - 1) / (encryptedChunkSize + encryptedTagSize)
+	return payload - chunks*encryptedTagSize
+}
+
+// encryptedStorage a storage keeping every file encrypted, with the suffix
+// of the encryption. Files without the suffix are ignored, sizes are the
+// sizes of the content.
+type encryptedStorage struct {
+	Storage
+	encryption encryption
+}
+
+// encryptedFileInfo an encrypted file, its content size is only read from
+// its header when asked for
+type encryptedFileInfo struct {
+	os.FileInfo
+	storage *encryptedStorage
+	name    string
+	//path of the encrypted file
+	path string
+	once sync.Once
+	size int64
+}
+
+func (i *encryptedFileInfo) Name() string {
+	return i.name
+}
+
+// Size size of the content, -1 when the header can not be read
+func (i *encryptedFileInfo) Size() int64 {
+	i.once.Do(func() {
+		i.size = -1
+		reader, err := i.storage.Storage.Open(i.path)
+		if err != nil {
+			return
+		}
+		defer reader.Close()
+		offset, err := i.storage.encryption.payloadOffset(reader)
+		if err == nil {
+			i.size = plaintextSize(i.FileInfo.Size(), offset)
+		}
+	})
+	return i.size
+}
+
+// info The info of an encrypted file, nil for files without the suffix
+func (s *encryptedStorage) info(info os.FileInfo, path string) os.FileInfo {
+	if info.IsDir() {
+		return info
+	}
+	if !strings.HasSuffix(info.Name(), s.encryption.extension()) {
+		return nil
+	}
+	return &encryptedFileInfo{FileInfo: info, storage: s, name: strings.TrimSuffix(info.Name(), s.encryption.extension()), path: path}
+}
+
+func (s *encryptedStorage) Stat(name string) (os.FileInfo, error) {
+	info, err := s.Storage.Stat(name + s.encryption.extension())
+	if err != nil {
+		return nil, err
+	}
+	return s.info(info, name+s.encryption.extension()), nil
+}
+
+func (s *encryptedStorage) ReadDir(name string) ([]os.FileInfo, error) {
+	files, err := s.Storage.ReadDir(name)
+	if err != nil {
+		return nil, err
+	}
+	var infos []os.FileInfo
+	for _, file := range files {
+		info := s.info(file, filepath.Join(name, file.Name()))
+		if info != nil {
+			infos = append(infos, info)
+		}
+	}
+	return infos, nil
+}
+
+func (s *encryptedStorage) Walk(root string, skipDir func(name string) bool, fn func(name string, info os.FileInfo) error) error {
+	return s.Storage.Walk(root, skipDir, func(name string, info os.FileInfo) error {
+		encrypted := s.info(info, name)
+		if encrypted == nil {
+			return nil
+		}
+		return fn(strings.TrimSuffix(name, s.encryption.extension()), encrypted)
+	})
+}
+
+func (s *encryptedStorage) Open(name string) (io.ReadCloser, error) {
+	reader, err := s.Storage.Open(name + s.encryption.extension())
+	if err != nil {
+		return nil, err
+	}
+	decrypted, err := s.encryption.decrypt(reader)
+	if err != nil {
+		reader.Close()
+		return nil, fmt.Errorf("failed decrypting '%v': %v", name, err)
+	}
+	return struct {
+		io.Reader
+		io.Closer
+	}{decrypted, reader}, nil
+}
+
+// encryptedWriter a file being encrypted to a storage
+type encryptedWriter struct {
+	io.WriteCloser
+	output StorageWriter
+}
+
+// Close writes the last chunk and finishes the file
+func (w *encryptedWriter) Close() error {
+	err := w.WriteCloser.Close()
+	if err != nil {
+		w.output.Abort()
+		return err
+	}
+	return w.output.Close()
+}
+
+func (w *encryptedWriter) Abort() error {
+	return w.output.Abort()
+}
+
+func (s *encryptedStorage) Create(name string, modTime time.Time) (StorageWriter, error) {
+	output, err := s.Storage.Create(name+s.encryption.extension(), modTime)
+	if err != nil {
+		return nil, err
+	}
+	encrypted, err := s.encryption.encrypt(output)
+	if err != nil {
+		output.Abort()
+		return nil, err
+	}
+	return &encryptedWriter{WriteCloser: encrypted, output: output}, nil
+}
+
+func (s *encryptedStorage) Remove(name string) error {
+	return s.Storage.Remove(name + s.encryption.extension())
+}
+
+func (s *encryptedStorage) Rename(from string, to string) error {
+	return s.Storage.Rename(from+s.encryption.extension(), to+s.encryption.extension())
+}
+
+func (s *encryptedStorage) Chtimes(name string, modTime time.Time) error {
+	return s.Storage.Chtimes(name+s.encryption.extension(), modTime)
+}
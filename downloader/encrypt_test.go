@@ -0,0 +1,244 @@
+package downloader
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"image/jpeg"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"filippo.io/age"
+)
+
+// writeTestAgeKey Write an age identity file, encrypted with passphrase
+// unless empty
+func writeTestAgeKey(t *testing.T, filePath string, passphrase string) *age.X25519Identity {
+	identity, err := age.GenerateX25519Identity()
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	data := []byte("# created: 2019-10-13T17:33:43Z\n" + identity.String() + "\n")
+	if passphrase != "" {
+		recipient, _ := age.NewScryptRecipient(passphrase)
+		recipient.SetWorkFactor(10)
+		encrypted := new(bytes.Buffer)
+		writer, _ := age.Encrypt(encrypted, recipient)
+		writer.Write(data)
+		writer.Close()
+		data = encrypted.Bytes()
+	}
+	err = ioutil.WriteFile(filePath, data, 0600)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	return identity
+}
+
+func TestEncryption(t *testing.T) {
+	folder := tempPath()
+	os.MkdirAll(folder, 0700)
+	defer os.RemoveAll(folder)
+	defer os.Setenv(passphraseVariable, os.Getenv(passphraseVariable))
+	ioutil.WriteFile(filepath.Join(folder, "aes.key"), []byte(strings.Repeat("0f", 32)+"\n"), 0600)
+	writeTestAgeKey(t, filepath.Join(folder, "age.key"), "")
+	writeTestAgeKey(t, filepath.Join(folder, "protected.key"), "secret")
+	offline := writeTestAgeKey(t, filepath.Join(folder, "offline.key"), "")
+	ioutil.WriteFile(filepath.Join(folder, "recipients.txt"), []byte(offline.Recipient().String()+"\n"), 0600)
+
+	os.Setenv(passphraseVariable, "")
+	_, err := newEncryption(&Options{Encrypt: EncryptAge, EncryptKey: filepath.Join(folder, "protected.key")})
+	if err == nil || !strings.Contains(err.Error(), passphraseVariable) {
+		t.Errorf("newEncryption() without a passphrase = %v", err)
+	}
+	os.Setenv(passphraseVariable, "secret")
+	_, err = newEncryption(&Options{Encrypt: EncryptAESGCM, EncryptKey: filepath.Join(folder, "age.key")})
+	if err == nil {
+		t.Errorf("AES-GCM keys should be checked")
+	}
+
+	for _, options := range []*Options{
+		{Encrypt: EncryptAESGCM, EncryptKey: filepath.Join(folder, "aes.key")},
+		{Encrypt: EncryptAge, EncryptKey: filepath.Join(folder, "age.key"), EncryptTo: filepath.Join(folder, "recipients.txt")},
+		{Encrypt: EncryptAge, EncryptKey: filepath.Join(folder, "protected.key")},
+	} {
+		encryption, err := newEncryption(options)
+		if err != nil {
+			t.Fatalf("%v", err)
+		}
+		for _, size := range []int{0, 1, encryptedChunkSize, encryptedChunkSize + 1, 3*encryptedChunkSize - 7} {
+			data := bytes.Repeat([]byte{7}, size)
+			encrypted := new(bytes.Buffer)
+			writer, err := encryption.encrypt(encrypted)
+			if err != nil {
+				t.Fatalf("%v", err)
+			}
+			writer.Write(data)
+			writer.Close()
+			offset, err := encryption.payloadOffset(bytes.NewReader(encrypted.Bytes()))
+			if err != nil || plaintextSize(int64(encrypted.Len()), offset) != int64(size) {
+				t.Errorf("%v: plaintextSize() = %v, %v; want %v", options.Encrypt, plaintextSize(int64(encrypted.Len()), offset), err, size)
+			}
+			reader, err := encryption.decrypt(bytes.NewReader(encrypted.Bytes()))
+			if err != nil {
+				t.Fatalf("%v", err)
+			}
+			decrypted, err := ioutil.ReadAll(reader)
+			if err != nil || !bytes.Equal(decrypted, data) {
+				t.Errorf("%v: decrypted %v bytes, %v; want %v", options.Encrypt, len(decrypted), err, size)
+			}
+			if size == 0 {
+				continue
+			}
+
+			//Changed and truncated files do not decrypt
+			changed := append([]byte(nil), encrypted.Bytes()...)
+			changed[len(changed)-20] ^= 1
+			damaged := [][]byte{changed}
+			if size > encryptedChunkSize {
+				damaged = append(damaged, encrypted.Bytes()[:offset+encryptedChunkSize+encryptedTagSize])
+			}
+			for _, data := range damaged {
+				reader, err := encryption.decrypt(bytes.NewReader(data))
+				if err == nil {
+					_, err = ioutil.ReadAll(reader)
+				}
+				if err == nil {
+					t.Errorf("%v: damaged file of %v bytes should not decrypt", options.Encrypt, size)
+				}
+			}
+		}
+
+		root := tempPath()
+		storage := &encryptedStorage{Storage: localStorage{}, encryption: encryption}
+		testStorage(t, storage, root)
+		os.RemoveAll(root)
+	}
+
+	//Files encrypted to the additional recipients decrypt with their identity
+	encryption, _ := newEncryption(&Options{Encrypt: EncryptAge, EncryptKey: filepath.Join(folder, "age.key"), EncryptTo: filepath.Join(folder, "recipients.txt")})
+	encrypted := new(bytes.Buffer)
+	writer, _ := encryption.encrypt(encrypted)
+	writer.Write([]byte("offline"))
+	writer.Close()
+	reader, err := age.Decrypt(encrypted, offline)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	data, _ := ioutil.ReadAll(reader)
+	if string(data) != "offline" {
+		t.Errorf("offline recipient decrypted %q", data)
+	}
+}
+
+func TestEncryptedBackup(t *testing.T) {
+	keyFolder := tempPath()
+	os.MkdirAll(keyFolder, 0700)
+	defer os.RemoveAll(keyFolder)
+	downloader := NewDownloader()
+	downloader.Options.BackupFolder = tempPath()
+	defer os.RemoveAll(downloader.Options.BackupFolder)
+	downloader.Options.Encrypt = EncryptAge
+	downloader.Options.EncryptKey = filepath.Join(keyFolder, "age.key")
+	writeTestAgeKey(t, downloader.Options.EncryptKey, "")
+	err := downloader.OpenStorage()
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	if downloader.requireLocal("migrate") == nil {
+		t.Errorf("encrypted folders should not be rewritten in place")
+	}
+	downloader.Options.Checksums = true
+	err = downloader.validateStorageOptions()
+	if err == nil || !strings.Contains(err.Error(), "-checksums") {
+		t.Errorf("validateStorageOptions() = %v; want -checksums rejected", err)
+	}
+	downloader.Options.Checksums = false
+
+	encoded := new(bytes.Buffer)
+	jpeg.Encode(encoded, testImage(64, 48, false), nil)
+	created := time.Date(2019, 10, 13, 17, 33, 43, 0, time.UTC)
+	store := func(id string) *LibraryItem {
+		item := adoptTestItem(id, id+".jpg")
+		item.UsedFileName = downloader.createFileName(item, 0)
+		filePath := downloader.getImageFilePath(item)
+		err := downloader.storage.MkdirAll(filepath.Dir(filePath))
+		if err != nil {
+			t.Fatalf("%v", err)
+		}
+		writer, err := downloader.storage.Create(filePath, created)
+		if err != nil {
+			t.Fatalf("%v", err)
+		}
+		writer.Write(encoded.Bytes())
+		writer.Close()
+		hash := sha256.Sum256(encoded.Bytes())
+		item.SHA256 = hex.EncodeToString(hash[:])
+		downloader.updateSize(item, filePath)
+		return item
+	}
+	good := store("ABCDEFGHIJKLMNOPQRSTUVW1")
+	downloader.writeJSON(good, downloader.getJSONFilePath(&good.MediaItem))
+	//Recorded with the hash of other content
+	bad := store("ABCDEFGHIJKLMNOPQRSTUVW2")
+	bad.SHA256 = strings.Repeat("0", 64)
+	downloader.writeJSON(bad, downloader.getJSONFilePath(&bad.MediaItem))
+	if good.Size != int64(encoded.Len()) {
+		t.Errorf("Size = %v; want the size of the content %v", good.Size, encoded.Len())
+	}
+
+	//Stored files are encrypted, with the suffix of the encryption
+	mediaFilePath := downloader.getImageFilePath(good)
+	data, err := ioutil.ReadFile(mediaFilePath + ".age")
+	if err != nil || bytes.Contains(data, encoded.Bytes()[:64]) {
+		t.Errorf("media file should be encrypted: %v", err)
+	}
+	data, _ = ioutil.ReadFile(downloader.getJSONFilePath(&good.MediaItem) + ".age")
+	if bytes.Contains(data, []byte(good.Id)) {
+		t.Errorf("sidecar should be encrypted")
+	}
+	catalog, err := downloader.loadCatalog()
+	if err != nil || len(catalog.items) != 2 || catalog.items[good.Id].Item.SHA256 != good.SHA256 {
+		t.Fatalf("catalog = %v, %v; want both items with their content hashes", catalog, err)
+	}
+
+	output := new(bytes.Buffer)
+	err = downloader.Verify(output, false)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	var report VerifyReport
+	json.Unmarshal(output.Bytes(), &report)
+	if report.Checked != 2 || len(report.Problems) != 1 || report.Problems[0].ID != bad.Id || report.Problems[0].Problem != VerifyHash {
+		t.Errorf("report = %v", output.String())
+	}
+
+	//Restored trees are decrypted, files not matching their hash are left out
+	target := tempPath()
+	defer os.RemoveAll(target)
+	err = downloader.Restore(target)
+	if err == nil {
+		t.Errorf("Restore() should fail for the changed item")
+	}
+	relative, _ := filepath.Rel(downloader.Options.BackupFolder, mediaFilePath)
+	data, _ = ioutil.ReadFile(filepath.Join(target, relative))
+	info, err := os.Stat(filepath.Join(target, relative))
+	if err != nil || !bytes.Equal(data, encoded.Bytes()) || !info.ModTime().Equal(created) {
+		t.Errorf("restored media = %v bytes, %v; want the decrypted content", len(data), err)
+	}
+	relative, _ = filepath.Rel(downloader.Options.BackupFolder, downloader.getImageFilePath(bad))
+	if _, err := os.Stat(filepath.Join(target, relative)); !os.IsNotExist(err) {
+		t.Errorf("changed media should not be restored: %v", err)
+	}
+	var item LibraryItem
+	relative, _ = filepath.Rel(downloader.Options.BackupFolder, downloader.getJSONFilePath(&good.MediaItem))
+	data, _ = ioutil.ReadFile(filepath.Join(target, relative))
+	if json.Unmarshal(data, &item) != nil || item.Id != good.Id {
+		t.Errorf("restored sidecar = %q", data)
+	}
+}
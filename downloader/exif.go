@@ -0,0 +1,246 @@
+package downloader
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"os"
+	"strings"
+)
+
+// EXIF tags used by the downloader
+const (
+	exifTagOrientation        = 0x0112
+	exifTagExifIFD            = 0x8769
+	exifTagGPSIFD             = 0x8825
+	exifTagOffsetTime         = 0x9010
+	exifTagOffsetTimeOriginal = 0x9011
+)
+
+// EXIF value types
+const (
+	exifTypeByte      = 1
+	exifTypeASCII     = 2
+	exifTypeShort     = 3
+	exifTypeLong      = 4
+	exifTypeRational  = 5
+	exifTypeUndefined = 7
+	exifTypeSLong     = 9
+	exifTypeSRational = 10
+)
+
+// exifTypeSizes size in bytes of a single value of each type
+var exifTypeSizes = map[uint16]uint32{
+	exifTypeByte: 1, exifTypeASCII: 1, exifTypeShort: 2, exifTypeLong: 4, exifTypeRational: 8,
+	exifTypeUndefined: 1, exifTypeSLong: 4, exifTypeSRational: 8,
+}
+
+// errNoEXIF the file has no EXIF data
+var errNoEXIF = errors.New("no EXIF data")
+
+// exifEntry a single EXIF tag
+type exifEntry struct {
+	Tag   uint16
+	Type  uint16
+	Count uint32
+	//Value the raw value bytes, in the byte order of the EXIF data
+	Value []byte
+}
+
+// exifData the tags of the main image (IFD0), the Exif and GPS sub IFDs
+type exifData struct {
+	order binary.ByteOrder
+	ifd0  []*exifEntry
+	exif  []*exifEntry
+	gps   []*exifEntry
+}
+
+// find returns the entry with the tag, or nil
+func findEXIFEntry(entries []*exifEntry, tag uint16) *exifEntry {
+	for _, entry := range entries {
+		if entry.Tag == tag {
+			return entry
+		}
+	}
+	return nil
+}
+
+// ascii returns an ASCII value, or an empty string
+func (e *exifEntry) ascii() string {
+	if e == nil || e.Type != exifTypeASCII {
+		return ""
+	}
+	return strings.TrimRight(string(e.Value), "\x00 ")
+}
+
+// orientation returns the orientation of the image, 1 (as stored) to 8
+func (x *exifData) orientation() int {
+	entry := findEXIFEntry(x.ifd0, exifTagOrientation)
+	if entry == nil || entry.Type != exifTypeShort || len(entry.Value) < 2 {
+		return 1
+	}
+	orientation := int(x.order.Uint16(entry.Value))
+	if orientation < 1 || orientation > 8 {
+		return 1
+	}
+	return orientation
+}
+
+// offsetTimeOriginal returns the UTC offset of the capture time, e.g. -08:00
+func (x *exifData) offsetTimeOriginal() string {
+	offset := findEXIFEntry(x.exif, exifTagOffsetTimeOriginal).ascii()
+	if offset == "" {
+		offset = findEXIFEntry(x.exif, exifTagOffsetTime).ascii()
+	}
+	return offset
+}
+
+// jpegSegment a JPEG marker segment before the image data
+type jpegSegment struct {
+	marker  byte
+	payload []byte
+}
+
+// readJPEGHeader Read the segments of a JPEG file before the image data,
+// returns them and the marker ending them (start of scan or end of image)
+func readJPEGHeader(reader *bufio.Reader) ([]*jpegSegment, byte, error) {
+	var soi [2]byte
+	_, err := io.ReadFull(reader, soi[:])
+	if err != nil || soi[0] != 0xff || soi[1] != 0xd8 {
+		return nil, 0, errors.New("not a JPEG file")
+	}
+	var segments []*jpegSegment
+	for {
+		var header [4]byte
+		_, err = io.ReadFull(reader, header[:2])
+		if err != nil {
+			return nil, 0, err
+		}
+		if header[0] != 0xff {
+			return nil, 0, errors.New("invalid JPEG segment")
+		}
+		marker := header[1]
+		if marker == 0xda || marker == 0xd9 {
+			//Start of scan or end of image, no more metadata
+			return segments, marker, nil
+		}
+		_, err = io.ReadFull(reader, header[2:])
+		if err != nil {
+			return nil, 0, err
+		}
+		length := int(binary.BigEndian.Uint16(header[2:]))
+		if length < 2 {
+			return nil, 0, errors.New("invalid JPEG segment length")
+		}
+		payload := make([]byte, length-2)
+		_, err = io.ReadFull(reader, payload)
+		if err != nil {
+			return nil, 0, err
+		}
+		segments = append(segments, &jpegSegment{marker: marker, payload: payload})
+	}
+}
+
+// isEXIFSegment returns true for the APP1 segment holding EXIF data
+func (s *jpegSegment) isEXIFSegment() bool {
+	return s.marker == 0xe1 && bytes.HasPrefix(s.payload, exifHeader)
+}
+
+// exifHeader the start of an APP1 segment holding EXIF data
+var exifHeader = []byte("Exif\x00\x00")
+
+// readEXIF Read the EXIF data of a JPEG file
+func readEXIF(r io.Reader) (*exifData, error) {
+	segments, _, err := readJPEGHeader(bufio.NewReader(r))
+	if err != nil {
+		return nil, err
+	}
+	for _, segment := range segments {
+		if segment.isEXIFSegment() {
+			return parseTIFF(segment.payload[len(exifHeader):])
+		}
+	}
+	return nil, errNoEXIF
+}
+
+// readEXIFFile Read the EXIF data of a JPEG file on disk
+func readEXIFFile(filePath string) (*exifData, error) {
+	file, err := os.Open(filePath)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	return readEXIF(file)
+}
+
+// parseTIFF Parse the TIFF structure of EXIF data
+func parseTIFF(tiff []byte) (*exifData, error) {
+	if len(tiff) < 8 {
+		return nil, errors.New("EXIF data too short")
+	}
+	x := new(exifData)
+	switch string(tiff[:2]) {
+	case "II":
+		x.order = binary.LittleEndian
+	case "MM":
+		x.order = binary.BigEndian
+	default:
+		return nil, errors.New("invalid EXIF byte order")
+	}
+
+	var err error
+	x.ifd0, err = parseIFD(tiff, x.order, x.order.Uint32(tiff[4:]))
+	if err != nil {
+		return nil, err
+	}
+	if pointer := findEXIFEntry(x.ifd0, exifTagExifIFD); pointer != nil && len(pointer.Value) == 4 {
+		x.exif, err = parseIFD(tiff, x.order, x.order.Uint32(pointer.Value))
+		if err != nil {
+			return nil, err
+		}
+	}
+	if pointer := findEXIFEntry(x.ifd0, exifTagGPSIFD); pointer != nil && len(pointer.Value) == 4 {
+		x.gps, err = parseIFD(tiff, x.order, x.order.Uint32(pointer.Value))
+		if err != nil {
+			return nil, err
+		}
+	}
+	return x, nil
+}
+
+// parseIFD Parse the entries of a single IFD at offset
+func parseIFD(tiff []byte, order binary.ByteOrder, offset uint32) ([]*exifEntry, error) {
+	if uint64(offset)+2 > uint64(len(tiff)) {
+		return nil, errors.New("invalid EXIF IFD offset")
+	}
+	count := int(order.Uint16(tiff[offset:]))
+	if uint64(offset)+2+uint64(count)*12 > uint64(len(tiff)) {
+		return nil, errors.New("EXIF IFD too short")
+	}
+	entries := make([]*exifEntry, 0, count)
+	for i := 0; i < count; i++ {
+		raw := tiff[offset+2+uint32(i)*12:]
+		entry := &exifEntry{Tag: order.Uint16(raw), Type: order.Uint16(raw[2:]), Count: order.Uint32(raw[4:])}
+		size, ok := exifTypeSizes[entry.Type]
+		if !ok {
+			//Unknown types are kept as is, their size is unknown
+			entry.Value = append([]byte(nil), raw[8:12]...)
+			entries = append(entries, entry)
+			continue
+		}
+		length := uint64(size) * uint64(entry.Count)
+		if length <= 4 {
+			entry.Value = append([]byte(nil), raw[8:8+length]...)
+		} else {
+			valueOffset := uint64(order.Uint32(raw[8:]))
+			if valueOffset+length > uint64(len(tiff)) {
+				return nil, errors.New("invalid EXIF value offset")
+			}
+			entry.Value = append([]byte(nil), tiff[valueOffset:valueOffset+length]...)
+		}
+		entries = append(entries, entry)
+	}
+	return entries, nil
+}
@@ -0,0 +1,346 @@
+package downloader
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"io"
+	"math"
+	"os"
+	"sort"
+	"time"
+)
+
+// EXIF tags written by the downloader
+const (
+	exifTagImageDescription = 0x010e
+	exifTagMake             = 0x010f
+	exifTagModel            = 0x0110
+	exifTagDateTimeOriginal = 0x9003
+	exifTagUserComment      = 0x9286
+)
+
+// EXIF GPS tags written by the downloader
+const (
+	exifTagGPSVersionID    = 0x0000
+	exifTagGPSLatitudeRef  = 0x0001
+	exifTagGPSLatitude     = 0x0002
+	exifTagGPSLongitudeRef = 0x0003
+	exifTagGPSLongitude    = 0x0004
+	exifTagGPSAltitudeRef  = 0x0005
+	exifTagGPSAltitude     = 0x0006
+)
+
+// IFDs tags can be added to
+const (
+	exifIFD0 = iota
+	exifIFDExif
+	exifIFDGPS
+)
+
+// exifSubIFDPointers the IFD0 tags pointing to the sub IFDs
+var exifSubIFDPointers = map[int]uint16{exifIFDExif: exifTagExifIFD, exifIFDGPS: exifTagGPSIFD}
+
+// exifTag a tag to add to EXIF data
+type exifTag struct {
+	ifd   int
+	tag   uint16
+	typ   uint16
+	count uint32
+	value []byte
+	//rationals numerator and denominator pairs of a rational tag, written in
+	//the byte order of the EXIF data
+	rationals []uint32
+}
+
+// asciiTag an ASCII tag, NUL terminated
+func asciiTag(ifd int, tag uint16, text string) *exifTag {
+	value := append([]byte(text), 0)
+	return &exifTag{ifd: ifd, tag: tag, typ: exifTypeASCII, count: uint32(len(value)), value: value}
+}
+
+// userCommentTag a UserComment tag, with the ASCII character code
+func userCommentTag(text string) *exifTag {
+	value := append([]byte("ASCII\x00\x00\x00"), text...)
+	return &exifTag{ifd: exifIFDExif, tag: exifTagUserComment, typ: exifTypeUndefined, count: uint32(len(value)), value: value}
+}
+
+// rationalTag a rational tag of numerator and denominator pairs
+func rationalTag(ifd int, tag uint16, rationals ...uint32) *exifTag {
+	return &exifTag{ifd: ifd, tag: tag, typ: exifTypeRational, count: uint32(len(rationals) / 2), rationals: rationals}
+}
+
+// gpsCoordinate degrees, minutes and seconds of a coordinate, to a ten
+// thousandth of a second
+func gpsCoordinate(value float64) []uint32 {
+	const secondDenominator = 10000
+	total := uint32(math.Round(math.Abs(value) * 3600 * secondDenominator))
+	degrees := total / (3600 * secondDenominator)
+	minutes := total % (3600 * secondDenominator) / (60 * secondDenominator)
+	seconds := total % (60 * secondDenominator)
+	return []uint32{degrees, 1, minutes, 1, seconds, secondDenominator}
+}
+
+// gpsTags the GPS tags of a location
+func gpsTags(geo *GeoData) []*exifTag {
+	latitudeRef, longitudeRef := "N", "E"
+	if geo.Latitude < 0 {
+		latitudeRef = "S"
+	}
+	if geo.Longitude < 0 {
+		longitudeRef = "W"
+	}
+	var altitudeRef byte
+	if geo.Altitude < 0 {
+		altitudeRef = 1
+	}
+	return []*exifTag{
+		{ifd: exifIFDGPS, tag: exifTagGPSVersionID, typ: exifTypeByte, count: 4, value: []byte{2, 3, 0, 0}},
+		asciiTag(exifIFDGPS, exifTagGPSLatitudeRef, latitudeRef),
+		rationalTag(exifIFDGPS, exifTagGPSLatitude, gpsCoordinate(geo.Latitude)...),
+		asciiTag(exifIFDGPS, exifTagGPSLongitudeRef, longitudeRef),
+		rationalTag(exifIFDGPS, exifTagGPSLongitude, gpsCoordinate(geo.Longitude)...),
+		{ifd: exifIFDGPS, tag: exifTagGPSAltitudeRef, typ: exifTypeByte, count: 1, value: []byte{altitudeRef}},
+		rationalTag(exifIFDGPS, exifTagGPSAltitude, uint32(math.Round(math.Abs(geo.Altitude)*100)), 100),
+	}
+}
+
+// newTIFF an empty TIFF structure holding an empty IFD0
+func newTIFF() []byte {
+	return []byte{'M', 'M', 0, 42, 0, 0, 0, 8, 0, 0, 0, 0, 0, 0}
+}
+
+// rawIFDEntries Read the raw 12 byte entries of an IFD and the offset of the
+// next IFD
+func rawIFDEntries(tiff []byte, order binary.ByteOrder, offset uint32) ([][]byte, uint32, error) {
+	if uint64(offset)+2 > uint64(len(tiff)) {
+		return nil, 0, errors.New("invalid EXIF IFD offset")
+	}
+	count := uint64(order.Uint16(tiff[offset:]))
+	end := uint64(offset) + 2 + count*12
+	if end+4 > uint64(len(tiff)) {
+		return nil, 0, errors.New("EXIF IFD too short")
+	}
+	entries := make([][]byte, count)
+	for i := range entries {
+		start := uint64(offset) + 2 + uint64(i)*12
+		entries[i] = append([]byte(nil), tiff[start:start+12]...)
+	}
+	return entries, order.Uint32(tiff[end:]), nil
+}
+
+// entryTag the tag of a raw IFD entry
+func entryTag(entry []byte, order binary.ByteOrder) uint16 {
+	return order.Uint16(entry)
+}
+
+// alignTIFF pad to an even offset, values and IFDs start on word boundaries
+func alignTIFF(tiff []byte) []byte {
+	if len(tiff)%2 == 1 {
+		tiff = append(tiff, 0)
+	}
+	return tiff
+}
+
+// appendEntry Build the raw entry of a tag, values longer than 4 bytes are
+// appended to tiff
+func appendEntry(tiff []byte, order binary.ByteOrder, tag *exifTag) ([]byte, []byte) {
+	entry := make([]byte, 12)
+	order.PutUint16(entry, tag.tag)
+	order.PutUint16(entry[2:], tag.typ)
+	order.PutUint32(entry[4:], tag.count)
+	value := tag.value
+	if tag.rationals != nil {
+		value = make([]byte, 4*len(tag.rationals))
+		for i, number := range tag.rationals {
+			order.PutUint32(value[4*i:], number)
+		}
+	}
+	if len(value) <= 4 {
+		copy(entry[8:], value)
+		return tiff, entry
+	}
+	tiff = alignTIFF(tiff)
+	order.PutUint32(entry[8:], uint32(len(tiff)))
+	return append(tiff, value...), entry
+}
+
+// appendIFD Append an IFD made of entries, sorted by tag, returns its offset
+func appendIFD(tiff []byte, order binary.ByteOrder, entries [][]byte, next uint32) ([]byte, uint32) {
+	sort.SliceStable(entries, func(i, j int) bool {
+		return entryTag(entries[i], order) < entryTag(entries[j], order)
+	})
+	tiff = alignTIFF(tiff)
+	offset := uint32(len(tiff))
+	var count [2]byte
+	order.PutUint16(count[:], uint16(len(entries)))
+	tiff = append(tiff, count[:]...)
+	for _, entry := range entries {
+		tiff = append(tiff, entry...)
+	}
+	var link [4]byte
+	order.PutUint32(link[:], next)
+	return append(tiff, link[:]...), offset
+}
+
+// addEXIFTags Add the tags missing from EXIF data. The updated IFDs are
+// appended to the end, so every existing offset (such as maker notes and
+// thumbnails) stays valid. Returns nil if no tag is missing.
+func addEXIFTags(tiff []byte, tags []*exifTag) ([]byte, error) {
+	x, err := parseTIFF(tiff)
+	if err != nil {
+		return nil, err
+	}
+	order := x.order
+	ifd0, next, err := rawIFDEntries(tiff, order, order.Uint32(tiff[4:]))
+	if err != nil {
+		return nil, err
+	}
+	existing := map[int][]*exifEntry{exifIFD0: x.ifd0, exifIFDExif: x.exif, exifIFDGPS: x.gps}
+	entries := map[int][][]byte{exifIFD0: ifd0}
+	for ifd, pointerTag := range exifSubIFDPointers {
+		pointer := findEXIFEntry(x.ifd0, pointerTag)
+		if pointer != nil && len(pointer.Value) == 4 {
+			entries[ifd], _, err = rawIFDEntries(tiff, order, order.Uint32(pointer.Value))
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	updated := append([]byte(nil), tiff...)
+	added := make(map[int]bool)
+	for _, tag := range tags {
+		if findEXIFEntry(existing[tag.ifd], tag.tag) != nil {
+			continue
+		}
+		if tag.tag == exifTagOffsetTimeOriginal && findEXIFEntry(x.exif, exifTagDateTimeOriginal) != nil {
+			//The offset of a date already in the file is not known
+			continue
+		}
+		var entry []byte
+		updated, entry = appendEntry(updated, order, tag)
+		entries[tag.ifd] = append(entries[tag.ifd], entry)
+		added[tag.ifd] = true
+	}
+	if len(added) == 0 {
+		return nil, nil
+	}
+
+	for _, ifd := range []int{exifIFDExif, exifIFDGPS} {
+		if !added[ifd] {
+			continue
+		}
+		var offset uint32
+		updated, offset = appendIFD(updated, order, entries[ifd], 0)
+		pointerEntry := make([]byte, 12)
+		order.PutUint16(pointerEntry, exifSubIFDPointers[ifd])
+		order.PutUint16(pointerEntry[2:], exifTypeLong)
+		order.PutUint32(pointerEntry[4:], 1)
+		order.PutUint32(pointerEntry[8:], offset)
+		replaced := false
+		for i, entry := range entries[exifIFD0] {
+			if entryTag(entry, order) == exifSubIFDPointers[ifd] {
+				entries[exifIFD0][i] = pointerEntry
+				replaced = true
+			}
+		}
+		if !replaced {
+			entries[exifIFD0] = append(entries[exifIFD0], pointerEntry)
+		}
+	}
+	var ifd0Offset uint32
+	updated, ifd0Offset = appendIFD(updated, order, entries[exifIFD0], next)
+	order.PutUint32(updated[4:], ifd0Offset)
+	return updated, nil
+}
+
+// maxSegmentPayload largest payload of a JPEG segment
+const maxSegmentPayload = 0xffff - 2
+
+// embedEXIF Add the tags missing from the EXIF data of a JPEG file. Only the
+// metadata segments are rewritten, the image data is copied as is. Returns
+// true if the file changed.
+func embedEXIF(filePath string, tags []*exifTag) (bool, error) {
+	input, err := os.Open(filePath)
+	if err != nil {
+		return false, err
+	}
+	defer input.Close()
+	info, err := input.Stat()
+	if err != nil {
+		return false, err
+	}
+	reader := bufio.NewReader(input)
+	segments, marker, err := readJPEGHeader(reader)
+	if err != nil {
+		return false, err
+	}
+
+	var segment *jpegSegment
+	for _, s := range segments {
+		if s.isEXIFSegment() {
+			segment = s
+			break
+		}
+	}
+	tiff := newTIFF()
+	if segment != nil {
+		tiff = segment.payload[len(exifHeader):]
+	}
+	tiff, err = addEXIFTags(tiff, tags)
+	if err != nil || tiff == nil {
+		return false, err
+	}
+	payload := append(append([]byte(nil), exifHeader...), tiff...)
+	if len(payload) > maxSegmentPayload {
+		return false, errors.New("EXIF data too large")
+	}
+	if segment != nil {
+		segment.payload = payload
+	} else {
+		//EXIF goes first, after the JFIF header if there is one
+		position := 0
+		if len(segments) > 0 && segments[0].marker == 0xe0 {
+			position = 1
+		}
+		segments = append(segments[:position], append([]*jpegSegment{{marker: 0xe1, payload: payload}}, segments[position:]...)...)
+	}
+
+	temp := filePath + ".exif"
+	output, err := os.Create(temp)
+	if err != nil {
+		return false, err
+	}
+	writer := bufio.NewWriter(output)
+	writer.Write([]byte{0xff, 0xd8})
+	for _, s := range segments {
+		var header [4]byte
+		header[0] = 0xff
+		header[1] = s.marker
+		binary.BigEndian.PutUint16(header[2:], uint16(len(s.payload)+2))
+		writer.Write(header[:])
+		writer.Write(s.payload)
+	}
+	writer.Write([]byte{0xff, marker})
+	_, err = io.Copy(writer, reader)
+	if err == nil {
+		err = writer.Flush()
+	}
+	closeErr := output.Close()
+	if err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(temp)
+		return false, err
+	}
+	input.Close()
+
+	err = os.Rename(temp, filePath)
+	if err != nil {
+		os.Remove(temp)
+		return false, err
+	}
+	return true, os.Chtimes(filePath, time.Now(), info.ModTime())
+}
@@ -0,0 +1,151 @@
+package downloader
+
+import (
+	"bytes"
+	"image"
+	"image/jpeg"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// imageData the bytes of a JPEG file from the start of scan marker
+func imageData(t *testing.T, data []byte) []byte {
+	index := bytes.Index(data, []byte{0xff, 0xda})
+	if index < 0 {
+		t.Fatalf("missing start of scan")
+	}
+	return data[index:]
+}
+
+func TestEmbedEXIF(t *testing.T) {
+	folder := tempPath()
+	defer os.RemoveAll(folder)
+	downloader := NewDownloader()
+	item := templateTestItem()
+	item.Description = "Dinner"
+	tags := downloader.exifTags(item, nil)
+
+	t.Run("No EXIF", func(t *testing.T) {
+		encoded := new(bytes.Buffer)
+		err := jpeg.Encode(encoded, testImage(64, 48, false), nil)
+		if err != nil {
+			t.Fatalf("%v", err)
+		}
+		filePath := filepath.Join(folder, "plain.jpg")
+		ioutil.WriteFile(filePath, encoded.Bytes(), 0644)
+
+		changed, err := embedEXIF(filePath, tags)
+		if err != nil || !changed {
+			t.Fatalf("embedEXIF() = %v, %v; want true", changed, err)
+		}
+		data, _ := ioutil.ReadFile(filePath)
+		if !bytes.Equal(imageData(t, data), imageData(t, encoded.Bytes())) {
+			t.Errorf("image data should be copied as is")
+		}
+		_, _, err = image.Decode(bytes.NewReader(data))
+		if err != nil {
+			t.Errorf("embedded file should decode: %v", err)
+		}
+
+		x, err := readEXIF(bytes.NewReader(data))
+		if err != nil {
+			t.Fatalf("%v", err)
+		}
+		if value := findEXIFEntry(x.exif, exifTagDateTimeOriginal).ascii(); value != "2019:10:03 07:33:43" {
+			t.Errorf("DateTimeOriginal = %v", value)
+		}
+		if value := x.offsetTimeOriginal(); value != "+00:00" {
+			t.Errorf("OffsetTimeOriginal = %v; want the offset of the date", value)
+		}
+		if value := findEXIFEntry(x.ifd0, exifTagImageDescription).ascii(); value != "Dinner" {
+			t.Errorf("ImageDescription = %v", value)
+		}
+		if value := findEXIFEntry(x.ifd0, exifTagModel).ascii(); value != "Moto G (5) Plus" {
+			t.Errorf("Model = %v", value)
+		}
+		comment := findEXIFEntry(x.exif, exifTagUserComment)
+		if comment == nil || !bytes.HasSuffix(comment.Value, []byte(item.Id)) {
+			t.Errorf("UserComment = %v", comment)
+		}
+
+		changed, err = embedEXIF(filePath, tags)
+		if err != nil || changed {
+			t.Errorf("embedEXIF() = %v, %v; want false once tags exist", changed, err)
+		}
+	})
+
+	t.Run("Existing EXIF", func(t *testing.T) {
+		filePath := filepath.Join(folder, "exif.jpg")
+		ioutil.WriteFile(filePath, testJPEG("-08:00"), 0644)
+		existing := []*exifTag{asciiTag(exifIFD0, exifTagMake, "Existing")}
+		_, err := embedEXIF(filePath, existing)
+		if err != nil {
+			t.Fatalf("%v", err)
+		}
+
+		changed, err := embedEXIF(filePath, tags)
+		if err != nil || !changed {
+			t.Fatalf("embedEXIF() = %v, %v; want true", changed, err)
+		}
+		x, err := readEXIFFile(filePath)
+		if err != nil {
+			t.Fatalf("%v", err)
+		}
+		if x.offsetTimeOriginal() != "-08:00" {
+			t.Errorf("existing tags should be kept, OffsetTimeOriginal = %v", x.offsetTimeOriginal())
+		}
+		if value := findEXIFEntry(x.ifd0, exifTagMake).ascii(); value != "Existing" {
+			t.Errorf("existing tags should not be replaced, Make = %v", value)
+		}
+		if value := findEXIFEntry(x.exif, exifTagDateTimeOriginal).ascii(); value != "2019:10:03 07:33:43" {
+			t.Errorf("DateTimeOriginal = %v", value)
+		}
+	})
+
+	t.Run("Offsets", func(t *testing.T) {
+		embedding := NewDownloader()
+		embedding.Options.EmbedMetadata = true
+		embedding.Options.TimeZone = "Asia/Tokyo"
+
+		//Dates are written in the offset already in the file
+		filePath := filepath.Join(folder, "offset.jpg")
+		ioutil.WriteFile(filePath, testJPEG("-08:00"), 0644)
+		_, err := embedding.embedMetadata(item, filePath)
+		if err != nil {
+			t.Fatalf("%v", err)
+		}
+		x, _ := readEXIFFile(filePath)
+		if value := findEXIFEntry(x.exif, exifTagDateTimeOriginal).ascii(); value != "2019:10:02 23:33:43" || x.offsetTimeOriginal() != "-08:00" {
+			t.Errorf("DateTimeOriginal = %v %v; want the time at -08:00", value, x.offsetTimeOriginal())
+		}
+
+		//Otherwise in the time zone, with its offset
+		encoded := new(bytes.Buffer)
+		jpeg.Encode(encoded, testImage(64, 48, false), nil)
+		filePath = filepath.Join(folder, "zone.jpg")
+		ioutil.WriteFile(filePath, encoded.Bytes(), 0644)
+		_, err = embedding.embedMetadata(item, filePath)
+		if err != nil {
+			t.Fatalf("%v", err)
+		}
+		x, _ = readEXIFFile(filePath)
+		if value := findEXIFEntry(x.exif, exifTagDateTimeOriginal).ascii(); value != "2019:10:03 16:33:43" || x.offsetTimeOriginal() != "+09:00" {
+			t.Errorf("DateTimeOriginal = %v %v; want the time in Tokyo", value, x.offsetTimeOriginal())
+		}
+
+		//The offset of a date already in the file is not guessed
+		filePath = filepath.Join(folder, "date.jpg")
+		ioutil.WriteFile(filePath, encoded.Bytes(), 0644)
+		embedEXIF(filePath, []*exifTag{asciiTag(exifIFDExif, exifTagDateTimeOriginal, "2019:10:03 09:33:43")})
+		_, err = embedding.embedMetadata(item, filePath)
+		if err != nil {
+			t.Fatalf("%v", err)
+		}
+		x, _ = readEXIFFile(filePath)
+		if x.offsetTimeOriginal() != "" {
+			t.Errorf("OffsetTimeOriginal = %v; want none for an existing date", x.offsetTimeOriginal())
+		}
+	})
+}
@@ -0,0 +1,168 @@
+package downloader
+
+import (
+	"fmt"
+	"log"
+	"path/filepath"
+	"strings"
+	"time"
+
+	photoslibrary "github.com/gphotosuploader/googlemirror/api/photoslibrary/v1"
+)
+
+// GeoData location of an item, which the Google Photos API does not provide
+type GeoData struct {
+	Latitude  float64
+	Longitude float64
+	Altitude  float64
+}
+
+// matchKey the key matching an item from another source with a Google Photos
+// item: the file name, ignoring the case, and the creation time to the second
+func matchKey(filename string, creationTime string) string {
+	t, err := time.Parse(time.RFC3339, creationTime)
+	if err != nil {
+		return ""
+	}
+	return fmt.Sprintf("%v|%v", strings.ToLower(filename), t.Unix())
+}
+
+// itemMatchKey the match key of a Google Photos item
+func itemMatchKey(item *photoslibrary.MediaItem) string {
+	if item.MediaMetadata == nil {
+		return ""
+	}
+	return matchKey(item.Filename, item.MediaMetadata.CreationTime)
+}
+
+// sameDimensions returns false if both items have dimensions and they differ
+func sameDimensions(a *photoslibrary.MediaItem, b *photoslibrary.MediaItem) bool {
+	if a.MediaMetadata == nil || b.MediaMetadata == nil {
+		return true
+	}
+	if a.MediaMetadata.Width == 0 || b.MediaMetadata.Width == 0 {
+		return true
+	}
+	return a.MediaMetadata.Width == b.MediaMetadata.Width && a.MediaMetadata.Height == b.MediaMetadata.Height
+}
+
+// provisionalIndex imported items not yet linked to their Google Photos item,
+// by match key
+type provisionalIndex struct {
+	entries map[string][]*catalogEntry
+}
+
+// newProvisionalIndex Index the provisional items of a catalog
+func newProvisionalIndex(catalog *Catalog) *provisionalIndex {
+	index := &provisionalIndex{entries: make(map[string][]*catalogEntry)}
+	for _, entry := range catalog.items {
+		if !entry.Item.Provisional {
+			continue
+		}
+		key := itemMatchKey(&entry.Item.MediaItem)
+		if key != "" {
+			index.entries[key] = append(index.entries[key], entry)
+		}
+	}
+	return index
+}
+
+// match Find the provisional item matching a Google Photos item
+func (p *provisionalIndex) match(item *photoslibrary.MediaItem) *catalogEntry {
+	key := itemMatchKey(item)
+	if key == "" {
+		return nil
+	}
+	for _, entry := range p.entries[key] {
+		if sameDimensions(&entry.Item.MediaItem, item) {
+			return entry
+		}
+	}
+	return nil
+}
+
+// remove Remove a linked provisional item, so it matches no other item
+func (p *provisionalIndex) remove(entry *catalogEntry) {
+	key := itemMatchKey(&entry.Item.MediaItem)
+	entries := p.entries[key]
+	for i := range entries {
+		if entries[i] == entry {
+			p.entries[key] = append(entries[:i], entries[i+1:]...)
+			return
+		}
+	}
+}
+
+// linkImported Link an imported item matching a Google Photos item to it,
+// moving its files to the paths of the Google Photos item. Returns nil if
+// nothing matches.
+func (d *Downloader) linkImported(item *photoslibrary.MediaItem) (*LibraryItem, error) {
+	if d.provisional == nil {
+		return nil, nil
+	}
+	entry := d.provisional.match(item)
+	if entry == nil {
+		return nil, nil
+	}
+
+	libraryItem := *entry.Item
+	libraryItem.MediaItem = *item
+	libraryItem.Provisional = false
+	libraryItem.addAlbum(d.albumTitle)
+
+	from := entry.MediaFilePath()
+	var to string
+	for conflict := 0; true; conflict++ {
+		libraryItem.UsedFileName = ""
+		libraryItem.UsedFileName = d.createFileName(&libraryItem, conflict)
+		to = d.getImageFilePath(&libraryItem)
+		if d.collisionKey(to) == d.collisionKey(from) || !d.pathExists(to) {
+			break
+		}
+		if d.templates().file == nil {
+			//Legacy names are unique per item, the file is someone else's
+			return nil, fmt.Errorf("can not link '%v', '%v' already exists", from, to)
+		}
+	}
+	d.recordFileNameMapping(&libraryItem)
+	log.Printf("Linking imported '%v' to '%v' [id %v]", from, item.Filename, item.Id)
+
+	if from != to {
+		//The folder templates may place the item in another folder
+		err := d.storage.MkdirAll(filepath.Dir(to))
+		if err != nil {
+			return nil, err
+		}
+		err = d.storage.Rename(from, to)
+		if err != nil {
+			return nil, err
+		}
+		d.names.add(to)
+		err = d.moveXMP(from, to)
+		if err != nil {
+			return nil, err
+		}
+	}
+	err := d.moveChecksum(&libraryItem, from, to)
+	if err != nil {
+		return nil, err
+	}
+	jsonFilePath := d.getJSONFilePath(item)
+	err = d.writeJSON(&libraryItem, jsonFilePath)
+	if err != nil {
+		return nil, err
+	}
+	d.provisional.remove(entry)
+	if jsonFilePath != entry.JSONFilePath {
+		err = d.storage.Remove(entry.JSONFilePath)
+		if err != nil {
+			return nil, err
+		}
+	}
+	err = d.writeXMP(&libraryItem, true)
+	if err != nil {
+		return nil, err
+	}
+	d.stats.UpdateStatsLinked(1)
+	return &libraryItem, nil
+}
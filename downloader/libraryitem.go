@@ -6,15 +6,71 @@ import (
 	photoslibrary "github.com/gphotosuploader/googlemirror/api/photoslibrary/v1"
 )
 
-//LibraryItem Google Photo item and meta data
+// LibraryItem Google Photo item and meta data
 type LibraryItem struct {
 	//Google Photos item
 	photoslibrary.MediaItem
 	//Actual file name that was used, without a path
 	UsedFileName string
+	//OriginalFileName file name before it was sanitized, if sanitizing changed it
+	OriginalFileName string `json:",omitempty"`
+	//SanitizeProfile profile used to sanitize OriginalFileName
+	SanitizeProfile string `json:",omitempty"`
+	//CaptureOffset UTC offset of the capture time, read from the EXIF data, e.g. -08:00
+	CaptureOffset string `json:",omitempty"`
+	//Albums titles of the albums the item was downloaded from
+	Albums []string `json:",omitempty"`
+	//SHA256 hash of the content as downloaded
+	SHA256 string `json:",omitempty"`
+	//PerceptualHash difference hash of JPEG and PNG images, hex encoded
+	PerceptualHash string `json:",omitempty"`
+	//FileSHA256 hash of the media file when it differs from the downloaded content, because metadata was embedded
+	FileSHA256 string `json:",omitempty"`
+	//Size bytes of the media file as stored
+	Size int64 `json:",omitempty"`
+	//GeoData location of the item, from Google Takeout
+	GeoData *GeoData `json:",omitempty"`
+	//Provisional the item was imported and its id is not a Google Photos id yet
+	Provisional bool `json:",omitempty"`
+	//AliasOf id of an item with identical content, the media file of this item is not stored
+	AliasOf string `json:",omitempty"`
+	//DeletedUpstream time (RFC3339) the item was found missing from Google Photos
+	DeletedUpstream string `json:",omitempty"`
+	//MetadataHistory previous versions of the Google Photos item metadata
+	MetadataHistory []*MetadataVersion `json:",omitempty"`
 }
 
-//MarshalJSON marshal as json
+// storedSHA256 hash of the media file as stored
+func (l *LibraryItem) storedSHA256() string {
+	if l.FileSHA256 != "" {
+		return l.FileSHA256
+	}
+	return l.SHA256
+}
+
+// addAlbum Add an album title to the item, returns true if it was added
+func (l *LibraryItem) addAlbum(title string) bool {
+	if title == "" {
+		return false
+	}
+	for _, album := range l.Albums {
+		if album == title {
+			return false
+		}
+	}
+	l.Albums = append(l.Albums, title)
+	return true
+}
+
+// MetadataVersion a previous version of the Google Photos item metadata
+type MetadataVersion struct {
+	//Replaced time (RFC3339) this version was replaced by newer metadata
+	Replaced string
+	//Item the Google Photos item as it was
+	Item *photoslibrary.MediaItem
+}
+
+// MarshalJSON marshal as json
 func (l *LibraryItem) MarshalJSON() ([]byte, error) {
 	data, err := l.MediaItem.MarshalJSON()
 	if err != nil {
@@ -26,5 +82,68 @@ func (l *LibraryItem) MarshalJSON() ([]byte, error) {
 		return nil, err
 	}
 	m["UsedFileName"] = l.UsedFileName
+	if l.OriginalFileName != "" {
+		m["OriginalFileName"] = l.OriginalFileName
+		m["SanitizeProfile"] = l.SanitizeProfile
+	}
+	if l.CaptureOffset != "" {
+		m["CaptureOffset"] = l.CaptureOffset
+	}
+	if len(l.Albums) > 0 {
+		m["Albums"] = l.Albums
+	}
+	if l.SHA256 != "" {
+		m["SHA256"] = l.SHA256
+	}
+	if l.PerceptualHash != "" {
+		m["PerceptualHash"] = l.PerceptualHash
+	}
+	if l.FileSHA256 != "" {
+		m["FileSHA256"] = l.FileSHA256
+	}
+	if l.Size != 0 {
+		m["Size"] = l.Size
+	}
+	if l.GeoData != nil {
+		m["GeoData"] = l.GeoData
+	}
+	if l.Provisional {
+		m["Provisional"] = l.Provisional
+	}
+	if l.AliasOf != "" {
+		m["AliasOf"] = l.AliasOf
+	}
+	if l.DeletedUpstream != "" {
+		m["DeletedUpstream"] = l.DeletedUpstream
+	}
+	if len(l.MetadataHistory) > 0 {
+		m["MetadataHistory"] = l.MetadataHistory
+	}
 	return json.Marshal(m)
 }
+
+// comparableMetadata the item metadata without volatile fields such as base
+// URLs, which change on every API call
+func comparableMetadata(item *photoslibrary.MediaItem) ([]byte, error) {
+	clone := *item
+	clone.BaseUrl = ""
+	if clone.ContributorInfo != nil {
+		contributor := *clone.ContributorInfo
+		contributor.ProfilePictureBaseUrl = ""
+		clone.ContributorInfo = &contributor
+	}
+	return clone.MarshalJSON()
+}
+
+// metadataChanged returns true if the Google Photos metadata differs
+func metadataChanged(stored *photoslibrary.MediaItem, fresh *photoslibrary.MediaItem) bool {
+	storedData, err := comparableMetadata(stored)
+	if err != nil {
+		return true
+	}
+	freshData, err := comparableMetadata(fresh)
+	if err != nil {
+		return true
+	}
+	return string(storedData) != string(freshData)
+}
@@ -0,0 +1,11 @@
+//go:build windows || plan9
+// +build windows plan9
+
+package downloader
+
+import "os"
+
+// linkCount number of hard links to a file, not available on this OS
+func linkCount(info os.FileInfo) uint64 {
+	return 1
+}
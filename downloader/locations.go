@@ -0,0 +1,205 @@
+package downloader
+
+import (
+	"encoding/json"
+	"fmt"
+	"image"
+	"io"
+	"io/ioutil"
+	"log"
+	"path"
+	"sort"
+	"strings"
+	"time"
+
+	photoslibrary "github.com/gphotosuploader/googlemirror/api/photoslibrary/v1"
+)
+
+// UnmatchedLocation a Takeout location no item in the backup folder was
+// found for
+type UnmatchedLocation struct {
+	//Path of the metadata file in the archive
+	Path         string `json:"path"`
+	Title        string `json:"title"`
+	CreationTime string `json:"creationTime"`
+	Reason       string `json:"reason"`
+}
+
+// takeoutLocation a Takeout metadata file with a location
+type takeoutLocation struct {
+	path     string
+	key      string
+	metadata *takeoutMetadata
+}
+
+// matchLocation Find the item a Takeout location belongs to, by file name,
+// creation time and the dimensions of the Takeout media file when known
+func matchLocation(items map[string][]*catalogEntry, item *photoslibrary.MediaItem) (*catalogEntry, string) {
+	candidates := items[itemMatchKey(item)]
+	if len(candidates) == 0 {
+		return nil, "no item with the same file name and creation time"
+	}
+	var matches []*catalogEntry
+	for _, entry := range candidates {
+		if sameDimensions(&entry.Item.MediaItem, item) {
+			matches = append(matches, entry)
+		}
+	}
+	if len(matches) == 0 {
+		return nil, "dimensions differ"
+	}
+	if len(matches) > 1 {
+		return nil, fmt.Sprintf("%v items with the same file name, creation time and dimensions", len(matches))
+	}
+	return matches[0], ""
+}
+
+// updateLocation Store a location in the sidecar of an item, and optionally
+// as EXIF GPS tags of its JPEG file. Returns true if anything changed.
+func (d *Downloader) updateLocation(entry *catalogEntry, geo *GeoData, writeEXIF bool) (bool, error) {
+	item := entry.Item
+	changed := item.GeoData == nil || *item.GeoData != *geo
+	item.GeoData = geo
+	//Packed media files are not rewritten, the location is kept in the sidecar
+	packed := entry.isPacked()
+	if writeEXIF && item.AliasOf == "" && !packed && strings.EqualFold(item.MimeType, "image/jpeg") {
+		embedded, err := embedEXIF(entry.MediaFilePath(), gpsTags(geo))
+		if err != nil {
+			return false, err
+		}
+		if embedded {
+			item.FileSHA256, err = hashFile(entry.MediaFilePath())
+			if err != nil {
+				return false, err
+			}
+			err = d.updateSize(item, entry.MediaFilePath())
+			if err != nil {
+				return false, err
+			}
+			changed = true
+		}
+	}
+	if !changed {
+		return false, nil
+	}
+	err := d.writeJSON(item, entry.JSONFilePath)
+	if err != nil {
+		return false, err
+	}
+	if !packed {
+		err = d.updateChecksum(item, entry.MediaFilePath())
+		if err != nil {
+			return false, err
+		}
+	}
+	return true, d.writeXMP(item, true)
+}
+
+// ImportLocations Store the locations of Google Takeout metadata files in the
+// sidecars of the matching items in the backup folder, and optionally as EXIF
+// GPS tags of their JPEG files. The locations no item was found for are
+// reported to w in JSON format.
+func (d *Downloader) ImportLocations(w io.Writer, archives []string, writeEXIF bool) error {
+	err := d.requireLocal("import-locations")
+	if err != nil {
+		return err
+	}
+	_, err = d.compileTemplates()
+	if err != nil {
+		return err
+	}
+	catalog, err := d.loadCatalog()
+	if err != nil {
+		return err
+	}
+	items := make(map[string][]*catalogEntry)
+	for _, entry := range catalog.items {
+		key := itemMatchKey(&entry.Item.MediaItem)
+		if key != "" {
+			items[key] = append(items[key], entry)
+		}
+	}
+
+	var locations []*takeoutLocation
+	dimensions := make(map[string]image.Config)
+	for _, archive := range archives {
+		log.Printf("Reading '%v'", archive)
+		err = walkArchive(archive, func(name string, r io.Reader) error {
+			folder := path.Dir(name)
+			base := path.Base(name)
+			if !strings.EqualFold(path.Ext(base), ".json") {
+				if strings.HasPrefix(mimeTypeByExtension(base), "image/") {
+					//Only the header is read
+					config, _, err := image.DecodeConfig(r)
+					if err == nil {
+						dimensions[takeoutKey(folder, base)] = config
+					}
+				}
+				return nil
+			}
+			data, err := ioutil.ReadAll(io.LimitReader(r, takeoutMaxMetadataSize))
+			if err != nil {
+				return err
+			}
+			metadata := parseTakeoutMetadata(data)
+			if metadata == nil || metadata.geoData() == nil {
+				return nil
+			}
+			locations = append(locations, &takeoutLocation{path: name, key: takeoutKey(folder, takeoutMediaName(base)), metadata: metadata})
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+	}
+	sort.Slice(locations, func(i, j int) bool {
+		return locations[i].path < locations[j].path
+	})
+
+	unmatched := []*UnmatchedLocation{}
+	done := make(map[*catalogEntry]bool)
+	var matched, updated int
+	for _, location := range locations {
+		item := new(photoslibrary.MediaItem)
+		item.Filename = location.metadata.Title
+		item.MediaMetadata = new(photoslibrary.MediaMetadata)
+		taken, err := location.metadata.takenTime()
+		if err == nil {
+			item.MediaMetadata.CreationTime = taken.Format(time.RFC3339)
+		}
+		if config, ok := dimensions[location.key]; ok {
+			item.MediaMetadata.Width = int64(config.Width)
+			item.MediaMetadata.Height = int64(config.Height)
+		}
+
+		entry, reason := matchLocation(items, item)
+		if entry == nil {
+			unmatched = append(unmatched, &UnmatchedLocation{Path: location.path, Title: item.Filename, CreationTime: item.MediaMetadata.CreationTime, Reason: reason})
+			continue
+		}
+		if done[entry] {
+			//Takeout lists an item once per album
+			continue
+		}
+		done[entry] = true
+		matched++
+		changed, err := d.updateLocation(entry, location.metadata.geoData(), writeEXIF)
+		if err != nil {
+			log.Printf("Failed to store the location of '%v': %v", entry.MediaFilePath(), err)
+			continue
+		}
+		if changed {
+			log.Printf("Stored location of '%v'", entry.MediaFilePath())
+			updated++
+		}
+	}
+	log.Printf("Locations: %v matched, %v updated, %v unmatched", matched, updated, len(unmatched))
+	err = d.flushChecksums()
+	if err != nil {
+		return err
+	}
+
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+	return encoder.Encode(unmatched)
+}
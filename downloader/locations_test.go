@@ -0,0 +1,108 @@
+package downloader
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"image/jpeg"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestImportLocations(t *testing.T) {
+	downloader := NewDownloader()
+	downloader.Options.BackupFolder = tempPath()
+	downloader.Options.WriteXMP = true
+	defer os.RemoveAll(downloader.Options.BackupFolder)
+	archivePath := filepath.Join(tempPath(), "takeout-001.zip")
+	defer os.RemoveAll(filepath.Dir(archivePath))
+
+	encoded := new(bytes.Buffer)
+	jpeg.Encode(encoded, testImage(64, 48, false), nil)
+	item := templateTestItem()
+	item.Filename = "IMG_1.jpg"
+	item.MediaMetadata.CreationTime = "2019-10-13T17:33:43Z"
+	item.MediaMetadata.Width = 64
+	item.MediaMetadata.Height = 48
+	item.UsedFileName = downloader.createFileName(item, 0)
+	mediaFilePath := downloader.getImageFilePath(item)
+	os.MkdirAll(filepath.Dir(mediaFilePath), 0700)
+	ioutil.WriteFile(mediaFilePath, encoded.Bytes(), 0644)
+	jsonFilePath := downloader.getJSONFilePath(&item.MediaItem)
+	downloader.writeJSON(item, jsonFilePath)
+
+	geo := `{"latitude": 32.08, "longitude": -34.78, "altitude": 12.5}`
+	writeTestZip(t, archivePath, [][2]string{
+		{"Takeout/Google Photos/Photos from 2019/IMG_1.jpg", encoded.String()},
+		{"Takeout/Google Photos/Photos from 2019/IMG_1.jpg.json", string(testTakeoutMetadata("IMG_1.jpg", geo))},
+		{"Takeout/Google Photos/Trip/IMG_1.jpg.json", string(testTakeoutMetadata("IMG_1.jpg", geo))},
+		{"Takeout/Google Photos/Photos from 2019/IMG_2.jpg.json", string(testTakeoutMetadata("IMG_2.jpg", geo))},
+	})
+
+	report := new(bytes.Buffer)
+	err := downloader.ImportLocations(report, []string{archivePath}, true)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	var unmatched []*UnmatchedLocation
+	err = json.Unmarshal(report.Bytes(), &unmatched)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	if len(unmatched) != 1 || unmatched[0].Title != "IMG_2.jpg" {
+		t.Errorf("unmatched = %v; want IMG_2.jpg", report.String())
+	}
+
+	stored, err := loadSidecar(downloader.storage, jsonFilePath)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	if stored.GeoData == nil || stored.GeoData.Longitude != -34.78 {
+		t.Errorf("GeoData = %v", stored.GeoData)
+	}
+	if stored.FileSHA256 == "" {
+		t.Errorf("FileSHA256 should be set once GPS tags are embedded")
+	}
+
+	x, err := readEXIFFile(mediaFilePath)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	if ref := findEXIFEntry(x.gps, exifTagGPSLongitudeRef).ascii(); ref != "W" {
+		t.Errorf("GPSLongitudeRef = %v", ref)
+	}
+	latitude := findEXIFEntry(x.gps, exifTagGPSLatitude)
+	if latitude == nil || len(latitude.Value) != 24 {
+		t.Fatalf("missing GPSLatitude")
+	}
+	//32.08 degrees is 32° 4' 48"
+	if binary.BigEndian.Uint32(latitude.Value) != 32 || binary.BigEndian.Uint32(latitude.Value[8:]) != 4 || binary.BigEndian.Uint32(latitude.Value[16:]) != 480000 {
+		t.Errorf("GPSLatitude = %v", latitude.Value)
+	}
+
+	xmp, err := ioutil.ReadFile(xmpFilePath(mediaFilePath))
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	for _, want := range []string{`exif:GPSLatitude="32,4.800000N"`, `exif:GPSLongitude="34,46.800000W"`, `exif:GPSAltitude="1250/100"`} {
+		if !strings.Contains(string(xmp), want) {
+			t.Errorf("XMP should contain %v", want)
+		}
+	}
+
+	t.Run("Dimensions differ", func(t *testing.T) {
+		item.MediaMetadata.Width = 4032
+		downloader.writeJSON(item, jsonFilePath)
+		report.Reset()
+		err := downloader.ImportLocations(report, []string{archivePath}, false)
+		if err != nil {
+			t.Fatalf("%v", err)
+		}
+		if !strings.Contains(report.String(), "dimensions differ") {
+			t.Errorf("report = %v", report.String())
+		}
+	})
+}
@@ -0,0 +1,254 @@
+package downloader
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+)
+
+// migrationFileName file in the backup folder holding an unfinished migration
+const migrationFileName = ".gitmoo-migrate.json"
+
+// migrationMove moving a single item to its path under the new naming options
+type migrationMove struct {
+	ID           string
+	FromJSON     string
+	ToJSON       string
+	FromMedia    string
+	ToMedia      string
+	UsedFileName string
+	//OriginalFileName, SanitizeProfile the file name mapping of the new name
+	OriginalFileName string `json:",omitempty"`
+	SanitizeProfile  string `json:",omitempty"`
+	//CaptureOffset the capture-local offset read while planning
+	CaptureOffset string `json:",omitempty"`
+}
+
+// Migrate Move all items in the backup folder to the paths given by the
+// current naming options. The plan is saved in the backup folder before
+// moving anything, so an interrupted migration resumes where it stopped.
+// With dryRun, the moves are only logged.
+func (d *Downloader) Migrate(dryRun bool) error {
+	err := d.requireLocal("migrate")
+	if err != nil {
+		return err
+	}
+	_, err = d.compileTemplates()
+	if err != nil {
+		return err
+	}
+	_, err = d.timeZone()
+	if err != nil {
+		return err
+	}
+
+	journalPath := filepath.Join(d.Options.BackupFolder, migrationFileName)
+	moves, err := loadMigration(journalPath)
+	if err != nil {
+		return err
+	}
+	if moves != nil {
+		log.Printf("Resuming migration of %v items", len(moves))
+	} else {
+		moves, err = d.planMigration()
+		if err != nil {
+			return err
+		}
+	}
+
+	if dryRun {
+		for _, move := range moves {
+			log.Printf("Would move '%v' to '%v'", move.FromMedia, move.ToMedia)
+		}
+		log.Printf("Migration dry run: %v items to move", len(moves))
+		return nil
+	}
+	if len(moves) == 0 {
+		log.Printf("Nothing to migrate")
+		return nil
+	}
+
+	bytes, err := json.MarshalIndent(moves, "", "  ")
+	if err != nil {
+		return err
+	}
+	err = ioutil.WriteFile(journalPath, bytes, 0644)
+	if err != nil {
+		return err
+	}
+
+	folders := make(map[string]bool)
+	for _, move := range moves {
+		err = d.applyMove(move)
+		if err != nil {
+			d.flushChecksums()
+			return fmt.Errorf("failed to move '%v': %v (run migrate again to resume)", move.FromMedia, err)
+		}
+		folders[filepath.Dir(move.FromJSON)] = true
+	}
+	removeEmptyFolders(d.Options.BackupFolder, folders)
+	err = d.flushChecksums()
+	if err != nil {
+		return err
+	}
+
+	log.Printf("Migrated %v items", len(moves))
+	return os.Remove(journalPath)
+}
+
+// loadMigration Load the moves of an unfinished migration, nil if none
+func loadMigration(journalPath string) ([]*migrationMove, error) {
+	bytes, err := ioutil.ReadFile(journalPath)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var moves []*migrationMove
+	err = json.Unmarshal(bytes, &moves)
+	if err != nil {
+		return nil, err
+	}
+	return moves, nil
+}
+
+// planMigration Compute the new paths of all items in the backup folder,
+// resolving conflicts with existing files and with other planned moves
+func (d *Downloader) planMigration() ([]*migrationMove, error) {
+	catalog, err := d.loadCatalog()
+	if err != nil {
+		return nil, err
+	}
+	ids := make([]string, 0, len(catalog.items))
+	for id := range catalog.items {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+
+	planned := make(map[string]bool)
+	var moves []*migrationMove
+	for _, id := range ids {
+		entry := catalog.items[id]
+		if entry.pack != nil {
+			//Packed items stay in their archives
+			continue
+		}
+		move := &migrationMove{
+			ID:            id,
+			FromJSON:      entry.JSONFilePath,
+			FromMedia:     entry.MediaFilePath(),
+			CaptureOffset: entry.Item.CaptureOffset,
+		}
+		if d.Options.TimeZoneFromEXIF && move.CaptureOffset == "" {
+			//Items downloaded before reading offsets was enabled
+			move.CaptureOffset, err = readCaptureOffset(entry.Item, move.FromMedia)
+			if err != nil {
+				log.Printf("Failed to read the capture time zone of '%v': %v", move.FromMedia, err)
+			}
+			d.setCaptureOffset(id, move.CaptureOffset)
+		}
+		move.ToJSON = d.getJSONFilePath(&entry.Item.MediaItem)
+
+		target := *entry.Item
+		for conflict := 0; true; conflict++ {
+			target.UsedFileName = ""
+			target.UsedFileName = d.createFileName(&target, conflict)
+			move.ToMedia = d.getImageFilePath(&target)
+			if d.collisionKey(move.ToMedia) == d.collisionKey(move.FromMedia) {
+				break
+			}
+			if !planned[d.collisionKey(move.ToMedia)] && !d.pathExists(move.ToMedia) {
+				break
+			}
+			if d.templates().file == nil {
+				//Legacy names are unique per item, the file is someone else's
+				return nil, fmt.Errorf("can not move '%v', '%v' already exists", move.FromMedia, move.ToMedia)
+			}
+		}
+		d.recordFileNameMapping(&target)
+		move.UsedFileName = target.UsedFileName
+		move.OriginalFileName = target.OriginalFileName
+		move.SanitizeProfile = target.SanitizeProfile
+		planned[d.collisionKey(move.ToMedia)] = true
+
+		if move.ToMedia == move.FromMedia && move.ToJSON == move.FromJSON && move.OriginalFileName == entry.Item.OriginalFileName && move.CaptureOffset == entry.Item.CaptureOffset {
+			continue
+		}
+		moves = append(moves, move)
+	}
+	return moves, nil
+}
+
+// applyMove Move the media and the sidecar of an item, each step can be
+// repeated safely when resuming
+func (d *Downloader) applyMove(move *migrationMove) error {
+	if move.FromMedia != move.ToMedia {
+		_, err := os.Stat(move.FromMedia)
+		if err == nil {
+			log.Printf("Moving '%v' to '%v'", move.FromMedia, move.ToMedia)
+			err = os.MkdirAll(filepath.Dir(move.ToMedia), 0700)
+			if err != nil {
+				return err
+			}
+			err = os.Rename(move.FromMedia, move.ToMedia)
+			if err != nil {
+				return err
+			}
+		} else if !os.IsNotExist(err) {
+			return err
+		}
+		err = d.moveXMP(move.FromMedia, move.ToMedia)
+		if err != nil {
+			return err
+		}
+	}
+
+	_, err := os.Stat(move.FromJSON)
+	if os.IsNotExist(err) {
+		//Already moved
+		return nil
+	}
+	item, err := d.loadJSON(move.FromJSON)
+	if err != nil {
+		return err
+	}
+	item.UsedFileName = move.UsedFileName
+	item.OriginalFileName = move.OriginalFileName
+	item.SanitizeProfile = move.SanitizeProfile
+	item.CaptureOffset = move.CaptureOffset
+	err = d.moveChecksum(item, move.FromMedia, move.ToMedia)
+	if err != nil {
+		return err
+	}
+	err = d.writeJSON(item, move.ToJSON)
+	if err != nil {
+		return err
+	}
+	//Dates in the XMP sidecar follow the time zone options
+	err = d.writeXMP(item, true)
+	if err != nil {
+		return err
+	}
+	if move.FromJSON == move.ToJSON {
+		return nil
+	}
+	return os.Remove(move.FromJSON)
+}
+
+// removeEmptyFolders Remove the given folders and their parents, up to root,
+// if they are empty
+func removeEmptyFolders(root string, folders map[string]bool) {
+	root = filepath.Clean(root)
+	for folder := range folders {
+		for folder = filepath.Clean(folder); folder != root && len(folder) > len(root); folder = filepath.Dir(folder) {
+			if os.Remove(folder) != nil {
+				break
+			}
+		}
+	}
+}
@@ -0,0 +1,112 @@
+package downloader
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestMigrate(t *testing.T) {
+	downloader := NewDownloader()
+	downloader.Options.BackupFolder = tempPath()
+	defer os.RemoveAll(downloader.Options.BackupFolder)
+
+	//Two items with the same file name in the legacy layout
+	first := createTestItem(t, downloader, "12345678901234567890")
+	second := createTestItem(t, downloader, "09876543210987654321")
+	second.Filename = first.Filename
+	err := downloader.writeJSON(second, downloader.getJSONFilePath(&second.MediaItem))
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	legacyPath := downloader.getImageFilePath(first)
+
+	downloader.Options.UseFileName = true
+	downloader.Options.FolderTemplate = "{year}/{month:02}"
+	downloader.compileTemplates()
+
+	t.Run("Dry Run", func(t *testing.T) {
+		err := downloader.Migrate(true)
+		if err != nil {
+			t.Fatalf("%v", err)
+		}
+		if _, err := os.Stat(legacyPath); err != nil {
+			t.Errorf("dry run should not move files: %v", err)
+		}
+	})
+
+	t.Run("Migrate", func(t *testing.T) {
+		err := downloader.Migrate(false)
+		if err != nil {
+			t.Fatalf("%v", err)
+		}
+		folder := filepath.Join(downloader.Options.BackupFolder, "2019", "10")
+		files, _ := ioutil.ReadDir(folder)
+		var names []string
+		for _, file := range files {
+			names = append(names, file.Name())
+		}
+		if len(names) != 4 {
+			t.Fatalf("migrated folder = %v; want 2 media and 2 json files", names)
+		}
+
+		for _, item := range []*LibraryItem{first, second} {
+			migrated, err := downloader.loadJSON(downloader.getJSONFilePath(&item.MediaItem))
+			if err != nil || migrated == nil {
+				t.Fatalf("missing migrated json for %v: %v", item.Id, err)
+			}
+			if _, err := os.Stat(downloader.getImageFilePath(migrated)); err != nil {
+				t.Errorf("missing migrated media for %v: %v", item.Id, err)
+			}
+		}
+		if _, err := os.Stat(filepath.Join(downloader.Options.BackupFolder, "2019", "October")); !os.IsNotExist(err) {
+			t.Errorf("empty legacy folder should be removed")
+		}
+		if _, err := os.Stat(filepath.Join(downloader.Options.BackupFolder, migrationFileName)); !os.IsNotExist(err) {
+			t.Errorf("finished migration should remove its journal")
+		}
+	})
+
+	t.Run("Resume", func(t *testing.T) {
+		//Back to the legacy layout, interrupted after moving the media of the first item
+		downloader.Options.UseFileName = false
+		downloader.Options.FolderTemplate = ""
+		downloader.compileTemplates()
+		moves, err := downloader.planMigration()
+		if err != nil {
+			t.Fatalf("%v", err)
+		}
+		if len(moves) != 2 {
+			t.Fatalf("downloader.planMigration() = %v moves; want 2", len(moves))
+		}
+		err = os.MkdirAll(filepath.Dir(moves[0].ToMedia), 0700)
+		if err != nil {
+			t.Fatalf("%v", err)
+		}
+		err = os.Rename(moves[0].FromMedia, moves[0].ToMedia)
+		if err != nil {
+			t.Fatalf("%v", err)
+		}
+		bytes, err := json.Marshal(moves)
+		if err != nil {
+			t.Fatalf("%v", err)
+		}
+		err = ioutil.WriteFile(filepath.Join(downloader.Options.BackupFolder, migrationFileName), bytes, 0644)
+		if err != nil {
+			t.Fatalf("%v", err)
+		}
+
+		err = downloader.Migrate(false)
+		if err != nil {
+			t.Fatalf("%v", err)
+		}
+		if _, err := os.Stat(legacyPath); err != nil {
+			t.Errorf("resumed migration should restore the legacy layout: %v", err)
+		}
+		if _, err := os.Stat(filepath.Join(downloader.Options.BackupFolder, "2019", "10")); !os.IsNotExist(err) {
+			t.Errorf("empty folder should be removed")
+		}
+	})
+}
@@ -0,0 +1,395 @@
+package downloader
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"strings"
+	"time"
+)
+
+// mp4Containers boxes holding the boxes that are edited, other boxes are kept
+// as is
+var mp4Containers = map[string]bool{"moov": true, "trak": true, "mdia": true, "minf": true, "stbl": true, "udta": true}
+
+// mp4Epoch start of MP4 and QuickTime times
+var mp4Epoch = time.Date(1904, 1, 1, 0, 0, 0, 0, time.UTC)
+
+// mp4LanguageUndefined the packed ISO-639-2 code `und`
+const mp4LanguageUndefined = 0x55c4
+
+// MP4 user data types, © is 0xa9 in MP4 box types
+const (
+	mp4UserDataDay         = "\xa9day"
+	mp4UserDataDescription = "\xa9des"
+)
+
+// isMP4 returns true for the mime types of MP4 and QuickTime files
+func isMP4(mimeType string) bool {
+	switch strings.ToLower(mimeType) {
+	case "video/mp4", "video/quicktime", "video/3gpp", "video/x-m4v":
+		return true
+	}
+	return false
+}
+
+// mp4Box a box inside the movie box, containers are parsed into children
+type mp4Box struct {
+	typ      string
+	data     []byte
+	children []*mp4Box
+	//largeSize the box was read with a 64-bit size, and is written with one
+	largeSize bool
+	//terminated the children end with the 4 zero bytes QuickTime writes
+	//after user data boxes
+	terminated bool
+}
+
+// mp4Terminated returns true if the boxes of data are followed by a 4 byte
+// zero terminator
+func mp4Terminated(data []byte) bool {
+	for len(data) >= 8 {
+		size := uint64(binary.BigEndian.Uint32(data))
+		if size == 1 && len(data) >= 16 {
+			size = binary.BigEndian.Uint64(data[8:])
+		}
+		if size < 8 || size > uint64(len(data)) {
+			return false
+		}
+		data = data[size:]
+	}
+	return len(data) == 4 && binary.BigEndian.Uint32(data) == 0
+}
+
+// parseMP4Boxes Parse a sequence of boxes
+func parseMP4Boxes(data []byte) ([]*mp4Box, error) {
+	var boxes []*mp4Box
+	for len(data) > 0 {
+		if len(data) < 8 {
+			return nil, errors.New("MP4 box too short")
+		}
+		size := uint64(binary.BigEndian.Uint32(data))
+		header := uint64(8)
+		if size == 1 {
+			if len(data) < 16 {
+				return nil, errors.New("MP4 box too short")
+			}
+			size = binary.BigEndian.Uint64(data[8:])
+			header = 16
+		} else if size == 0 {
+			size = uint64(len(data))
+		}
+		if size < header || size > uint64(len(data)) {
+			return nil, errors.New("invalid MP4 box size")
+		}
+		box := &mp4Box{typ: string(data[4:8]), largeSize: header == 16}
+		if mp4Containers[box.typ] {
+			payload := data[header:size]
+			if box.typ == "udta" && mp4Terminated(payload) {
+				box.terminated = true
+				payload = payload[:len(payload)-4]
+			}
+			var err error
+			box.children, err = parseMP4Boxes(payload)
+			if err != nil {
+				return nil, err
+			}
+		} else {
+			box.data = data[header:size]
+		}
+		boxes = append(boxes, box)
+		data = data[size:]
+	}
+	return boxes, nil
+}
+
+// bytes Serialize the box
+func (b *mp4Box) bytes() []byte {
+	payload := b.data
+	if b.children != nil || b.terminated {
+		payload = nil
+		for _, child := range b.children {
+			payload = append(payload, child.bytes()...)
+		}
+		if b.terminated {
+			payload = append(payload, 0, 0, 0, 0)
+		}
+	}
+	if b.largeSize {
+		box := make([]byte, 16, 16+len(payload))
+		binary.BigEndian.PutUint32(box, 1)
+		copy(box[4:], b.typ)
+		binary.BigEndian.PutUint64(box[8:], uint64(16+len(payload)))
+		return append(box, payload...)
+	}
+	box := make([]byte, 8, 8+len(payload))
+	binary.BigEndian.PutUint32(box, uint32(8+len(payload)))
+	copy(box[4:], b.typ)
+	return append(box, payload...)
+}
+
+// child the first child box of a type, or nil
+func (b *mp4Box) child(typ string) *mp4Box {
+	for _, child := range b.children {
+		if child.typ == typ {
+			return child
+		}
+	}
+	return nil
+}
+
+// walk calls fn for the box and all the boxes it contains
+func (b *mp4Box) walk(fn func(box *mp4Box)) {
+	fn(b)
+	for _, child := range b.children {
+		child.walk(fn)
+	}
+}
+
+// setMP4Times Set the creation and modification times of a movie, track or
+// media header box, returns true if they changed
+func setMP4Times(data []byte, seconds uint64) bool {
+	if len(data) < 1 {
+		return false
+	}
+	if data[0] == 1 {
+		if len(data) < 20 {
+			return false
+		}
+		if binary.BigEndian.Uint64(data[4:]) == seconds && binary.BigEndian.Uint64(data[12:]) == seconds {
+			return false
+		}
+		binary.BigEndian.PutUint64(data[4:], seconds)
+		binary.BigEndian.PutUint64(data[12:], seconds)
+		return true
+	}
+	if len(data) < 12 || seconds > math.MaxUint32 {
+		return false
+	}
+	if uint64(binary.BigEndian.Uint32(data[4:])) == seconds && uint64(binary.BigEndian.Uint32(data[8:])) == seconds {
+		return false
+	}
+	binary.BigEndian.PutUint32(data[4:], uint32(seconds))
+	binary.BigEndian.PutUint32(data[8:], uint32(seconds))
+	return true
+}
+
+// mp4UserDataText the payload of a QuickTime user data text box
+func mp4UserDataText(text string) []byte {
+	data := make([]byte, 4, 4+len(text))
+	binary.BigEndian.PutUint16(data, uint16(len(text)))
+	binary.BigEndian.PutUint16(data[2:], mp4LanguageUndefined)
+	return append(data, text...)
+}
+
+// shiftChunkOffsets Move the chunk offsets pointing at or after from by delta
+func shiftChunkOffsets(moov *mp4Box, from uint64, delta int64) error {
+	var err error
+	moov.walk(func(box *mp4Box) {
+		if err != nil || (box.typ != "stco" && box.typ != "co64") {
+			return
+		}
+		if len(box.data) < 8 {
+			err = errors.New("invalid MP4 chunk offsets")
+			return
+		}
+		count := uint64(binary.BigEndian.Uint32(box.data[4:]))
+		size := uint64(4)
+		if box.typ == "co64" {
+			size = 8
+		}
+		if uint64(len(box.data)) < 8+count*size {
+			err = errors.New("invalid MP4 chunk offsets")
+			return
+		}
+		for i := uint64(0); i < count; i++ {
+			entry := box.data[8+i*size:]
+			if box.typ == "co64" {
+				offset := binary.BigEndian.Uint64(entry)
+				if offset >= from {
+					binary.BigEndian.PutUint64(entry, uint64(int64(offset)+delta))
+				}
+				continue
+			}
+			offset := uint64(binary.BigEndian.Uint32(entry))
+			if offset >= from {
+				shifted := int64(offset) + delta
+				if shifted > math.MaxUint32 {
+					err = errors.New("MP4 chunk offset overflow")
+					return
+				}
+				binary.BigEndian.PutUint32(entry, uint32(shifted))
+			}
+		}
+	})
+	return err
+}
+
+// mp4Atom a top level box of a file
+type mp4Atom struct {
+	typ    string
+	offset int64
+	header int64
+	size   int64
+}
+
+// readMP4Atoms Read the top level boxes of a file
+func readMP4Atoms(file io.ReaderAt, fileSize int64) ([]*mp4Atom, error) {
+	var atoms []*mp4Atom
+	for offset := int64(0); offset < fileSize; {
+		var header [16]byte
+		_, err := file.ReadAt(header[:8], offset)
+		if err != nil {
+			return nil, err
+		}
+		atom := &mp4Atom{typ: string(header[4:8]), offset: offset, header: 8, size: int64(binary.BigEndian.Uint32(header[:]))}
+		if atom.size == 1 {
+			_, err = file.ReadAt(header[8:], offset+8)
+			if err != nil {
+				return nil, err
+			}
+			atom.header = 16
+			atom.size = int64(binary.BigEndian.Uint64(header[8:]))
+		} else if atom.size == 0 {
+			atom.size = fileSize - offset
+		}
+		if atom.size < atom.header || offset+atom.size > fileSize {
+			return nil, errors.New("invalid MP4 box size")
+		}
+		atoms = append(atoms, atom)
+		offset += atom.size
+	}
+	return atoms, nil
+}
+
+// embedMP4 Set the creation and modification times of an MP4 or QuickTime
+// file and add the missing user data text boxes. Only the movie box is
+// rewritten, the media data is copied as is. Returns true if the file changed.
+func embedMP4(filePath string, created time.Time, userData map[string]string) (bool, error) {
+	file, err := os.OpenFile(filePath, os.O_RDWR, 0)
+	if err != nil {
+		return false, err
+	}
+	defer file.Close()
+	info, err := file.Stat()
+	if err != nil {
+		return false, err
+	}
+	atoms, err := readMP4Atoms(file, info.Size())
+	if err != nil {
+		return false, err
+	}
+	var atom *mp4Atom
+	for _, a := range atoms {
+		if a.typ == "moov" {
+			atom = a
+		}
+	}
+	if atom == nil {
+		return false, errors.New("missing MP4 movie box")
+	}
+	data := make([]byte, atom.size-atom.header)
+	_, err = file.ReadAt(data, atom.offset+atom.header)
+	if err != nil {
+		return false, err
+	}
+	children, err := parseMP4Boxes(data)
+	if err != nil {
+		return false, err
+	}
+	moov := &mp4Box{typ: "moov", children: children, largeSize: atom.header == 16}
+
+	changed := false
+	seconds := created.Unix() - mp4Epoch.Unix()
+	if seconds > 0 {
+		moov.walk(func(box *mp4Box) {
+			if box.typ == "mvhd" || box.typ == "tkhd" || box.typ == "mdhd" {
+				changed = setMP4Times(box.data, uint64(seconds)) || changed
+			}
+		})
+	}
+	for _, typ := range []string{mp4UserDataDay, mp4UserDataDescription} {
+		text := userData[typ]
+		if text == "" {
+			continue
+		}
+		udta := moov.child("udta")
+		if udta == nil {
+			udta = &mp4Box{typ: "udta", children: []*mp4Box{}}
+			moov.children = append(moov.children, udta)
+		}
+		if udta.child(typ) == nil {
+			udta.children = append(udta.children, &mp4Box{typ: typ, data: mp4UserDataText(text)})
+			changed = true
+		}
+	}
+	if !changed {
+		return false, nil
+	}
+
+	updated := moov.bytes()
+	delta := int64(len(updated)) - atom.size
+	if delta == 0 && linkCount(info) <= 1 {
+		//Same size, only the header values changed. Hard linked files are
+		//rewritten instead, so the other links keep their content
+		_, err = file.WriteAt(updated, atom.offset)
+		if err != nil {
+			return false, err
+		}
+		err = file.Close()
+		if err != nil {
+			return false, err
+		}
+		return true, os.Chtimes(filePath, time.Now(), info.ModTime())
+	}
+
+	//Media data after the movie box moves, and the chunk offsets with it
+	err = shiftChunkOffsets(moov, uint64(atom.offset+atom.size), delta)
+	if err != nil {
+		return false, err
+	}
+	updated = moov.bytes()
+	return true, rewriteMP4(file, info, atom, updated)
+}
+
+// rewriteMP4 Write a copy of the file with a new movie box and replace it
+func rewriteMP4(file *os.File, info os.FileInfo, atom *mp4Atom, moov []byte) error {
+	filePath := file.Name()
+	temp := filePath + ".mp4"
+	output, err := os.Create(temp)
+	if err != nil {
+		return err
+	}
+	writer := bufio.NewWriter(output)
+	_, err = io.Copy(writer, io.NewSectionReader(file, 0, atom.offset))
+	if err == nil {
+		_, err = writer.Write(moov)
+	}
+	if err == nil {
+		end := atom.offset + atom.size
+		_, err = io.Copy(writer, io.NewSectionReader(file, end, info.Size()-end))
+	}
+	if err == nil {
+		err = writer.Flush()
+	}
+	closeErr := output.Close()
+	if err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(temp)
+		return fmt.Errorf("failed to rewrite '%v': %v", filePath, err)
+	}
+	file.Close()
+
+	err = os.Rename(temp, filePath)
+	if err != nil {
+		os.Remove(temp)
+		return err
+	}
+	return os.Chtimes(filePath, time.Now(), info.ModTime())
+}
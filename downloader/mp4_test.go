@@ -0,0 +1,192 @@
+package downloader
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// testBox an MP4 box
+func testBox(typ string, payload ...[]byte) []byte {
+	data := bytes.Join(payload, nil)
+	box := make([]byte, 8)
+	binary.BigEndian.PutUint32(box, uint32(8+len(data)))
+	copy(box[4:], typ)
+	return append(box, data...)
+}
+
+// testMP4 a minimal MP4 file with one track and one chunk holding `media`,
+// the movie box before or after the media data
+func testMP4(moovFirst bool) []byte {
+	ftyp := testBox("ftyp", []byte("isom\x00\x00\x02\x00isom"))
+	mdat := testBox("mdat", []byte("media"))
+	header := make([]byte, 100)
+	build := func(chunkOffset uint32) []byte {
+		stco := make([]byte, 12)
+		binary.BigEndian.PutUint32(stco[4:], 1)
+		binary.BigEndian.PutUint32(stco[8:], chunkOffset)
+		return testBox("moov",
+			testBox("mvhd", header),
+			testBox("trak",
+				testBox("tkhd", header[:84]),
+				testBox("mdia",
+					testBox("mdhd", header[:24]),
+					testBox("minf", testBox("stbl", testBox("stco", stco))))))
+	}
+	if moovFirst {
+		moov := build(0)
+		return bytes.Join([][]byte{ftyp, build(uint32(len(ftyp) + len(moov) + 8)), mdat}, nil)
+	}
+	return bytes.Join([][]byte{ftyp, mdat, build(uint32(len(ftyp) + 8))}, nil)
+}
+
+// readTestMP4 the movie box of a file and the data its first chunk offset
+// points to
+func readTestMP4(t *testing.T, filePath string) (*mp4Box, string) {
+	data, err := ioutil.ReadFile(filePath)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	boxes, err := parseMP4Boxes(data)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	var moov *mp4Box
+	for _, box := range boxes {
+		if box.typ == "moov" {
+			moov = box
+		}
+	}
+	stco := moov.child("trak").child("mdia").child("minf").child("stbl").child("stco")
+	offset := binary.BigEndian.Uint32(stco.data[8:])
+	return moov, string(data[offset : offset+5])
+}
+
+func TestEmbedMP4(t *testing.T) {
+	folder := tempPath()
+	defer os.RemoveAll(folder)
+	created, _ := time.Parse(time.RFC3339, "2019-10-13T17:33:43Z")
+	seconds := uint32(created.Unix() - mp4Epoch.Unix())
+
+	for _, moovFirst := range []bool{true, false} {
+		filePath := filepath.Join(folder, "video.mp4")
+		ioutil.WriteFile(filePath, testMP4(moovFirst), 0644)
+
+		changed, err := embedMP4(filePath, created, nil)
+		if err != nil || !changed {
+			t.Fatalf("embedMP4() = %v, %v; want true", changed, err)
+		}
+		moov, media := readTestMP4(t, filePath)
+		for _, box := range []*mp4Box{moov.child("mvhd"), moov.child("trak").child("tkhd"), moov.child("trak").child("mdia").child("mdhd")} {
+			if binary.BigEndian.Uint32(box.data[4:]) != seconds || binary.BigEndian.Uint32(box.data[8:]) != seconds {
+				t.Errorf("%v times should be set", box.typ)
+			}
+		}
+		if media != "media" {
+			t.Errorf("chunk offset points to %v; want media", media)
+		}
+
+		userData := map[string]string{mp4UserDataDay: "2019-10-13T17:33:43Z", mp4UserDataDescription: "Dinner"}
+		changed, err = embedMP4(filePath, created, userData)
+		if err != nil || !changed {
+			t.Fatalf("embedMP4() = %v, %v; want true", changed, err)
+		}
+		moov, media = readTestMP4(t, filePath)
+		day := moov.child("udta").child(mp4UserDataDay)
+		if day == nil || string(day.data[4:]) != "2019-10-13T17:33:43Z" {
+			t.Errorf("missing %v user data", mp4UserDataDay)
+		}
+		if media != "media" {
+			t.Errorf("moov first %v: shifted chunk offset points to %v; want media", moovFirst, media)
+		}
+
+		changed, err = embedMP4(filePath, created, userData)
+		if err != nil || changed {
+			t.Errorf("embedMP4() = %v, %v; want false once set", changed, err)
+		}
+	}
+}
+
+// testLargeBox an MP4 box with a 64-bit size
+func testLargeBox(typ string, payload ...[]byte) []byte {
+	data := bytes.Join(payload, nil)
+	box := make([]byte, 16)
+	binary.BigEndian.PutUint32(box, 1)
+	copy(box[4:], typ)
+	binary.BigEndian.PutUint64(box[8:], uint64(16+len(data)))
+	return append(box, data...)
+}
+
+func TestEmbedMP4Boxes(t *testing.T) {
+	folder := tempPath()
+	defer os.RemoveAll(folder)
+	created, _ := time.Parse(time.RFC3339, "2019-10-13T17:33:43Z")
+	ftyp := testBox("ftyp", []byte("qt  \x00\x00\x02\x00qt  "))
+	mdat := testBox("mdat", []byte("media"))
+	header := make([]byte, 100)
+	userData := map[string]string{mp4UserDataDay: "2019-10-13T17:33:43Z"}
+
+	t.Run("Terminated User Data", func(t *testing.T) {
+		//QuickTime ends user data with 4 zero bytes
+		udta := testBox("udta", testBox("\xa9mak", mp4UserDataText("Apple")), []byte{0, 0, 0, 0})
+		filePath := filepath.Join(folder, "video.mov")
+		ioutil.WriteFile(filePath, bytes.Join([][]byte{ftyp, mdat, testBox("moov", testBox("mvhd", header), udta)}, nil), 0644)
+
+		changed, err := embedMP4(filePath, created, nil)
+		if err != nil || !changed {
+			t.Fatalf("embedMP4() = %v, %v; want true", changed, err)
+		}
+		changed, err = embedMP4(filePath, created, userData)
+		if err != nil || !changed {
+			t.Fatalf("embedMP4() = %v, %v; want true", changed, err)
+		}
+		data, _ := ioutil.ReadFile(filePath)
+		boxes, err := parseMP4Boxes(data[len(ftyp)+len(mdat):])
+		if err != nil {
+			t.Fatalf("%v", err)
+		}
+		stored := boxes[0].child("udta")
+		if stored == nil || !stored.terminated || stored.child("\xa9mak") == nil || stored.child(mp4UserDataDay) == nil {
+			t.Fatalf("udta = %+v; want the added box before the terminator", stored)
+		}
+		if !bytes.HasSuffix(data, []byte{0, 0, 0, 0}) {
+			t.Errorf("the terminator should be kept")
+		}
+	})
+
+	t.Run("Large Size", func(t *testing.T) {
+		build := func(chunkOffset uint64) []byte {
+			co64 := make([]byte, 16)
+			binary.BigEndian.PutUint32(co64[4:], 1)
+			binary.BigEndian.PutUint64(co64[8:], chunkOffset)
+			return testLargeBox("moov",
+				testBox("mvhd", header),
+				testBox("trak", testBox("mdia", testBox("minf", testBox("stbl", testBox("co64", co64))))))
+		}
+		moov := build(0)
+		filePath := filepath.Join(folder, "video.mp4")
+		ioutil.WriteFile(filePath, bytes.Join([][]byte{ftyp, build(uint64(len(ftyp) + len(moov) + 8)), mdat}, nil), 0644)
+
+		changed, err := embedMP4(filePath, created, userData)
+		if err != nil || !changed {
+			t.Fatalf("embedMP4() = %v, %v; want true", changed, err)
+		}
+		data, _ := ioutil.ReadFile(filePath)
+		if binary.BigEndian.Uint32(data[len(ftyp):]) != 1 {
+			t.Errorf("the movie box should keep its 64-bit size")
+		}
+		boxes, err := parseMP4Boxes(data[len(ftyp):])
+		if err != nil || !boxes[0].largeSize {
+			t.Fatalf("parseMP4Boxes() = %v, %v", boxes, err)
+		}
+		co64 := boxes[0].child("trak").child("mdia").child("minf").child("stbl").child("co64")
+		offset := binary.BigEndian.Uint64(co64.data[8:])
+		if string(data[offset:offset+5]) != "media" {
+			t.Errorf("shifted chunk offset points to %v; want media", string(data[offset:offset+5]))
+		}
+	})
+}
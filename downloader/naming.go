@@ -0,0 +1,377 @@
+package downloader
+
+import (
+	"fmt"
+	"mime"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"time"
+
+	photoslibrary "github.com/gphotosuploader/googlemirror/api/photoslibrary/v1"
+)
+
+const (
+	//NamingPresetLegacy file names based on the creation day and the item id, the default
+	NamingPresetLegacy = "legacy"
+	//NamingPresetFileName file names as uploaded to Google Photos, same as -use-file-name
+	NamingPresetFileName = "filename"
+)
+
+// namingPresets file name templates of the built-in naming modes, the legacy
+// mode has no template since it falls back to hashed folders
+var namingPresets = map[string]string{
+	NamingPresetLegacy:   "",
+	NamingPresetFileName: "{filename}",
+}
+
+// templateField renders a single field of a naming template
+type templateField struct {
+	//numeric fields accept a zero padded width, e.g. {month:02}
+	numeric bool
+	//layout fields require a time layout, e.g. {date:2006-01}
+	layout bool
+	render func(c *templateContext, spec string) string
+}
+
+// templateContext values available while rendering a template
+type templateContext struct {
+	item  *photoslibrary.MediaItem
+	time  time.Time
+	album string
+	//profile used to sanitize names, empty renders names as is
+	profile string
+}
+
+// cameraMake camera make of a photo or a video
+func cameraMake(item *photoslibrary.MediaItem) string {
+	if item.MediaMetadata == nil {
+		return ""
+	}
+	if item.MediaMetadata.Photo != nil {
+		return item.MediaMetadata.Photo.CameraMake
+	}
+	if item.MediaMetadata.Video != nil {
+		return item.MediaMetadata.Video.CameraMake
+	}
+	return ""
+}
+
+// cameraModel camera model of a photo or a video
+func cameraModel(item *photoslibrary.MediaItem) string {
+	if item.MediaMetadata == nil {
+		return ""
+	}
+	if item.MediaMetadata.Photo != nil {
+		return item.MediaMetadata.Photo.CameraModel
+	}
+	if item.MediaMetadata.Video != nil {
+		return item.MediaMetadata.Video.CameraModel
+	}
+	return ""
+}
+
+// mimeExtension file extension based on the mime type, as in legacy names
+func mimeExtension(mimeType string) string {
+	ext, _ := mime.ExtensionsByType(mimeType)
+	if len(ext) > 0 {
+		return ext[0]
+	}
+	return ""
+}
+
+// extensionMimeTypes types of common media extensions, which are missing from
+// some system mime tables
+var extensionMimeTypes = map[string]string{
+	".jpg":  "image/jpeg",
+	".jpeg": "image/jpeg",
+	".png":  "image/png",
+	".gif":  "image/gif",
+	".webp": "image/webp",
+	".heic": "image/heic",
+	".heif": "image/heif",
+	".dng":  "image/x-adobe-dng",
+	".mp4":  "video/mp4",
+	".m4v":  "video/x-m4v",
+	".mov":  "video/quicktime",
+	".3gp":  "video/3gpp",
+	".mkv":  "video/x-matroska",
+	".avi":  "video/x-msvideo",
+}
+
+// mimeTypeByExtension the mime type of a media file by its extension
+func mimeTypeByExtension(name string) string {
+	ext := strings.ToLower(filepath.Ext(name))
+	if mimeType, ok := extensionMimeTypes[ext]; ok {
+		return mimeType
+	}
+	mimeType, _, err := mime.ParseMediaType(mime.TypeByExtension(ext))
+	if err != nil {
+		return "application/octet-stream"
+	}
+	return mimeType
+}
+
+// numberField a numeric template field
+func numberField(value func(c *templateContext) int64) templateField {
+	return templateField{numeric: true, render: func(c *templateContext, spec string) string {
+		return fmt.Sprintf("%"+spec+"d", value(c))
+	}}
+}
+
+// textField a text template field
+func textField(value func(c *templateContext) string) templateField {
+	return templateField{render: func(c *templateContext, spec string) string {
+		return value(c)
+	}}
+}
+
+// templateFields fields available in naming templates
+var templateFields = map[string]templateField{
+	"year":   numberField(func(c *templateContext) int64 { return int64(c.time.Year()) }),
+	"month":  numberField(func(c *templateContext) int64 { return int64(c.time.Month()) }),
+	"day":    numberField(func(c *templateContext) int64 { return int64(c.time.Day()) }),
+	"hour":   numberField(func(c *templateContext) int64 { return int64(c.time.Hour()) }),
+	"minute": numberField(func(c *templateContext) int64 { return int64(c.time.Minute()) }),
+	"second": numberField(func(c *templateContext) int64 { return int64(c.time.Second()) }),
+	"width": numberField(func(c *templateContext) int64 {
+		if c.item.MediaMetadata == nil {
+			return 0
+		}
+		return c.item.MediaMetadata.Width
+	}),
+	"height": numberField(func(c *templateContext) int64 {
+		if c.item.MediaMetadata == nil {
+			return 0
+		}
+		return c.item.MediaMetadata.Height
+	}),
+	"month_name": textField(func(c *templateContext) string { return c.time.Month().String() }),
+	"date": {layout: true, render: func(c *templateContext, spec string) string {
+		return c.time.Format(spec)
+	}},
+	"album":        textField(func(c *templateContext) string { return c.album }),
+	"camera_make":  textField(func(c *templateContext) string { return cameraMake(c.item) }),
+	"camera_model": textField(func(c *templateContext) string { return cameraModel(c.item) }),
+	"filename":     textField(func(c *templateContext) string { return c.item.Filename }),
+	"basename": textField(func(c *templateContext) string {
+		return strings.TrimSuffix(c.item.Filename, filepath.Ext(c.item.Filename))
+	}),
+	"ext": textField(func(c *templateContext) string { return filepath.Ext(c.item.Filename) }),
+	"id":  textField(func(c *templateContext) string { return c.item.Id }),
+	"id8": textField(func(c *templateContext) string {
+		if len(c.item.Id) < 8 {
+			return c.item.Id
+		}
+		return c.item.Id[len(c.item.Id)-8:]
+	}),
+	"mime_ext": textField(func(c *templateContext) string { return mimeExtension(c.item.MimeType) }),
+	"type": textField(func(c *templateContext) string {
+		return strings.SplitN(c.item.MimeType, "/", 2)[0]
+	}),
+}
+
+var templateNumericSpec = regexp.MustCompile(`^0?[1-9]$`)
+
+// templatePart a literal text, or a field with an optional spec
+type templatePart struct {
+	literal string
+	field   string
+	spec    string
+}
+
+// NamingTemplate a compiled naming template such as `{year}/{month:02}`
+type NamingTemplate struct {
+	text  string
+	parts []templatePart
+	//folder templates may contain path separators
+	folder bool
+}
+
+// ParseNamingTemplate compiles and validates a naming template, folder
+// templates may contain path separators, file templates may not
+func ParseNamingTemplate(text string, folder bool) (*NamingTemplate, error) {
+	t := &NamingTemplate{text: text, folder: folder}
+	rest := text
+	for rest != "" {
+		open := strings.IndexAny(rest, "{}")
+		if open < 0 {
+			t.parts = append(t.parts, templatePart{literal: rest})
+			break
+		}
+		if rest[open] == '}' {
+			return nil, fmt.Errorf("template '%v': unexpected '}'", text)
+		}
+		if open > 0 {
+			t.parts = append(t.parts, templatePart{literal: rest[:open]})
+		}
+		end := strings.Index(rest[open:], "}")
+		if end < 0 {
+			return nil, fmt.Errorf("template '%v': missing '}'", text)
+		}
+		part, err := parseTemplateField(rest[open+1 : open+end])
+		if err != nil {
+			return nil, fmt.Errorf("template '%v': %v", text, err)
+		}
+		t.parts = append(t.parts, part)
+		rest = rest[open+end+1:]
+	}
+	if len(t.parts) == 0 {
+		return nil, fmt.Errorf("template is empty")
+	}
+	if !folder {
+		for _, part := range t.parts {
+			if strings.ContainsAny(part.literal, `/\`) {
+				return nil, fmt.Errorf("file name template '%v' can not contain folders, use a folder template", text)
+			}
+		}
+	}
+	return t, nil
+}
+
+// parseTemplateField parses `name` or `name:spec`
+func parseTemplateField(text string) (templatePart, error) {
+	part := templatePart{field: text}
+	index := strings.Index(text, ":")
+	if index >= 0 {
+		part.field = text[:index]
+		part.spec = text[index+1:]
+	}
+	field, ok := templateFields[part.field]
+	if !ok {
+		return part, fmt.Errorf("unknown field '{%v}'", part.field)
+	}
+	switch {
+	case field.layout:
+		if part.spec == "" {
+			return part, fmt.Errorf("field '{%v}' requires a time layout, e.g. {%v:2006-01}", part.field, part.field)
+		}
+	case field.numeric:
+		if part.spec != "" && !templateNumericSpec.MatchString(part.spec) {
+			return part, fmt.Errorf("invalid width '%v' for '{%v}', e.g. {%v:02}", part.spec, part.field, part.field)
+		}
+	default:
+		if part.spec != "" {
+			return part, fmt.Errorf("field '{%v}' does not accept a format", part.field)
+		}
+	}
+	return part, nil
+}
+
+// String returns the template text
+func (t *NamingTemplate) String() string {
+	return t.text
+}
+
+// render Render the template, field values are sanitized so they can not
+// add or escape folders, then every name is sanitized for the context profile
+func (t *NamingTemplate) render(c *templateContext) string {
+	var builder strings.Builder
+	for _, part := range t.parts {
+		if part.field == "" {
+			builder.WriteString(part.literal)
+			continue
+		}
+		value := templateFields[part.field].render(c, part.spec)
+		if c.profile != "" && !(t.folder && templateFields[part.field].layout) {
+			value = strings.Map(func(r rune) rune {
+				if isPathSeparator(r) {
+					return '_'
+				}
+				return r
+			}, value)
+		}
+		builder.WriteString(value)
+	}
+	if !t.folder {
+		return sanitizeName(builder.String(), c.profile)
+	}
+
+	//Sanitize every folder, dropping empty ones (e.g. a missing album)
+	var folders []string
+	for _, folder := range strings.FieldsFunc(builder.String(), isPathSeparator) {
+		folder = sanitizeName(folder, c.profile)
+		if folder != "" {
+			folders = append(folders, folder)
+		}
+	}
+	return filepath.Join(folders...)
+}
+
+// namingTemplates the templates used by the downloader
+type namingTemplates struct {
+	//folder template, nil uses the FolderFormat time layout
+	folder *NamingTemplate
+	//file template, nil uses the legacy naming
+	file *NamingTemplate
+}
+
+// compileTemplates Compile the naming templates from the options, they are
+// kept for the paths of items. DownloadAll and the commands call it first,
+// so the naming options must not change after without calling it again.
+func (d *Downloader) compileTemplates() (*namingTemplates, error) {
+	err := ValidateSanitizeProfile(d.Options.SanitizeProfile)
+	if err != nil {
+		return nil, err
+	}
+	templates := new(namingTemplates)
+	if d.Options.FolderTemplate != "" {
+		templates.folder, err = ParseNamingTemplate(d.Options.FolderTemplate, true)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	fileTemplate := d.Options.FileTemplate
+	if fileTemplate == "" {
+		fileTemplate = NamingPresetLegacy
+		if d.Options.UseFileName {
+			fileTemplate = NamingPresetFileName
+		}
+	}
+	if preset, ok := namingPresets[fileTemplate]; ok {
+		fileTemplate = preset
+	}
+	if fileTemplate != "" {
+		templates.file, err = ParseNamingTemplate(fileTemplate, false)
+		if err != nil {
+			return nil, err
+		}
+	}
+	d.naming = templates
+	return templates, nil
+}
+
+// templates The naming templates last compiled by compileTemplates, those of
+// the default options until it is called
+func (d *Downloader) templates() *namingTemplates {
+	return d.naming
+}
+
+// templateContext the values used to render templates for an item
+func (d *Downloader) templateContext(item *photoslibrary.MediaItem) *templateContext {
+	return &templateContext{item: item, time: d.creationTime(item), album: d.albumTitle, profile: d.sanitizeProfile()}
+}
+
+// creationTime the item creation time in the location used to bucket it by
+// date, the epoch if it can not be parsed
+func (d *Downloader) creationTime(item *photoslibrary.MediaItem) time.Time {
+	if item.MediaMetadata != nil {
+		t, err := time.Parse(time.RFC3339, item.MediaMetadata.CreationTime)
+		if err == nil {
+			return t.In(d.location(item))
+		}
+	}
+	//Default to an epoch if cannot parse time
+	return time.Unix(0, 0).UTC()
+}
+
+// renderFileName Render the file name template for an item
+func (d *Downloader) renderFileName(item *photoslibrary.MediaItem) string {
+	fileName := d.templates().file.render(d.templateContext(item))
+	if strings.TrimSuffix(fileName, filepath.Ext(fileName)) == "" {
+		//Nothing left but an extension, e.g. a missing camera model
+		fileName = item.Id + fileName
+	}
+	return fileName
+}
@@ -0,0 +1,156 @@
+package downloader
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	photoslibrary "github.com/gphotosuploader/googlemirror/api/photoslibrary/v1"
+)
+
+// templateTestItem a photo with all the fields used in templates
+func templateTestItem() *LibraryItem {
+	item := new(LibraryItem)
+	item.Id = "12345678901234567890"
+	item.Filename = "IMG_1234.jpg"
+	item.MimeType = "image/jpeg"
+	item.MediaMetadata = new(photoslibrary.MediaMetadata)
+	item.MediaMetadata.CreationTime = "2019-10-03T07:33:43Z"
+	item.MediaMetadata.Width = 4032
+	item.MediaMetadata.Height = 3024
+	item.MediaMetadata.Photo = &photoslibrary.Photo{CameraMake: "motorola", CameraModel: "Moto G (5) Plus"}
+	return item
+}
+
+func TestParseNamingTemplate(t *testing.T) {
+	valid := []string{"{year}", "{month:02}", "{date:2006-01-02}", "IMG_{id8}{mime_ext}", "{width}x{height}"}
+	for _, text := range valid {
+		_, err := ParseNamingTemplate(text, false)
+		if err != nil {
+			t.Errorf("ParseNamingTemplate(%v) = %v; want valid", text, err)
+		}
+	}
+
+	invalid := []string{"", "{year", "year}", "{unknown}", "{month:x}", "{date}", "{filename:02}", "{year}/{filename}"}
+	for _, text := range invalid {
+		_, err := ParseNamingTemplate(text, false)
+		if err == nil {
+			t.Errorf("ParseNamingTemplate(%v) should fail", text)
+		}
+	}
+
+	_, err := ParseNamingTemplate("{year}/{month:02}", true)
+	if err != nil {
+		t.Errorf("ParseNamingTemplate() = %v; want folders allowed in folder templates", err)
+	}
+}
+
+func TestRenderNamingTemplate(t *testing.T) {
+	item := templateTestItem()
+	context := &templateContext{item: &item.MediaItem, time: NewDownloader().creationTime(&item.MediaItem), album: "Trip / 2019", profile: SanitizePOSIX}
+
+	tests := []struct {
+		template string
+		folder   bool
+		want     string
+	}{
+		{"{year}/{month:02}/{day:02}", true, filepath.Join("2019", "10", "03")},
+		{"{date:2006/January}", true, filepath.Join("2019", "October")},
+		{"{album}/{camera_make}", true, filepath.Join("Trip _ 2019", "motorola")},
+		{"{camera_model}_{width}x{height}_{filename}", false, "Moto G (5) Plus_4032x3024_IMG_1234.jpg"},
+		{"{basename}-{id8}{ext}", false, "IMG_1234-34567890.jpg"},
+		{"{type}_{hour:02}{minute:02}{second:02}", false, "image_073343"},
+	}
+	for _, test := range tests {
+		template, err := ParseNamingTemplate(test.template, test.folder)
+		if err != nil {
+			t.Fatalf("%v", err)
+		}
+		have := template.render(context)
+		if have != test.want {
+			t.Errorf("NamingTemplate.render(%v) = %v; want %v", test.template, have, test.want)
+		}
+	}
+
+	t.Run("Empty Folders", func(t *testing.T) {
+		context := &templateContext{item: &item.MediaItem, time: context.time, profile: SanitizePOSIX}
+		template, _ := ParseNamingTemplate("{year}/{album}/..", true)
+		if have := template.render(context); have != "2019" {
+			t.Errorf("NamingTemplate.render() = %v; want 2019", have)
+		}
+	})
+}
+
+func TestNamingTemplates(t *testing.T) {
+	t.Run("Templates", func(t *testing.T) {
+		downloader := NewDownloader()
+		downloader.Options.BackupFolder = tempPath()
+		defer os.RemoveAll(downloader.Options.BackupFolder)
+		downloader.Options.FolderTemplate = "{year}/{month:02}"
+		downloader.Options.FileTemplate = "{date:20060102}_{id8}{mime_ext}"
+		downloader.compileTemplates()
+
+		item := templateTestItem()
+		item.MimeType = "video/mp4"
+
+		// Extensions can vary by system and will just defer to that for the correct extension
+		ext := mimeExtension(item.MimeType)
+		folder := filepath.Join(downloader.Options.BackupFolder, "2019", "10")
+		if have := downloader.getImageFilePath(item); have != filepath.Join(folder, "20191003_34567890"+ext) {
+			t.Errorf("downloader.getImageFilePath() = %v", have)
+		}
+		if have := downloader.getJSONFilePath(&item.MediaItem); have != filepath.Join(folder, "."+item.Id+".json") {
+			t.Errorf("downloader.getJSONFilePath() = %v", have)
+		}
+		if have := downloader.createFileName(item, 2); have != "20191003_34567890 (2)"+ext {
+			t.Errorf("downloader.createFileName() = %v", have)
+		}
+	})
+
+	t.Run("Presets", func(t *testing.T) {
+		item := templateTestItem()
+		item.MediaMetadata.Photo = nil
+
+		legacy := NewDownloader()
+		legacy.Options.FileTemplate = NamingPresetLegacy
+		legacy.compileTemplates()
+		if have := legacy.createFileName(item, 0); have != "3_34567890"+mimeExtension(item.MimeType) {
+			t.Errorf("downloader.createFileName() = %v with the legacy preset", have)
+		}
+
+		fileName := NewDownloader()
+		fileName.Options.FileTemplate = NamingPresetFileName
+		fileName.compileTemplates()
+		if have := fileName.createFileName(item, 0); have != item.Filename {
+			t.Errorf("downloader.createFileName() = %v with the filename preset", have)
+		}
+
+		//Missing fields do not leave an extension only name
+		missing := NewDownloader()
+		missing.Options.FileTemplate = "{camera_model}{mime_ext}"
+		missing.compileTemplates()
+		if have := missing.createFileName(item, 0); have != item.Id+mimeExtension(item.MimeType) {
+			t.Errorf("downloader.createFileName() = %v with missing fields", have)
+		}
+	})
+
+	t.Run("Compiled", func(t *testing.T) {
+		downloader := NewDownloader()
+		downloader.Options.FileTemplate = "{id8}{mime_ext}"
+		compiled, err := downloader.compileTemplates()
+		if err != nil {
+			t.Fatalf("%v", err)
+		}
+		if downloader.templates() != compiled {
+			t.Errorf("templates() should return the compiled templates")
+		}
+		downloader.Options.FileTemplate = "{unknown}"
+		_, err = downloader.compileTemplates()
+		if err == nil {
+			t.Errorf("compileTemplates() should fail for unknown fields")
+		}
+		if downloader.templates() != compiled {
+			t.Errorf("templates() should keep the templates compiled last")
+		}
+	})
+}
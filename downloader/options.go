@@ -5,12 +5,42 @@ package downloader
 type Options struct {
 	//BackupFolderis the backup folder
 	BackupFolder string
+	//SSHKey private key for sftp:// backup folders, default the keys in ~/.ssh and the ssh agent
+	SSHKey string
+	//KnownHosts known_hosts file checking the host keys of sftp:// servers, default ~/.ssh/known_hosts
+	KnownHosts string
+	//Encrypt encrypt the stored files: age or aes-gcm, empty stores them as is
+	Encrypt string
+	//EncryptKey age identity file, which may be encrypted with a passphrase, or AES-GCM key file
+	EncryptKey string
+	//EncryptTo file of additional age recipients the stored files are encrypted to
+	EncryptTo string
 	//FolderFormat time format used to format folder structure
 	FolderFormat string
+	//FolderTemplate naming template for folders, e.g. `{year}/{month:02}`, replaces FolderFormat
+	FolderTemplate string
 	//UseFileName use file name when uploaded to Google Photos
 	UseFileName bool
+	//FileTemplate naming template for files, e.g. `{day}_{id8}{mime_ext}`, or a preset: legacy, filename
+	FileTemplate string
+	//TimeZone IANA time zone (or Local) used to bucket items by date, default is UTC
+	TimeZone string
+	//TimeZoneFromEXIF bucket photos by the capture-local UTC offset in their EXIF data, when available
+	TimeZoneFromEXIF bool
+	//SanitizeProfile how file and folder names are sanitized: posix, windows or portable (default depends on the OS)
+	SanitizeProfile string
 	//OriginalFiles retain EXIF metadata on downloaded images. Location information is not included.
 	IncludeEXIF bool
+	//EmbedVideoTags with EmbedMetadata, also add creation date and description user data to videos, which may rewrite the whole file
+	EmbedVideoTags bool
+	//WriteXMP write an XMP sidecar next to each media file, for photo managers such as Lightroom, digiKam and darktable
+	WriteXMP bool
+	//Checksums keep a SHA256SUMS manifest of the media files in every folder
+	Checksums bool
+	//ChecksumsKey signify secret key signing the SHA256SUMS manifests
+	ChecksumsKey string
+	//EmbedMetadata write the creation date, description, camera and Google Photos id into downloaded photos when missing, and the creation time into videos
+	EmbedMetadata bool
 	//MaxItems how many items to download
 	MaxItems int
 	//number of items to download on per API call
@@ -19,8 +49,34 @@ type Options struct {
 	Throttle int
 	//DownloadThrottle is the rate to limit downloading of items (KB/sec)
 	DownloadThrottle float64
+	//BandwidthSchedule time-of-day download rate limits shared by all downloads, e.g. `Mon-Fri 08:00-18:00=200KB, *=unlimited`
+	BandwidthSchedule string
+	//MinFreeSpace size to leave free on the volume of a local backup folder, e.g. `1GB`, downloads pause below it. Empty only checks downloads fit
+	MinFreeSpace string
+	//MaxArchiveSize size the media files of the backup folder may take, e.g. `500GB`, empty is unlimited
+	MaxArchiveSize string
 	//ConcurrentDownloads is the number of downloads that can happen at once
 	ConcurrentDownloads int
+	//Dedupe what to do with items identical to stored ones: hardlink, reflink or alias, empty keeps copies
+	Dedupe string
+	//AdoptFolder folder of existing copies, such as another tool's backup, matching items are taken from it instead of downloaded
+	AdoptFolder string
+	//AdoptMode how adopted files are put in the backup folder: copy, move, hardlink or reflink
+	AdoptMode string
+	//AdoptHash hash the files of AdoptFolder, so matching files with different content are told apart
+	AdoptHash bool
+	//DeletedPolicy what to do with items deleted from Google Photos: keep, trash or mark
+	DeletedPolicy string
+	//TrashRetentionDays days to keep trashed items before removing them, 0 keeps them forever
+	TrashRetentionDays int
+	//KeepMetadataHistory keep previous versions of changed metadata in the JSON file
+	KeepMetadataHistory bool
+	//Pack pack the files of finished folders into an archive per folder: tar or zip, empty keeps loose files
+	Pack string
+	//PackAfterDays days after the newest item of a folder was created before it is packed
+	PackAfterDays int
+	//DeferredRetryDelay minutes to wait before fetching again videos which are still processing
+	DeferredRetryDelay int
 	//Google photos AlbumID
 	AlbumID string
 	//CredentialsFile Google API credentials.json file
@@ -0,0 +1,532 @@
+package downloader
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	photoslibrary "github.com/gphotosuploader/googlemirror/api/photoslibrary/v1"
+)
+
+const (
+	//PackTar pack finished folders into tar archives
+	PackTar = "tar"
+	//PackZip pack finished folders into zip archives, without compression
+	PackZip = "zip"
+)
+
+// packIndexFileName index of the packed files of a folder
+const packIndexFileName = ".gitmoo-pack.json"
+
+// packSegmentPrefix name prefix of the archives of a folder
+const packSegmentPrefix = "pack-"
+
+// packSegment an archive of a folder
+type packSegment struct {
+	Name   string
+	SHA256 string
+	Size   int64
+}
+
+// packedFile where the content of a packed file is in its archive
+type packedFile struct {
+	//Segment index of the archive in the segments of the folder
+	Segment int
+	//Offset of the content in the archive, which is stored without compression
+	Offset  int64
+	Size    int64
+	SHA256  string
+	ModTime time.Time
+}
+
+// packIndex the packed files of a folder. The first archive holds the files
+// of the folder when it was packed, later ones hold items added or updated
+// after. The sidecars are also kept in the index, so the catalog is loaded
+// without reading the archives.
+type packIndex struct {
+	//Format tar or zip, the same for all archives of a folder
+	Format   string
+	Segments []*packSegment
+	//Files the latest copy of every packed file, by name
+	Files map[string]*packedFile
+	//Sidecars the packed sidecars, by name
+	Sidecars map[string]*LibraryItem
+	//folder holding the index and the archives
+	folder string
+}
+
+// ValidatePackFormat returns an error for unknown archive formats
+func ValidatePackFormat(format string) error {
+	switch format {
+	case "", PackTar, PackZip:
+		return nil
+	}
+	return fmt.Errorf("unknown pack format '%v', use %v or %v", format, PackTar, PackZip)
+}
+
+// isPackFile returns true for the archives and the index of a packed folder
+func isPackFile(name string) bool {
+	if name == packIndexFileName {
+		return true
+	}
+	ext := filepath.Ext(name)
+	return strings.HasPrefix(name, packSegmentPrefix) && (ext == "."+PackTar || ext == "."+PackZip)
+}
+
+// loadPackIndex Load the index of a folder, returns nil if the folder is not
+// packed
+func (d *Downloader) loadPackIndex(folder string) (*packIndex, error) {
+	data, err := readStorageFile(d.storage, filepath.Join(folder, packIndexFileName))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	index := new(packIndex)
+	err = json.Unmarshal(data, index)
+	if err != nil {
+		return nil, fmt.Errorf("failed reading pack index of '%v': %v", folder, err)
+	}
+	if index.Files == nil {
+		index.Files = make(map[string]*packedFile)
+	}
+	if index.Sidecars == nil {
+		index.Sidecars = make(map[string]*LibraryItem)
+	}
+	index.folder = folder
+	return index, nil
+}
+
+// savePackIndex Write the index of a folder
+func (d *Downloader) savePackIndex(index *packIndex) error {
+	data, err := json.MarshalIndent(index, "", "  ")
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(d.storage, filepath.Join(index.folder, packIndexFileName), data)
+}
+
+// segmentPath path of an archive of the index
+func (p *packIndex) segmentPath(segment int) string {
+	return filepath.Join(p.folder, p.Segments[segment].Name)
+}
+
+// openPacked Open the content of a packed file
+func (d *Downloader) openPacked(index *packIndex, name string) (io.ReadCloser, error) {
+	packed := index.Files[name]
+	if packed == nil {
+		return nil, &os.PathError{Op: "open", Path: filepath.Join(index.folder, name), Err: os.ErrNotExist}
+	}
+	reader, err := d.storage.Open(index.segmentPath(packed.Segment))
+	if err != nil {
+		return nil, err
+	}
+	if seeker, ok := reader.(io.Seeker); ok {
+		_, err = seeker.Seek(packed.Offset, io.SeekStart)
+	} else {
+		_, err = io.CopyN(ioutil.Discard, reader, packed.Offset)
+	}
+	if err != nil {
+		reader.Close()
+		return nil, err
+	}
+	return struct {
+		io.Reader
+		io.Closer
+	}{io.LimitReader(reader, packed.Size), reader}, nil
+}
+
+// isPackedPath returns true if a file of a packed folder is in its archives,
+// so new items do not take its name
+func (d *Downloader) isPackedPath(filePath string) bool {
+	index := d.packs[filepath.Dir(filePath)]
+	if index == nil {
+		return false
+	}
+	name := filepath.Base(filePath)
+	if index.Files[name] != nil {
+		return true
+	}
+	if !isCaseInsensitive(d.sanitizeProfile()) {
+		return false
+	}
+	for packed := range index.Files {
+		if strings.EqualFold(packed, name) {
+			return true
+		}
+	}
+	return false
+}
+
+// countingWriter counts the bytes written, for the offsets of packed files
+type countingWriter struct {
+	io.Writer
+	count int64
+}
+
+func (w *countingWriter) Write(data []byte) (int, error) {
+	n, err := w.Writer.Write(data)
+	w.count += int64(n)
+	return n, err
+}
+
+// packFiles Write the loose files of a folder to a new archive, the files
+// are recorded in the index but not removed
+func (d *Downloader) packFiles(index *packIndex, names []string) error {
+	segment := &packSegment{Name: fmt.Sprintf("%v%03d.%v", packSegmentPrefix, len(index.Segments)+1, index.Format)}
+	segmentPath := filepath.Join(index.folder, segment.Name)
+	output, err := d.storage.Create(segmentPath, time.Time{})
+	if err != nil {
+		return err
+	}
+	hasher := sha256.New()
+	counter := &countingWriter{Writer: io.MultiWriter(output, hasher)}
+	var tarWriter *tar.Writer
+	var zipWriter *zip.Writer
+	if index.Format == PackZip {
+		zipWriter = zip.NewWriter(counter)
+	} else {
+		tarWriter = tar.NewWriter(counter)
+	}
+
+	packed := make(map[string]*packedFile)
+	for _, name := range names {
+		filePath := filepath.Join(index.folder, name)
+		info, err := d.storage.Stat(filePath)
+		if err != nil {
+			output.Abort()
+			return err
+		}
+		var w io.Writer
+		if zipWriter != nil {
+			w, err = zipWriter.CreateHeader(&zip.FileHeader{Name: name, Method: zip.Store, Modified: info.ModTime()})
+			if err == nil {
+				//The zip writer buffers its output
+				err = zipWriter.Flush()
+			}
+		} else {
+			err = tarWriter.WriteHeader(&tar.Header{Typeflag: tar.TypeReg, Name: name, Mode: 0644, Size: info.Size(), ModTime: info.ModTime()})
+			w = tarWriter
+		}
+		if err != nil {
+			output.Abort()
+			return err
+		}
+		file := &packedFile{Segment: len(index.Segments), Offset: counter.count, ModTime: info.ModTime()}
+		input, err := d.storage.Open(filePath)
+		if err != nil {
+			output.Abort()
+			return err
+		}
+		fileHasher := sha256.New()
+		file.Size, err = io.Copy(io.MultiWriter(w, fileHasher), input)
+		input.Close()
+		if err == nil && zipWriter != nil {
+			err = zipWriter.Flush()
+		}
+		if err != nil {
+			output.Abort()
+			return err
+		}
+		file.SHA256 = hex.EncodeToString(fileHasher.Sum(nil))
+		packed[name] = file
+	}
+	if zipWriter != nil {
+		err = zipWriter.Close()
+	} else {
+		err = tarWriter.Close()
+	}
+	if err != nil {
+		output.Abort()
+		return err
+	}
+	err = output.Close()
+	if err != nil {
+		return err
+	}
+	segment.SHA256 = hex.EncodeToString(hasher.Sum(nil))
+	segment.Size = counter.count
+	index.Segments = append(index.Segments, segment)
+	for name, file := range packed {
+		index.Files[name] = file
+	}
+	return d.setChecksum(segmentPath, segment.SHA256)
+}
+
+// isFinishedFolder returns true when the items of a folder were all created
+// more than PackAfterDays ago, so no new items are expected
+func (d *Downloader) isFinishedFolder(entries []*catalogEntry, now time.Time) bool {
+	cutoff := now.AddDate(0, 0, -d.Options.PackAfterDays)
+	for _, entry := range entries {
+		created, err := time.Parse(time.RFC3339, entry.Item.MediaMetadata.CreationTime)
+		if err != nil || created.After(cutoff) {
+			return false
+		}
+	}
+	return true
+}
+
+// packFolder Pack the loose files of the items of a folder into a new
+// archive, and remove them
+func (d *Downloader) packFolder(folder string, index *packIndex, entries []*catalogEntry) error {
+	items := make(map[string]*LibraryItem)
+	var names []string
+	for _, entry := range entries {
+		files := []string{entry.JSONFilePath}
+		if entry.Item.AliasOf == "" {
+			files = append(files, entry.MediaFilePath(), xmpFilePath(entry.MediaFilePath()))
+		}
+		for _, filePath := range files {
+			_, err := d.storage.Stat(filePath)
+			if os.IsNotExist(err) {
+				continue
+			}
+			if err != nil {
+				return err
+			}
+			names = append(names, filepath.Base(filePath))
+		}
+		items[filepath.Base(entry.JSONFilePath)] = entry.Item
+	}
+	if len(names) == 0 {
+		return nil
+	}
+	sort.Strings(names)
+	if index == nil {
+		index = &packIndex{
+			Format:   d.Options.Pack,
+			Files:    make(map[string]*packedFile),
+			Sidecars: make(map[string]*LibraryItem),
+			folder:   folder,
+		}
+	}
+	log.Printf("Packing %v files of '%v'", len(names), folder)
+	err := d.packFiles(index, names)
+	if err != nil {
+		return err
+	}
+	for _, name := range names {
+		if item := items[name]; item != nil {
+			index.Sidecars[name] = item
+		}
+	}
+	//The index is saved before removing the files, so an interruption leaves
+	//copies rather than losing files
+	err = d.savePackIndex(index)
+	if err != nil {
+		return err
+	}
+	for _, name := range names {
+		filePath := filepath.Join(folder, name)
+		err = d.setChecksum(filePath, "")
+		if err != nil {
+			return err
+		}
+		err = d.storage.Remove(filePath)
+		if err != nil {
+			return err
+		}
+	}
+	d.packs[folder] = index
+	return nil
+}
+
+// Pack Pack the loose files of finished folders (whose items were all created
+// more than PackAfterDays ago) into an archive per folder. Items added to or
+// updated in a packed folder later are packed into another archive of the
+// folder.
+func (d *Downloader) Pack() error {
+	if d.Options.Pack == "" {
+		return fmt.Errorf("pack needs -pack %v or %v", PackTar, PackZip)
+	}
+	err := ValidatePackFormat(d.Options.Pack)
+	if err != nil {
+		return err
+	}
+	_, err = d.compileTemplates()
+	if err != nil {
+		return err
+	}
+	catalog, err := d.loadCatalog()
+	if err != nil {
+		return err
+	}
+	folders := make(map[string][]*catalogEntry)
+	for _, entry := range catalog.items {
+		folder := filepath.Dir(entry.JSONFilePath)
+		folders[folder] = append(folders[folder], entry)
+	}
+	names := make([]string, 0, len(folders))
+	for folder := range folders {
+		names = append(names, folder)
+	}
+	sort.Strings(names)
+	now := time.Now()
+	for _, folder := range names {
+		if !d.isFinishedFolder(folders[folder], now) {
+			continue
+		}
+		err = d.packFolder(folder, d.packs[folder], folders[folder])
+		if err != nil {
+			return fmt.Errorf("failed packing '%v': %v", folder, err)
+		}
+	}
+	return d.flushChecksums()
+}
+
+// refreshPacked Update the sidecar of an item whose media file is packed,
+// the updated sidecar is written as a loose file until packed again
+func (d *Downloader) refreshPacked(entry *catalogEntry, item *photoslibrary.MediaItem) error {
+	libraryItem := entry.Item
+	changed := d.refreshMetadata(libraryItem, item)
+	if libraryItem.DeletedUpstream != "" {
+		log.Printf("'%v' [id %v] is back in Google Photos", item.Filename, item.Id)
+		libraryItem.DeletedUpstream = ""
+		changed = true
+	}
+	if libraryItem.addAlbum(d.albumTitle) {
+		changed = true
+	}
+	if changed {
+		err := d.writeJSON(libraryItem, entry.JSONFilePath)
+		if err != nil {
+			return err
+		}
+		err = d.writeXMP(libraryItem, true)
+		if err != nil {
+			return err
+		}
+	}
+	log.Printf("Skipping '%v' [packed in '%v']", item.Filename, filepath.Dir(entry.JSONFilePath))
+	d.stats.UpdateStatsSkipped(1)
+	return nil
+}
+
+// openBackupFile Open a file of the backup folder, from the archives of its
+// folder when it is packed. Returns the modification time of the file.
+func (d *Downloader) openBackupFile(filePath string) (io.ReadCloser, time.Time, error) {
+	info, err := d.storage.Stat(filePath)
+	if err == nil {
+		reader, err := d.storage.Open(filePath)
+		return reader, info.ModTime(), err
+	}
+	index := d.packs[filepath.Dir(filePath)]
+	if !os.IsNotExist(err) || index == nil || index.Files[filepath.Base(filePath)] == nil {
+		return nil, time.Time{}, err
+	}
+	reader, err := d.openPacked(index, filepath.Base(filePath))
+	return reader, index.Files[filepath.Base(filePath)].ModTime, err
+}
+
+// restoreFile Copy a file of the backup folder to the restored tree, keeping
+// its modification time. The copy is checked against hash unless empty.
+func (d *Downloader) restoreFile(filePath string, target string, hash string) error {
+	reader, modTime, err := d.openBackupFile(filePath)
+	if err != nil {
+		return err
+	}
+	defer reader.Close()
+	err = os.MkdirAll(filepath.Dir(target), 0700)
+	if err != nil {
+		return err
+	}
+	output, err := localStorage{}.Create(target, modTime)
+	if err != nil {
+		return err
+	}
+	hasher := sha256.New()
+	_, err = io.Copy(io.MultiWriter(output, hasher), reader)
+	if err == nil && hash != "" && hex.EncodeToString(hasher.Sum(nil)) != hash {
+		err = fmt.Errorf("content differs from the recorded hash %v", hash)
+	}
+	if err != nil {
+		output.Abort()
+		return err
+	}
+	return output.Close()
+}
+
+// Restore Write the items of the backup folder to target as a clean tree of
+// loose, decrypted files, the sidecar, media file and XMP sidecar of every
+// item are taken from the backup folder or from the archives of packed
+// folders. Media files are checked against their recorded hashes, aliases get
+// a copy of the content of the item holding it.
+func (d *Downloader) Restore(target string) error {
+	_, err := d.compileTemplates()
+	if err != nil {
+		return err
+	}
+	catalog, err := d.loadCatalog()
+	if err != nil {
+		return err
+	}
+	ids := make([]string, 0, len(catalog.items))
+	for id := range catalog.items {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+
+	var restored, failed int
+	for _, id := range ids {
+		entry := catalog.items[id]
+		relative, err := filepath.Rel(d.Options.BackupFolder, entry.JSONFilePath)
+		if err != nil {
+			return err
+		}
+		folder := filepath.Join(target, filepath.Dir(relative))
+		//Aliases get a copy of the content of the item holding it
+		item := *entry.Item
+		source := entry
+		if item.AliasOf != "" {
+			source = catalog.items[item.AliasOf]
+			if source == nil || source.Item.AliasOf != "" {
+				log.Printf("Failed to restore '%v' [id %v]: alias of missing item %v", item.Filename, id, item.AliasOf)
+				failed++
+				continue
+			}
+			item.AliasOf = ""
+			item.Size = source.Item.Size
+			item.FileSHA256 = source.Item.FileSHA256
+		}
+		data, err := item.MarshalJSON()
+		if err != nil {
+			return err
+		}
+		err = writeStorageFile(localStorage{}, filepath.Join(target, relative), data)
+		if err != nil {
+			return err
+		}
+		mediaFilePath := source.MediaFilePath()
+		err = d.restoreFile(mediaFilePath, filepath.Join(folder, item.UsedFileName), source.Item.storedSHA256())
+		if err != nil {
+			log.Printf("Failed to restore '%v': %v", mediaFilePath, err)
+			failed++
+			continue
+		}
+		xmpPath := xmpFilePath(entry.MediaFilePath())
+		err = d.restoreFile(xmpPath, xmpFilePath(filepath.Join(folder, item.UsedFileName)), "")
+		if err != nil && !os.IsNotExist(err) {
+			log.Printf("Failed to restore '%v': %v", xmpPath, err)
+			failed++
+			continue
+		}
+		restored++
+	}
+	log.Printf("Restored %v items to '%v', %v failed", restored, target, failed)
+	if failed > 0 {
+		return fmt.Errorf("failed restoring %v items", failed)
+	}
+	return nil
+}
@@ -0,0 +1,219 @@
+package downloader
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"encoding/json"
+	"image/jpeg"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"testing"
+	"time"
+)
+
+// readTestArchive Read the files of a tar or zip archive
+func readTestArchive(t *testing.T, filePath string) map[string][]byte {
+	files := make(map[string][]byte)
+	if filepath.Ext(filePath) == "."+PackZip {
+		archive, err := zip.OpenReader(filePath)
+		if err != nil {
+			t.Fatalf("%v", err)
+		}
+		defer archive.Close()
+		for _, file := range archive.File {
+			reader, err := file.Open()
+			if err != nil {
+				t.Fatalf("%v", err)
+			}
+			files[file.Name], err = ioutil.ReadAll(reader)
+			reader.Close()
+			if err != nil {
+				t.Fatalf("%v", err)
+			}
+		}
+		return files
+	}
+	file, err := os.Open(filePath)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	defer file.Close()
+	archive := tar.NewReader(file)
+	for {
+		header, err := archive.Next()
+		if err == io.EOF {
+			return files
+		}
+		if err != nil {
+			t.Fatalf("%v", err)
+		}
+		files[header.Name], _ = ioutil.ReadAll(archive)
+	}
+}
+
+// folderNames names of the files of a folder
+func folderNames(folder string) []string {
+	files, _ := ioutil.ReadDir(folder)
+	var names []string
+	for _, file := range files {
+		names = append(names, file.Name())
+	}
+	sort.Strings(names)
+	return names
+}
+
+func TestPack(t *testing.T) {
+	for _, format := range []string{PackTar, PackZip} {
+		t.Run(format, func(t *testing.T) {
+			downloader := NewDownloader()
+			downloader.Options.BackupFolder = tempPath()
+			defer os.RemoveAll(downloader.Options.BackupFolder)
+			downloader.Options.Pack = format
+			downloader.Options.PackAfterDays = 31
+			downloader.Options.Checksums = true
+			downloader.Options.WriteXMP = true
+
+			encoded := new(bytes.Buffer)
+			jpeg.Encode(encoded, testImage(64, 48, false), nil)
+			store := func(id string, created time.Time) *LibraryItem {
+				item := adoptTestItem(id, id+".jpg")
+				item.MediaMetadata.CreationTime = created.Format(time.RFC3339)
+				item.UsedFileName = downloader.createFileName(item, 0)
+				filePath := downloader.getImageFilePath(item)
+				os.MkdirAll(filepath.Dir(filePath), 0700)
+				ioutil.WriteFile(filePath, encoded.Bytes(), 0644)
+				os.Chtimes(filePath, created, created)
+				item.SHA256, _ = hashFile(filePath)
+				downloader.updateSize(item, filePath)
+				downloader.writeJSON(item, downloader.getJSONFilePath(&item.MediaItem))
+				downloader.writeXMP(item, true)
+				downloader.updateChecksum(item, filePath)
+				return item
+			}
+			october := time.Date(2019, 10, 13, 17, 33, 43, 0, time.UTC)
+			first := store("ABCDEFGHIJKLMNOPQRSTUVW1", october)
+			store("ABCDEFGHIJKLMNOPQRSTUVW2", october.Add(time.Hour))
+			recent := store("ABCDEFGHIJKLMNOPQRSTUVW3", time.Now().UTC().Add(-time.Hour))
+			packedFolder := filepath.Dir(downloader.getImageFilePath(first))
+			recentFolder := filepath.Dir(downloader.getImageFilePath(recent))
+
+			err := downloader.Pack()
+			if err != nil {
+				t.Fatalf("%v", err)
+			}
+			want := []string{packIndexFileName, checksumsFileName, "pack-001." + format}
+			if names := folderNames(packedFolder); len(names) != 3 || names[0] != want[0] || names[1] != want[1] || names[2] != want[2] {
+				t.Errorf("packed folder = %v; want %v", names, want)
+			}
+			if names := folderNames(recentFolder); len(names) != 4 {
+				t.Errorf("recent folder should not be packed, got %v", names)
+			}
+			manifest, _ := ioutil.ReadFile(filepath.Join(packedFolder, checksumsFileName))
+			checksums := parseChecksums(manifest)
+			if len(checksums) != 1 || checksums["pack-001."+format] == "" {
+				t.Errorf("%v = %q; want the archive", checksumsFileName, manifest)
+			}
+			files := readTestArchive(t, filepath.Join(packedFolder, "pack-001."+format))
+			if len(files) != 6 || !bytes.Equal(files[first.UsedFileName], encoded.Bytes()) {
+				t.Errorf("archive holds %v files; want the 6 files of the items", len(files))
+			}
+
+			//Packed items are known to the catalog, and their names are taken
+			catalog, err := downloader.loadCatalog()
+			if err != nil {
+				t.Fatalf("%v", err)
+			}
+			entry := catalog.items[first.Id]
+			if entry == nil || !entry.isPacked() || catalog.items[recent.Id].isPacked() {
+				t.Fatalf("catalog = %v; want the October items packed", catalog.items)
+			}
+			next := adoptTestItem("XBCDEFGHIJKLMNOPQRSTUVW1", "next.jpg")
+			next.UsedFileName = first.UsedFileName
+			if !downloader.isConflictingFilePath(next) {
+				t.Errorf("packed file names should conflict")
+			}
+			reader, err := downloader.openPacked(entry.pack, first.UsedFileName)
+			if err != nil {
+				t.Fatalf("%v", err)
+			}
+			data, _ := ioutil.ReadAll(reader)
+			reader.Close()
+			if !bytes.Equal(data, encoded.Bytes()) {
+				t.Errorf("openPacked() read %v bytes; want %v", len(data), encoded.Len())
+			}
+
+			//Updated sidecars and new items go into the next archive
+			listed := first.MediaItem
+			listed.Description = "updated"
+			err = downloader.refreshPacked(entry, &listed)
+			if err != nil {
+				t.Fatalf("%v", err)
+			}
+			stored, _ := loadSidecar(downloader.storage, entry.JSONFilePath)
+			if stored == nil || stored.Description != "updated" {
+				t.Errorf("refreshPacked() should write the updated sidecar, got %v", stored)
+			}
+			added := store("ABCDEFGHIJKLMNOPQRSTUVW4", october.Add(2*time.Hour))
+			err = downloader.Pack()
+			if err != nil {
+				t.Fatalf("%v", err)
+			}
+			files = readTestArchive(t, filepath.Join(packedFolder, "pack-002."+format))
+			if len(files) != 5 || files[added.UsedFileName] == nil {
+				t.Errorf("second archive holds %v files; want the 3 files of the new item and 2 updated", len(files))
+			}
+			catalog, _ = downloader.loadCatalog()
+			if catalog.items[first.Id].Item.Description != "updated" || !catalog.items[added.Id].isPacked() {
+				t.Errorf("catalog should hold the latest sidecars of packed items")
+			}
+
+			//Restored trees hold loose files with their modification times
+			target := tempPath()
+			defer os.RemoveAll(target)
+			err = downloader.Restore(target)
+			if err != nil {
+				t.Fatalf("%v", err)
+			}
+			relative, _ := filepath.Rel(downloader.Options.BackupFolder, downloader.getImageFilePath(first))
+			restored := filepath.Join(target, relative)
+			data, _ = ioutil.ReadFile(restored)
+			info, err := os.Stat(restored)
+			if err != nil || !bytes.Equal(data, encoded.Bytes()) || !info.ModTime().Equal(october) {
+				t.Errorf("restored media = %v bytes, %v; want %v bytes at %v", len(data), err, encoded.Len(), october)
+			}
+			var item LibraryItem
+			data, _ = ioutil.ReadFile(filepath.Join(target, relative[:len(relative)-len(filepath.Ext(relative))]+".json"))
+			if json.Unmarshal(data, &item) != nil || item.Description != "updated" {
+				t.Errorf("restored sidecar = %q", data)
+			}
+			if names := folderNames(filepath.Dir(restored)); len(names) != 9 {
+				t.Errorf("restored folder = %v; want the 9 files of the items", names)
+			}
+
+			//Verify reads packed files from their archives
+			segment := filepath.Join(packedFolder, "pack-001."+format)
+			archive, _ := ioutil.ReadFile(segment)
+			packed := catalog.items[first.Id].pack.Files[first.UsedFileName]
+			archive[packed.Offset+packed.Size/2] ^= 0xff
+			ioutil.WriteFile(segment, archive, 0644)
+			output := new(bytes.Buffer)
+			err = downloader.Verify(output, true)
+			if err != nil {
+				t.Fatalf("%v", err)
+			}
+			var report VerifyReport
+			json.Unmarshal(output.Bytes(), &report)
+			if report.Checked != 4 || len(report.Problems) != 1 || report.Problems[0].ID != first.Id || report.Problems[0].Problem != VerifyHash {
+				t.Errorf("report = %v", output.String())
+			}
+			catalog, _ = downloader.loadCatalog()
+			if catalog.items[first.Id].isPacked() {
+				t.Errorf("repaired items should be downloaded again as loose files")
+			}
+		})
+	}
+}
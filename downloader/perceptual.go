@@ -0,0 +1,156 @@
+package downloader
+
+import (
+	"fmt"
+	"image"
+	//Decoders for perceptual hashes
+	_ "image/jpeg"
+	_ "image/png"
+	"math/bits"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// perceptualGridSize the size of the grayscale grid images are shrunk to, the
+// hash compares horizontally adjacent cells of the first 8 rows
+const perceptualGridSize = 9
+
+// perceptualSamples samples taken per grid cell along each axis
+const perceptualSamples = 16
+
+// hasPerceptualHash returns true for the mime types perceptual hashes are
+// computed for
+func hasPerceptualHash(mimeType string) bool {
+	mimeType = strings.ToLower(mimeType)
+	return mimeType == "image/jpeg" || mimeType == "image/png"
+}
+
+// shrinkGray Shrink an image to a grid of average luminance values
+func shrinkGray(img image.Image, size int) [][]float64 {
+	bounds := img.Bounds()
+	stepX := bounds.Dx()/(size*perceptualSamples) + 1
+	stepY := bounds.Dy()/(size*perceptualSamples) + 1
+	ycbcr, isYCbCr := img.(*image.YCbCr)
+
+	sums := make([]float64, size*size)
+	counts := make([]float64, size*size)
+	for y := bounds.Min.Y; y < bounds.Max.Y; y += stepY {
+		row := (y - bounds.Min.Y) * size / bounds.Dy()
+		for x := bounds.Min.X; x < bounds.Max.X; x += stepX {
+			column := (x - bounds.Min.X) * size / bounds.Dx()
+			var luminance float64
+			if isYCbCr {
+				luminance = float64(ycbcr.Y[ycbcr.YOffset(x, y)])
+			} else {
+				r, g, b, _ := img.At(x, y).RGBA()
+				luminance = (0.299*float64(r) + 0.587*float64(g) + 0.114*float64(b)) / 257
+			}
+			sums[row*size+column] += luminance
+			counts[row*size+column]++
+		}
+	}
+
+	grid := make([][]float64, size)
+	for row := range grid {
+		grid[row] = make([]float64, size)
+		for column := range grid[row] {
+			if counts[row*size+column] > 0 {
+				grid[row][column] = sums[row*size+column] / counts[row*size+column]
+			}
+		}
+	}
+	return grid
+}
+
+// orientGrid Turn a grid as stored into the grid as displayed, following an
+// EXIF orientation
+func orientGrid(grid [][]float64, orientation int) [][]float64 {
+	size := len(grid)
+	last := size - 1
+	oriented := make([][]float64, size)
+	for y := range oriented {
+		oriented[y] = make([]float64, size)
+		for x := range oriented[y] {
+			sx, sy := x, y
+			switch orientation {
+			case 2:
+				sx = last - x
+			case 3:
+				sx, sy = last-x, last-y
+			case 4:
+				sy = last - y
+			case 5:
+				sx, sy = y, x
+			case 6:
+				sx, sy = y, last-x
+			case 7:
+				sx, sy = last-y, last-x
+			case 8:
+				sx, sy = last-y, x
+			}
+			oriented[y][x] = grid[sy][sx]
+		}
+	}
+	return oriented
+}
+
+// dHash Difference hash of an image, each bit tells if a cell is darker than
+// the cell on its right
+func dHash(img image.Image, orientation int) uint64 {
+	grid := orientGrid(shrinkGray(img, perceptualGridSize), orientation)
+	var hash uint64
+	for y := 0; y < perceptualGridSize-1; y++ {
+		for x := 0; x < perceptualGridSize-1; x++ {
+			hash <<= 1
+			if grid[y][x] < grid[y][x+1] {
+				hash |= 1
+			}
+		}
+	}
+	return hash
+}
+
+// perceptualHashFile Perceptual hash of a JPEG or PNG file, hex encoded
+func perceptualHashFile(filePath string) (string, error) {
+	file, err := os.Open(filePath)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+	img, _, err := image.Decode(file)
+	if err != nil {
+		return "", err
+	}
+
+	//Originals keep the orientation in EXIF, resized copies are rotated
+	orientation := 1
+	_, err = file.Seek(0, 0)
+	if err != nil {
+		return "", err
+	}
+	x, err := readEXIF(file)
+	if err == nil {
+		orientation = x.orientation()
+	}
+	return formatPerceptualHash(dHash(img, orientation)), nil
+}
+
+// formatPerceptualHash hex encode a perceptual hash
+func formatPerceptualHash(hash uint64) string {
+	return fmt.Sprintf("%016x", hash)
+}
+
+// perceptualDistance Hamming distance between two hex encoded perceptual
+// hashes
+func perceptualDistance(a string, b string) (int, error) {
+	x, err := strconv.ParseUint(a, 16, 64)
+	if err != nil {
+		return 0, err
+	}
+	y, err := strconv.ParseUint(b, 16, 64)
+	if err != nil {
+		return 0, err
+	}
+	return bits.OnesCount64(x ^ y), nil
+}
@@ -0,0 +1,169 @@
+package downloader
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"image/png"
+	"math"
+	"math/rand"
+	"os"
+	"strings"
+	"testing"
+)
+
+// testImage a grayscale pattern of the given size, the same shot at any size
+func testImage(width int, height int, mirror bool) image.Image {
+	img := image.NewGray(image.Rect(0, 0, width, height))
+	for y := 0; y < height; y++ {
+		for x := 0; x < width; x++ {
+			u := float64(x) / float64(width)
+			if mirror {
+				u = 1 - u
+			}
+			v := float64(y) / float64(height)
+			value := 128 + 60*math.Sin(u*7+v*3) + 60*math.Cos(v*11-u*2)
+			img.SetGray(x, y, color.Gray{Y: uint8(value)})
+		}
+	}
+	return img
+}
+
+func TestDHash(t *testing.T) {
+	original := dHash(testImage(640, 480, false), 1)
+	resized := dHash(testImage(160, 120, false), 1)
+	mirrored := dHash(testImage(640, 480, true), 1)
+
+	distance, _ := perceptualDistance(formatPerceptualHash(original), formatPerceptualHash(resized))
+	if distance > 4 {
+		t.Errorf("distance to a resized copy = %v; want at most 4", distance)
+	}
+	distance, _ = perceptualDistance(formatPerceptualHash(original), formatPerceptualHash(mirrored))
+	if distance < 16 {
+		t.Errorf("distance to a different image = %v; want at least 16", distance)
+	}
+
+	//Stored rotated counter clockwise, displayed rotated clockwise (orientation 6)
+	display := testImage(288, 288, false)
+	stored := image.NewGray(display.Bounds())
+	for y := 0; y < 288; y++ {
+		for x := 0; x < 288; x++ {
+			stored.Set(y, 287-x, display.At(x, y))
+		}
+	}
+	distance, _ = perceptualDistance(formatPerceptualHash(dHash(display, 1)), formatPerceptualHash(dHash(stored, 6)))
+	if distance > 2 {
+		t.Errorf("distance to a rotated copy = %v; want at most 2", distance)
+	}
+}
+
+func TestDuplicates(t *testing.T) {
+	downloader := NewDownloader()
+	downloader.Options.BackupFolder = tempPath()
+	defer os.RemoveAll(downloader.Options.BackupFolder)
+
+	write := func(item *LibraryItem, img image.Image) {
+		file, err := os.Create(downloader.getImageFilePath(item))
+		if err != nil {
+			t.Fatalf("%v", err)
+		}
+		defer file.Close()
+		if item.MimeType == "image/png" {
+			err = png.Encode(file, img)
+		} else {
+			err = jpeg.Encode(file, img, &jpeg.Options{Quality: 60})
+		}
+		if err != nil {
+			t.Fatalf("%v", err)
+		}
+	}
+	original := createTestItem(t, downloader, "12345678901234567890")
+	original.MimeType = "image/png"
+	original.UsedFileName = downloader.createFileName(original, 0)
+	downloader.writeJSON(original, downloader.getJSONFilePath(&original.MediaItem))
+	write(original, testImage(640, 480, false))
+	resized := createTestItem(t, downloader, "09876543210987654321")
+	write(resized, testImage(320, 240, false))
+	other := createTestItem(t, downloader, "11111111112222222222")
+	write(other, testImage(640, 480, true))
+
+	output := new(bytes.Buffer)
+	err := downloader.Duplicates(output, DuplicatesJSON, 6)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	var groups []*DuplicateGroup
+	err = json.Unmarshal(output.Bytes(), &groups)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	if len(groups) != 1 || len(groups[0].Items) != 2 {
+		t.Fatalf("Duplicates() = %v; want one group of 2 items", output.String())
+	}
+	for _, item := range groups[0].Items {
+		if item.ID == other.Id {
+			t.Errorf("different image should not be grouped")
+		}
+	}
+	stored, _ := downloader.loadJSON(downloader.getJSONFilePath(&other.MediaItem))
+	if stored.PerceptualHash == "" {
+		t.Errorf("perceptual hash should be stored")
+	}
+
+	output.Reset()
+	err = downloader.Duplicates(output, DuplicatesCSV, 6)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	lines := strings.Split(strings.TrimSpace(output.String()), "\n")
+	if len(lines) != 3 || !strings.HasPrefix(lines[0], "group,id") {
+		t.Errorf("Duplicates() CSV = %v; want a header and 2 items", output.String())
+	}
+
+	if downloader.Duplicates(output, "xml", 6) == nil {
+		t.Errorf("Duplicates() should fail on unknown formats")
+	}
+}
+
+func TestFindDuplicates(t *testing.T) {
+	//Hashes near a few shots, compared to the distances of all pairs
+	random := rand.New(rand.NewSource(1))
+	var entries []*catalogEntry
+	for i := 0; i < 300; i++ {
+		hash := uint64(i%10) * 0x0123456789abcdef
+		for flips := random.Intn(12); flips > 0; flips-- {
+			hash ^= 1 << uint(random.Intn(64))
+		}
+		item := new(LibraryItem)
+		item.Id = fmt.Sprintf("%v", i)
+		item.PerceptualHash = formatPerceptualHash(hash)
+		entries = append(entries, &catalogEntry{Item: item})
+	}
+	for _, maxDistance := range []int{0, 3, 10, 64} {
+		groups, err := findDuplicates(entries, maxDistance)
+		if err != nil {
+			t.Fatalf("%v", err)
+		}
+		group := make(map[string]int)
+		for g, duplicates := range groups {
+			for _, item := range duplicates.Items {
+				group[item.ID] = g + 1
+			}
+		}
+		for i, a := range entries {
+			for _, b := range entries[i+1:] {
+				distance, _ := perceptualDistance(a.Item.PerceptualHash, b.Item.PerceptualHash)
+				if distance <= maxDistance && (group[a.Item.Id] == 0 || group[a.Item.Id] != group[b.Item.Id]) {
+					t.Fatalf("max distance %v: %v and %v are %v apart but not grouped", maxDistance, a.Item.Id, b.Item.Id, distance)
+				}
+			}
+		}
+	}
+	_, err := findDuplicates([]*catalogEntry{{Item: &LibraryItem{PerceptualHash: "not hex"}}}, 3)
+	if err == nil {
+		t.Errorf("findDuplicates() should fail for invalid hashes")
+	}
+}
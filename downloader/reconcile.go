@@ -0,0 +1,222 @@
+package downloader
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+)
+
+const (
+	//DeletedPolicyKeep only report items deleted from Google Photos
+	DeletedPolicyKeep = "keep"
+	//DeletedPolicyTrash move items deleted from Google Photos to the trash folder
+	DeletedPolicyTrash = "trash"
+	//DeletedPolicyMark mark items deleted from Google Photos in their sidecar
+	DeletedPolicyMark = "mark"
+)
+
+// ValidateDeletedPolicy returns an error for unknown deleted items policies
+func ValidateDeletedPolicy(policy string) error {
+	switch policy {
+	case "", DeletedPolicyKeep, DeletedPolicyTrash, DeletedPolicyMark:
+		return nil
+	}
+	return fmt.Errorf("unknown deleted items policy '%v', use %v, %v or %v", policy, DeletedPolicyKeep, DeletedPolicyTrash, DeletedPolicyMark)
+}
+
+// reconcile Handle items in the backup folder which were not seen during a
+// full pass, meaning they were deleted from Google Photos
+func (d *Downloader) reconcile() error {
+	err := ValidateDeletedPolicy(d.Options.DeletedPolicy)
+	if err != nil {
+		return err
+	}
+
+	catalog, err := d.loadCatalog()
+	if err != nil {
+		return err
+	}
+
+	now := time.Now()
+	trashed := make(map[string]bool)
+	for id, entry := range catalog.items {
+		if d.seen[id] || entry.Item.Provisional {
+			//Imported items are not known to Google Photos until linked
+			continue
+		}
+		policy := d.Options.DeletedPolicy
+		if policy == DeletedPolicyTrash && entry.isPacked() {
+			//Packed media files cannot be moved out of their archives
+			policy = DeletedPolicyMark
+		}
+		if entry.Item.DeletedUpstream != "" && policy == DeletedPolicyMark {
+			continue
+		}
+		log.Printf("Deleted from Google Photos: '%v' [id %v] (%v)", entry.Item.Filename, id, entry.MediaFilePath())
+		d.stats.UpdateStatsDeleted(1)
+
+		switch policy {
+		case DeletedPolicyMark:
+			entry.Item.DeletedUpstream = now.UTC().Format(time.RFC3339)
+			err = d.writeJSON(entry.Item, entry.JSONFilePath)
+		case DeletedPolicyTrash:
+			err = d.handOverAliases(entry, catalog)
+			if err == nil {
+				err = d.moveToTrash(entry, now)
+				trashed[id] = true
+			}
+		}
+		if err != nil {
+			log.Printf("Failed to handle deleted '%v' [id %v]: %v", entry.Item.Filename, id, err)
+			d.stats.UpdateStatsError(1)
+		}
+	}
+
+	//Trashed items still holding the content of aliases are not purged
+	aliased := make(map[string]bool)
+	for id, entry := range catalog.items {
+		if entry.Item.AliasOf != "" && !trashed[id] {
+			aliased[entry.Item.AliasOf] = true
+		}
+	}
+	return d.purgeTrash(now, aliased)
+}
+
+// handOverAliases Move the media file of an item about to be trashed to its
+// first alias still in Google Photos, which holds the content from then on,
+// the other aliases point to it instead
+func (d *Downloader) handOverAliases(entry *catalogEntry, catalog *Catalog) error {
+	var ids []string
+	for id, alias := range catalog.items {
+		if alias.Item.AliasOf == entry.Item.Id && (d.seen[id] || alias.Item.Provisional) {
+			ids = append(ids, id)
+		}
+	}
+	if len(ids) == 0 {
+		return nil
+	}
+	sort.Strings(ids)
+	heir := catalog.items[ids[0]]
+
+	mediaFilePath := entry.MediaFilePath()
+	heirFilePath := heir.MediaFilePath()
+	log.Printf("Moving '%v' to its alias '%v' [id %v]", mediaFilePath, heirFilePath, heir.Item.Id)
+	err := d.storage.MkdirAll(filepath.Dir(heirFilePath))
+	if err != nil {
+		return err
+	}
+	err = d.storage.Rename(mediaFilePath, heirFilePath)
+	if err != nil {
+		return err
+	}
+	d.names.add(heirFilePath)
+	err = d.setChecksum(mediaFilePath, "")
+	if err != nil {
+		return err
+	}
+	heir.Item.AliasOf = ""
+	heir.Item.Size = entry.Item.Size
+	heir.Item.FileSHA256 = entry.Item.FileSHA256
+	err = d.writeJSON(heir.Item, heir.JSONFilePath)
+	if err != nil {
+		return err
+	}
+	err = d.writeXMP(heir.Item, true)
+	if err != nil {
+		return err
+	}
+	err = d.updateChecksum(heir.Item, heirFilePath)
+	if err != nil {
+		return err
+	}
+	for _, id := range ids[1:] {
+		alias := catalog.items[id]
+		alias.Item.AliasOf = heir.Item.Id
+		err = d.writeJSON(alias.Item, alias.JSONFilePath)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// trashPath Path inside the trash folder for a path in the backup folder
+func (d *Downloader) trashPath(path string) (string, error) {
+	relative, err := filepath.Rel(d.Options.BackupFolder, path)
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(d.Options.BackupFolder, trashFolder, relative), nil
+}
+
+// moveToTrash Move the media and sidecar of an item to the trash folder,
+// keeping their relative path
+func (d *Downloader) moveToTrash(entry *catalogEntry, now time.Time) error {
+	entry.Item.DeletedUpstream = now.UTC().Format(time.RFC3339)
+
+	jsonTrashPath, err := d.trashPath(entry.JSONFilePath)
+	if err != nil {
+		return err
+	}
+	err = d.writeJSON(entry.Item, jsonTrashPath)
+	if err != nil {
+		return err
+	}
+
+	mediaFilePath := entry.MediaFilePath()
+	_, err = d.storage.Stat(mediaFilePath)
+	if err == nil {
+		mediaTrashPath, err := d.trashPath(mediaFilePath)
+		if err != nil {
+			return err
+		}
+		err = d.storage.Rename(mediaFilePath, mediaTrashPath)
+		if err != nil {
+			return err
+		}
+		err = d.moveXMP(mediaFilePath, mediaTrashPath)
+		if err != nil {
+			return err
+		}
+		err = d.setChecksum(mediaFilePath, "")
+		if err != nil {
+			return err
+		}
+	}
+
+	return d.storage.Remove(entry.JSONFilePath)
+}
+
+// purgeTrash Permanently remove trashed items older than the retention period,
+// but the items in aliased, which hold the content of other items
+func (d *Downloader) purgeTrash(now time.Time, aliased map[string]bool) error {
+	if d.Options.TrashRetentionDays <= 0 {
+		return nil
+	}
+	retention := time.Duration(d.Options.TrashRetentionDays) * 24 * time.Hour
+
+	return d.walkSidecars(filepath.Join(d.Options.BackupFolder, trashFolder), func(item *LibraryItem, jsonFilePath string) error {
+		deleted, err := time.Parse(time.RFC3339, item.DeletedUpstream)
+		if err != nil || now.Sub(deleted) < retention {
+			return nil
+		}
+		if aliased[item.Id] {
+			log.Printf("Keeping '%v' [id %v] in trash, it holds the content of aliases", item.Filename, item.Id)
+			return nil
+		}
+		entry := &catalogEntry{Item: item, JSONFilePath: jsonFilePath}
+		log.Printf("Purging '%v' [id %v] from trash", item.Filename, item.Id)
+		err = d.storage.Remove(entry.MediaFilePath())
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		err = d.storage.Remove(xmpFilePath(entry.MediaFilePath()))
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		return d.storage.Remove(jsonFilePath)
+	})
+}
@@ -0,0 +1,188 @@
+package downloader
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	photoslibrary "github.com/gphotosuploader/googlemirror/api/photoslibrary/v1"
+)
+
+// createTestItem Create a sidecar and an empty media file for an item
+func createTestItem(t *testing.T, downloader *Downloader, id string) *LibraryItem {
+	item := new(LibraryItem)
+	item.Id = id
+	item.Filename = id + ".jpg"
+	item.MimeType = "image/jpeg"
+	item.MediaMetadata = new(photoslibrary.MediaMetadata)
+	item.MediaMetadata.CreationTime = "2019-10-13T17:33:43Z"
+	item.UsedFileName = downloader.createFileName(item, 0)
+
+	err := downloader.writeJSON(item, downloader.getJSONFilePath(&item.MediaItem))
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	err = ioutil.WriteFile(downloader.getImageFilePath(item), []byte("image"), 0644)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	return item
+}
+
+func TestReconcile(t *testing.T) {
+	if ValidateDeletedPolicy("delete") == nil || ValidateDeletedPolicy(DeletedPolicyTrash) != nil {
+		t.Errorf("ValidateDeletedPolicy() should only accept the known policies")
+	}
+
+	t.Run("Keep", func(t *testing.T) {
+		downloader := NewDownloader()
+		downloader.Options.BackupFolder = tempPath()
+		defer os.RemoveAll(downloader.Options.BackupFolder)
+
+		deleted := createTestItem(t, downloader, "12345678901234567890")
+		downloader.seen = map[string]bool{}
+
+		err := downloader.reconcile()
+		if err != nil {
+			t.Fatalf("%v", err)
+		}
+		if downloader.stats.Deleted != 1 {
+			t.Errorf("Stats.Deleted = %v; want 1", downloader.stats.Deleted)
+		}
+		if _, err := os.Stat(downloader.getImageFilePath(deleted)); err != nil {
+			t.Errorf("deleted item should be kept: %v", err)
+		}
+	})
+
+	t.Run("Trash", func(t *testing.T) {
+		downloader := NewDownloader()
+		downloader.Options.BackupFolder = tempPath()
+		defer os.RemoveAll(downloader.Options.BackupFolder)
+		downloader.Options.UseFileName = true
+		downloader.compileTemplates()
+		downloader.Options.DeletedPolicy = DeletedPolicyTrash
+
+		kept := createTestItem(t, downloader, "kept")
+		deleted := createTestItem(t, downloader, "deleted")
+		downloader.seen = map[string]bool{kept.Id: true}
+
+		err := downloader.reconcile()
+		if err != nil {
+			t.Fatalf("%v", err)
+		}
+		if _, err := os.Stat(downloader.getImageFilePath(kept)); err != nil {
+			t.Errorf("seen item should be kept: %v", err)
+		}
+		if _, err := os.Stat(downloader.getImageFilePath(deleted)); !os.IsNotExist(err) {
+			t.Errorf("deleted item should be moved to trash")
+		}
+		trashed := filepath.Join(downloader.Options.BackupFolder, trashFolder, "2019", "October", deleted.Filename)
+		if _, err := os.Stat(trashed); err != nil {
+			t.Errorf("deleted item should be in trash: %v", err)
+		}
+
+		//Purge after the retention period
+		downloader.Options.TrashRetentionDays = 1
+		err = downloader.purgeTrash(time.Now().Add(48*time.Hour), nil)
+		if err != nil {
+			t.Fatalf("%v", err)
+		}
+		if _, err := os.Stat(trashed); !os.IsNotExist(err) {
+			t.Errorf("trashed item should be purged")
+		}
+	})
+
+	t.Run("Aliases", func(t *testing.T) {
+		downloader := NewDownloader()
+		downloader.Options.BackupFolder = tempPath()
+		defer os.RemoveAll(downloader.Options.BackupFolder)
+		downloader.Options.UseFileName = true
+		downloader.compileTemplates()
+		downloader.Options.DeletedPolicy = DeletedPolicyTrash
+
+		original := createTestItem(t, downloader, "original")
+		original.SHA256, _ = hashFile(downloader.getImageFilePath(original))
+		downloader.writeJSON(original, downloader.getJSONFilePath(&original.MediaItem))
+		first := createTestItem(t, downloader, "first")
+		second := createTestItem(t, downloader, "second")
+		for _, alias := range []*LibraryItem{first, second} {
+			os.Remove(downloader.getImageFilePath(alias))
+			alias.AliasOf = original.Id
+			alias.SHA256 = original.SHA256
+			downloader.writeJSON(alias, downloader.getJSONFilePath(&alias.MediaItem))
+		}
+
+		//Restored aliases get a copy of the content
+		target := tempPath()
+		defer os.RemoveAll(target)
+		err := downloader.Restore(target)
+		if err != nil {
+			t.Fatalf("%v", err)
+		}
+		relative, _ := filepath.Rel(downloader.Options.BackupFolder, downloader.getImageFilePath(second))
+		data, _ := ioutil.ReadFile(filepath.Join(target, relative))
+		if string(data) != "image" {
+			t.Errorf("restored alias = %q; want the content of the original", data)
+		}
+
+		//The content of a trashed original moves to its first alias
+		downloader.seen = map[string]bool{first.Id: true, second.Id: true}
+		err = downloader.reconcile()
+		if err != nil {
+			t.Fatalf("%v", err)
+		}
+		data, _ = ioutil.ReadFile(downloader.getImageFilePath(first))
+		if string(data) != "image" {
+			t.Errorf("alias media = %q; want the content of the trashed original", data)
+		}
+		heir, _ := downloader.loadJSON(downloader.getJSONFilePath(&first.MediaItem))
+		alias, _ := downloader.loadJSON(downloader.getJSONFilePath(&second.MediaItem))
+		if heir == nil || heir.AliasOf != "" || alias == nil || alias.AliasOf != first.Id {
+			t.Errorf("aliases = %v, %v; want the second an alias of the first", heir, alias)
+		}
+
+		//Trashed items holding the content of aliases are not purged
+		downloader.Options.TrashRetentionDays = 1
+		trashed, _ := downloader.trashPath(downloader.getJSONFilePath(&original.MediaItem))
+		err = downloader.purgeTrash(time.Now().Add(48*time.Hour), map[string]bool{original.Id: true})
+		if err != nil {
+			t.Fatalf("%v", err)
+		}
+		if _, err := os.Stat(trashed); err != nil {
+			t.Errorf("aliased item should be kept in trash: %v", err)
+		}
+	})
+
+	t.Run("Mark", func(t *testing.T) {
+		downloader := NewDownloader()
+		downloader.Options.BackupFolder = tempPath()
+		defer os.RemoveAll(downloader.Options.BackupFolder)
+		downloader.Options.DeletedPolicy = DeletedPolicyMark
+
+		deleted := createTestItem(t, downloader, "12345678901234567890")
+		downloader.seen = map[string]bool{}
+
+		err := downloader.reconcile()
+		if err != nil {
+			t.Fatalf("%v", err)
+		}
+		item, err := downloader.loadJSON(downloader.getJSONFilePath(&deleted.MediaItem))
+		if err != nil {
+			t.Fatalf("%v", err)
+		}
+		if item.DeletedUpstream == "" {
+			t.Errorf("LibraryItem.DeletedUpstream should be set")
+		}
+
+		//Marked items are reported once
+		err = downloader.reconcile()
+		if err != nil {
+			t.Fatalf("%v", err)
+		}
+		if downloader.stats.Deleted != 1 {
+			t.Errorf("Stats.Deleted = %v; want 1", downloader.stats.Deleted)
+		}
+	})
+}
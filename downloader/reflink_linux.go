@@ -0,0 +1,33 @@
+//go:build linux
+// +build linux
+
+package downloader
+
+import (
+	"os"
+	"syscall"
+)
+
+// ficlone the FICLONE ioctl, cloning a file on copy-on-write file systems
+// such as Btrfs and XFS
+const ficlone = 0x40049409
+
+// reflink Create a copy-on-write clone of a file
+func reflink(source string, target string) error {
+	input, err := os.Open(source)
+	if err != nil {
+		return err
+	}
+	defer input.Close()
+	output, err := os.OpenFile(target, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+	if err != nil {
+		return err
+	}
+	_, _, errno := syscall.Syscall(syscall.SYS_IOCTL, output.Fd(), ficlone, input.Fd())
+	output.Close()
+	if errno != 0 {
+		os.Remove(target)
+		return &os.LinkError{Op: "reflink", Old: source, New: target, Err: errno}
+	}
+	return nil
+}
@@ -0,0 +1,14 @@
+//go:build !linux
+// +build !linux
+
+package downloader
+
+import (
+	"errors"
+	"os"
+)
+
+// reflink Create a copy-on-write clone of a file, only supported on Linux
+func reflink(source string, target string) error {
+	return &os.LinkError{Op: "reflink", Old: source, New: target, Err: errors.New("not supported on this OS")}
+}
@@ -0,0 +1,713 @@
+package downloader
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// s3PartSize size of the parts of multipart uploads, files up to this size
+// are uploaded in a single request. Each upload buffers one part in memory.
+const s3PartSize = 8 << 20
+
+// s3MaxCopySize largest object copied by a single CopyObject request, larger
+// objects are copied in parts of s3CopyPartSize
+var s3MaxCopySize int64 = 5 << 30
+
+// s3CopyPartSize size of the parts of multipart copies, up to 10000 parts
+// make 5TB, the largest S3 object
+var s3CopyPartSize int64 = 512 << 20
+
+// s3MtimeHeader metadata holding the modification time of an object, in
+// seconds since the epoch as rclone stores it
+const s3MtimeHeader = "X-Amz-Meta-Mtime"
+
+// s3EmptyHash SHA-256 of an empty payload
+const s3EmptyHash = "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855"
+
+// s3Credentials keys signing requests
+type s3Credentials struct {
+	accessKey    string
+	secretKey    string
+	sessionToken string
+}
+
+// s3Storage the backup folder in an S3 compatible bucket, addressed by path
+// so it works with MinIO and other servers without bucket DNS names
+type s3Storage struct {
+	//root the backup folder as joined by the downloader
+	root        string
+	endpoint    *url.URL
+	region      string
+	bucket      string
+	prefix      string
+	credentials s3Credentials
+	client      *http.Client
+	now         func() time.Time
+}
+
+// newS3Storage opens `s3://bucket/prefix`. Credentials, region and endpoint
+// are read from the environment variables used by the AWS tools.
+func newS3Storage(folder string, location *url.URL) (*s3Storage, error) {
+	if location.Host == "" {
+		return nil, fmt.Errorf("missing bucket in '%v'", folder)
+	}
+	s := &s3Storage{
+		root:   filepath.Clean(folder),
+		bucket: location.Host,
+		prefix: strings.Trim(location.Path, "/"),
+		credentials: s3Credentials{
+			accessKey:    os.Getenv("AWS_ACCESS_KEY_ID"),
+			secretKey:    os.Getenv("AWS_SECRET_ACCESS_KEY"),
+			sessionToken: os.Getenv("AWS_SESSION_TOKEN"),
+		},
+		client: http.DefaultClient,
+		now:    time.Now,
+	}
+	if s.credentials.accessKey == "" || s.credentials.secretKey == "" {
+		return nil, errors.New("missing S3 credentials, set AWS_ACCESS_KEY_ID and AWS_SECRET_ACCESS_KEY")
+	}
+	s.region = os.Getenv("AWS_REGION")
+	if s.region == "" {
+		s.region = os.Getenv("AWS_DEFAULT_REGION")
+	}
+	if s.region == "" {
+		s.region = "us-east-1"
+	}
+	endpoint := os.Getenv("AWS_ENDPOINT_URL")
+	if endpoint == "" {
+		endpoint = "https://s3." + s.region + ".amazonaws.com"
+	}
+	var err error
+	s.endpoint, err = url.Parse(endpoint)
+	if err != nil {
+		return nil, err
+	}
+	//Requests for objects of a missing bucket only tell the object is missing
+	response, err := s.request(http.MethodGet, "", url.Values{"list-type": {"2"}, "max-keys": {"0"}}, nil, nil)
+	if err != nil {
+		return nil, err
+	}
+	response.Body.Close()
+	return s, nil
+}
+
+// s3Escape URI encode as S3 signatures require, slashes are kept in paths
+func s3Escape(text string, path bool) string {
+	var escaped strings.Builder
+	for _, c := range []byte(text) {
+		if 'A' <= c && c <= 'Z' || 'a' <= c && c <= 'z' || '0' <= c && c <= '9' || c == '-' || c == '_' || c == '.' || c == '~' || (path && c == '/') {
+			escaped.WriteByte(c)
+		} else {
+			fmt.Fprintf(&escaped, "%%%02X", c)
+		}
+	}
+	return escaped.String()
+}
+
+// s3CanonicalQuery the query string, sorted and encoded as S3 signatures
+// require
+func s3CanonicalQuery(query url.Values) string {
+	keys := make([]string, 0, len(query))
+	for key := range query {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	var pairs []string
+	for _, key := range keys {
+		for _, value := range query[key] {
+			pairs = append(pairs, s3Escape(key, false)+"="+s3Escape(value, false))
+		}
+	}
+	return strings.Join(pairs, "&")
+}
+
+// hmacSHA256 keyed hash used to derive the signing key
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
+
+// signS3Request Sign a request with AWS Signature Version 4, payloadHash is
+// the hex SHA-256 of the body
+func signS3Request(request *http.Request, credentials s3Credentials, region string, payloadHash string, now time.Time) {
+	timestamp := now.UTC().Format("20060102T150405Z")
+	date := timestamp[:8]
+	request.Header.Set("X-Amz-Date", timestamp)
+	request.Header.Set("X-Amz-Content-Sha256", payloadHash)
+	if credentials.sessionToken != "" {
+		request.Header.Set("X-Amz-Security-Token", credentials.sessionToken)
+	}
+
+	headers := map[string]string{"host": request.URL.Host}
+	for name, values := range request.Header {
+		headers[strings.ToLower(name)] = strings.TrimSpace(strings.Join(values, ","))
+	}
+	names := make([]string, 0, len(headers))
+	for name := range headers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var canonicalHeaders strings.Builder
+	for _, name := range names {
+		canonicalHeaders.WriteString(name + ":" + headers[name] + "\n")
+	}
+	signedHeaders := strings.Join(names, ";")
+
+	canonicalRequest := strings.Join([]string{
+		request.Method,
+		request.URL.EscapedPath(),
+		request.URL.RawQuery,
+		canonicalHeaders.String(),
+		signedHeaders,
+		payloadHash,
+	}, "\n")
+	scope := date + "/" + region + "/s3/aws4_request"
+	requestHash := sha256.Sum256([]byte(canonicalRequest))
+	stringToSign := "AWS4-HMAC-SHA256\n" + timestamp + "\n" + scope + "\n" + hex.EncodeToString(requestHash[:])
+
+	key := hmacSHA256([]byte("AWS4"+credentials.secretKey), date)
+	key = hmacSHA256(key, region)
+	key = hmacSHA256(key, "s3")
+	key = hmacSHA256(key, "aws4_request")
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+	request.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%v/%v, SignedHeaders=%v, Signature=%v", credentials.accessKey, scope, signedHeaders, signature))
+}
+
+// key the object key of a name in the backup folder
+func (s *s3Storage) key(name string) (string, error) {
+	relative, err := filepath.Rel(s.root, filepath.Clean(name))
+	if err != nil {
+		return "", err
+	}
+	relative = filepath.ToSlash(relative)
+	if relative == ".." || strings.HasPrefix(relative, "../") {
+		return "", fmt.Errorf("'%v' is outside of '%v'", name, s.root)
+	}
+	if relative == "." {
+		return s.prefix, nil
+	}
+	return strings.TrimPrefix(s.prefix+"/"+relative, "/"), nil
+}
+
+// name the name in the backup folder of an object key
+func (s *s3Storage) name(key string) string {
+	relative := key
+	if s.prefix != "" {
+		relative = strings.TrimPrefix(key, s.prefix+"/")
+	}
+	return filepath.Join(s.root, filepath.FromSlash(relative))
+}
+
+// s3Error an error response
+type s3Error struct {
+	Code    string
+	Message string
+}
+
+// request Send a signed request for an object key, or the bucket if key is
+// empty. Responses with an error status are returned as errors, not found
+// errors satisfy os.IsNotExist.
+func (s *s3Storage) request(method string, key string, query url.Values, header http.Header, body []byte) (*http.Response, error) {
+	location := *s.endpoint
+	location.Path = strings.TrimSuffix(location.Path, "/") + "/" + s.bucket
+	if key != "" {
+		location.Path += "/" + key
+	}
+	location.RawPath = s3Escape(location.Path, true)
+	location.RawQuery = s3CanonicalQuery(query)
+	request, err := http.NewRequest(method, location.String(), bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	for name, values := range header {
+		request.Header[name] = values
+	}
+	payloadHash := s3EmptyHash
+	if len(body) > 0 {
+		hash := sha256.Sum256(body)
+		payloadHash = hex.EncodeToString(hash[:])
+	}
+	signS3Request(request, s.credentials, s.region, payloadHash, s.now())
+
+	response, err := s.client.Do(request)
+	if err != nil {
+		return nil, err
+	}
+	if response.StatusCode < 300 {
+		return response, nil
+	}
+	defer response.Body.Close()
+	data, _ := ioutil.ReadAll(io.LimitReader(response.Body, 1<<16))
+	var s3err s3Error
+	xml.Unmarshal(data, &s3err)
+	if response.StatusCode == http.StatusNotFound && s3err.Code != "NoSuchBucket" {
+		return nil, &os.PathError{Op: strings.ToLower(method), Path: key, Err: os.ErrNotExist}
+	}
+	if s3err.Code == "" {
+		s3err.Code = response.Status
+	}
+	return nil, fmt.Errorf("S3 %v '%v': %v %v", method, key, s3err.Code, s3err.Message)
+}
+
+// parseS3Mtime Parse the modification time metadata, in seconds with an
+// optional fraction
+func parseS3Mtime(value string) (time.Time, bool) {
+	parts := strings.SplitN(value, ".", 2)
+	seconds, err := strconv.ParseInt(parts[0], 10, 64)
+	if err != nil {
+		return time.Time{}, false
+	}
+	var nanoseconds int64
+	if len(parts) == 2 && parts[1] != "" {
+		fraction := (parts[1] + "000000000")[:9]
+		nanoseconds, err = strconv.ParseInt(fraction, 10, 64)
+		if err != nil {
+			return time.Time{}, false
+		}
+	}
+	return time.Unix(seconds, nanoseconds), true
+}
+
+// formatS3Mtime Format a modification time as metadata
+func formatS3Mtime(t time.Time) string {
+	return fmt.Sprintf("%d.%09d", t.Unix(), t.Nanosecond())
+}
+
+func (s *s3Storage) Stat(name string) (os.FileInfo, error) {
+	key, err := s.key(name)
+	if err != nil {
+		return nil, err
+	}
+	response, err := s.request(http.MethodHead, key, nil, nil, nil)
+	if err != nil {
+		return nil, err
+	}
+	response.Body.Close()
+	info := &storageFileInfo{name: path.Base(key), size: response.ContentLength}
+	info.modTime, _ = http.ParseTime(response.Header.Get("Last-Modified"))
+	if mtime, ok := parseS3Mtime(response.Header.Get(s3MtimeHeader)); ok {
+		info.modTime = mtime
+	}
+	return info, nil
+}
+
+// s3ListResult a page of ListObjectsV2
+type s3ListResult struct {
+	Contents []struct {
+		Key          string
+		Size         int64
+		LastModified time.Time
+	}
+	CommonPrefixes []struct {
+		Prefix string
+	}
+	IsTruncated           bool
+	NextContinuationToken string
+}
+
+// list List the objects under a key, with delimiter only the first level
+func (s *s3Storage) list(key string, delimiter string, fn func(result *s3ListResult) error) error {
+	query := url.Values{"list-type": {"2"}}
+	if key != "" {
+		query.Set("prefix", key+"/")
+	}
+	if delimiter != "" {
+		query.Set("delimiter", delimiter)
+	}
+	for {
+		response, err := s.request(http.MethodGet, "", query, nil, nil)
+		if err != nil {
+			return err
+		}
+		var result s3ListResult
+		err = xml.NewDecoder(response.Body).Decode(&result)
+		response.Body.Close()
+		if err != nil {
+			return err
+		}
+		err = fn(&result)
+		if err != nil {
+			return err
+		}
+		if !result.IsTruncated || result.NextContinuationToken == "" {
+			return nil
+		}
+		query.Set("continuation-token", result.NextContinuationToken)
+	}
+}
+
+func (s *s3Storage) ReadDir(name string) ([]os.FileInfo, error) {
+	key, err := s.key(name)
+	if err != nil {
+		return nil, err
+	}
+	var files []os.FileInfo
+	err = s.list(key, "/", func(result *s3ListResult) error {
+		for _, prefix := range result.CommonPrefixes {
+			files = append(files, &storageFileInfo{name: path.Base(prefix.Prefix), dir: true})
+		}
+		for _, object := range result.Contents {
+			if !strings.HasSuffix(object.Key, "/") {
+				files = append(files, &storageFileInfo{name: path.Base(object.Key), size: object.Size, modTime: object.LastModified})
+			}
+		}
+		return nil
+	})
+	sort.Slice(files, func(i, j int) bool { return files[i].Name() < files[j].Name() })
+	return files, err
+}
+
+func (s *s3Storage) Walk(root string, skipDir func(name string) bool, fn func(name string, info os.FileInfo) error) error {
+	key, err := s.key(root)
+	if err != nil {
+		return err
+	}
+	root = filepath.Clean(root)
+	return s.list(key, "", func(result *s3ListResult) error {
+		for _, object := range result.Contents {
+			if strings.HasSuffix(object.Key, "/") {
+				continue
+			}
+			name := s.name(object.Key)
+			skipped := false
+			for dir := filepath.Dir(name); skipDir != nil && dir != root && len(dir) > len(root); dir = filepath.Dir(dir) {
+				if skipDir(dir) {
+					skipped = true
+					break
+				}
+			}
+			if skipped {
+				continue
+			}
+			err := fn(name, &storageFileInfo{name: path.Base(object.Key), size: object.Size, modTime: object.LastModified})
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// MkdirAll does nothing, buckets have no folders
+func (s *s3Storage) MkdirAll(name string) error {
+	return nil
+}
+
+func (s *s3Storage) Open(name string) (io.ReadCloser, error) {
+	key, err := s.key(name)
+	if err != nil {
+		return nil, err
+	}
+	response, err := s.request(http.MethodGet, key, nil, nil, nil)
+	if err != nil {
+		return nil, err
+	}
+	return response.Body, nil
+}
+
+// objectHeader the headers of a new object
+func objectHeader(key string, modTime time.Time) http.Header {
+	header := http.Header{"Content-Type": {mimeTypeByExtension(key)}}
+	if !modTime.IsZero() {
+		header.Set(s3MtimeHeader, formatS3Mtime(modTime))
+	}
+	return header
+}
+
+// s3Writer streams an object, in a single request up to s3PartSize and as a
+// multipart upload above
+type s3Writer struct {
+	storage  *s3Storage
+	key      string
+	header   http.Header
+	buffer   []byte
+	uploadID string
+	parts    []s3CompletedPart
+}
+
+// s3CompletedPart an uploaded part of a multipart upload
+type s3CompletedPart struct {
+	PartNumber int
+	ETag       string
+}
+
+func (s *s3Storage) Create(name string, modTime time.Time) (StorageWriter, error) {
+	key, err := s.key(name)
+	if err != nil {
+		return nil, err
+	}
+	return &s3Writer{storage: s, key: key, header: objectHeader(key, modTime)}, nil
+}
+
+// initiate Start the multipart upload
+func (w *s3Writer) initiate() error {
+	response, err := w.storage.request(http.MethodPost, w.key, url.Values{"uploads": {""}}, w.header, nil)
+	if err != nil {
+		return err
+	}
+	var result struct {
+		UploadID string `xml:"UploadId"`
+	}
+	err = xml.NewDecoder(response.Body).Decode(&result)
+	response.Body.Close()
+	if err != nil {
+		return err
+	}
+	w.uploadID = result.UploadID
+	return nil
+}
+
+// uploadPart Upload the buffered data as the next part
+func (w *s3Writer) uploadPart() error {
+	if w.uploadID == "" {
+		err := w.initiate()
+		if err != nil {
+			return err
+		}
+	}
+	partNumber := len(w.parts) + 1
+	query := url.Values{"partNumber": {strconv.Itoa(partNumber)}, "uploadId": {w.uploadID}}
+	response, err := w.storage.request(http.MethodPut, w.key, query, nil, w.buffer)
+	if err != nil {
+		return err
+	}
+	response.Body.Close()
+	w.parts = append(w.parts, s3CompletedPart{PartNumber: partNumber, ETag: response.Header.Get("ETag")})
+	w.buffer = w.buffer[:0]
+	return nil
+}
+
+func (w *s3Writer) Write(data []byte) (int, error) {
+	written := 0
+	for len(data) > 0 {
+		if len(w.buffer) == s3PartSize {
+			err := w.uploadPart()
+			if err != nil {
+				return written, err
+			}
+		}
+		if w.buffer == nil {
+			w.buffer = make([]byte, 0, s3PartSize)
+		}
+		n := s3PartSize - len(w.buffer)
+		if n > len(data) {
+			n = len(data)
+		}
+		w.buffer = append(w.buffer, data[:n]...)
+		data = data[n:]
+		written += n
+	}
+	return written, nil
+}
+
+func (w *s3Writer) Close() error {
+	if w.uploadID == "" {
+		response, err := w.storage.request(http.MethodPut, w.key, nil, w.header, w.buffer)
+		if err != nil {
+			return err
+		}
+		return response.Body.Close()
+	}
+	if len(w.buffer) > 0 {
+		err := w.uploadPart()
+		if err != nil {
+			w.Abort()
+			return err
+		}
+	}
+	body, err := xml.Marshal(struct {
+		XMLName xml.Name          `xml:"CompleteMultipartUpload"`
+		Parts   []s3CompletedPart `xml:"Part"`
+	}{Parts: w.parts})
+	if err != nil {
+		return err
+	}
+	response, err := w.storage.request(http.MethodPost, w.key, url.Values{"uploadId": {w.uploadID}}, nil, body)
+	if err != nil {
+		w.Abort()
+		return err
+	}
+	defer response.Body.Close()
+	//Errors can come after a success status, while the parts are combined
+	return checkS3Result(response)
+}
+
+// Abort aborts the multipart upload, nothing was stored otherwise
+func (w *s3Writer) Abort() error {
+	w.buffer = nil
+	if w.uploadID == "" {
+		return nil
+	}
+	response, err := w.storage.request(http.MethodDelete, w.key, url.Values{"uploadId": {w.uploadID}}, nil, nil)
+	if err != nil {
+		return err
+	}
+	return response.Body.Close()
+}
+
+// checkS3Result returns the error of a response with a success status and an
+// error body
+func checkS3Result(response *http.Response) error {
+	data, err := ioutil.ReadAll(response.Body)
+	if err != nil {
+		return err
+	}
+	var result struct {
+		XMLName xml.Name
+		Code    string
+		Message string
+	}
+	if xml.Unmarshal(data, &result) == nil && result.XMLName.Local == "Error" {
+		return fmt.Errorf("S3 %v %v", result.Code, result.Message)
+	}
+	return nil
+}
+
+func (s *s3Storage) Remove(name string) error {
+	key, err := s.key(name)
+	if err != nil {
+		return err
+	}
+	response, err := s.request(http.MethodDelete, key, nil, nil, nil)
+	if err != nil {
+		return err
+	}
+	return response.Body.Close()
+}
+
+// copyPart Copy the bytes from first to last of the object source as the
+// next part
+func (w *s3Writer) copyPart(source string, first int64, last int64) error {
+	partNumber := len(w.parts) + 1
+	query := url.Values{"partNumber": {strconv.Itoa(partNumber)}, "uploadId": {w.uploadID}}
+	header := http.Header{
+		"X-Amz-Copy-Source":       {source},
+		"X-Amz-Copy-Source-Range": {fmt.Sprintf("bytes=%v-%v", first, last)},
+	}
+	response, err := w.storage.request(http.MethodPut, w.key, query, header, nil)
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+	data, err := ioutil.ReadAll(response.Body)
+	if err != nil {
+		return err
+	}
+	var result struct {
+		XMLName xml.Name
+		ETag    string
+		Code    string
+		Message string
+	}
+	err = xml.Unmarshal(data, &result)
+	if err != nil {
+		return err
+	}
+	if result.XMLName.Local == "Error" {
+		return fmt.Errorf("S3 %v %v", result.Code, result.Message)
+	}
+	w.parts = append(w.parts, s3CompletedPart{PartNumber: partNumber, ETag: result.ETag})
+	return nil
+}
+
+// copyParts Copy an object of size bytes over s3MaxCopySize with a multipart
+// upload, as CopyObject is limited to 5GB
+func (s *s3Storage) copyParts(from string, to string, size int64, header http.Header) error {
+	w := &s3Writer{storage: s, key: to, header: header}
+	err := w.initiate()
+	if err != nil {
+		return err
+	}
+	source := s3Escape("/"+s.bucket+"/"+from, true)
+	for first := int64(0); first < size; first += s3CopyPartSize {
+		last := first + s3CopyPartSize - 1
+		if last >= size {
+			last = size - 1
+		}
+		err = w.copyPart(source, first, last)
+		if err != nil {
+			w.Abort()
+			return err
+		}
+	}
+	return w.Close()
+}
+
+// copy Copy an object on the server, header replaces its metadata if set
+func (s *s3Storage) copy(from string, to string, header http.Header) error {
+	response, err := s.request(http.MethodHead, from, nil, nil, nil)
+	if err != nil {
+		return err
+	}
+	response.Body.Close()
+	if response.ContentLength > s3MaxCopySize {
+		if header == nil {
+			//Multipart uploads do not copy the metadata of the source
+			header = objectHeader(to, time.Time{})
+			if mtime := response.Header.Get(s3MtimeHeader); mtime != "" {
+				header.Set(s3MtimeHeader, mtime)
+			}
+		}
+		return s.copyParts(from, to, response.ContentLength, header)
+	}
+	if header == nil {
+		header = http.Header{}
+	} else {
+		header.Set("X-Amz-Metadata-Directive", "REPLACE")
+	}
+	header.Set("X-Amz-Copy-Source", s3Escape("/"+s.bucket+"/"+from, true))
+	response, err = s.request(http.MethodPut, to, nil, header, nil)
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+	return checkS3Result(response)
+}
+
+// Rename copies the object and removes the original, the modification time
+// is kept with the metadata
+func (s *s3Storage) Rename(from string, to string) error {
+	fromKey, err := s.key(from)
+	if err != nil {
+		return err
+	}
+	toKey, err := s.key(to)
+	if err != nil {
+		return err
+	}
+	if fromKey == toKey {
+		return nil
+	}
+	err = s.copy(fromKey, toKey, nil)
+	if err != nil {
+		return err
+	}
+	return s.Remove(from)
+}
+
+// Chtimes replaces the modification time metadata by copying the object
+// onto itself
+func (s *s3Storage) Chtimes(name string, modTime time.Time) error {
+	key, err := s.key(name)
+	if err != nil {
+		return err
+	}
+	return s.copy(key, key, objectHeader(key, modTime))
+}
@@ -0,0 +1,231 @@
+package downloader
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"sync"
+	"unicode"
+	"unicode/utf8"
+)
+
+const (
+	//SanitizePOSIX only path separators and control characters are replaced
+	SanitizePOSIX = "posix"
+	//SanitizeWindows names valid on Windows and SMB shares, collisions are case insensitive
+	SanitizeWindows = "windows"
+	//SanitizePortable names valid on all common file systems, collisions are case insensitive
+	SanitizePortable = "portable"
+)
+
+// maxNameLength longest file or folder name, in bytes, on common file systems
+const maxNameLength = 255
+
+// windowsReservedNames names Windows does not allow, with or without an extension
+var windowsReservedNames = map[string]bool{
+	"CON": true, "PRN": true, "AUX": true, "NUL": true,
+	"COM1": true, "COM2": true, "COM3": true, "COM4": true, "COM5": true, "COM6": true, "COM7": true, "COM8": true, "COM9": true,
+	"LPT1": true, "LPT2": true, "LPT3": true, "LPT4": true, "LPT5": true, "LPT6": true, "LPT7": true, "LPT8": true, "LPT9": true,
+}
+
+// DefaultSanitizeProfile the sanitize profile of the current OS
+func DefaultSanitizeProfile() string {
+	if runtime.GOOS == "windows" {
+		return SanitizeWindows
+	}
+	return SanitizePOSIX
+}
+
+// ValidateSanitizeProfile returns an error for unknown profiles
+func ValidateSanitizeProfile(profile string) error {
+	switch profile {
+	case "", SanitizePOSIX, SanitizeWindows, SanitizePortable:
+		return nil
+	}
+	return fmt.Errorf("unknown sanitize profile '%v', use %v, %v or %v", profile, SanitizePOSIX, SanitizeWindows, SanitizePortable)
+}
+
+// isCaseInsensitive returns true if the profile targets case insensitive file
+// systems
+func isCaseInsensitive(profile string) bool {
+	return profile == SanitizeWindows || profile == SanitizePortable
+}
+
+// isPathSeparator returns true for both slash and backslash
+func isPathSeparator(r rune) bool {
+	return r == '/' || r == '\\'
+}
+
+// sanitizeName Make a single file or folder name safe for the profile. Path
+// separators, control characters and invalid UTF-8 are replaced with `_`, names
+// made only of dots are dropped and long names are shortened keeping the
+// extension. An empty profile returns the name as is.
+func sanitizeName(name string, profile string) string {
+	if profile == "" {
+		return name
+	}
+	windows := profile == SanitizeWindows || profile == SanitizePortable
+
+	name = strings.ToValidUTF8(name, "_")
+	name = strings.Map(func(r rune) rune {
+		switch {
+		case isPathSeparator(r) || r < 0x20 || r == 0x7f:
+			return '_'
+		case windows && strings.ContainsRune(`<>:"|?*`, r):
+			return '_'
+		case profile == SanitizePortable && !unicode.IsPrint(r):
+			return '_'
+		}
+		return r
+	}, name)
+	name = strings.TrimSpace(name)
+	if windows {
+		//Windows drops trailing dots and spaces
+		name = strings.TrimRight(name, ". ")
+	}
+	if profile == SanitizePortable {
+		//Leading dashes are read as options by command line tools
+		name = strings.TrimLeft(name, "- ")
+	}
+	if strings.Trim(name, ".") == "" {
+		return ""
+	}
+	if windows {
+		base := strings.TrimRight(strings.SplitN(name, ".", 2)[0], " ")
+		if windowsReservedNames[strings.ToUpper(base)] {
+			name = base + "_" + name[len(base):]
+		}
+	}
+	return truncateName(name, maxNameLength)
+}
+
+// truncateName Shorten a name to at most length bytes, keeping the extension
+// and whole UTF-8 characters
+func truncateName(name string, length int) string {
+	if len(name) <= length {
+		return name
+	}
+	ext := filepath.Ext(name)
+	if len(ext) > length/2 {
+		ext = ""
+	}
+	base := name[:length-len(ext)]
+	for !utf8.ValidString(base) {
+		base = base[:len(base)-1]
+	}
+	return base + ext
+}
+
+// sanitizeProfile the sanitize profile from the options, or the OS default
+func (d *Downloader) sanitizeProfile() string {
+	if d.Options.SanitizeProfile == "" {
+		return DefaultSanitizeProfile()
+	}
+	return d.Options.SanitizeProfile
+}
+
+// collisionKey the key used to detect colliding paths, case insensitive
+// profiles ignore the case
+func (d *Downloader) collisionKey(filePath string) string {
+	if isCaseInsensitive(d.sanitizeProfile()) {
+		return strings.ToLower(filePath)
+	}
+	return filePath
+}
+
+// nameCache the lower-cased names of the files of folders, listed once per
+// pass for the conflict checks of case insensitive profiles. Files are added
+// as they are created or renamed, removed files are kept as the name may
+// still exist with another case.
+type nameCache struct {
+	folders map[string]map[string]bool
+	mutex   sync.Mutex
+}
+
+// newNameCache creates an empty cache
+func newNameCache() *nameCache {
+	return &nameCache{folders: make(map[string]map[string]bool)}
+}
+
+// contains returns true if a file of the folder of filePath has its name
+// ignoring the case, the folder is listed the first time
+func (n *nameCache) contains(storage Storage, filePath string) bool {
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+
+	folder := filepath.Dir(filePath)
+	names, ok := n.folders[folder]
+	if !ok {
+		files, err := storage.ReadDir(folder)
+		if err != nil && !os.IsNotExist(err) {
+			return false
+		}
+		names = make(map[string]bool, len(files))
+		for _, file := range files {
+			names[strings.ToLower(file.Name())] = true
+		}
+		n.folders[folder] = names
+	}
+	return names[strings.ToLower(filepath.Base(filePath))]
+}
+
+// add Record a file created or renamed to filePath
+func (n *nameCache) add(filePath string) {
+	if n == nil {
+		return
+	}
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+
+	names, ok := n.folders[filepath.Dir(filePath)]
+	if ok {
+		names[strings.ToLower(filepath.Base(filePath))] = true
+	}
+}
+
+// pathExists Check if a file exists, for case insensitive profiles a file
+// differing only by case exists as well
+func (d *Downloader) pathExists(filePath string) bool {
+	_, err := d.storage.Stat(filePath)
+	if err == nil {
+		return true
+	}
+	if !isCaseInsensitive(d.sanitizeProfile()) {
+		return false
+	}
+	if d.names != nil {
+		return d.names.contains(d.storage, filePath)
+	}
+	files, err := d.storage.ReadDir(filepath.Dir(filePath))
+	if err != nil {
+		return false
+	}
+	name := filepath.Base(filePath)
+	for _, file := range files {
+		if strings.EqualFold(file.Name(), name) {
+			return true
+		}
+	}
+	return false
+}
+
+// recordFileNameMapping Keep the name an item would have without sanitizing
+// in its sidecar, when sanitizing changed it
+func (d *Downloader) recordFileNameMapping(item *LibraryItem) {
+	item.OriginalFileName = ""
+	item.SanitizeProfile = ""
+	file := d.templates().file
+	if file == nil {
+		return
+	}
+	context := d.templateContext(&item.MediaItem)
+	sanitized := file.render(context)
+	context.profile = ""
+	original := file.render(context)
+	if original != sanitized {
+		item.OriginalFileName = original
+		item.SanitizeProfile = d.sanitizeProfile()
+	}
+}
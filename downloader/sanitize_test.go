@@ -0,0 +1,133 @@
+package downloader
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestSanitizeName(t *testing.T) {
+	tests := []struct {
+		name    string
+		profile string
+		want    string
+	}{
+		{"a/b\\c.jpg", SanitizePOSIX, "a_b_c.jpg"},
+		{"what?.jpg", SanitizePOSIX, "what?.jpg"},
+		{"what?.jpg", SanitizeWindows, "what_.jpg"},
+		{`a<b>c:d"e|f*.jpg`, SanitizeWindows, "a_b_c_d_e_f_.jpg"},
+		{"trailing. . ", SanitizeWindows, "trailing"},
+		{"CON.jpg", SanitizeWindows, "CON_.jpg"},
+		{"lpt1", SanitizeWindows, "lpt1_"},
+		{"CONSOLE.jpg", SanitizeWindows, "CONSOLE.jpg"},
+		{"bad\xffutf8.jpg", SanitizePOSIX, "bad_utf8.jpg"},
+		{"tab\there.jpg", SanitizePOSIX, "tab_here.jpg"},
+		{"--rm.jpg", SanitizePortable, "rm.jpg"},
+		{"..", SanitizePOSIX, ""},
+		{"a/b", "", "a/b"},
+	}
+	for _, test := range tests {
+		have := sanitizeName(test.name, test.profile)
+		if have != test.want {
+			t.Errorf("sanitizeName(%q, %v) = %q; want %q", test.name, test.profile, have, test.want)
+		}
+	}
+
+	t.Run("Long", func(t *testing.T) {
+		have := sanitizeName(strings.Repeat("é", 200)+".jpeg", SanitizePOSIX)
+		if len(have) > maxNameLength || !strings.HasSuffix(have, "é.jpeg") {
+			t.Errorf("sanitizeName() = %v (%v bytes); want at most %v bytes keeping the extension", have, len(have), maxNameLength)
+		}
+	})
+}
+
+func TestSanitizedFileNames(t *testing.T) {
+	t.Run("Mapping", func(t *testing.T) {
+		downloader := NewDownloader()
+		downloader.Options.UseFileName = true
+		downloader.compileTemplates()
+		downloader.Options.SanitizeProfile = SanitizeWindows
+
+		item := templateTestItem()
+		item.Filename = "Meeting: notes?.jpg"
+		item.UsedFileName = downloader.createFileName(item, 0)
+		downloader.recordFileNameMapping(item)
+
+		if item.UsedFileName != "Meeting_ notes_.jpg" {
+			t.Errorf("downloader.createFileName() = %v", item.UsedFileName)
+		}
+		if item.OriginalFileName != item.Filename || item.SanitizeProfile != SanitizeWindows {
+			t.Errorf("LibraryItem.OriginalFileName = %v (%v); want %v", item.OriginalFileName, item.SanitizeProfile, item.Filename)
+		}
+	})
+
+	t.Run("Case Insensitive Conflict", func(t *testing.T) {
+		downloader := NewDownloader()
+		downloader.Options.BackupFolder = tempPath()
+		defer os.RemoveAll(downloader.Options.BackupFolder)
+		downloader.Options.UseFileName = true
+		downloader.compileTemplates()
+
+		item := templateTestItem()
+		path := downloader.getImageFilePath(item)
+		err := os.MkdirAll(filepath.Dir(path), 0700)
+		if err != nil {
+			t.Fatalf("%v", err)
+		}
+		err = ioutil.WriteFile(filepath.Join(filepath.Dir(path), "img_1234.JPG"), []byte{}, 0644)
+		if err != nil {
+			t.Fatalf("%v", err)
+		}
+
+		downloader.Options.SanitizeProfile = SanitizePOSIX
+		if downloader.isConflictingFilePath(item) {
+			t.Errorf("downloader.isConflictingFilePath() = true; want false for posix")
+		}
+		downloader.Options.SanitizeProfile = SanitizePortable
+		if !downloader.isConflictingFilePath(item) {
+			t.Errorf("downloader.isConflictingFilePath() = false; want true for portable")
+		}
+	})
+}
+
+// listingStorage counts the folders listed through a Storage
+type listingStorage struct {
+	Storage
+	listed int
+}
+
+// ReadDir counts and lists a folder
+func (s *listingStorage) ReadDir(name string) ([]os.FileInfo, error) {
+	s.listed++
+	return s.Storage.ReadDir(name)
+}
+
+func TestNameCache(t *testing.T) {
+	downloader := NewDownloader()
+	downloader.Options.BackupFolder = tempPath()
+	defer os.RemoveAll(downloader.Options.BackupFolder)
+	downloader.Options.SanitizeProfile = SanitizeWindows
+	storage := &listingStorage{Storage: localStorage{}}
+	downloader.storage = storage
+	downloader.names = newNameCache()
+
+	ioutil.WriteFile(filepath.Join(downloader.Options.BackupFolder, "IMG_1.jpg"), nil, 0644)
+	for _, name := range []string{"img_1.jpg", "IMG_2.jpg", "img_3.jpg"} {
+		exists := downloader.pathExists(filepath.Join(downloader.Options.BackupFolder, name))
+		if exists != (name == "img_1.jpg") {
+			t.Errorf("pathExists(%v) = %v", name, exists)
+		}
+	}
+	if storage.listed != 1 {
+		t.Errorf("folder listed %v times; want once per pass", storage.listed)
+	}
+
+	//Files created during the pass are known without listing again
+	ioutil.WriteFile(filepath.Join(downloader.Options.BackupFolder, "IMG_2.jpg"), nil, 0644)
+	downloader.names.add(filepath.Join(downloader.Options.BackupFolder, "IMG_2.jpg"))
+	if !downloader.pathExists(filepath.Join(downloader.Options.BackupFolder, "img_2.jpg")) || storage.listed != 1 {
+		t.Errorf("created files should be added to the cache")
+	}
+}
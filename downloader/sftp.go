@@ -0,0 +1,404 @@
+package downloader
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/url"
+	"os"
+	"os/user"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/sftp"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+// sftpNoSuchFile SSH_FX_NO_SUCH_FILE status of SFTP responses
+const sftpNoSuchFile = 2
+
+// sftpStorage the backup folder on an SFTP server
+type sftpStorage struct {
+	//root the backup folder as joined by the downloader
+	root string
+	//path the backup folder on the server, relative paths start at the home folder
+	path    string
+	address string
+	config  *ssh.ClientConfig
+	//lock guards the connection, which is opened again when lost
+	lock   sync.Mutex
+	conn   *ssh.Client
+	client *sftp.Client
+}
+
+// sshUser the user name to log in with when the URL has none
+func sshUser() string {
+	current, err := user.Current()
+	if err != nil {
+		return os.Getenv("USER")
+	}
+	//Windows user names include the domain
+	return current.Username[strings.LastIndex(current.Username, `\`)+1:]
+}
+
+// sshAuthMethods Authenticate with the ssh agent, and keyFile or the default
+// keys in ~/.ssh. Default keys with a passphrase are skipped, use an ssh agent
+// for them.
+func sshAuthMethods(keyFile string) ([]ssh.AuthMethod, error) {
+	var methods []ssh.AuthMethod
+	if socket := os.Getenv("SSH_AUTH_SOCK"); socket != "" {
+		conn, err := net.Dial("unix", socket)
+		if err == nil {
+			methods = append(methods, ssh.PublicKeysCallback(agent.NewClient(conn).Signers))
+		}
+	}
+	var signers []ssh.Signer
+	if keyFile != "" {
+		data, err := ioutil.ReadFile(keyFile)
+		if err != nil {
+			return nil, err
+		}
+		signer, err := ssh.ParsePrivateKey(data)
+		if err != nil {
+			return nil, fmt.Errorf("failed reading SSH key '%v': %v, keys with a passphrase need an ssh agent", keyFile, err)
+		}
+		signers = append(signers, signer)
+	} else if home, err := os.UserHomeDir(); err == nil {
+		for _, name := range []string{"id_ed25519", "id_ecdsa", "id_rsa"} {
+			data, err := ioutil.ReadFile(filepath.Join(home, ".ssh", name))
+			if err != nil {
+				continue
+			}
+			signer, err := ssh.ParsePrivateKey(data)
+			if err != nil {
+				continue
+			}
+			signers = append(signers, signer)
+		}
+	}
+	if len(signers) > 0 {
+		methods = append(methods, ssh.PublicKeys(signers...))
+	}
+	if len(methods) == 0 {
+		return nil, errors.New("no SSH keys found, set -ssh-key or start an ssh agent")
+	}
+	return methods, nil
+}
+
+// sshHostKeyCallback Check host keys against knownHostsFile, or
+// ~/.ssh/known_hosts
+func sshHostKeyCallback(knownHostsFile string) (ssh.HostKeyCallback, error) {
+	if knownHostsFile == "" {
+		home, err := os.UserHomeDir()
+		if err != nil {
+			return nil, err
+		}
+		knownHostsFile = filepath.Join(home, ".ssh", "known_hosts")
+	}
+	callback, err := knownhosts.New(knownHostsFile)
+	if err != nil {
+		return nil, fmt.Errorf("failed reading known hosts: %v", err)
+	}
+	return func(hostname string, remote net.Addr, key ssh.PublicKey) error {
+		err := callback(hostname, remote, key)
+		var keyErr *knownhosts.KeyError
+		if errors.As(err, &keyErr) {
+			if len(keyErr.Want) == 0 {
+				return fmt.Errorf("unknown host key of %v, add it to '%v' (e.g. with ssh-keyscan) after checking its fingerprint %v", hostname, knownHostsFile, ssh.FingerprintSHA256(key))
+			}
+			return fmt.Errorf("host key of %v does not match '%v', it changed or the connection is intercepted", hostname, knownHostsFile)
+		}
+		return err
+	}, nil
+}
+
+// newSFTPStorage opens `sftp://user@host:port/path`, paths starting with
+// `/~/` are in the home folder of the user
+func newSFTPStorage(folder string, location *url.URL, options *Options) (*sftpStorage, error) {
+	if location.Hostname() == "" {
+		return nil, fmt.Errorf("missing host in '%v'", folder)
+	}
+	s := &sftpStorage{
+		root: filepath.Clean(folder),
+		path: location.Path,
+	}
+	switch {
+	case s.path == "" || s.path == "/~":
+		s.path = "."
+	case strings.HasPrefix(s.path, "/~/"):
+		s.path = s.path[len("/~/"):]
+	}
+	port := location.Port()
+	if port == "" {
+		port = "22"
+	}
+	s.address = net.JoinHostPort(location.Hostname(), port)
+	userName := location.User.Username()
+	if userName == "" {
+		userName = sshUser()
+	}
+	methods, err := sshAuthMethods(options.SSHKey)
+	if err != nil {
+		return nil, err
+	}
+	hostKeyCallback, err := sshHostKeyCallback(options.KnownHosts)
+	if err != nil {
+		return nil, err
+	}
+	s.config = &ssh.ClientConfig{
+		User:            userName,
+		Auth:            methods,
+		HostKeyCallback: hostKeyCallback,
+		Timeout:         30 * time.Second,
+	}
+	_, err = s.connect()
+	if err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// connect returns the SFTP client, connecting when not connected
+func (s *sftpStorage) connect() (*sftp.Client, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.client != nil {
+		return s.client, nil
+	}
+	conn, err := ssh.Dial("tcp", s.address, s.config)
+	if err != nil {
+		return nil, fmt.Errorf("failed connecting to %v: %v", s.address, err)
+	}
+	client, err := sftp.NewClient(conn)
+	if err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("failed starting SFTP on %v: %v", s.address, err)
+	}
+	s.conn, s.client = conn, client
+	return client, nil
+}
+
+// disconnect Close a lost connection, the next request connects again
+func (s *sftpStorage) disconnect(client *sftp.Client) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.client != client {
+		return
+	}
+	s.client.Close()
+	s.conn.Close()
+	s.client, s.conn = nil, nil
+}
+
+// do Run fn with the SFTP client, once more on a new connection if the
+// connection was lost
+func (s *sftpStorage) do(fn func(client *sftp.Client) error) error {
+	client, err := s.connect()
+	if err != nil {
+		return err
+	}
+	err = fn(client)
+	if !errors.Is(err, sftp.ErrSSHFxConnectionLost) {
+		return err
+	}
+	s.disconnect(client)
+	client, err = s.connect()
+	if err != nil {
+		return err
+	}
+	return fn(client)
+}
+
+// remote the path on the server of a name in the backup folder
+func (s *sftpStorage) remote(name string) (string, error) {
+	relative, err := filepath.Rel(s.root, filepath.Clean(name))
+	if err != nil {
+		return "", err
+	}
+	relative = filepath.ToSlash(relative)
+	if relative == ".." || strings.HasPrefix(relative, "../") {
+		return "", fmt.Errorf("'%v' is outside of '%v'", name, s.root)
+	}
+	return path.Join(s.path, relative), nil
+}
+
+// sftpError Return missing file errors of the server as errors satisfying
+// os.IsNotExist
+func sftpError(op string, name string, err error) error {
+	var status *sftp.StatusError
+	if errors.Is(err, os.ErrNotExist) || errors.As(err, &status) && status.Code == sftpNoSuchFile {
+		return &os.PathError{Op: op, Path: name, Err: os.ErrNotExist}
+	}
+	return err
+}
+
+func (s *sftpStorage) Stat(name string) (os.FileInfo, error) {
+	remote, err := s.remote(name)
+	if err != nil {
+		return nil, err
+	}
+	var info os.FileInfo
+	err = s.do(func(client *sftp.Client) error {
+		info, err = client.Stat(remote)
+		return err
+	})
+	return info, sftpError("stat", name, err)
+}
+
+func (s *sftpStorage) ReadDir(name string) ([]os.FileInfo, error) {
+	remote, err := s.remote(name)
+	if err != nil {
+		return nil, err
+	}
+	var files []os.FileInfo
+	err = s.do(func(client *sftp.Client) error {
+		files, err = client.ReadDir(remote)
+		return err
+	})
+	if err != nil {
+		return nil, sftpError("readdir", name, err)
+	}
+	sort.Slice(files, func(i, j int) bool { return files[i].Name() < files[j].Name() })
+	return files, nil
+}
+
+func (s *sftpStorage) Walk(root string, skipDir func(name string) bool, fn func(name string, info os.FileInfo) error) error {
+	return walkStorage(s, root, skipDir, fn)
+}
+
+func (s *sftpStorage) MkdirAll(name string) error {
+	remote, err := s.remote(name)
+	if err != nil {
+		return err
+	}
+	return s.do(func(client *sftp.Client) error {
+		return client.MkdirAll(remote)
+	})
+}
+
+func (s *sftpStorage) Open(name string) (io.ReadCloser, error) {
+	remote, err := s.remote(name)
+	if err != nil {
+		return nil, err
+	}
+	var file *sftp.File
+	err = s.do(func(client *sftp.Client) error {
+		file, err = client.Open(remote)
+		return err
+	})
+	if err != nil {
+		return nil, sftpError("open", name, err)
+	}
+	return file, nil
+}
+
+// sftpWriter streams a file to a temporary name, which is renamed to the file
+// name once complete, so a partial file never has the name of a complete one
+type sftpWriter struct {
+	*sftp.File
+	client  *sftp.Client
+	temp    string
+	remote  string
+	modTime time.Time
+}
+
+func (s *sftpStorage) Create(name string, modTime time.Time) (StorageWriter, error) {
+	remote, err := s.remote(name)
+	if err != nil {
+		return nil, err
+	}
+	temp := path.Join(path.Dir(remote), "."+path.Base(remote)+storageTempSuffix)
+	writer := &sftpWriter{temp: temp, remote: remote, modTime: modTime}
+	err = s.do(func(client *sftp.Client) error {
+		writer.client = client
+		writer.File, err = client.Create(temp)
+		return err
+	})
+	if err != nil {
+		return nil, sftpError("create", name, err)
+	}
+	return writer, nil
+}
+
+// Close closes the temporary file, sets its modification time and renames it
+func (w *sftpWriter) Close() error {
+	err := w.File.Close()
+	if err == nil && !w.modTime.IsZero() {
+		err = w.client.Chtimes(w.temp, time.Now(), w.modTime)
+		if err != nil {
+			err = fmt.Errorf("failed writing timestamp to file: %v", err)
+		}
+	}
+	if err == nil {
+		err = sftpRename(w.client, w.temp, w.remote)
+	}
+	if err != nil {
+		w.client.Remove(w.temp)
+	}
+	return err
+}
+
+// Abort closes and removes the temporary file
+func (w *sftpWriter) Abort() error {
+	w.File.Close()
+	return w.client.Remove(w.temp)
+}
+
+// sftpRename Rename a file replacing an existing one, atomically if the
+// server supports the OpenSSH POSIX rename extension
+func sftpRename(client *sftp.Client, from string, to string) error {
+	if _, ok := client.HasExtension("posix-rename@openssh.com"); ok {
+		return client.PosixRename(from, to)
+	}
+	//Plain SFTP renames fail when the target exists
+	err := client.Remove(to)
+	if err != nil && !os.IsNotExist(sftpError("remove", to, err)) {
+		return err
+	}
+	return client.Rename(from, to)
+}
+
+func (s *sftpStorage) Remove(name string) error {
+	remote, err := s.remote(name)
+	if err != nil {
+		return err
+	}
+	err = s.do(func(client *sftp.Client) error {
+		return client.Remove(remote)
+	})
+	return sftpError("remove", name, err)
+}
+
+func (s *sftpStorage) Rename(from string, to string) error {
+	fromRemote, err := s.remote(from)
+	if err != nil {
+		return err
+	}
+	toRemote, err := s.remote(to)
+	if err != nil {
+		return err
+	}
+	err = s.do(func(client *sftp.Client) error {
+		return sftpRename(client, fromRemote, toRemote)
+	})
+	return sftpError("rename", from, err)
+}
+
+func (s *sftpStorage) Chtimes(name string, modTime time.Time) error {
+	remote, err := s.remote(name)
+	if err != nil {
+		return err
+	}
+	err = s.do(func(client *sftp.Client) error {
+		return client.Chtimes(remote, time.Now(), modTime)
+	})
+	return sftpError("chtimes", name, err)
+}
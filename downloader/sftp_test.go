@@ -0,0 +1,186 @@
+package downloader
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/pkg/sftp"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+// startTestSFTPServer Serve SFTP over SSH on a local port, for clients with
+// clientKey. Returns the listener and the host key.
+func startTestSFTPServer(t *testing.T, clientKey ssh.PublicKey) (net.Listener, ssh.Signer) {
+	_, privateKey, _ := ed25519.GenerateKey(nil)
+	hostKey, err := ssh.NewSignerFromKey(privateKey)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	config := &ssh.ServerConfig{
+		PublicKeyCallback: func(conn ssh.ConnMetadata, key ssh.PublicKey) (*ssh.Permissions, error) {
+			if conn.User() == "tester" && bytes.Equal(key.Marshal(), clientKey.Marshal()) {
+				return nil, nil
+			}
+			return nil, errors.New("unknown key")
+		},
+	}
+	config.AddHostKey(hostKey)
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go serveTestSFTP(conn, config)
+		}
+	}()
+	return listener, hostKey
+}
+
+// serveTestSFTP Serve the sftp subsystem of an SSH connection
+func serveTestSFTP(conn net.Conn, config *ssh.ServerConfig) {
+	_, channels, requests, err := ssh.NewServerConn(conn, config)
+	if err != nil {
+		return
+	}
+	go ssh.DiscardRequests(requests)
+	for newChannel := range channels {
+		if newChannel.ChannelType() != "session" {
+			newChannel.Reject(ssh.UnknownChannelType, "session only")
+			continue
+		}
+		channel, requests, err := newChannel.Accept()
+		if err != nil {
+			continue
+		}
+		go func() {
+			for request := range requests {
+				ok := request.Type == "subsystem" && len(request.Payload) > 4 && string(request.Payload[4:]) == "sftp"
+				request.Reply(ok, nil)
+				if ok {
+					server, err := sftp.NewServer(channel)
+					if err == nil {
+						go func() {
+							server.Serve()
+							channel.Close()
+						}()
+					}
+				}
+			}
+		}()
+	}
+}
+
+// writeTestSSHKey Write a private key for the client, returns its public key
+func writeTestSSHKey(t *testing.T, filePath string) ssh.PublicKey {
+	publicKey, privateKey, _ := ed25519.GenerateKey(nil)
+	data, err := x509.MarshalPKCS8PrivateKey(privateKey)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	err = ioutil.WriteFile(filePath, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: data}), 0600)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	key, _ := ssh.NewPublicKey(publicKey)
+	return key
+}
+
+func TestSFTPStorage(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("the test server serves local paths as SFTP paths")
+	}
+	defer os.Setenv("SSH_AUTH_SOCK", os.Getenv("SSH_AUTH_SOCK"))
+	os.Setenv("SSH_AUTH_SOCK", "")
+	keyFolder := tempPath()
+	os.MkdirAll(keyFolder, 0700)
+	defer os.RemoveAll(keyFolder)
+	options := &Options{
+		SSHKey:     filepath.Join(keyFolder, "id_ed25519"),
+		KnownHosts: filepath.Join(keyFolder, "known_hosts"),
+	}
+	listener, hostKey := startTestSFTPServer(t, writeTestSSHKey(t, options.SSHKey))
+	defer listener.Close()
+	address := listener.Addr().String()
+	folder := tempPath()
+	os.MkdirAll(folder, 0700)
+	defer os.RemoveAll(folder)
+	options.BackupFolder = "sftp://tester@" + address + folder
+
+	//Unknown and changed host keys are refused
+	ioutil.WriteFile(options.KnownHosts, nil, 0600)
+	_, err := NewStorage(options)
+	if err == nil || !strings.Contains(err.Error(), "unknown host key") {
+		t.Errorf("NewStorage() with an unknown host = %v", err)
+	}
+	otherKey := writeTestSSHKey(t, filepath.Join(keyFolder, "other"))
+	ioutil.WriteFile(options.KnownHosts, []byte(knownhosts.Line([]string{knownhosts.Normalize(address)}, otherKey)+"\n"), 0600)
+	_, err = NewStorage(options)
+	if err == nil || !strings.Contains(err.Error(), "does not match") {
+		t.Errorf("NewStorage() with a changed host key = %v", err)
+	}
+
+	ioutil.WriteFile(options.KnownHosts, []byte(knownhosts.Line([]string{knownhosts.Normalize(address)}, hostKey.PublicKey())+"\n"), 0600)
+	storage, err := NewStorage(options)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	testStorage(t, storage, options.BackupFolder)
+
+	//Files are written to a temporary name and renamed when complete
+	name := filepath.Join(options.BackupFolder, "IMG_1.JPG")
+	writer, err := storage.Create(name, time.Time{})
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	writer.Write([]byte("partial"))
+	if _, err := os.Stat(filepath.Join(folder, ".IMG_1.JPG"+storageTempSuffix)); err != nil {
+		t.Errorf("file should be written to a temporary name: %v", err)
+	}
+	if _, err := storage.Stat(name); !os.IsNotExist(err) {
+		t.Errorf("incomplete file should not have its name: %v", err)
+	}
+	writer.Close()
+	data, err := ioutil.ReadFile(filepath.Join(folder, "IMG_1.JPG"))
+	if err != nil || string(data) != "partial" {
+		t.Errorf("file = %q, %v", data, err)
+	}
+	writer, _ = storage.Create(filepath.Join(options.BackupFolder, "IMG_2.JPG"), time.Time{})
+	writer.Write([]byte("aborted"))
+	writer.Abort()
+	files, _ := ioutil.ReadDir(folder)
+	for _, file := range files {
+		if strings.HasSuffix(file.Name(), storageTempSuffix) || file.Name() == "IMG_2.JPG" {
+			t.Errorf("aborted file %v should be removed", file.Name())
+		}
+	}
+
+	//Names differing by case conflict on case insensitive profiles
+	downloader := NewDownloader()
+	downloader.Options.BackupFolder = options.BackupFolder
+	downloader.storage = storage
+	downloader.Options.SanitizeProfile = SanitizeWindows
+	if !downloader.pathExists(filepath.Join(options.BackupFolder, "img_1.jpg")) {
+		t.Errorf("pathExists() = false; want true for windows")
+	}
+	downloader.Options.SanitizeProfile = SanitizePOSIX
+	if downloader.pathExists(filepath.Join(options.BackupFolder, "img_1.jpg")) {
+		t.Errorf("pathExists() = true; want false for posix")
+	}
+}
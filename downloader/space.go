@@ -0,0 +1,200 @@
+package downloader
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/dustin/go-humanize"
+	photoslibrary "github.com/gphotosuploader/googlemirror/api/photoslibrary/v1"
+)
+
+const (
+	//photoBytesPerPixel estimated bytes per pixel of compressed photos (JPEG, HEIC, WebP)
+	photoBytesPerPixel = 1
+	//losslessBytesPerPixel estimated bytes per pixel of PNG, TIFF, BMP and raw photos
+	losslessBytesPerPixel = 4
+	//videoBytesPerPixel estimated bytes per pixel of a video of about a minute,
+	//as the duration is not known before downloading
+	videoBytesPerPixel = 64
+	//unknownPhotoSize estimated size of a photo without dimensions
+	unknownPhotoSize = 20 * 1000 * 1000
+	//unknownVideoSize estimated size of a video without dimensions
+	unknownVideoSize = 500 * 1000 * 1000
+)
+
+// spaceLimitError a download would go over the free space or archive size limits
+type spaceLimitError struct {
+	message string
+}
+
+// Error returns the limit which was hit
+func (e *spaceLimitError) Error() string {
+	return e.message
+}
+
+// isSpaceLimit returns true when err is a spaceLimitError
+func isSpaceLimit(err error) bool {
+	_, ok := err.(*spaceLimitError)
+	return ok
+}
+
+// spaceGuard checks there is room for each download before it starts
+type spaceGuard struct {
+	//folder local backup folder whose volume free space is checked, empty for remote storage
+	folder string
+	//minFree bytes to leave free on the volume of folder, on top of the
+	//downloads, which always have to fit
+	minFree uint64
+	//maxSize bytes the media files of the backup folder may take, 0 is unlimited
+	maxSize uint64
+	//used bytes taken by the stored media files
+	used uint64
+	//reserved estimated bytes of the downloads in progress
+	reserved uint64
+	//freeSpace returns the bytes available on the volume of a folder
+	freeSpace func(folder string) (uint64, error)
+	mutex     sync.Mutex
+}
+
+// parseSize parses a size such as `10GB` or `500MiB` into bytes, empty is 0
+func parseSize(text string) (uint64, error) {
+	text = strings.TrimSpace(text)
+	if text == "" {
+		return 0, nil
+	}
+	size, err := humanize.ParseBytes(text)
+	if err != nil {
+		return 0, fmt.Errorf("invalid size '%v'", text)
+	}
+	return size, nil
+}
+
+// newSpaceGuard creates the guard of the size limits of the options, the
+// stored size is taken from the catalog when the archive size is limited
+func (d *Downloader) newSpaceGuard(catalog *Catalog) (*spaceGuard, error) {
+	minFree, err := parseSize(d.Options.MinFreeSpace)
+	if err != nil {
+		return nil, fmt.Errorf("invalid -min-free: %v", err)
+	}
+	maxSize, err := parseSize(d.Options.MaxArchiveSize)
+	if err != nil {
+		return nil, fmt.Errorf("invalid -max-size: %v", err)
+	}
+	guard := &spaceGuard{folder: d.localBackupFolder(), minFree: minFree, maxSize: maxSize, freeSpace: freeSpace}
+	if guard.folder == "" && minFree > 0 {
+		log.Printf("Free space of remote backup folders is not checked, -min-free is ignored")
+	}
+	if guard.folder != "" {
+		_, err = guard.freeSpace(existingParent(guard.folder))
+		if err != nil {
+			log.Printf("Free space of '%v' is not checked: %v", guard.folder, err)
+			guard.folder = ""
+		}
+	}
+	if maxSize > 0 {
+		for _, entry := range catalog.items {
+			if entry.Item.AliasOf == "" && entry.Item.Size > 0 {
+				guard.used += uint64(entry.Item.Size)
+			}
+		}
+		log.Printf("Backup folder holds %v of media files, limit %v", humanize.Bytes(guard.used), humanize.Bytes(maxSize))
+	}
+	return guard, nil
+}
+
+// localBackupFolder returns the backup folder when it is on the local file
+// system, encrypted or not, and empty otherwise
+func (d *Downloader) localBackupFolder() string {
+	storage := d.storage
+	if encrypted, ok := storage.(*encryptedStorage); ok {
+		storage = encrypted.Storage
+	}
+	if _, ok := storage.(localStorage); !ok {
+		return ""
+	}
+	return d.Options.BackupFolder
+}
+
+// estimateSize estimates the bytes of a media item before downloading it,
+// from its dimensions and type
+func estimateSize(item *photoslibrary.MediaItem) uint64 {
+	mimeType := strings.ToLower(item.MimeType)
+	video := strings.HasPrefix(mimeType, "video")
+	var pixels uint64
+	if item.MediaMetadata != nil && item.MediaMetadata.Width > 0 && item.MediaMetadata.Height > 0 {
+		pixels = uint64(item.MediaMetadata.Width) * uint64(item.MediaMetadata.Height)
+	}
+	switch {
+	case pixels == 0 && video:
+		return unknownVideoSize
+	case pixels == 0:
+		return unknownPhotoSize
+	case video:
+		return pixels * videoBytesPerPixel
+	case strings.HasSuffix(mimeType, "/png"), strings.HasSuffix(mimeType, "/tiff"), strings.HasSuffix(mimeType, "/bmp"),
+		strings.HasPrefix(mimeType, "image/x-"), strings.HasSuffix(mimeType, "/dng"):
+		return pixels * losslessBytesPerPixel
+	}
+	return pixels * photoBytesPerPixel
+}
+
+// reserve Reserve the estimated size of item for its download, or return a
+// spaceLimitError when it would go over a limit
+func (g *spaceGuard) reserve(item *LibraryItem) (uint64, error) {
+	if g == nil {
+		return 0, nil
+	}
+	estimate := estimateSize(&item.MediaItem)
+
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+
+	if g.maxSize > 0 && g.used+g.reserved+estimate > g.maxSize {
+		return 0, &spaceLimitError{fmt.Sprintf("the backup folder holds %v, '%v' (about %v) would go over the -max-size limit of %v",
+			humanize.Bytes(g.used), item.Filename, humanize.Bytes(estimate), humanize.Bytes(g.maxSize))}
+	}
+	if g.folder != "" {
+		free, err := g.freeSpace(existingParent(g.folder))
+		if err != nil {
+			log.Printf("Failed to get the free space of '%v': %v", g.folder, err)
+		} else if free < g.reserved+estimate+g.minFree && g.minFree == 0 {
+			return 0, &spaceLimitError{fmt.Sprintf("%v free on the volume of '%v', '%v' (about %v) would not fit",
+				humanize.Bytes(free), g.folder, item.Filename, humanize.Bytes(estimate))}
+		} else if free < g.reserved+estimate+g.minFree {
+			return 0, &spaceLimitError{fmt.Sprintf("%v free on the volume of '%v', '%v' (about %v) would leave less than the -min-free of %v",
+				humanize.Bytes(free), g.folder, item.Filename, humanize.Bytes(estimate), humanize.Bytes(g.minFree))}
+		}
+	}
+	g.reserved += estimate
+	return estimate, nil
+}
+
+// release Release the reservation of a finished download, which stored
+// written bytes
+func (g *spaceGuard) release(estimate uint64, written uint64) {
+	if g == nil {
+		return
+	}
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+
+	g.reserved -= estimate
+	g.used += written
+}
+
+// existingParent returns folder, or its closest existing parent when it is
+// not created yet
+func existingParent(folder string) string {
+	for {
+		_, err := os.Stat(folder)
+		parent := filepath.Dir(folder)
+		if err == nil || parent == folder {
+			return folder
+		}
+		folder = parent
+	}
+}
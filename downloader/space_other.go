@@ -0,0 +1,15 @@
+//go:build !linux && !darwin && !freebsd && !windows
+// +build !linux,!darwin,!freebsd,!windows
+
+package downloader
+
+import (
+	"errors"
+	"os"
+)
+
+// freeSpace returns the bytes available on the volume of folder, not
+// available on this OS
+func freeSpace(folder string) (uint64, error) {
+	return 0, &os.PathError{Op: "statfs", Path: folder, Err: errors.New("not supported on this OS")}
+}
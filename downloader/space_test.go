@@ -0,0 +1,145 @@
+package downloader
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	photoslibrary "github.com/gphotosuploader/googlemirror/api/photoslibrary/v1"
+)
+
+func TestEstimateSize(t *testing.T) {
+	sizes := []struct {
+		mimeType string
+		width    int64
+		height   int64
+		size     uint64
+	}{
+		{"image/jpeg", 4000, 3000, 12000000},
+		{"image/heif", 4000, 3000, 12000000},
+		{"image/png", 1000, 1000, 4000000},
+		{"image/x-canon-cr2", 1000, 1000, 4000000},
+		{"video/mp4", 1920, 1080, 1920 * 1080 * videoBytesPerPixel},
+		{"image/jpeg", 0, 0, unknownPhotoSize},
+		{"video/mp4", 0, 0, unknownVideoSize},
+	}
+	for _, s := range sizes {
+		item := &photoslibrary.MediaItem{MimeType: s.mimeType, MediaMetadata: &photoslibrary.MediaMetadata{Width: s.width, Height: s.height}}
+		size := estimateSize(item)
+		if size != s.size {
+			t.Errorf("estimateSize(%v %vx%v) = %v; want %v", s.mimeType, s.width, s.height, size, s.size)
+		}
+	}
+	if estimateSize(&photoslibrary.MediaItem{MimeType: "image/jpeg"}) != unknownPhotoSize {
+		t.Errorf("items without metadata should have the unknown size")
+	}
+}
+
+func TestParseSize(t *testing.T) {
+	sizes := map[string]uint64{"": 0, "10GB": 10000000000, "500MiB": 500 * 1024 * 1024, " 1 kb ": 1000}
+	for text, want := range sizes {
+		size, err := parseSize(text)
+		if err != nil || size != want {
+			t.Errorf("parseSize(%q) = %v, %v; want %v", text, size, err, want)
+		}
+	}
+	_, err := parseSize("lots")
+	if err == nil {
+		t.Errorf("parseSize() should fail for invalid sizes")
+	}
+}
+
+func TestSpaceGuard(t *testing.T) {
+	downloader := NewDownloader()
+	downloader.Options.BackupFolder = tempPath()
+	defer os.RemoveAll(downloader.Options.BackupFolder)
+	downloader.Options.MinFreeSpace = "1MB"
+	downloader.Options.MaxArchiveSize = "10MB"
+
+	stored := adoptTestItem("ABCDEFGHIJKLMNOPQRSTUVW1", "IMG_1.jpg")
+	stored.UsedFileName = downloader.createFileName(stored, 0)
+	stored.Size = 4000000
+	downloader.writeJSON(stored, downloader.getJSONFilePath(&stored.MediaItem))
+	alias := adoptTestItem("ABCDEFGHIJKLMNOPQRSTUVW2", "IMG_2.jpg")
+	alias.UsedFileName = downloader.createFileName(alias, 0)
+	alias.Size = 4000000
+	alias.AliasOf = stored.Id
+	downloader.writeJSON(alias, downloader.getJSONFilePath(&alias.MediaItem))
+	catalog, err := downloader.loadCatalog()
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	guard, err := downloader.newSpaceGuard(catalog)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	if guard.used != 4000000 || guard.folder != downloader.Options.BackupFolder {
+		t.Errorf("used = %v, folder = '%v'; want the size of the media files of the backup folder", guard.used, guard.folder)
+	}
+	free := uint64(5000000)
+	guard.freeSpace = func(folder string) (uint64, error) {
+		return free, nil
+	}
+	downloader.space = guard
+
+	//Reservations of downloads in progress count against the free space
+	photo := adoptTestItem("ABCDEFGHIJKLMNOPQRSTUVW3", "IMG_3.jpg")
+	photo.MediaMetadata.Width, photo.MediaMetadata.Height = 2000, 1000
+	estimate, err := guard.reserve(photo)
+	if err != nil || estimate != 2000000 {
+		t.Fatalf("reserve() = %v, %v", estimate, err)
+	}
+	_, err = guard.reserve(photo)
+	if err != nil {
+		t.Errorf("reserve() = %v; want room for a second photo", err)
+	}
+	_, err = guard.reserve(photo)
+	if !isSpaceLimit(err) {
+		t.Errorf("reserve() = %v; want the -min-free limit", err)
+	}
+	guard.release(estimate, 1500000)
+	guard.release(estimate, 1500000)
+	if guard.reserved != 0 || guard.used != 7000000 {
+		t.Errorf("reserved = %v, used = %v; want 0, 7000000", guard.reserved, guard.used)
+	}
+
+	//Downloads over the archive size do not start
+	free = 100000000
+	_, err = guard.reserve(photo)
+	if err != nil {
+		t.Errorf("reserve() = %v", err)
+	}
+	filePath := filepath.Join(downloader.Options.BackupFolder, "IMG_3.jpg")
+	err = downloader.createImage(photo, filePath)
+	if !isSpaceLimit(err) {
+		t.Errorf("createImage() = %v; want the -max-size limit", err)
+	}
+	if _, err := os.Stat(filePath); !os.IsNotExist(err) {
+		t.Errorf("paused downloads should not create files: %v", err)
+	}
+
+	//Without -min-free downloads still have to fit in the free space
+	downloader.Options.MinFreeSpace = ""
+	downloader.Options.MaxArchiveSize = ""
+	guard, err = downloader.newSpaceGuard(catalog)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	guard.freeSpace = func(folder string) (uint64, error) {
+		return 3000000, nil
+	}
+	_, err = guard.reserve(photo)
+	if err != nil {
+		t.Errorf("reserve() = %v; want room for a photo", err)
+	}
+	_, err = guard.reserve(photo)
+	if !isSpaceLimit(err) {
+		t.Errorf("reserve() = %v; want the free space limit", err)
+	}
+
+	downloader.Options.MaxArchiveSize = "big"
+	_, err = downloader.newSpaceGuard(catalog)
+	if err == nil {
+		t.Errorf("newSpaceGuard() should fail for invalid sizes")
+	}
+}
@@ -0,0 +1,16 @@
+//go:build linux || darwin || freebsd
+// +build linux darwin freebsd
+
+package downloader
+
+import "syscall"
+
+// freeSpace returns the bytes available to the user on the volume of folder
+func freeSpace(folder string) (uint64, error) {
+	var stat syscall.Statfs_t
+	err := syscall.Statfs(folder, &stat)
+	if err != nil {
+		return 0, err
+	}
+	return uint64(stat.Bavail) * uint64(stat.Bsize), nil
+}
@@ -0,0 +1,23 @@
+package downloader
+
+import (
+	"syscall"
+	"unsafe"
+)
+
+// getDiskFreeSpaceEx GetDiskFreeSpaceExW of kernel32.dll
+var getDiskFreeSpaceEx = syscall.NewLazyDLL("kernel32.dll").NewProc("GetDiskFreeSpaceExW")
+
+// freeSpace returns the bytes available to the user on the volume of folder
+func freeSpace(folder string) (uint64, error) {
+	path, err := syscall.UTF16PtrFromString(folder)
+	if err != nil {
+		return 0, err
+	}
+	var available uint64
+	result, _, err := getDiskFreeSpaceEx.Call(uintptr(unsafe.Pointer(path)), uintptr(unsafe.Pointer(&available)), 0, 0)
+	if result == 0 {
+		return 0, err
+	}
+	return available, nil
+}
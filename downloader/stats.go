@@ -1,9 +1,14 @@
 package downloader
 
 import (
+	"io"
 	"sync"
+	"time"
 )
 
+// throughputWindow number of seconds the throughput is averaged over
+const throughputWindow = 10
+
 // Stats TODO
 type Stats struct {
 	Total      int
@@ -11,6 +16,15 @@ type Stats struct {
 	TotalSize  uint64
 	Downloaded int
 	Skipped    int
+	Deleted    int
+	Updated    int
+	Pending    int
+	Linked     int
+	Adopted    int
+
+	//transferred bytes per second over the last throughputWindow seconds
+	transferred       [throughputWindow]uint64
+	transferredSecond [throughputWindow]int64
 
 	mutex sync.Mutex
 }
@@ -47,3 +61,92 @@ func (s *Stats) UpdateStatsSkipped(skipped int) {
 
 	s.Skipped += skipped
 }
+
+// UpdateStatsDeleted increment the items deleted from Google Photos
+func (s *Stats) UpdateStatsDeleted(deleted int) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	s.Deleted += deleted
+}
+
+// UpdateStatsUpdated increment the items with refreshed metadata
+func (s *Stats) UpdateStatsUpdated(updated int) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	s.Updated += updated
+}
+
+// UpdateStatsLinked increment the imported items linked to Google Photos items
+func (s *Stats) UpdateStatsLinked(linked int) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	s.Linked += linked
+}
+
+// UpdateStatsAdopted increment the items taken from the adopt folder
+func (s *Stats) UpdateStatsAdopted(adopted int) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	s.Adopted += adopted
+}
+
+// SetStatsPending set the items waiting in the deferred queue
+func (s *Stats) SetStatsPending(pending int) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	s.Pending = pending
+}
+
+// UpdateStatsTransferred records bytes transferred now, used for throughput
+func (s *Stats) UpdateStatsTransferred(transferred int) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	second := time.Now().Unix()
+	index := second % throughputWindow
+	if s.transferredSecond[index] != second {
+		s.transferredSecond[index] = second
+		s.transferred[index] = 0
+	}
+	s.transferred[index] += uint64(transferred)
+}
+
+// Throughput returns the current download rate of all downloads in bytes/sec
+func (s *Stats) Throughput() float64 {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	now := time.Now().Unix()
+	var total uint64
+	for i := range s.transferred {
+		if now-s.transferredSecond[i] < throughputWindow {
+			total += s.transferred[i]
+		}
+	}
+	return float64(total) / throughputWindow
+}
+
+// Reader wraps r so bytes read are counted towards the throughput
+func (s *Stats) Reader(r io.Reader) io.Reader {
+	return &meteredReader{reader: r, stats: s}
+}
+
+// meteredReader a reader reporting transferred bytes to Stats
+type meteredReader struct {
+	reader io.Reader
+	stats  *Stats
+}
+
+// Read reads and records the transferred bytes
+func (m *meteredReader) Read(p []byte) (int, error) {
+	n, err := m.reader.Read(p)
+	if n > 0 {
+		m.stats.UpdateStatsTransferred(n)
+	}
+	return n, err
+}
@@ -0,0 +1,309 @@
+package downloader
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// storageTempSuffix suffix of files remote storages are writing, they are
+// renamed to their name once complete
+const storageTempSuffix = ".gitmoo-tmp"
+
+// Storage where the backup folder is kept. Names are paths inside the backup
+// folder, joined to Options.BackupFolder with filepath.Join. Errors for missing
+// files satisfy os.IsNotExist.
+type Storage interface {
+	//Stat returns the size and modification time of a file
+	Stat(name string) (os.FileInfo, error)
+	//ReadDir lists the files and folders of a folder
+	ReadDir(name string) ([]os.FileInfo, error)
+	//Walk calls fn for every file under root, skipping the folders skipDir returns true for
+	Walk(root string, skipDir func(name string) bool, fn func(name string, info os.FileInfo) error) error
+	//MkdirAll creates a folder and its parents, if the storage has folders
+	MkdirAll(name string) error
+	//Open opens a file for reading
+	Open(name string) (io.ReadCloser, error)
+	//Create streams a file, replacing an existing one, modTime is set unless it is zero
+	Create(name string, modTime time.Time) (StorageWriter, error)
+	//Remove removes a file
+	Remove(name string) error
+	//Rename moves a file, replacing an existing one
+	Rename(from string, to string) error
+	//Chtimes sets the modification time of a file
+	Chtimes(name string, modTime time.Time) error
+}
+
+// StorageWriter a file being written to a Storage
+type StorageWriter interface {
+	io.Writer
+	//Close finishes the file, it is not complete before Close succeeds
+	Close() error
+	//Abort discards the file
+	Abort() error
+}
+
+// localStorage the backup folder on a local (or mounted) file system
+type localStorage struct{}
+
+// localWriter a file being written to the local file system
+type localWriter struct {
+	*os.File
+	modTime time.Time
+}
+
+// Close closes the file and sets its modification time
+func (w *localWriter) Close() error {
+	err := w.File.Close()
+	if err != nil || w.modTime.IsZero() {
+		return err
+	}
+	err = os.Chtimes(w.Name(), time.Now(), w.modTime)
+	if err != nil {
+		return fmt.Errorf("failed writing timestamp to file: %v", err)
+	}
+	return nil
+}
+
+// Abort closes and removes the file
+func (w *localWriter) Abort() error {
+	w.File.Close()
+	return os.Remove(w.Name())
+}
+
+func (localStorage) Stat(name string) (os.FileInfo, error) {
+	return os.Stat(name)
+}
+
+func (localStorage) ReadDir(name string) ([]os.FileInfo, error) {
+	return ioutil.ReadDir(name)
+}
+
+func (localStorage) Walk(root string, skipDir func(name string) bool, fn func(name string, info os.FileInfo) error) error {
+	return filepath.Walk(root, func(name string, info os.FileInfo, err error) error {
+		if err != nil {
+			//Missing root or files removed while walking
+			if os.IsNotExist(err) {
+				return nil
+			}
+			return err
+		}
+		if info.IsDir() {
+			if name != root && skipDir != nil && skipDir(name) {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		return fn(name, info)
+	})
+}
+
+func (localStorage) MkdirAll(name string) error {
+	return os.MkdirAll(name, 0700)
+}
+
+func (localStorage) Open(name string) (io.ReadCloser, error) {
+	return os.Open(name)
+}
+
+func (localStorage) Create(name string, modTime time.Time) (StorageWriter, error) {
+	file, err := os.Create(name)
+	if err != nil {
+		return nil, err
+	}
+	return &localWriter{File: file, modTime: modTime}, nil
+}
+
+func (localStorage) Remove(name string) error {
+	return os.Remove(name)
+}
+
+func (localStorage) Rename(from string, to string) error {
+	return os.Rename(from, to)
+}
+
+func (localStorage) Chtimes(name string, modTime time.Time) error {
+	return os.Chtimes(name, time.Now(), modTime)
+}
+
+// storageFileInfo a file or folder of a storage without file system info
+type storageFileInfo struct {
+	name    string
+	size    int64
+	modTime time.Time
+	dir     bool
+}
+
+func (i *storageFileInfo) Name() string       { return i.name }
+func (i *storageFileInfo) Size() int64        { return i.size }
+func (i *storageFileInfo) ModTime() time.Time { return i.modTime }
+func (i *storageFileInfo) IsDir() bool        { return i.dir }
+func (i *storageFileInfo) Sys() interface{}   { return nil }
+
+func (i *storageFileInfo) Mode() os.FileMode {
+	if i.dir {
+		return os.ModeDir | 0700
+	}
+	return 0644
+}
+
+// walkStorage Walk a storage with folders by reading them one at a time
+func walkStorage(storage Storage, root string, skipDir func(name string) bool, fn func(name string, info os.FileInfo) error) error {
+	files, err := storage.ReadDir(root)
+	if err != nil {
+		//Missing root or folders removed while walking
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	for _, file := range files {
+		name := filepath.Join(root, file.Name())
+		if file.IsDir() {
+			if skipDir != nil && skipDir(name) {
+				continue
+			}
+			err = walkStorage(storage, name, skipDir, fn)
+		} else {
+			err = fn(name, file)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// NewStorage opens the storage of the backup folder of options: a local
+// folder, `s3://bucket/prefix` for S3 compatible object storage, or
+// `sftp://user@host/path` for an SFTP server, or `webdav://host/path` for a
+// WebDAV server such as Nextcloud. Files are encrypted with Options.Encrypt.
+func NewStorage(options *Options) (Storage, error) {
+	encryption, err := newEncryption(options)
+	if err != nil {
+		return nil, err
+	}
+	storage, err := openStorage(options)
+	if err != nil || encryption == nil {
+		return storage, err
+	}
+	return &encryptedStorage{Storage: storage, encryption: encryption}, nil
+}
+
+// openStorage opens the storage of the backup folder, without encryption
+func openStorage(options *Options) (Storage, error) {
+	folder := options.BackupFolder
+	location, err := url.Parse(folder)
+	if err != nil || len(location.Scheme) < 2 {
+		//Local paths, including Windows paths with a drive letter
+		return localStorage{}, nil
+	}
+	switch location.Scheme {
+	case "s3":
+		return newS3Storage(folder, location)
+	case "sftp":
+		return newSFTPStorage(folder, location, options)
+	case "webdav", "webdavs":
+		return newWebDAVStorage(folder, location)
+	}
+	return nil, fmt.Errorf("unknown storage '%v' in '%v'", location.Scheme, folder)
+}
+
+// isLocal returns true when the backup folder is on the local file system,
+// and not encrypted
+func (d *Downloader) isLocal() bool {
+	_, ok := d.storage.(localStorage)
+	return ok
+}
+
+// requireLocal returns an error when the backup folder is not on the local
+// file system, for operations reading and rewriting media files in place
+func (d *Downloader) requireLocal(operation string) error {
+	if d.isLocal() {
+		return nil
+	}
+	if _, ok := d.storage.(*encryptedStorage); ok {
+		return fmt.Errorf("%v can not be used with encryption", operation)
+	}
+	return fmt.Errorf("%v needs a backup folder on the local file system", operation)
+}
+
+// validateStorageOptions returns an error for options rewriting or linking
+// media files in place, which need a backup folder on the local file system.
+// Aliases only remove duplicates, they work on any storage. Manifests of
+// encrypted folders would list the hashes of the content under names without
+// the suffix of the stored files, which sha256sum can not check.
+func (d *Downloader) validateStorageOptions() error {
+	options := map[string]bool{
+		"-embed-metadata": d.Options.EmbedMetadata,
+		"-timezone-exif":  d.Options.TimeZoneFromEXIF,
+		"-dedupe":         d.Options.Dedupe != "" && d.Options.Dedupe != DedupeAlias,
+		"-adopt":          d.Options.AdoptFolder != "",
+	}
+	for _, option := range []string{"-embed-metadata", "-timezone-exif", "-dedupe", "-adopt"} {
+		if options[option] {
+			err := d.requireLocal(option)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	if _, ok := d.storage.(*encryptedStorage); ok && d.Options.Checksums {
+		return fmt.Errorf("-checksums can not be used with encryption")
+	}
+	return nil
+}
+
+// OpenStorage Open the storage of Options.BackupFolder, the local file system
+// is used until it is opened
+func (d *Downloader) OpenStorage() error {
+	storage, err := NewStorage(d.Options)
+	if err != nil {
+		return err
+	}
+	d.storage = storage
+	return nil
+}
+
+// updateSize Record the size of the stored media file of an item
+func (d *Downloader) updateSize(item *LibraryItem, filePath string) error {
+	info, err := d.storage.Stat(filePath)
+	if err != nil {
+		return err
+	}
+	item.Size = info.Size()
+	return nil
+}
+
+// readStorageFile Read a whole file
+func readStorageFile(storage Storage, name string) ([]byte, error) {
+	input, err := storage.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer input.Close()
+	return ioutil.ReadAll(input)
+}
+
+// writeStorageFile Write a whole file, its folder is created if missing
+func writeStorageFile(storage Storage, name string, data []byte) error {
+	err := storage.MkdirAll(filepath.Dir(name))
+	if err != nil {
+		return err
+	}
+	output, err := storage.Create(name, time.Time{})
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(output, bytes.NewReader(data))
+	if err != nil {
+		output.Abort()
+		return err
+	}
+	return output.Close()
+}
@@ -0,0 +1,141 @@
+package downloader
+
+import (
+	"os"
+	"path/filepath"
+	"sort"
+	"testing"
+	"time"
+)
+
+// testStorage Check the behaviour the downloader relies on, for every storage
+func testStorage(t *testing.T, storage Storage, root string) {
+	name := filepath.Join(root, "2019", "October", "IMG_1.jpg")
+	modTime := time.Date(2019, 10, 1, 12, 30, 0, 0, time.UTC)
+
+	if _, err := storage.Stat(name); !os.IsNotExist(err) {
+		t.Errorf("Stat() of a missing file = %v; want not exist", err)
+	}
+	if _, err := storage.Open(name); !os.IsNotExist(err) {
+		t.Errorf("Open() of a missing file = %v; want not exist", err)
+	}
+	err := storage.MkdirAll(filepath.Dir(name))
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	writer, err := storage.Create(name, modTime)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	writer.Write([]byte("first"))
+	err = writer.Close()
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	info, err := storage.Stat(name)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	if info.Size() != 5 || !info.ModTime().Equal(modTime) || info.IsDir() {
+		t.Errorf("Stat() = %v bytes at %v; want 5 at %v", info.Size(), info.ModTime(), modTime)
+	}
+	data, err := readStorageFile(storage, name)
+	if err != nil || string(data) != "first" {
+		t.Errorf("readStorageFile() = %q, %v", data, err)
+	}
+
+	modTime = modTime.Add(time.Hour)
+	err = storage.Chtimes(name, modTime)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	info, _ = storage.Stat(name)
+	if info == nil || !info.ModTime().Equal(modTime) {
+		t.Errorf("Chtimes() did not set the modification time")
+	}
+
+	for _, other := range []string{
+		filepath.Join(root, "2019", "October", ".ABC.json"),
+		filepath.Join(root, "2019", "IMG_2.jpg"),
+		filepath.Join(root, trashFolder, "2019", "IMG_3.jpg"),
+	} {
+		err = writeStorageFile(storage, other, []byte("other"))
+		if err != nil {
+			t.Fatalf("%v", err)
+		}
+	}
+	files, err := storage.ReadDir(filepath.Join(root, "2019"))
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	if len(files) != 2 || files[0].Name() != "IMG_2.jpg" || files[1].Name() != "October" || !files[1].IsDir() {
+		t.Errorf("ReadDir() = %v", files)
+	}
+
+	var walked []string
+	err = storage.Walk(root, isTrashFolder, func(name string, info os.FileInfo) error {
+		relative, _ := filepath.Rel(root, name)
+		walked = append(walked, filepath.ToSlash(relative))
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	sort.Strings(walked)
+	want := []string{"2019/IMG_2.jpg", "2019/October/.ABC.json", "2019/October/IMG_1.jpg"}
+	if len(walked) != len(want) {
+		t.Fatalf("Walk() = %v; want %v", walked, want)
+	}
+	for i := range want {
+		if walked[i] != want[i] {
+			t.Errorf("Walk() = %v; want %v", walked, want)
+		}
+	}
+
+	moved := filepath.Join(root, "2019", "IMG_1.jpg")
+	err = storage.Rename(name, moved)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	if _, err := storage.Stat(name); !os.IsNotExist(err) {
+		t.Errorf("renamed file should be gone: %v", err)
+	}
+	info, _ = storage.Stat(moved)
+	if info == nil || info.Size() != 5 || !info.ModTime().Equal(modTime) {
+		t.Errorf("Rename() should keep the content and modification time, got %v", info)
+	}
+	err = storage.Remove(moved)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	if _, err := storage.Stat(moved); !os.IsNotExist(err) {
+		t.Errorf("removed file should be gone: %v", err)
+	}
+
+	err = storage.Walk(filepath.Join(root, "missing"), nil, func(name string, info os.FileInfo) error {
+		t.Errorf("unexpected %v", name)
+		return nil
+	})
+	if err != nil {
+		t.Errorf("Walk() of a missing folder = %v", err)
+	}
+}
+
+func TestLocalStorage(t *testing.T) {
+	root := tempPath()
+	defer os.RemoveAll(root)
+	testStorage(t, localStorage{}, root)
+}
+
+func TestNewStorage(t *testing.T) {
+	for _, folder := range []string{"archive", "/mnt/photos", `C:\photos`} {
+		storage, err := NewStorage(&Options{BackupFolder: folder})
+		if err != nil || storage != (localStorage{}) {
+			t.Errorf("NewStorage(%v) = %v, %v; want local", folder, storage, err)
+		}
+	}
+	_, err := NewStorage(&Options{BackupFolder: "ftp://example.com/photos"})
+	if err == nil {
+		t.Errorf("unknown storages should fail")
+	}
+}
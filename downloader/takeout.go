@@ -0,0 +1,528 @@
+package downloader
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"image"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	photoslibrary "github.com/gphotosuploader/googlemirror/api/photoslibrary/v1"
+)
+
+// takeoutStagingFolder folder inside the backup folder holding media read
+// from an archive before its metadata
+const takeoutStagingFolder = ".takeout"
+
+// takeoutIDPrefix prefix of the provisional ids of imported items
+const takeoutIDPrefix = "takeout-"
+
+// takeoutSupplemental suffix of the metadata file names of newer Takeout
+// archives, truncated along with long file names
+const takeoutSupplemental = ".supplemental-metadata"
+
+// takeoutMaxMetadataSize metadata files larger than this are not Takeout metadata
+const takeoutMaxMetadataSize = 1 << 20
+
+// takeoutYearFolder folders holding all items by year, other folders are albums
+var takeoutYearFolder = regexp.MustCompile(`^Photos from \d{4}$`)
+
+// takeoutDuplicateIndex index Takeout appends to metadata of items sharing a
+// name, e.g. IMG.jpg(1).json for IMG(1).jpg
+var takeoutDuplicateIndex = regexp.MustCompile(`\((\d+)\)$`)
+
+// takeoutTime a time in Takeout metadata, seconds since the epoch
+type takeoutTime struct {
+	Timestamp string `json:"timestamp"`
+}
+
+// takeoutGeoData a location in Takeout metadata, zero when unknown
+type takeoutGeoData struct {
+	Latitude  float64 `json:"latitude"`
+	Longitude float64 `json:"longitude"`
+	Altitude  float64 `json:"altitude"`
+}
+
+// takeoutMetadata the metadata file of a Takeout media file
+type takeoutMetadata struct {
+	Title          string          `json:"title"`
+	Description    string          `json:"description"`
+	URL            string          `json:"url"`
+	CreationTime   *takeoutTime    `json:"creationTime"`
+	PhotoTakenTime *takeoutTime    `json:"photoTakenTime"`
+	GeoData        *takeoutGeoData `json:"geoData"`
+	GeoDataExif    *takeoutGeoData `json:"geoDataExif"`
+}
+
+// takenTime the time the item was taken, or uploaded if unknown
+func (m *takeoutMetadata) takenTime() (time.Time, error) {
+	for _, t := range []*takeoutTime{m.PhotoTakenTime, m.CreationTime} {
+		if t == nil {
+			continue
+		}
+		seconds, err := strconv.ParseInt(t.Timestamp, 10, 64)
+		if err == nil && seconds > 0 {
+			return time.Unix(seconds, 0).UTC(), nil
+		}
+	}
+	return time.Time{}, fmt.Errorf("missing time in metadata of '%v'", m.Title)
+}
+
+// geoData the location of the item, as edited in Google Photos or else as
+// read from the EXIF data
+func (m *takeoutMetadata) geoData() *GeoData {
+	for _, geo := range []*takeoutGeoData{m.GeoData, m.GeoDataExif} {
+		if geo != nil && (geo.Latitude != 0 || geo.Longitude != 0) {
+			return &GeoData{Latitude: geo.Latitude, Longitude: geo.Longitude, Altitude: geo.Altitude}
+		}
+	}
+	return nil
+}
+
+// parseTakeoutMetadata Parse a metadata file, returns nil for other JSON
+// files such as album metadata
+func parseTakeoutMetadata(data []byte) *takeoutMetadata {
+	metadata := new(takeoutMetadata)
+	if json.Unmarshal(data, metadata) != nil {
+		return nil
+	}
+	if metadata.Title == "" || (metadata.PhotoTakenTime == nil && metadata.CreationTime == nil) {
+		return nil
+	}
+	return metadata
+}
+
+// takeoutMediaName the name of the media file a metadata file belongs to,
+// possibly truncated for long names
+func takeoutMediaName(metadataName string) string {
+	name := strings.TrimSuffix(metadataName, filepath.Ext(metadataName))
+	index := ""
+	if match := takeoutDuplicateIndex.FindStringSubmatch(name); match != nil {
+		index = match[0]
+		name = strings.TrimSuffix(name, index)
+	}
+	for i := len(takeoutSupplemental); i > 1; i-- {
+		if strings.HasSuffix(name, takeoutSupplemental[:i]) {
+			name = strings.TrimSuffix(name, takeoutSupplemental[:i])
+			break
+		}
+	}
+	if index != "" {
+		ext := path.Ext(name)
+		name = strings.TrimSuffix(name, ext) + index + ext
+	}
+	return name
+}
+
+// takeoutKey the key pairing media and metadata files in the same folder
+func takeoutKey(folder string, name string) string {
+	return folder + "/" + strings.ToLower(name)
+}
+
+// takeoutMedia a media file read from an archive into the staging folder
+type takeoutMedia struct {
+	folder string
+	name   string
+	path   string
+	sha256 string
+}
+
+// takeoutPending a metadata file waiting for its media file
+type takeoutPending struct {
+	folder    string
+	mediaName string
+	metadata  *takeoutMetadata
+}
+
+// takeoutImport state of importing Takeout archives, media and metadata files
+// are paired in whatever order the archives list them
+type takeoutImport struct {
+	d        *Downloader
+	staging  string
+	media    map[string]*takeoutMedia
+	metadata map[string]*takeoutPending
+	//items by match key, the items already in the backup folder included
+	items map[string][]*catalogEntry
+
+	imported int
+	merged   int
+	noMeta   int
+	noMedia  int
+}
+
+// walkArchive calls fn for every file in a zip, tar or tgz archive, or in an
+// extracted archive folder
+func walkArchive(archivePath string, fn func(name string, r io.Reader) error) error {
+	info, err := os.Stat(archivePath)
+	if err != nil {
+		return err
+	}
+	if info.IsDir() {
+		return filepath.Walk(archivePath, func(filePath string, info os.FileInfo, err error) error {
+			if err != nil || !info.Mode().IsRegular() {
+				return err
+			}
+			relative, err := filepath.Rel(archivePath, filePath)
+			if err != nil {
+				return err
+			}
+			file, err := os.Open(filePath)
+			if err != nil {
+				return err
+			}
+			defer file.Close()
+			return fn(filepath.ToSlash(relative), file)
+		})
+	}
+
+	lower := strings.ToLower(archivePath)
+	if strings.HasSuffix(lower, ".zip") {
+		archive, err := zip.OpenReader(archivePath)
+		if err != nil {
+			return err
+		}
+		defer archive.Close()
+		for _, file := range archive.File {
+			if !file.Mode().IsRegular() {
+				continue
+			}
+			reader, err := file.Open()
+			if err != nil {
+				return err
+			}
+			err = fn(file.Name, reader)
+			reader.Close()
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	if !strings.HasSuffix(lower, ".tgz") && !strings.HasSuffix(lower, ".tar.gz") && !strings.HasSuffix(lower, ".tar") {
+		return fmt.Errorf("unsupported archive '%v', use zip, tgz or tar", archivePath)
+	}
+	file, err := os.Open(archivePath)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	var reader io.Reader = file
+	if !strings.HasSuffix(lower, ".tar") {
+		gz, err := gzip.NewReader(file)
+		if err != nil {
+			return err
+		}
+		defer gz.Close()
+		reader = gz
+	}
+	archive := tar.NewReader(reader)
+	for {
+		header, err := archive.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if header.Typeflag != tar.TypeReg {
+			continue
+		}
+		err = fn(header.Name, archive)
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// add Handle a file read from an archive
+func (t *takeoutImport) add(name string, r io.Reader) error {
+	folder := path.Dir(name)
+	base := path.Base(name)
+	if strings.EqualFold(path.Ext(base), ".json") {
+		data, err := ioutil.ReadAll(io.LimitReader(r, takeoutMaxMetadataSize))
+		if err != nil {
+			return err
+		}
+		metadata := parseTakeoutMetadata(data)
+		if metadata == nil {
+			return nil
+		}
+		mediaName := takeoutMediaName(base)
+		key := takeoutKey(folder, mediaName)
+		media := t.media[key]
+		if media == nil {
+			t.metadata[key] = &takeoutPending{folder: folder, mediaName: mediaName, metadata: metadata}
+			return nil
+		}
+		delete(t.media, key)
+		return t.place(media, metadata)
+	}
+
+	mimeType := mimeTypeByExtension(base)
+	if !strings.HasPrefix(mimeType, "image/") && !strings.HasPrefix(mimeType, "video/") {
+		//Not media, e.g. the archive browser page
+		return nil
+	}
+	media, err := t.stage(folder, base, r)
+	if err != nil {
+		return err
+	}
+	key := takeoutKey(folder, base)
+	pending := t.metadata[key]
+	if pending == nil {
+		t.media[key] = media
+		return nil
+	}
+	delete(t.metadata, key)
+	return t.place(media, pending.metadata)
+}
+
+// stage Copy a media file into the staging folder, hashing its content
+func (t *takeoutImport) stage(folder string, name string, r io.Reader) (*takeoutMedia, error) {
+	file, err := ioutil.TempFile(t.staging, "media")
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	hasher := sha256.New()
+	_, err = io.Copy(io.MultiWriter(file, hasher), r)
+	if err != nil {
+		os.Remove(file.Name())
+		return nil, err
+	}
+	return &takeoutMedia{folder: folder, name: name, path: file.Name(), sha256: hex.EncodeToString(hasher.Sum(nil))}, nil
+}
+
+// takeoutAlbum the album title of a Takeout folder, empty for the year folders
+func takeoutAlbum(folder string) string {
+	album := path.Base(folder)
+	if album == "." || album == "/" || takeoutYearFolder.MatchString(album) {
+		return ""
+	}
+	return album
+}
+
+// place Store a media file with its metadata, or merge it into the item it
+// is a copy of, Takeout lists items once per album
+func (t *takeoutImport) place(media *takeoutMedia, metadata *takeoutMetadata) error {
+	d := t.d
+	taken, err := metadata.takenTime()
+	if err != nil {
+		os.Remove(media.path)
+		log.Printf("Skipping '%v': %v", media.name, err)
+		t.noMeta++
+		return nil
+	}
+
+	item := new(LibraryItem)
+	item.Filename = metadata.Title
+	item.Description = metadata.Description
+	item.ProductUrl = metadata.URL
+	item.MimeType = mimeTypeByExtension(media.name)
+	item.MediaMetadata = &photoslibrary.MediaMetadata{CreationTime: taken.Format(time.RFC3339)}
+	if strings.HasPrefix(item.MimeType, "video/") {
+		item.MediaMetadata.Video = new(photoslibrary.Video)
+	} else {
+		item.MediaMetadata.Photo = new(photoslibrary.Photo)
+		file, err := os.Open(media.path)
+		if err != nil {
+			return err
+		}
+		config, _, err := image.DecodeConfig(file)
+		file.Close()
+		if err == nil {
+			item.MediaMetadata.Width = int64(config.Width)
+			item.MediaMetadata.Height = int64(config.Height)
+		}
+	}
+	key := itemMatchKey(&item.MediaItem)
+	hash := sha256.Sum256([]byte(key))
+	item.Id = takeoutIDPrefix + hex.EncodeToString(hash[:12])
+	item.SHA256 = media.sha256
+	item.GeoData = metadata.geoData()
+	item.Provisional = true
+	item.addAlbum(takeoutAlbum(media.folder))
+
+	for _, entry := range t.items[key] {
+		if !sameDimensions(&entry.Item.MediaItem, &item.MediaItem) {
+			continue
+		}
+		os.Remove(media.path)
+		changed := false
+		for _, album := range item.Albums {
+			changed = entry.Item.addAlbum(album) || changed
+		}
+		if entry.Item.GeoData == nil && item.GeoData != nil {
+			entry.Item.GeoData = item.GeoData
+			changed = true
+		}
+		if changed {
+			err = d.writeJSON(entry.Item, entry.JSONFilePath)
+			if err != nil {
+				return err
+			}
+			err = d.writeXMP(entry.Item, true)
+			if err != nil {
+				return err
+			}
+		}
+		t.merged++
+		return nil
+	}
+
+	for conflict := 0; true; conflict++ {
+		item.UsedFileName = d.createFileName(item, conflict)
+		if !d.isConflictingFilePath(item) {
+			break
+		}
+	}
+	d.recordFileNameMapping(item)
+	filePath := d.getImageFilePath(item)
+	err = os.MkdirAll(filepath.Dir(filePath), 0700)
+	if err != nil {
+		return err
+	}
+	err = os.Rename(media.path, filePath)
+	if err != nil {
+		return err
+	}
+	err = os.Chtimes(filePath, time.Now(), taken)
+	if err != nil {
+		return err
+	}
+	err = d.applyCaptureOffset(item, filePath)
+	if err != nil {
+		log.Printf("Failed to apply the capture time zone of '%v': %v", item.Filename, err)
+	}
+	err = d.updateSize(item, d.getImageFilePath(item))
+	if err != nil {
+		return err
+	}
+	err = d.updateChecksum(item, d.getImageFilePath(item))
+	if err != nil {
+		return err
+	}
+	err = d.writeXMP(item, true)
+	if err != nil {
+		return err
+	}
+	jsonFilePath := d.getJSONFilePath(&item.MediaItem)
+	err = d.writeJSON(item, jsonFilePath)
+	if err != nil {
+		return err
+	}
+	log.Printf("Imported '%v' [saved as '%v']", media.name, item.UsedFileName)
+	t.items[key] = append(t.items[key], &catalogEntry{Item: item, JSONFilePath: jsonFilePath})
+	t.imported++
+	return nil
+}
+
+// finish Pair the media files left with metadata of truncated names, and
+// report the files left unpaired
+func (t *takeoutImport) finish() error {
+	keys := make([]string, 0, len(t.media))
+	for key := range t.media {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		media := t.media[key]
+		var match string
+		for pendingKey, pending := range t.metadata {
+			if pending.folder == media.folder && strings.HasPrefix(media.name, pending.mediaName) && len(pending.mediaName) > len(match) {
+				match = pendingKey
+			}
+		}
+		if match == "" {
+			log.Printf("No metadata for '%v'", path.Join(media.folder, media.name))
+			os.Remove(media.path)
+			t.noMeta++
+			continue
+		}
+		pending := t.metadata[match]
+		delete(t.metadata, match)
+		err := t.place(media, pending.metadata)
+		if err != nil {
+			return err
+		}
+	}
+	for _, pending := range t.metadata {
+		log.Printf("No media for '%v'", path.Join(pending.folder, pending.mediaName))
+		t.noMedia++
+	}
+	return nil
+}
+
+// ImportTakeout Import the media of Google Takeout archives with their
+// metadata into the backup folder. Imported items have provisional ids until
+// a download pass links them to their Google Photos items.
+func (d *Downloader) ImportTakeout(archives []string) error {
+	err := d.requireLocal("import-takeout")
+	if err != nil {
+		return err
+	}
+	_, err = d.compileTemplates()
+	if err != nil {
+		return err
+	}
+	_, err = d.timeZone()
+	if err != nil {
+		return err
+	}
+	catalog, err := d.loadCatalog()
+	if err != nil {
+		return err
+	}
+
+	t := &takeoutImport{
+		d:        d,
+		staging:  filepath.Join(d.Options.BackupFolder, takeoutStagingFolder),
+		media:    make(map[string]*takeoutMedia),
+		metadata: make(map[string]*takeoutPending),
+		items:    make(map[string][]*catalogEntry),
+	}
+	for _, entry := range catalog.items {
+		key := itemMatchKey(&entry.Item.MediaItem)
+		if key != "" {
+			t.items[key] = append(t.items[key], entry)
+		}
+	}
+	err = os.MkdirAll(t.staging, 0700)
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(t.staging)
+
+	for _, archive := range archives {
+		log.Printf("Reading '%v'", archive)
+		err = walkArchive(archive, t.add)
+		if err != nil {
+			return err
+		}
+	}
+	err = t.finish()
+	if err != nil {
+		return err
+	}
+	err = d.flushChecksums()
+	if err != nil {
+		return err
+	}
+	log.Printf("Takeout import: %v imported, %v already present, %v without metadata, %v without media", t.imported, t.merged, t.noMeta, t.noMedia)
+	return nil
+}
@@ -0,0 +1,168 @@
+package downloader
+
+import (
+	"archive/zip"
+	"bytes"
+	"image/jpeg"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	photoslibrary "github.com/gphotosuploader/googlemirror/api/photoslibrary/v1"
+)
+
+// testTakeoutMetadata a Takeout metadata file taken at 2019-10-13T17:33:43Z
+func testTakeoutMetadata(title string, geo string) []byte {
+	return []byte(`{"title": "` + title + `", "description": "",
+		"photoTakenTime": {"timestamp": "1570988023", "formatted": "Oct 13, 2019, 5:33:43 PM UTC"},
+		"geoData": ` + geo + `,
+		"url": "https://photos.google.com/photo/AF1Qip"}`)
+}
+
+// writeTestZip write an archive with the files in order
+func writeTestZip(t *testing.T, filePath string, files [][2]string) {
+	buffer := new(bytes.Buffer)
+	archive := zip.NewWriter(buffer)
+	for _, file := range files {
+		w, err := archive.Create(file[0])
+		if err != nil {
+			t.Fatalf("%v", err)
+		}
+		w.Write([]byte(file[1]))
+	}
+	archive.Close()
+	err := ioutil.WriteFile(filePath, buffer.Bytes(), 0644)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+}
+
+func TestTakeoutMediaName(t *testing.T) {
+	names := map[string]string{
+		"IMG_1234.JPG.json":                                  "IMG_1234.JPG",
+		"IMG_1234.jpg(1).json":                               "IMG_1234(1).jpg",
+		"IMG_1234.jpg.supplemental-metadata.json":            "IMG_1234.jpg",
+		"IMG_1234.jpg.supplemental-metadata(2).json":         "IMG_1234(2).jpg",
+		"PXL_20191013_173343123.MP.jpg.supplemental-me.json": "PXL_20191013_173343123.MP.jpg",
+	}
+	for metadataName, want := range names {
+		if got := takeoutMediaName(metadataName); got != want {
+			t.Errorf("takeoutMediaName(%v) = %v; want %v", metadataName, got, want)
+		}
+	}
+}
+
+func TestImportTakeout(t *testing.T) {
+	downloader := NewDownloader()
+	downloader.Options.BackupFolder = tempPath()
+	defer os.RemoveAll(downloader.Options.BackupFolder)
+	archivePath := filepath.Join(tempPath(), "takeout-001.zip")
+	defer os.RemoveAll(filepath.Dir(archivePath))
+
+	encoded := new(bytes.Buffer)
+	jpeg.Encode(encoded, testImage(64, 48, false), nil)
+	photo := encoded.String()
+	geo := `{"latitude": 32.08, "longitude": 34.78, "altitude": 12.5}`
+	noGeo := `{"latitude": 0.0, "longitude": 0.0, "altitude": 0.0}`
+	writeTestZip(t, archivePath, [][2]string{
+		{"Takeout/archive_browser.html", "<html></html>"},
+		{"Takeout/Google Photos/Photos from 2019/IMG_1.jpg", photo},
+		{"Takeout/Google Photos/Photos from 2019/IMG_1.jpg.json", string(testTakeoutMetadata("IMG_1.jpg", geo))},
+		{"Takeout/Google Photos/Photos from 2019/IMG_2.jpg.supplemental-metadata(1).json", string(testTakeoutMetadata("IMG_2.jpg", noGeo))},
+		{"Takeout/Google Photos/Photos from 2019/IMG_2(1).jpg", photo},
+		{"Takeout/Google Photos/Trip/metadata.json", `{"title": "Trip"}`},
+		{"Takeout/Google Photos/Trip/IMG_1.jpg", photo},
+		{"Takeout/Google Photos/Trip/IMG_1.jpg.json", string(testTakeoutMetadata("IMG_1.jpg", geo))},
+		{"Takeout/Google Photos/Trip/VID_3.mp4", "video"},
+	})
+
+	err := downloader.ImportTakeout([]string{archivePath})
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	catalog, err := downloader.loadCatalog()
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	if len(catalog.items) != 2 {
+		t.Fatalf("imported %v items; want 2", len(catalog.items))
+	}
+	var imported *catalogEntry
+	for _, entry := range catalog.items {
+		if !entry.Item.Provisional {
+			t.Errorf("'%v' should be provisional", entry.Item.Filename)
+		}
+		if entry.Item.Filename == "IMG_1.jpg" {
+			imported = entry
+		} else if entry.Item.GeoData != nil {
+			t.Errorf("zero location should be missing, got %v", entry.Item.GeoData)
+		}
+	}
+	if imported == nil {
+		t.Fatalf("IMG_1.jpg should be imported")
+	}
+	if imported.Item.GeoData == nil || imported.Item.GeoData.Latitude != 32.08 || imported.Item.GeoData.Altitude != 12.5 {
+		t.Errorf("GeoData = %v", imported.Item.GeoData)
+	}
+	if len(imported.Item.Albums) != 1 || imported.Item.Albums[0] != "Trip" {
+		t.Errorf("album copy should be merged, Albums = %v", imported.Item.Albums)
+	}
+	if imported.Item.MediaMetadata.Width != 64 || imported.Item.MediaMetadata.Height != 48 {
+		t.Errorf("dimensions = %vx%v", imported.Item.MediaMetadata.Width, imported.Item.MediaMetadata.Height)
+	}
+	if imported.Item.SHA256 == "" {
+		t.Errorf("SHA256 should be set")
+	}
+	if _, err := os.Stat(imported.MediaFilePath()); err != nil {
+		t.Errorf("%v", err)
+	}
+	if _, err := os.Stat(filepath.Join(downloader.Options.BackupFolder, takeoutStagingFolder)); !os.IsNotExist(err) {
+		t.Errorf("staging folder should be removed")
+	}
+
+	//A download pass links the matching Google Photos item
+	item := new(photoslibrary.MediaItem)
+	item.Id = "ABCDEFGHIJKLMNOPQRSTUVWXYZ"
+	item.Filename = "IMG_1.jpg"
+	item.MimeType = "image/jpeg"
+	item.MediaMetadata = &photoslibrary.MediaMetadata{CreationTime: "2019-10-13T17:33:43Z", Width: 64, Height: 48}
+	downloader.provisional = newProvisionalIndex(catalog)
+
+	//The item moves to its template folder, a failed link keeps the match
+	downloader.Options.FolderTemplate = "Linked/{year}"
+	downloader.compileTemplates()
+	blocking := filepath.Join(downloader.Options.BackupFolder, "Linked")
+	ioutil.WriteFile(blocking, nil, 0644)
+	_, err = downloader.linkImported(item)
+	if err == nil {
+		t.Errorf("linkImported() should fail when the folder can not be created")
+	}
+	os.Remove(blocking)
+	linked, err := downloader.linkImported(item)
+	if err != nil || linked == nil {
+		t.Fatalf("linkImported() = %v, %v", linked, err)
+	}
+	if linked.Provisional || linked.GeoData == nil || len(linked.Albums) != 1 {
+		t.Errorf("linked item should keep the imported metadata: %+v", linked)
+	}
+	if have := downloader.getImageFilePath(linked); filepath.Dir(have) != filepath.Join(blocking, "2019") {
+		t.Errorf("linked to '%v'; want the template folder", have)
+	} else if _, err := os.Stat(have); err != nil {
+		t.Errorf("%v", err)
+	}
+	if _, err := os.Stat(imported.JSONFilePath); !os.IsNotExist(err) {
+		t.Errorf("provisional sidecar should be removed")
+	}
+	catalog, err = downloader.loadCatalog()
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	if catalog.items[item.Id] == nil {
+		t.Errorf("catalog should hold the Google Photos id")
+	}
+	again, _ := downloader.linkImported(item)
+	if again != nil {
+		t.Errorf("an imported item should only be linked once")
+	}
+}
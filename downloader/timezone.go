@@ -0,0 +1,165 @@
+package downloader
+
+import (
+	"fmt"
+	"log"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	photoslibrary "github.com/gphotosuploader/googlemirror/api/photoslibrary/v1"
+)
+
+// timeZones the locations used to bucket items by date
+type timeZones struct {
+	mutex sync.Mutex
+	//name and zone, the configured time zone as last loaded
+	name string
+	zone *time.Location
+	//offsets capture-local UTC offsets read from EXIF data, by item id
+	offsets map[string]string
+}
+
+// parseUTCOffset Parse an EXIF UTC offset such as `+09:00` or `-08:00`
+func parseUTCOffset(offset string) (*time.Location, error) {
+	t, err := time.Parse("Z07:00", strings.TrimSpace(offset))
+	if err != nil {
+		return nil, fmt.Errorf("invalid UTC offset '%v'", offset)
+	}
+	return t.Location(), nil
+}
+
+// timeZone the configured time zone, UTC if none
+func (d *Downloader) timeZone() (*time.Location, error) {
+	if d.Options.TimeZone == "" {
+		return time.UTC, nil
+	}
+	d.timeZones.mutex.Lock()
+	defer d.timeZones.mutex.Unlock()
+	if d.timeZones.zone == nil || d.timeZones.name != d.Options.TimeZone {
+		zone, err := time.LoadLocation(d.Options.TimeZone)
+		if err != nil {
+			return nil, fmt.Errorf("unknown time zone '%v': %v", d.Options.TimeZone, err)
+		}
+		d.timeZones.name = d.Options.TimeZone
+		d.timeZones.zone = zone
+	}
+	return d.timeZones.zone, nil
+}
+
+// captureOffset the capture-local UTC offset known for an item, or an empty
+// string
+func (d *Downloader) captureOffset(id string) string {
+	d.timeZones.mutex.Lock()
+	defer d.timeZones.mutex.Unlock()
+	return d.timeZones.offsets[id]
+}
+
+// setCaptureOffset Remember the capture-local UTC offset of an item
+func (d *Downloader) setCaptureOffset(id string, offset string) {
+	if offset == "" {
+		return
+	}
+	d.timeZones.mutex.Lock()
+	defer d.timeZones.mutex.Unlock()
+	if d.timeZones.offsets == nil {
+		d.timeZones.offsets = make(map[string]string)
+	}
+	d.timeZones.offsets[id] = offset
+}
+
+// location the location used to bucket an item by date: its capture-local
+// offset when reading it from EXIF is enabled and it is known, otherwise the
+// configured time zone
+func (d *Downloader) location(item *photoslibrary.MediaItem) *time.Location {
+	if d.Options.TimeZoneFromEXIF {
+		offset := d.captureOffset(item.Id)
+		if offset != "" {
+			location, err := parseUTCOffset(offset)
+			if err == nil {
+				return location
+			}
+		}
+	}
+	zone, err := d.timeZone()
+	if err != nil {
+		//Reported by DownloadAll
+		return time.UTC
+	}
+	return zone
+}
+
+// readCaptureOffset Read the capture-local UTC offset from the EXIF data of a
+// media file, returns an empty string if it has none
+func readCaptureOffset(item *LibraryItem, filePath string) (string, error) {
+	if !strings.EqualFold(item.MimeType, "image/jpeg") {
+		return "", nil
+	}
+	x, err := readEXIFFile(filePath)
+	if err == errNoEXIF {
+		return "", nil
+	}
+	if err != nil {
+		return "", err
+	}
+	offset := x.offsetTimeOriginal()
+	if offset == "" {
+		return "", nil
+	}
+	_, err = parseUTCOffset(offset)
+	if err != nil {
+		return "", err
+	}
+	return offset, nil
+}
+
+// applyCaptureOffset Read the capture-local offset of a downloaded file and,
+// if its folder or name depend on it, move the file. The sidecar is moved by
+// the caller.
+func (d *Downloader) applyCaptureOffset(item *LibraryItem, filePath string) error {
+	if !d.Options.TimeZoneFromEXIF {
+		return nil
+	}
+	offset, err := readCaptureOffset(item, filePath)
+	if err != nil || offset == "" {
+		return err
+	}
+
+	item.CaptureOffset = offset
+	d.setCaptureOffset(item.Id, offset)
+
+	target := *item
+	var mediaFilePath string
+	for conflict := 0; true; conflict++ {
+		target.UsedFileName = ""
+		target.UsedFileName = d.createFileName(&target, conflict)
+		mediaFilePath = d.getImageFilePath(&target)
+		if d.collisionKey(mediaFilePath) == d.collisionKey(filePath) || !d.pathExists(mediaFilePath) {
+			break
+		}
+		if d.templates().file == nil {
+			//Legacy names are unique per item, the file is someone else's
+			return fmt.Errorf("can not move '%v', '%v' already exists", filePath, mediaFilePath)
+		}
+	}
+	if mediaFilePath != filePath {
+		log.Printf("Moving '%v' to '%v' (captured at UTC%v)", filePath, mediaFilePath, offset)
+		err = d.storage.MkdirAll(filepath.Dir(mediaFilePath))
+		if err != nil {
+			return err
+		}
+		err = d.storage.Rename(filePath, mediaFilePath)
+		if err != nil {
+			return err
+		}
+		d.names.add(mediaFilePath)
+		err = d.moveXMP(filePath, mediaFilePath)
+		if err != nil {
+			return err
+		}
+		item.UsedFileName = target.UsedFileName
+		d.recordFileNameMapping(item)
+	}
+	return nil
+}
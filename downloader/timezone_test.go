@@ -0,0 +1,132 @@
+package downloader
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	_ "time/tzdata"
+)
+
+// testJPEG a minimal JPEG file with an EXIF OffsetTimeOriginal tag
+func testJPEG(offset string) []byte {
+	le := binary.LittleEndian
+	tiff := new(bytes.Buffer)
+	tiff.WriteString("II*\x00")
+	binary.Write(tiff, le, uint32(8))
+	//IFD0, pointing to the Exif IFD at 26
+	binary.Write(tiff, le, uint16(1))
+	binary.Write(tiff, le, []uint16{exifTagExifIFD, exifTypeLong})
+	binary.Write(tiff, le, []uint32{1, 26, 0})
+	//Exif IFD, the offset value at 44
+	binary.Write(tiff, le, uint16(1))
+	binary.Write(tiff, le, []uint16{exifTagOffsetTimeOriginal, exifTypeASCII})
+	binary.Write(tiff, le, []uint32{uint32(len(offset) + 1), 44, 0})
+	tiff.WriteString(offset + "\x00")
+
+	jpeg := new(bytes.Buffer)
+	jpeg.Write([]byte{0xff, 0xd8, 0xff, 0xe1})
+	binary.Write(jpeg, binary.BigEndian, uint16(2+len(exifHeader)+tiff.Len()))
+	jpeg.Write(exifHeader)
+	jpeg.Write(tiff.Bytes())
+	jpeg.Write([]byte{0xff, 0xda, 0x00, 0x02, 0xff, 0xd9})
+	return jpeg.Bytes()
+}
+
+func TestReadEXIF(t *testing.T) {
+	x, err := readEXIF(bytes.NewReader(testJPEG("-08:00")))
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	if x.offsetTimeOriginal() != "-08:00" {
+		t.Errorf("offsetTimeOriginal() = %v; want -08:00", x.offsetTimeOriginal())
+	}
+
+	_, err = readEXIF(bytes.NewReader([]byte{0xff, 0xd8, 0xff, 0xda, 0x00, 0x02}))
+	if err != errNoEXIF {
+		t.Errorf("readEXIF() = %v; want %v", err, errNoEXIF)
+	}
+	_, err = readEXIF(bytes.NewReader([]byte("not a jpeg")))
+	if err == nil {
+		t.Errorf("readEXIF() should fail on other files")
+	}
+}
+
+func TestTimeZone(t *testing.T) {
+	downloader := NewDownloader()
+	downloader.Options.BackupFolder = "backup"
+	item := templateTestItem()
+	item.MediaMetadata.CreationTime = "2019-11-01T05:00:00Z"
+
+	if path := downloader.getJSONFilePath(&item.MediaItem); path != filepath.Join("backup", "2019", "November", "1_34567890.json") {
+		t.Errorf("UTC path = %v", path)
+	}
+
+	downloader.Options.TimeZone = "America/Los_Angeles"
+	if path := downloader.getJSONFilePath(&item.MediaItem); path != filepath.Join("backup", "2019", "October", "31_34567890.json") {
+		t.Errorf("America/Los_Angeles path = %v", path)
+	}
+
+	downloader.Options.TimeZoneFromEXIF = true
+	downloader.setCaptureOffset(item.Id, "+09:00")
+	if path := downloader.getJSONFilePath(&item.MediaItem); path != filepath.Join("backup", "2019", "November", "1_34567890.json") {
+		t.Errorf("capture-local path = %v", path)
+	}
+
+	downloader.Options.TimeZone = "Mars/Olympus_Mons"
+	_, err := downloader.timeZone()
+	if err == nil {
+		t.Errorf("timeZone() should fail on unknown time zones")
+	}
+}
+
+func TestCaptureOffset(t *testing.T) {
+	downloader := NewDownloader()
+	downloader.Options.BackupFolder = tempPath()
+	downloader.Options.TimeZoneFromEXIF = true
+	defer os.RemoveAll(downloader.Options.BackupFolder)
+
+	item := templateTestItem()
+	item.MediaMetadata.CreationTime = "2019-11-01T05:00:00Z"
+	item.UsedFileName = downloader.createFileName(item, 0)
+	jsonFilePath := downloader.getJSONFilePath(&item.MediaItem)
+	filePath := downloader.getImageFilePath(item)
+	err := downloader.writeJSON(item, jsonFilePath)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	err = ioutil.WriteFile(filePath, testJPEG("-08:00"), 0644)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+
+	err = downloader.finishDownload(item, filePath)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	moved := filepath.Join(downloader.Options.BackupFolder, "2019", "October", "31_34567890"+mimeExtension(item.MimeType))
+	if _, err := os.Stat(moved); err != nil {
+		t.Errorf("media should be moved to the capture-local folder: %v", err)
+	}
+	if _, err := os.Stat(jsonFilePath); !os.IsNotExist(err) {
+		t.Errorf("old json file should be removed")
+	}
+
+	//A new downloader knows the offset from the catalog
+	downloader = NewDownloader()
+	downloader.Options.BackupFolder = filepath.Dir(filepath.Dir(filepath.Dir(moved)))
+	downloader.Options.TimeZoneFromEXIF = true
+	_, err = downloader.loadCatalog()
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	stored, err := downloader.loadJSON(downloader.getJSONFilePath(&item.MediaItem))
+	if err != nil || stored == nil {
+		t.Fatalf("missing moved json: %v", err)
+	}
+	if stored.CaptureOffset != "-08:00" {
+		t.Errorf("CaptureOffset = %v; want -08:00", stored.CaptureOffset)
+	}
+}
@@ -0,0 +1,363 @@
+package downloader
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"image"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	//Registers the GIF decoder, JPEG and PNG are registered for perceptual hashes
+	_ "image/gif"
+)
+
+// Problems found by verify
+const (
+	//VerifyMissing the media file of a sidecar is missing
+	VerifyMissing = "missing"
+	//VerifyEmpty the media file is empty, its download did not finish
+	VerifyEmpty = "empty"
+	//VerifySize the media file size differs from the recorded size
+	VerifySize = "size"
+	//VerifyHash the media file hash differs from the recorded hash
+	VerifyHash = "hash"
+	//VerifyDecode the media file does not decode as its mime type
+	VerifyDecode = "decode"
+	//VerifyOrphan a media file without a sidecar
+	VerifyOrphan = "orphan"
+)
+
+// deferredStatusRepair status of items queued for download by verify
+const deferredStatusRepair = "REPAIR"
+
+// VerifyProblem a problem with an item or a file in the backup folder
+type VerifyProblem struct {
+	//ID of the item, empty for orphan media files
+	ID       string `json:"id,omitempty"`
+	Filename string `json:"filename,omitempty"`
+	Path     string `json:"path"`
+	Problem  string `json:"problem"`
+	Detail   string `json:"detail,omitempty"`
+	//Repaired the item was queued to be downloaded again
+	Repaired bool `json:"repaired,omitempty"`
+}
+
+// VerifyReport result of verifying the backup folder
+type VerifyReport struct {
+	//Checked number of items checked
+	Checked  int              `json:"checked"`
+	Problems []*VerifyProblem `json:"problems"`
+}
+
+// decodeMedia Check a media file decodes as its mime type. JPEG, PNG and GIF
+// images are fully decoded, the box structure of MP4 and QuickTime videos is
+// read. Other types are not checked.
+func decodeMedia(media *io.SectionReader, mimeType string) error {
+	switch {
+	case isMP4(mimeType):
+		atoms, err := readMP4Atoms(media, media.Size())
+		if err != nil {
+			return err
+		}
+		for _, atom := range atoms {
+			if atom.typ == "moov" {
+				return nil
+			}
+		}
+		return errors.New("missing MP4 movie box")
+	case mimeType == "image/jpeg" || mimeType == "image/png" || mimeType == "image/gif":
+		_, format, err := image.Decode(io.NewSectionReader(media, 0, media.Size()))
+		if err != nil {
+			return err
+		}
+		if "image/"+format != mimeType {
+			return fmt.Errorf("%v image", format)
+		}
+	}
+	return nil
+}
+
+// verifiedMedia the content of a media file being verified, loose or packed
+type verifiedMedia struct {
+	*io.SectionReader
+	file *os.File
+	//SHA256 hash recorded in the pack index, empty for loose files
+	SHA256 string
+	//spooled the file is a temporary copy
+	spooled bool
+}
+
+// Close closes the media file, removing temporary copies
+func (m *verifiedMedia) Close() error {
+	err := m.file.Close()
+	if m.spooled {
+		os.Remove(m.file.Name())
+	}
+	return err
+}
+
+// spoolError a failure reading a media file from the storage, such as a file
+// which does not decrypt
+type spoolError struct {
+	err error
+}
+
+func (e *spoolError) Error() string {
+	return e.err.Error()
+}
+
+// openVerifiedMedia Open the media file of an item, from its archive when
+// packed. Files of other storages are copied to a temporary file first.
+func (d *Downloader) openVerifiedMedia(entry *catalogEntry) (*verifiedMedia, error) {
+	var packed *packedFile
+	if entry.isPacked() {
+		packed = entry.pack.Files[entry.Item.UsedFileName]
+	}
+	if !d.isLocal() {
+		reader, _, err := d.openBackupFile(entry.MediaFilePath())
+		if err != nil {
+			return nil, err
+		}
+		defer reader.Close()
+		file, err := ioutil.TempFile("", "gitmoo-verify-")
+		if err != nil {
+			return nil, err
+		}
+		media := &verifiedMedia{file: file, spooled: true}
+		if packed != nil {
+			media.SHA256 = packed.SHA256
+		}
+		size, err := io.Copy(file, reader)
+		if err != nil {
+			media.Close()
+			return nil, &spoolError{err}
+		}
+		media.SectionReader = io.NewSectionReader(file, 0, size)
+		return media, nil
+	}
+	if packed != nil {
+		file, err := os.Open(entry.pack.segmentPath(packed.Segment))
+		if err != nil {
+			return nil, err
+		}
+		return &verifiedMedia{SectionReader: io.NewSectionReader(file, packed.Offset, packed.Size), file: file, SHA256: packed.SHA256}, nil
+	}
+	file, err := os.Open(entry.MediaFilePath())
+	if err != nil {
+		return nil, err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+	return &verifiedMedia{SectionReader: io.NewSectionReader(file, 0, info.Size()), file: file}, nil
+}
+
+// verifyEntry Check the media file of an item, returns the problem found or
+// nil. Sizes missing from items stored before sizes were recorded are set
+// when the hash matches, and true is returned.
+func (d *Downloader) verifyEntry(entry *catalogEntry) (*VerifyProblem, bool) {
+	item := entry.Item
+	problem := &VerifyProblem{ID: item.Id, Filename: item.Filename, Path: entry.MediaFilePath()}
+	media, err := d.openVerifiedMedia(entry)
+	if os.IsNotExist(err) {
+		problem.Problem = VerifyMissing
+		return problem, false
+	}
+	if _, ok := err.(*spoolError); ok {
+		problem.Problem, problem.Detail = VerifyHash, err.Error()
+		return problem, false
+	}
+	if err != nil {
+		problem.Problem, problem.Detail = VerifyMissing, err.Error()
+		return problem, false
+	}
+	defer media.Close()
+	size := media.Size()
+	if size == 0 {
+		problem.Problem = VerifyEmpty
+		return problem, false
+	}
+	if item.Size != 0 && item.Size != size {
+		problem.Problem, problem.Detail = VerifySize, fmt.Sprintf("%v bytes, recorded %v", size, item.Size)
+		return problem, false
+	}
+	recorded := item.storedSHA256()
+	if recorded == "" {
+		recorded = media.SHA256
+	}
+	if recorded != "" {
+		hasher := sha256.New()
+		_, err = io.Copy(hasher, io.NewSectionReader(media, 0, size))
+		if err != nil {
+			problem.Problem, problem.Detail = VerifyHash, err.Error()
+			return problem, false
+		}
+		hash := hex.EncodeToString(hasher.Sum(nil))
+		if hash != recorded {
+			problem.Problem, problem.Detail = VerifyHash, fmt.Sprintf("%v, recorded %v", hash, recorded)
+			return problem, false
+		}
+	}
+	err = decodeMedia(media.SectionReader, strings.ToLower(item.MimeType))
+	if err != nil {
+		problem.Problem, problem.Detail = VerifyDecode, err.Error()
+		return problem, false
+	}
+	if item.Size == 0 && item.storedSHA256() != "" {
+		item.Size = size
+		return nil, true
+	}
+	return nil, false
+}
+
+// repairEntry Move the bad media file of an item to the trash folder and queue
+// the item to be downloaded again on the next run
+func (d *Downloader) repairEntry(entry *catalogEntry, problem *VerifyProblem) error {
+	if entry.Item.Provisional {
+		//Imported items have no Google Photos id to download them by
+		return nil
+	}
+	if entry.isPacked() {
+		//The bad copy stays in its archive until the folder is packed again
+		delete(entry.pack.Files, entry.Item.UsedFileName)
+		err := d.savePackIndex(entry.pack)
+		if err != nil {
+			return err
+		}
+	} else if problem.Problem != VerifyMissing {
+		trashPath, err := d.trashPath(problem.Path)
+		if err != nil {
+			return err
+		}
+		err = d.storage.MkdirAll(filepath.Dir(trashPath))
+		if err != nil {
+			return err
+		}
+		log.Printf("Moving bad '%v' to '%v'", problem.Path, trashPath)
+		err = d.storage.Rename(problem.Path, trashPath)
+		if err != nil {
+			return err
+		}
+	}
+	err := d.setChecksum(problem.Path, "")
+	if err != nil {
+		return err
+	}
+	//The download records the hashes and size again
+	entry.Item.SHA256 = ""
+	entry.Item.FileSHA256 = ""
+	entry.Item.PerceptualHash = ""
+	entry.Item.Size = 0
+	err = d.writeJSON(entry.Item, entry.JSONFilePath)
+	if err != nil {
+		return err
+	}
+	d.deferred.add(&entry.Item.MediaItem, deferredStatusRepair, 0)
+	problem.Repaired = true
+	return nil
+}
+
+// isVerifiedMedia returns true for files of the backup folder which should
+// belong to an item, skipping sidecars, XMP files, manifests, archives of
+// packed folders and state files
+func isVerifiedMedia(name string) bool {
+	if strings.HasPrefix(name, ".") || name == checksumsFileName || name == checksumsSignatureFileName || isPackFile(name) {
+		return false
+	}
+	ext := strings.ToLower(filepath.Ext(name))
+	return ext != ".json" && ext != xmpExtension
+}
+
+// Verify Check that the media file of every item in the backup folder exists
+// and matches its recorded size, hash and mime type, and find media files
+// without sidecars. Encrypted files are checked against the hashes of their
+// content. The report is written to w in JSON format. With repair,
+// items with bad or missing media files are queued to be downloaded again on
+// the next run, the bad files are moved to the trash folder.
+func (d *Downloader) Verify(w io.Writer, repair bool) error {
+	_, err := d.compileTemplates()
+	if err != nil {
+		return err
+	}
+	catalog, err := d.loadCatalog()
+	if err != nil {
+		return err
+	}
+	if repair {
+		err = d.deferred.load(d.storage, filepath.Join(d.Options.BackupFolder, deferredFileName))
+		if err != nil {
+			return err
+		}
+	}
+	ids := make([]string, 0, len(catalog.items))
+	for id := range catalog.items {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+
+	report := &VerifyReport{Problems: []*VerifyProblem{}}
+	referenced := make(map[string]bool)
+	for _, id := range ids {
+		entry := catalog.items[id]
+		if entry.Item.AliasOf != "" {
+			continue
+		}
+		referenced[filepath.Clean(entry.MediaFilePath())] = true
+		report.Checked++
+		problem, updated := d.verifyEntry(entry)
+		if updated {
+			err = d.writeJSON(entry.Item, entry.JSONFilePath)
+			if err != nil {
+				return err
+			}
+		}
+		if problem == nil {
+			continue
+		}
+		if repair {
+			err = d.repairEntry(entry, problem)
+			if err != nil {
+				log.Printf("Failed to repair '%v': %v", problem.Path, err)
+			}
+		}
+		report.Problems = append(report.Problems, problem)
+	}
+
+	skipDir := func(name string) bool {
+		return isTrashFolder(name) || filepath.Base(name) == takeoutStagingFolder
+	}
+	err = d.storage.Walk(d.Options.BackupFolder, skipDir, func(filePath string, info os.FileInfo) error {
+		if isVerifiedMedia(info.Name()) && !referenced[filepath.Clean(filePath)] {
+			report.Problems = append(report.Problems, &VerifyProblem{Path: filePath, Problem: VerifyOrphan})
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	if repair {
+		err = d.deferred.save()
+		if err != nil {
+			return err
+		}
+		err = d.flushChecksums()
+		if err != nil {
+			return err
+		}
+	}
+	log.Printf("Verified %v items, found %v problems", report.Checked, len(report.Problems))
+
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+	return encoder.Encode(report)
+}
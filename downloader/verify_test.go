@@ -0,0 +1,120 @@
+package downloader
+
+import (
+	"bytes"
+	"encoding/json"
+	"image/jpeg"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestVerify(t *testing.T) {
+	downloader := NewDownloader()
+	downloader.Options.BackupFolder = tempPath()
+	defer os.RemoveAll(downloader.Options.BackupFolder)
+
+	encoded := new(bytes.Buffer)
+	jpeg.Encode(encoded, testImage(64, 48, false), nil)
+	store := func(id string, data []byte) *LibraryItem {
+		item := adoptTestItem(id, id+".jpg")
+		item.UsedFileName = downloader.createFileName(item, 0)
+		filePath := downloader.getImageFilePath(item)
+		os.MkdirAll(filepath.Dir(filePath), 0700)
+		ioutil.WriteFile(filePath, encoded.Bytes(), 0644)
+		item.SHA256, _ = hashFile(filePath)
+		downloader.updateSize(item, filePath)
+		if data != nil {
+			ioutil.WriteFile(filePath, data, 0644)
+		}
+		downloader.writeJSON(item, downloader.getJSONFilePath(&item.MediaItem))
+		return item
+	}
+	store("ABCDEFGHIJKLMNOPQRSTUVW1", nil)
+	store("ABCDEFGHIJKLMNOPQRSTUVW2", []byte{})
+	store("ABCDEFGHIJKLMNOPQRSTUVW3", encoded.Bytes()[:encoded.Len()-10])
+	changed := append([]byte(nil), encoded.Bytes()...)
+	changed[len(changed)-3] ^= 0xff
+	store("ABCDEFGHIJKLMNOPQRSTUVW4", changed)
+	missing := store("ABCDEFGHIJKLMNOPQRSTUVW5", nil)
+	os.Remove(downloader.getImageFilePath(missing))
+	//Not checked against a hash, but does not decode
+	undecodable := store("ABCDEFGHIJKLMNOPQRSTUVW6", nil)
+	ioutil.WriteFile(downloader.getImageFilePath(undecodable), encoded.Bytes()[:encoded.Len()/2], 0644)
+	undecodable.SHA256 = ""
+	undecodable.Size = 0
+	downloader.writeJSON(undecodable, downloader.getJSONFilePath(&undecodable.MediaItem))
+	provisional := store("ABCDEFGHIJKLMNOPQRSTUVW7", []byte{})
+	provisional.Provisional = true
+	downloader.writeJSON(provisional, downloader.getJSONFilePath(&provisional.MediaItem))
+	//Stored before sizes were recorded
+	unsized := store("ABCDEFGHIJKLMNOPQRSTUVW8", nil)
+	unsized.Size = 0
+	downloader.writeJSON(unsized, downloader.getJSONFilePath(&unsized.MediaItem))
+	orphan := filepath.Join(downloader.Options.BackupFolder, "orphan.jpg")
+	ioutil.WriteFile(orphan, encoded.Bytes(), 0644)
+
+	output := new(bytes.Buffer)
+	err := downloader.Verify(output, true)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	var report VerifyReport
+	err = json.Unmarshal(output.Bytes(), &report)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	if report.Checked != 8 {
+		t.Errorf("Checked = %v; want 8", report.Checked)
+	}
+	problems := make(map[string]*VerifyProblem)
+	for _, problem := range report.Problems {
+		key := problem.ID
+		if key == "" {
+			key = problem.Path
+		}
+		problems[key] = problem
+	}
+	want := map[string]string{
+		"ABCDEFGHIJKLMNOPQRSTUVW2": VerifyEmpty,
+		"ABCDEFGHIJKLMNOPQRSTUVW3": VerifySize,
+		"ABCDEFGHIJKLMNOPQRSTUVW4": VerifyHash,
+		"ABCDEFGHIJKLMNOPQRSTUVW5": VerifyMissing,
+		"ABCDEFGHIJKLMNOPQRSTUVW6": VerifyDecode,
+		"ABCDEFGHIJKLMNOPQRSTUVW7": VerifyEmpty,
+		orphan:                     VerifyOrphan,
+	}
+	if len(problems) != len(want) {
+		t.Errorf("report = %v", output.String())
+	}
+	for key, problem := range want {
+		if problems[key] == nil || problems[key].Problem != problem {
+			t.Errorf("problem of %v = %v; want %v", key, problems[key], problem)
+		}
+	}
+
+	if problems["ABCDEFGHIJKLMNOPQRSTUVW7"] != nil && problems["ABCDEFGHIJKLMNOPQRSTUVW7"].Repaired {
+		t.Errorf("provisional items can not be downloaded again")
+	}
+	queue := newDeferredQueue()
+	err = queue.load(downloader.storage, filepath.Join(downloader.Options.BackupFolder, deferredFileName))
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	if len(queue.items) != 5 || queue.items["ABCDEFGHIJKLMNOPQRSTUVW3"] == nil {
+		t.Errorf("deferred = %v; want the 5 bad items", queue.items)
+	}
+	badPath := problems["ABCDEFGHIJKLMNOPQRSTUVW3"].Path
+	if _, err := os.Stat(badPath); !os.IsNotExist(err) {
+		t.Errorf("bad file should be moved away")
+	}
+	trashPath, _ := downloader.trashPath(badPath)
+	if _, err := os.Stat(trashPath); err != nil {
+		t.Errorf("bad file should be in the trash: %v", err)
+	}
+	stored, _ := loadSidecar(downloader.storage, downloader.getJSONFilePath(&unsized.MediaItem))
+	if stored == nil || stored.Size != int64(encoded.Len()) {
+		t.Errorf("Size should be recorded, got %v", stored)
+	}
+}
@@ -0,0 +1,577 @@
+package downloader
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// webdavChunkSize files up to this size are uploaded in a single request,
+// larger ones in chunks of this size on Nextcloud and ownCloud, and streamed
+// on other servers. Each upload buffers one chunk in memory.
+const webdavChunkSize = 10 << 20
+
+// webdavMtimeHeader modification time of uploaded files in seconds since the
+// epoch, set by Nextcloud and ownCloud
+const webdavMtimeHeader = "X-OC-MTime"
+
+// webdavPropfind properties read by PROPFIND
+const webdavPropfind = `<?xml version="1.0" encoding="utf-8"?>` +
+	`<d:propfind xmlns:d="DAV:"><d:prop><d:resourcetype/><d:getcontentlength/><d:getlastmodified/></d:prop></d:propfind>`
+
+// webdavStorage the backup folder on a WebDAV server, such as Nextcloud
+type webdavStorage struct {
+	//root the backup folder as joined by the downloader
+	root string
+	//endpoint the server, without a path
+	endpoint *url.URL
+	//path the backup folder on the server
+	path     string
+	user     string
+	password string
+	//uploads the chunked upload folder of Nextcloud and ownCloud servers
+	uploads string
+	client  *http.Client
+	//folders created or found by MkdirAll
+	folders sync.Map
+}
+
+// nextcloudUploads the chunked upload folder of the user of a Nextcloud or
+// ownCloud files path, empty for other servers
+func nextcloudUploads(filesPath string) string {
+	const files = "/remote.php/dav/files/"
+	i := strings.Index(filesPath, files)
+	if i < 0 {
+		return ""
+	}
+	user := strings.SplitN(filesPath[i+len(files):], "/", 2)[0]
+	if user == "" {
+		return ""
+	}
+	return filesPath[:i] + "/remote.php/dav/uploads/" + user
+}
+
+// newWebDAVStorage opens `webdav://user@host/path` over HTTP or
+// `webdavs://user@host/path` over HTTPS. The password is read from the
+// WEBDAV_PASSWORD environment variable when not in the URL.
+func newWebDAVStorage(folder string, location *url.URL) (*webdavStorage, error) {
+	if location.Host == "" {
+		return nil, fmt.Errorf("missing host in '%v'", folder)
+	}
+	s := &webdavStorage{
+		root:     filepath.Clean(folder),
+		endpoint: &url.URL{Scheme: "http", Host: location.Host},
+		path:     "/" + strings.Trim(location.Path, "/"),
+		user:     location.User.Username(),
+		client:   http.DefaultClient,
+	}
+	if location.Scheme == "webdavs" {
+		s.endpoint.Scheme = "https"
+	}
+	if s.user == "" {
+		s.user = os.Getenv("WEBDAV_USER")
+	}
+	if password, ok := location.User.Password(); ok {
+		s.password = password
+	} else {
+		s.password = os.Getenv("WEBDAV_PASSWORD")
+	}
+	s.uploads = nextcloudUploads(s.path)
+	//Fail early on wrong credentials, a missing backup folder is created later
+	_, err := s.propfind(s.path, "0")
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	return s, nil
+}
+
+// remote the path on the server of a name in the backup folder
+func (s *webdavStorage) remote(name string) (string, error) {
+	relative, err := filepath.Rel(s.root, filepath.Clean(name))
+	if err != nil {
+		return "", err
+	}
+	relative = filepath.ToSlash(relative)
+	if relative == ".." || strings.HasPrefix(relative, "../") {
+		return "", fmt.Errorf("'%v' is outside of '%v'", name, s.root)
+	}
+	return path.Join(s.path, relative), nil
+}
+
+// url the URL of a path on the server
+func (s *webdavStorage) url(remote string) string {
+	location := *s.endpoint
+	location.Path = remote
+	return location.String()
+}
+
+// request Send a request for a path on the server. Responses with an error
+// status are returned as errors, not found errors satisfy os.IsNotExist.
+func (s *webdavStorage) request(method string, remote string, header http.Header, body io.Reader) (*http.Response, error) {
+	request, err := http.NewRequest(method, s.url(remote), body)
+	if err != nil {
+		return nil, err
+	}
+	for name, values := range header {
+		request.Header[name] = values
+	}
+	if s.user != "" || s.password != "" {
+		request.SetBasicAuth(s.user, s.password)
+	}
+	response, err := s.client.Do(request)
+	if err != nil {
+		return nil, err
+	}
+	if response.StatusCode < 300 {
+		return response, nil
+	}
+	response.Body.Close()
+	if response.StatusCode == http.StatusNotFound {
+		return nil, &os.PathError{Op: strings.ToLower(method), Path: remote, Err: os.ErrNotExist}
+	}
+	return nil, &webdavError{method: method, remote: remote, status: response.StatusCode, text: response.Status}
+}
+
+// webdavError an error status of a request
+type webdavError struct {
+	method string
+	remote string
+	status int
+	text   string
+}
+
+func (e *webdavError) Error() string {
+	return fmt.Sprintf("WebDAV %v '%v': %v", e.method, e.remote, e.text)
+}
+
+// webdavStatus returns the status of a failed request, 0 for other errors
+func webdavStatus(err error) int {
+	var statusErr *webdavError
+	if errors.As(err, &statusErr) {
+		return statusErr.status
+	}
+	return 0
+}
+
+// webdavMultistatus a PROPFIND or PROPPATCH response
+type webdavMultistatus struct {
+	Responses []struct {
+		Href     string `xml:"href"`
+		Propstat []struct {
+			Prop struct {
+				ContentLength int64  `xml:"getcontentlength"`
+				LastModified  string `xml:"getlastmodified"`
+				ResourceType  struct {
+					Collection *struct{} `xml:"collection"`
+				} `xml:"resourcetype"`
+			} `xml:"prop"`
+			Status string `xml:"status"`
+		} `xml:"propstat"`
+	} `xml:"response"`
+}
+
+// propfind List a file, or a folder with its files for depth 1, the files
+// are keyed by their path on the server
+func (s *webdavStorage) propfind(remote string, depth string) (map[string]*storageFileInfo, error) {
+	header := http.Header{"Depth": {depth}, "Content-Type": {"application/xml; charset=utf-8"}}
+	response, err := s.request("PROPFIND", remote, header, strings.NewReader(webdavPropfind))
+	if err != nil {
+		return nil, err
+	}
+	defer response.Body.Close()
+	var multistatus webdavMultistatus
+	err = xml.NewDecoder(response.Body).Decode(&multistatus)
+	if err != nil {
+		return nil, fmt.Errorf("WebDAV PROPFIND '%v': %v", remote, err)
+	}
+	files := make(map[string]*storageFileInfo)
+	for _, r := range multistatus.Responses {
+		href, err := url.Parse(r.Href)
+		if err != nil {
+			continue
+		}
+		filePath := path.Clean("/" + href.Path)
+		info := &storageFileInfo{name: path.Base(filePath)}
+		for _, propstat := range r.Propstat {
+			if !strings.Contains(propstat.Status, " 200 ") {
+				continue
+			}
+			if propstat.Prop.ResourceType.Collection != nil {
+				info.dir = true
+			}
+			if propstat.Prop.ContentLength != 0 {
+				info.size = propstat.Prop.ContentLength
+			}
+			if propstat.Prop.LastModified != "" {
+				info.modTime, _ = http.ParseTime(propstat.Prop.LastModified)
+			}
+		}
+		files[filePath] = info
+	}
+	return files, nil
+}
+
+func (s *webdavStorage) Stat(name string) (os.FileInfo, error) {
+	remote, err := s.remote(name)
+	if err != nil {
+		return nil, err
+	}
+	files, err := s.propfind(remote, "0")
+	if err != nil {
+		return nil, err
+	}
+	for _, info := range files {
+		return info, nil
+	}
+	return nil, &os.PathError{Op: "stat", Path: name, Err: os.ErrNotExist}
+}
+
+func (s *webdavStorage) ReadDir(name string) ([]os.FileInfo, error) {
+	remote, err := s.remote(name)
+	if err != nil {
+		return nil, err
+	}
+	found, err := s.propfind(remote, "1")
+	if err != nil {
+		return nil, err
+	}
+	var files []os.FileInfo
+	for filePath, info := range found {
+		//The folder itself is listed with its files
+		if filePath != path.Clean(remote) {
+			files = append(files, info)
+		}
+	}
+	sort.Slice(files, func(i, j int) bool { return files[i].Name() < files[j].Name() })
+	return files, nil
+}
+
+func (s *webdavStorage) Walk(root string, skipDir func(name string) bool, fn func(name string, info os.FileInfo) error) error {
+	return walkStorage(s, root, skipDir, fn)
+}
+
+// mkcol Create a folder and its missing parents
+func (s *webdavStorage) mkcol(remote string) error {
+	if remote == "/" || remote == "." {
+		return nil
+	}
+	if _, ok := s.folders.Load(remote); ok {
+		return nil
+	}
+	response, err := s.request("MKCOL", remote, nil, nil)
+	switch webdavStatus(err) {
+	case http.StatusConflict:
+		//The parent is missing
+		err = s.mkcol(path.Dir(remote))
+		if err != nil {
+			return err
+		}
+		response, err = s.request("MKCOL", remote, nil, nil)
+		if webdavStatus(err) == http.StatusMethodNotAllowed {
+			err = nil
+		}
+	case http.StatusMethodNotAllowed:
+		//The folder exists
+		err = nil
+	}
+	if err != nil {
+		return err
+	}
+	if response != nil {
+		response.Body.Close()
+	}
+	s.folders.Store(remote, true)
+	return nil
+}
+
+func (s *webdavStorage) MkdirAll(name string) error {
+	remote, err := s.remote(name)
+	if err != nil {
+		return err
+	}
+	return s.mkcol(remote)
+}
+
+func (s *webdavStorage) Open(name string) (io.ReadCloser, error) {
+	remote, err := s.remote(name)
+	if err != nil {
+		return nil, err
+	}
+	response, err := s.request(http.MethodGet, remote, nil, nil)
+	if err != nil {
+		return nil, err
+	}
+	return response.Body, nil
+}
+
+// webdavWriter uploads a file in a single request up to webdavChunkSize.
+// Larger files are uploaded in chunks on Nextcloud and ownCloud, and
+// streamed to a temporary name renamed once complete on other servers.
+type webdavWriter struct {
+	storage *webdavStorage
+	remote  string
+	header  http.Header
+	buffer  []byte
+	//upload the chunked upload folder
+	upload string
+	chunks int
+	size   int64
+	//stream the body of the streamed upload to temp
+	stream *io.PipeWriter
+	temp   string
+	done   chan error
+}
+
+func (s *webdavStorage) Create(name string, modTime time.Time) (StorageWriter, error) {
+	remote, err := s.remote(name)
+	if err != nil {
+		return nil, err
+	}
+	header := http.Header{"Content-Type": {mimeTypeByExtension(remote)}}
+	if !modTime.IsZero() {
+		header.Set(webdavMtimeHeader, strconv.FormatInt(modTime.Unix(), 10))
+	}
+	return &webdavWriter{storage: s, remote: remote, header: header}, nil
+}
+
+// start Start a chunked or a streamed upload, once the file is larger than a
+// single request
+func (w *webdavWriter) start() error {
+	if w.storage.uploads != "" {
+		id := make([]byte, 8)
+		_, err := rand.Read(id)
+		if err != nil {
+			return err
+		}
+		upload := w.storage.uploads + "/gitmoo-" + hex.EncodeToString(id)
+		header := http.Header{"Destination": {w.storage.url(w.remote)}}
+		response, err := w.storage.request("MKCOL", upload, header, nil)
+		if err != nil {
+			return err
+		}
+		response.Body.Close()
+		w.upload = upload
+		return nil
+	}
+	w.temp = path.Join(path.Dir(w.remote), "."+path.Base(w.remote)+storageTempSuffix)
+	reader, writer := io.Pipe()
+	w.stream = writer
+	w.done = make(chan error, 1)
+	go func() {
+		response, err := w.storage.request(http.MethodPut, w.temp, w.header, reader)
+		if err == nil {
+			err = response.Body.Close()
+		}
+		//Unblock writes when the request failed
+		reader.CloseWithError(err)
+		w.done <- err
+	}()
+	return nil
+}
+
+// uploadChunk Upload the buffered data as the next chunk
+func (w *webdavWriter) uploadChunk() error {
+	w.chunks++
+	header := http.Header{"Destination": {w.storage.url(w.remote)}}
+	response, err := w.storage.request(http.MethodPut, fmt.Sprintf("%v/%05d", w.upload, w.chunks), header, bytes.NewReader(w.buffer))
+	if err != nil {
+		return err
+	}
+	response.Body.Close()
+	w.size += int64(len(w.buffer))
+	w.buffer = w.buffer[:0]
+	return nil
+}
+
+func (w *webdavWriter) Write(data []byte) (int, error) {
+	if w.stream != nil {
+		return w.stream.Write(data)
+	}
+	written := 0
+	for len(data) > 0 {
+		if len(w.buffer) == webdavChunkSize {
+			if w.upload == "" {
+				err := w.start()
+				if err != nil {
+					return written, err
+				}
+			}
+			if w.stream != nil {
+				_, err := w.stream.Write(w.buffer)
+				w.buffer = nil
+				if err != nil {
+					return written, err
+				}
+				n, err := w.stream.Write(data)
+				return written + n, err
+			}
+			err := w.uploadChunk()
+			if err != nil {
+				return written, err
+			}
+		}
+		if w.buffer == nil {
+			w.buffer = make([]byte, 0, webdavChunkSize)
+		}
+		n := webdavChunkSize - len(w.buffer)
+		if n > len(data) {
+			n = len(data)
+		}
+		w.buffer = append(w.buffer, data[:n]...)
+		data = data[n:]
+		written += n
+	}
+	return written, nil
+}
+
+// move Move a file on the server, replacing an existing one
+func (s *webdavStorage) move(from string, to string, header http.Header) error {
+	if header == nil {
+		header = http.Header{}
+	}
+	header.Set("Destination", s.url(to))
+	header.Set("Overwrite", "T")
+	response, err := s.request("MOVE", from, header, nil)
+	if err != nil {
+		return err
+	}
+	return response.Body.Close()
+}
+
+func (w *webdavWriter) Close() error {
+	switch {
+	case w.stream != nil:
+		w.stream.Close()
+		err := <-w.done
+		if err == nil {
+			err = w.storage.move(w.temp, w.remote, nil)
+		}
+		if err != nil {
+			w.Abort()
+		}
+		return err
+	case w.upload != "":
+		if len(w.buffer) > 0 {
+			err := w.uploadChunk()
+			if err != nil {
+				w.Abort()
+				return err
+			}
+		}
+		header := http.Header{"Oc-Total-Length": {strconv.FormatInt(w.size, 10)}}
+		if mtime := w.header.Get(webdavMtimeHeader); mtime != "" {
+			header.Set(webdavMtimeHeader, mtime)
+		}
+		//The server combines the chunks into the file
+		err := w.storage.move(w.upload+"/.file", w.remote, header)
+		if err != nil {
+			w.Abort()
+		}
+		return err
+	}
+	response, err := w.storage.request(http.MethodPut, w.remote, w.header, bytes.NewReader(w.buffer))
+	if err != nil {
+		return err
+	}
+	return response.Body.Close()
+}
+
+// Abort cancels the upload and removes what was uploaded
+func (w *webdavWriter) Abort() error {
+	w.buffer = nil
+	switch {
+	case w.stream != nil:
+		w.stream.CloseWithError(errors.New("upload aborted"))
+		<-w.done
+		w.stream = nil
+		response, err := w.storage.request(http.MethodDelete, w.temp, nil, nil)
+		if os.IsNotExist(err) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		return response.Body.Close()
+	case w.upload != "":
+		response, err := w.storage.request(http.MethodDelete, w.upload, nil, nil)
+		w.upload = ""
+		if err != nil {
+			return err
+		}
+		return response.Body.Close()
+	}
+	return nil
+}
+
+func (s *webdavStorage) Remove(name string) error {
+	remote, err := s.remote(name)
+	if err != nil {
+		return err
+	}
+	response, err := s.request(http.MethodDelete, remote, nil, nil)
+	if err != nil {
+		return err
+	}
+	return response.Body.Close()
+}
+
+func (s *webdavStorage) Rename(from string, to string) error {
+	fromRemote, err := s.remote(from)
+	if err != nil {
+		return err
+	}
+	toRemote, err := s.remote(to)
+	if err != nil {
+		return err
+	}
+	if fromRemote == toRemote {
+		return nil
+	}
+	return s.move(fromRemote, toRemote, nil)
+}
+
+// Chtimes sets the modification time with PROPPATCH, as Nextcloud and
+// ownCloud allow
+func (s *webdavStorage) Chtimes(name string, modTime time.Time) error {
+	remote, err := s.remote(name)
+	if err != nil {
+		return err
+	}
+	body := `<?xml version="1.0" encoding="utf-8"?><d:propertyupdate xmlns:d="DAV:"><d:set><d:prop>` +
+		`<d:lastmodified>` + strconv.FormatInt(modTime.Unix(), 10) + `</d:lastmodified></d:prop></d:set></d:propertyupdate>`
+	header := http.Header{"Content-Type": {"application/xml; charset=utf-8"}}
+	response, err := s.request("PROPPATCH", remote, header, strings.NewReader(body))
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+	data, err := ioutil.ReadAll(response.Body)
+	if err != nil {
+		return err
+	}
+	var multistatus webdavMultistatus
+	xml.Unmarshal(data, &multistatus)
+	for _, r := range multistatus.Responses {
+		for _, propstat := range r.Propstat {
+			if !strings.Contains(propstat.Status, " 200 ") {
+				return fmt.Errorf("failed writing timestamp to '%v': %v", remote, propstat.Status)
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,235 @@
+package downloader
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"golang.org/x/net/webdav"
+)
+
+// fakeNextcloud a WebDAV server keeping files in a local folder, which sets
+// modification times and combines chunked uploads as Nextcloud does
+type fakeNextcloud struct {
+	sync.Mutex
+	dir string
+	dav *webdav.Handler
+	//chunks number of chunks uploaded
+	chunks int
+	//streamed number of uploads without a length
+	streamed int
+	//requests requests being served
+	requests sync.WaitGroup
+}
+
+func newFakeNextcloud(dir string) *fakeNextcloud {
+	return &fakeNextcloud{
+		dir: dir,
+		dav: &webdav.Handler{Prefix: "/remote.php/dav", FileSystem: webdav.Dir(dir), LockSystem: webdav.NewMemLS()},
+	}
+}
+
+// local the local path of a path on the server
+func (f *fakeNextcloud) local(remote string) string {
+	return filepath.Join(f.dir, filepath.FromSlash(strings.TrimPrefix(remote, "/remote.php/dav")))
+}
+
+// failingBody keeps the error reading a request body
+type failingBody struct {
+	io.ReadCloser
+	err error
+}
+
+func (b *failingBody) Read(data []byte) (int, error) {
+	n, err := b.ReadCloser.Read(data)
+	if err != nil && err != io.EOF {
+		b.err = err
+	}
+	return n, err
+}
+
+// statusRecorder keeps the status of a response
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (r *statusRecorder) WriteHeader(status int) {
+	r.status = status
+	r.ResponseWriter.WriteHeader(status)
+}
+
+// setMtime Set the modification time of a file from the Nextcloud header
+func setMtime(filePath string, value string) {
+	seconds, err := strconv.ParseInt(value, 10, 64)
+	if err == nil {
+		os.Chtimes(filePath, time.Now(), time.Unix(seconds, 0))
+	}
+}
+
+var lastModifiedProperty = regexp.MustCompile(`<d:lastmodified>(\d+)</d:lastmodified>`)
+
+func (f *fakeNextcloud) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.requests.Add(1)
+	defer f.requests.Done()
+	user, password, _ := r.BasicAuth()
+	if user != "tester" || password != "secret" {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+	destination := ""
+	if location, err := url.Parse(r.Header.Get("Destination")); err == nil {
+		destination = location.Path
+	}
+	switch {
+	case r.Method == "MOVE" && strings.HasPrefix(r.URL.Path, "/remote.php/dav/uploads/") && strings.HasSuffix(r.URL.Path, "/.file"):
+		upload := f.local(strings.TrimSuffix(r.URL.Path, "/.file"))
+		files, _ := ioutil.ReadDir(upload)
+		sort.Slice(files, func(i, j int) bool { return files[i].Name() < files[j].Name() })
+		var data []byte
+		for _, file := range files {
+			chunk, _ := ioutil.ReadFile(filepath.Join(upload, file.Name()))
+			data = append(data, chunk...)
+		}
+		if strconv.Itoa(len(data)) != r.Header.Get("Oc-Total-Length") {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		ioutil.WriteFile(f.local(destination), data, 0644)
+		setMtime(f.local(destination), r.Header.Get(webdavMtimeHeader))
+		os.RemoveAll(upload)
+		w.WriteHeader(http.StatusCreated)
+		return
+	case r.Method == "PROPPATCH":
+		body, _ := ioutil.ReadAll(r.Body)
+		match := lastModifiedProperty.FindSubmatch(body)
+		if match != nil {
+			setMtime(f.local(r.URL.Path), string(match[1]))
+			w.WriteHeader(http.StatusMultiStatus)
+			io.WriteString(w, `<?xml version="1.0" encoding="utf-8"?><d:multistatus xmlns:d="DAV:"><d:response><d:href>`+
+				r.URL.Path+`</d:href><d:propstat><d:prop><d:lastmodified/></d:prop><d:status>HTTP/1.1 200 OK</d:status></d:propstat></d:response></d:multistatus>`)
+			return
+		}
+		r.Body = ioutil.NopCloser(bytes.NewReader(body))
+	case r.Method == http.MethodPut:
+		f.Lock()
+		if strings.HasPrefix(r.URL.Path, "/remote.php/dav/uploads/") {
+			f.chunks++
+		}
+		if r.ContentLength < 0 {
+			f.streamed++
+		}
+		f.Unlock()
+	}
+	body := &failingBody{ReadCloser: r.Body}
+	r.Body = body
+	recorder := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+	f.dav.ServeHTTP(recorder, r)
+	if r.Method == http.MethodPut && body.err != nil {
+		//Nextcloud discards incomplete uploads
+		os.Remove(f.local(r.URL.Path))
+	}
+	if recorder.status < 300 && r.Header.Get(webdavMtimeHeader) != "" {
+		switch r.Method {
+		case http.MethodPut:
+			setMtime(f.local(r.URL.Path), r.Header.Get(webdavMtimeHeader))
+		case "MOVE":
+			setMtime(f.local(destination), r.Header.Get(webdavMtimeHeader))
+		}
+	}
+}
+
+func TestWebDAVStorage(t *testing.T) {
+	dir := tempPath()
+	os.MkdirAll(filepath.Join(dir, "files", "tester"), 0700)
+	os.MkdirAll(filepath.Join(dir, "uploads", "tester"), 0700)
+	defer os.RemoveAll(dir)
+	fake := newFakeNextcloud(dir)
+	server := httptest.NewServer(fake)
+	defer server.Close()
+	host := strings.TrimPrefix(server.URL, "http://")
+	defer os.Setenv("WEBDAV_PASSWORD", os.Getenv("WEBDAV_PASSWORD"))
+
+	os.Setenv("WEBDAV_PASSWORD", "wrong")
+	_, err := NewStorage(&Options{BackupFolder: "webdav://tester@" + host + "/remote.php/dav/files/tester/backup"})
+	if err == nil || !strings.Contains(err.Error(), "401") {
+		t.Errorf("NewStorage() with a wrong password = %v", err)
+	}
+	os.Setenv("WEBDAV_PASSWORD", "secret")
+
+	large := bytes.Repeat([]byte("0123456789abcdef"), webdavChunkSize/16+1000)
+	modTime := time.Date(2019, 10, 1, 12, 30, 0, 0, time.UTC)
+	for _, test := range []struct {
+		folder  string
+		chunked bool
+	}{
+		{"/remote.php/dav/files/tester/backup", true},
+		{"/remote.php/dav/other/backup", false},
+	} {
+		folder := "webdav://tester@" + host + test.folder
+		storage, err := NewStorage(&Options{BackupFolder: folder})
+		if err != nil {
+			t.Fatalf("%v", err)
+		}
+		testStorage(t, storage, folder)
+
+		fake.chunks, fake.streamed = 0, 0
+		name := filepath.Join(folder, "2019", "VID_1.mp4")
+		err = storage.MkdirAll(filepath.Dir(name))
+		if err != nil {
+			t.Fatalf("%v", err)
+		}
+		writer, err := storage.Create(name, modTime)
+		if err != nil {
+			t.Fatalf("%v", err)
+		}
+		writer.Write(large)
+		err = writer.Close()
+		if err != nil {
+			t.Fatalf("%v", err)
+		}
+		localPath := fake.local(test.folder + "/2019/VID_1.mp4")
+		data, _ := ioutil.ReadFile(localPath)
+		if !bytes.Equal(data, large) {
+			t.Errorf("%v: stored %v bytes; want %v", test.folder, len(data), len(large))
+		}
+		info, _ := storage.Stat(name)
+		if info == nil || !info.ModTime().Equal(modTime) {
+			t.Errorf("%v: modification time should be kept, got %v", test.folder, info)
+		}
+		if test.chunked && (fake.chunks != 2 || fake.streamed != 0) {
+			t.Errorf("%v: %v chunks, %v streamed; want 2 chunks", test.folder, fake.chunks, fake.streamed)
+		}
+		if !test.chunked && (fake.chunks != 0 || fake.streamed != 1) {
+			t.Errorf("%v: %v chunks, %v streamed; want 1 streamed", test.folder, fake.chunks, fake.streamed)
+		}
+
+		writer, _ = storage.Create(filepath.Join(folder, "2019", "VID_2.mp4"), modTime)
+		writer.Write(large)
+		writer.Abort()
+		//The server may still be reading the aborted upload
+		fake.requests.Wait()
+		files, _ := ioutil.ReadDir(filepath.Dir(localPath))
+		for _, file := range files {
+			if strings.HasPrefix(file.Name(), ".") || file.Name() == "VID_2.mp4" {
+				t.Errorf("%v: aborted upload left %v", test.folder, file.Name())
+			}
+		}
+		uploads, _ := ioutil.ReadDir(filepath.Join(dir, "uploads", "tester"))
+		if len(uploads) != 0 {
+			t.Errorf("%v: aborted upload left %v", test.folder, uploads)
+		}
+	}
+}
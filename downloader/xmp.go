@@ -0,0 +1,129 @@
+package downloader
+
+import (
+	"bytes"
+	"encoding/xml"
+	"fmt"
+	"log"
+	"math"
+	"os"
+	"time"
+)
+
+// xmpExtension the XMP sidecar of a media file is the media file name with
+// this extension appended, as darktable and digiKam expect
+const xmpExtension = ".xmp"
+
+// xmpFilePath path of the XMP sidecar of a media file
+func xmpFilePath(mediaFilePath string) string {
+	return mediaFilePath + xmpExtension
+}
+
+// xmlText XML escaped text
+func xmlText(text string) string {
+	buffer := new(bytes.Buffer)
+	xml.EscapeText(buffer, []byte(text))
+	return buffer.String()
+}
+
+// xmpCoordinate a GPS coordinate in XMP form, degrees and decimal minutes
+// followed by the reference, e.g. 32,4.800000N
+func xmpCoordinate(value float64, positive string, negative string) string {
+	ref := positive
+	if value < 0 {
+		ref = negative
+	}
+	degrees, fraction := math.Modf(math.Abs(value))
+	return fmt.Sprintf("%d,%.6f%v", int(degrees), fraction*60, ref)
+}
+
+// buildXMP Build an XMP packet holding the item metadata
+func (d *Downloader) buildXMP(item *LibraryItem) []byte {
+	buffer := new(bytes.Buffer)
+	buffer.WriteString("<?xpacket begin=\"\ufeff\" id=\"W5M0MpCehiHzreSzNTczkc9d\"?>\n")
+	buffer.WriteString("<x:xmpmeta xmlns:x=\"adobe:ns:meta/\">\n")
+	buffer.WriteString(" <rdf:RDF xmlns:rdf=\"http://www.w3.org/1999/02/22-rdf-syntax-ns#\">\n")
+	buffer.WriteString("  <rdf:Description rdf:about=\"\"\n")
+	buffer.WriteString("    xmlns:dc=\"http://purl.org/dc/elements/1.1/\"\n")
+	buffer.WriteString("    xmlns:xmp=\"http://ns.adobe.com/xap/1.0/\"\n")
+	buffer.WriteString("    xmlns:exif=\"http://ns.adobe.com/exif/1.0/\"\n")
+	buffer.WriteString("    xmlns:tiff=\"http://ns.adobe.com/tiff/1.0/\"\n")
+	buffer.WriteString("    xmlns:photoshop=\"http://ns.adobe.com/photoshop/1.0/\"")
+	if item.MediaMetadata != nil {
+		_, err := time.Parse(time.RFC3339, item.MediaMetadata.CreationTime)
+		if err == nil {
+			created := xmlText(d.creationTime(&item.MediaItem).Format(time.RFC3339))
+			buffer.WriteString("\n    exif:DateTimeOriginal=\"" + created + "\"")
+			buffer.WriteString("\n    xmp:CreateDate=\"" + created + "\"")
+			buffer.WriteString("\n    photoshop:DateCreated=\"" + created + "\"")
+		}
+	}
+	if value := cameraMake(&item.MediaItem); value != "" {
+		buffer.WriteString("\n    tiff:Make=\"" + xmlText(value) + "\"")
+	}
+	if value := cameraModel(&item.MediaItem); value != "" {
+		buffer.WriteString("\n    tiff:Model=\"" + xmlText(value) + "\"")
+	}
+	if item.GeoData != nil {
+		altitudeRef := "0"
+		if item.GeoData.Altitude < 0 {
+			altitudeRef = "1"
+		}
+		buffer.WriteString("\n    exif:GPSLatitude=\"" + xmpCoordinate(item.GeoData.Latitude, "N", "S") + "\"")
+		buffer.WriteString("\n    exif:GPSLongitude=\"" + xmpCoordinate(item.GeoData.Longitude, "E", "W") + "\"")
+		buffer.WriteString("\n    exif:GPSAltitudeRef=\"" + altitudeRef + "\"")
+		buffer.WriteString(fmt.Sprintf("\n    exif:GPSAltitude=\"%d/100\"", int64(math.Round(math.Abs(item.GeoData.Altitude)*100))))
+	}
+	if item.ProductUrl != "" {
+		buffer.WriteString("\n    dc:source=\"" + xmlText(item.ProductUrl) + "\"")
+	}
+	buffer.WriteString(">\n")
+
+	buffer.WriteString("   <xmp:Identifier>\n    <rdf:Bag>\n")
+	buffer.WriteString("     <rdf:li>" + xmlText(item.Id) + "</rdf:li>\n")
+	buffer.WriteString("    </rdf:Bag>\n   </xmp:Identifier>\n")
+	if item.Description != "" {
+		buffer.WriteString("   <dc:description>\n    <rdf:Alt>\n")
+		buffer.WriteString("     <rdf:li xml:lang=\"x-default\">" + xmlText(item.Description) + "</rdf:li>\n")
+		buffer.WriteString("    </rdf:Alt>\n   </dc:description>\n")
+	}
+	if len(item.Albums) > 0 {
+		buffer.WriteString("   <dc:subject>\n    <rdf:Bag>\n")
+		for _, album := range item.Albums {
+			buffer.WriteString("     <rdf:li>" + xmlText(album) + "</rdf:li>\n")
+		}
+		buffer.WriteString("    </rdf:Bag>\n   </dc:subject>\n")
+	}
+
+	buffer.WriteString("  </rdf:Description>\n")
+	buffer.WriteString(" </rdf:RDF>\n")
+	buffer.WriteString("</x:xmpmeta>\n")
+	buffer.WriteString("<?xpacket end=\"w\"?>\n")
+	return buffer.Bytes()
+}
+
+// writeXMP Write the XMP sidecar of an item when XMP sidecars are enabled,
+// if it is missing or always when force is set
+func (d *Downloader) writeXMP(item *LibraryItem, force bool) error {
+	if !d.Options.WriteXMP || item.AliasOf != "" {
+		return nil
+	}
+	filePath := xmpFilePath(d.getImageFilePath(item))
+	if !force {
+		_, err := d.storage.Stat(filePath)
+		if err == nil || !os.IsNotExist(err) {
+			return err
+		}
+	}
+	log.Printf("Writing XMP for '%v' ", item.UsedFileName)
+	return writeStorageFile(d.storage, filePath, d.buildXMP(item))
+}
+
+// moveXMP Move the XMP sidecar of a media file along with it, if there is one
+func (d *Downloader) moveXMP(fromMediaFilePath string, toMediaFilePath string) error {
+	err := d.storage.Rename(xmpFilePath(fromMediaFilePath), xmpFilePath(toMediaFilePath))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	return err
+}
@@ -0,0 +1,90 @@
+package downloader
+
+import (
+	"bytes"
+	"encoding/xml"
+	"io"
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestBuildXMP(t *testing.T) {
+	downloader := NewDownloader()
+	item := templateTestItem()
+	item.Description = "Dinner <with> \"friends\" & family"
+	item.addAlbum("Trip 2019")
+	item.addAlbum("Food")
+	if item.addAlbum("Food") {
+		t.Errorf("addAlbum() should not add an album twice")
+	}
+
+	data := downloader.buildXMP(item)
+	decoder := xml.NewDecoder(bytes.NewReader(data))
+	for {
+		_, err := decoder.Token()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatalf("invalid XMP: %v\n%s", err, data)
+		}
+	}
+
+	xmp := string(data)
+	expected := []string{
+		`exif:DateTimeOriginal="2019-10-03T07:33:43Z"`,
+		`tiff:Make="motorola"`,
+		`tiff:Model="Moto G (5) Plus"`,
+		`<rdf:li>12345678901234567890</rdf:li>`,
+		`<rdf:li xml:lang="x-default">Dinner &lt;with&gt; &#34;friends&#34; &amp; family</rdf:li>`,
+		`<rdf:li>Trip 2019</rdf:li>`,
+		`<rdf:li>Food</rdf:li>`,
+	}
+	for _, text := range expected {
+		if !strings.Contains(xmp, text) {
+			t.Errorf("XMP is missing %v:\n%v", text, xmp)
+		}
+	}
+}
+
+func TestWriteXMP(t *testing.T) {
+	downloader := NewDownloader()
+	downloader.Options.BackupFolder = tempPath()
+	defer os.RemoveAll(downloader.Options.BackupFolder)
+
+	item := createTestItem(t, downloader, "12345678901234567890")
+	filePath := xmpFilePath(downloader.getImageFilePath(item))
+
+	err := downloader.writeXMP(item, false)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	if _, err := os.Stat(filePath); !os.IsNotExist(err) {
+		t.Errorf("XMP should only be written when enabled")
+	}
+
+	downloader.Options.WriteXMP = true
+	err = downloader.writeXMP(item, false)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	item.Description = "Changed"
+	err = downloader.writeXMP(item, false)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	data, _ := ioutil.ReadFile(filePath)
+	if strings.Contains(string(data), "Changed") {
+		t.Errorf("existing XMP should be kept unless forced")
+	}
+	err = downloader.writeXMP(item, true)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	data, _ = ioutil.ReadFile(filePath)
+	if !strings.Contains(string(data), "Changed") {
+		t.Errorf("forced XMP should be regenerated")
+	}
+}
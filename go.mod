@@ -3,13 +3,17 @@ module github.com/dtylman/gitmoo-goog
 go 1.15
 
 require (
+	filippo.io/age v1.0.0
 	github.com/dtylman/gopack v0.0.0-20191030095432-3a1a77a8b52c
 	github.com/dustin/go-humanize v1.0.0
-	github.com/fujiwara/shapeio v0.0.0-20170602072123-c073257dd745
 	github.com/gphotosuploader/googlemirror v0.5.0
-	golang.org/x/net v0.0.0-20190503192946-f4e77d36d62c
+	github.com/pkg/sftp v1.13.5
+	golang.org/x/crypto v0.0.0-20211215153901-e495a2d5b3d3
+	golang.org/x/net v0.0.0-20211112202133-69e39bad7dc2
 	golang.org/x/oauth2 v0.0.0-20190604053449-0f29369cfe45
 	golang.org/x/sync v0.0.0-20201207232520-09787c993a3a
+	golang.org/x/time v0.0.0-20181108054448-85acf8d2951c
+	google.golang.org/api v0.19.0
 	gopkg.in/natefinch/lumberjack.v2 v2.0.0
 	gopkg.in/yaml.v2 v2.4.0 // indirect
 )
@@ -12,6 +12,9 @@ import (
 	"os"
 	"path/filepath"
 	"strings"
+	"time"
+	//Time zone database for -timezone on systems without one
+	_ "time/tzdata"
 
 	"github.com/dtylman/gitmoo-goog/downloader"
 	"github.com/dtylman/gitmoo-goog/version"
@@ -32,6 +35,10 @@ var options struct {
 }
 var authCodeChan chan string
 
+// pausedLoopDelay time to wait with -loop before the next pass, when downloads
+// were paused for lack of space
+const pausedLoopDelay = 15 * time.Minute
+
 // Retrieve a token, saves the token, then returns the generated client.
 func getClient(config *oauth2.Config, tokFile string) *http.Client {
 	tok, err := tokenFromFile(tokFile)
@@ -145,6 +152,10 @@ func process(downloader *downloader.Downloader) error {
 		if !options.loop {
 			break
 		}
+		if downloader.Paused() != "" {
+			log.Printf("Waiting %v for space before the next pass", pausedLoopDelay)
+			time.Sleep(pausedLoopDelay)
+		}
 	}
 	return nil
 }
@@ -156,20 +167,49 @@ func main() {
 	flag.BoolVar(&options.ignoreerrors, "force", false, "ignore errors, and force working")
 	flag.StringVar(&options.logfile, "logfile", "", "log to this file")
 	flag.BoolVar(&options.version, "version", false, "at startup, print the gitmoo-goog version")
-	flag.StringVar(&downloader.Options.BackupFolder, "folder", workingDirectory, "backup folder")
+	flag.StringVar(&downloader.Options.BackupFolder, "folder", workingDirectory, "backup folder, s3://bucket/prefix for S3 compatible object storage, sftp://user@host/path for an SFTP server, or webdav://user@host/path (webdavs:// for HTTPS) for a WebDAV server such as Nextcloud")
+	flag.StringVar(&downloader.Options.SSHKey, "ssh-key", "", "private key for sftp:// backup folders, keys with a passphrase need an ssh agent (default the ssh agent and the keys in ~/.ssh)")
+	flag.StringVar(&downloader.Options.KnownHosts, "known-hosts", "", "known_hosts file checking the host key of sftp:// servers (default ~/.ssh/known_hosts)")
+	flag.StringVar(&downloader.Options.Encrypt, "encrypt", "", "encrypt the stored files: age (to the identity of -encrypt-key, suffix .age) or aes-gcm (with the key of -encrypt-key, suffix .aesgcm)")
+	flag.StringVar(&downloader.Options.EncryptKey, "encrypt-key", "", "with -encrypt age, an identity file made by age-keygen, which may be encrypted with 'age -p' (passphrase in GITMOO_PASSPHRASE). With -encrypt aes-gcm, a file holding a 256 bits key in hex")
+	flag.StringVar(&downloader.Options.EncryptTo, "encrypt-to", "", "with -encrypt age, a file of additional age recipients the stored files are encrypted to, such as an offline key")
 	flag.StringVar(&downloader.Options.AlbumID, "album", "", "download only from this album (use google album id)")
 	flag.IntVar(&downloader.Options.MaxItems, "max", math.MaxInt32, "max items to download")
 	flag.IntVar(&downloader.Options.PageSize, "pagesize", 50, "number of items to download on per API call")
 	flag.IntVar(&downloader.Options.Throttle, "throttle", 5, "time, in seconds, to wait between API calls")
 	flag.StringVar(&downloader.Options.FolderFormat, "folder-format", filepath.Join("2006", "January"), "time format used for folder paths based on https://golang.org/pkg/time/#Time.Format")
+	flag.StringVar(&downloader.Options.FolderTemplate, "folder-template", "", "naming template for folders, e.g. '{year}/{month:02}', overrides -folder-format")
 	flag.BoolVar(&downloader.Options.UseFileName, "use-file-name", false, "use file name when uploaded to Google Photos")
+	flag.StringVar(&downloader.Options.FileTemplate, "file-template", "", "naming template for files, e.g. '{year}{month:02}{day:02}_{id8}{mime_ext}', or a preset: legacy, filename (same as -use-file-name)")
+	flag.StringVar(&downloader.Options.SanitizeProfile, "sanitize", "", "how file and folder names are made safe: posix, windows (also SMB shares) or portable. Windows and portable detect file names differing only by case as conflicts (default windows on Windows, posix otherwise)")
+	flag.BoolVar(&downloader.Options.EmbedMetadata, "embed-metadata", false, "write the creation date, description, camera and Google Photos id into downloaded JPEG files when missing, and the creation time into MP4 and QuickTime videos, without re-encoding")
+	flag.BoolVar(&downloader.Options.EmbedVideoTags, "embed-video-tags", false, "with -embed-metadata, also add the creation date (©day) and description (©des) to videos, this may rewrite the whole file")
+	flag.BoolVar(&downloader.Options.WriteXMP, "xmp", false, "write an XMP sidecar (description, creation time, camera, albums as keywords, Google Photos id) next to each media file")
+	flag.BoolVar(&downloader.Options.Checksums, "checksums", false, "keep a SHA256SUMS file of the media files in every folder, which can be checked with 'sha256sum -c'")
+	flag.StringVar(&downloader.Options.ChecksumsKey, "checksums-key", "", "with -checksums, sign every SHA256SUMS file with this signify secret key (created with 'signify -G -n'), into SHA256SUMS.sig")
+	flag.StringVar(&downloader.Options.TimeZone, "timezone", "", "IANA time zone used to bucket items by date in folders and names, e.g. 'America/Los_Angeles', or Local (default UTC)")
+	flag.BoolVar(&downloader.Options.TimeZoneFromEXIF, "timezone-exif", false, "bucket photos by the capture-local UTC offset in their EXIF data (OffsetTimeOriginal) when available, requires -include-exif")
 	flag.BoolVar(&downloader.Options.IncludeEXIF, "include-exif", false, "retain EXIF metadata on downloaded images. Location information is not included.")
-	flag.Float64Var(&downloader.Options.DownloadThrottle, "download-throttle", 0, "rate in KB/sec, to limit downloading of items")
+	flag.Float64Var(&downloader.Options.DownloadThrottle, "download-throttle", 0, "rate in KB/sec, to limit downloading of items (shared by all concurrent downloads)")
+	flag.StringVar(&downloader.Options.BandwidthSchedule, "bandwidth-schedule", "", "time-of-day download rate limits shared by all downloads, e.g. 'Mon-Fri 08:00-18:00=200KB, *=unlimited'")
 	flag.IntVar(&downloader.Options.ConcurrentDownloads, "concurrent-downloads", 5, "number of concurrent item downloads")
+	flag.StringVar(&downloader.Options.MinFreeSpace, "min-free", "", "free space to leave on the volume of a local backup folder, e.g. '10GB', downloads pause when an item would go below it or not fit (sizes are estimated from the dimensions and type of items)")
+	flag.StringVar(&downloader.Options.MaxArchiveSize, "max-size", "", "size the media files of the backup folder may take, e.g. '500GB', downloads pause when an item would go over it (default unlimited)")
+	flag.StringVar(&downloader.Options.Dedupe, "dedupe", "", "what to do with downloaded items identical to stored ones: hardlink, reflink (copy-on-write clone, Linux only) or alias (record in the JSON file only), default keeps both copies")
+	flag.StringVar(&downloader.Options.AdoptFolder, "adopt", "", "folder of existing copies (e.g. from gphotos-sync, rclone or exports), items matching a file by name, time and dimensions are taken from it instead of downloaded")
+	flag.StringVar(&downloader.Options.AdoptMode, "adopt-mode", "copy", "how files from -adopt are put in the backup folder: copy, move, hardlink (same file system) or reflink (copy-on-write clone, Linux only)")
+	flag.BoolVar(&downloader.Options.AdoptHash, "adopt-hash", false, "hash the files of -adopt, so matching files with different content are told apart")
+	flag.StringVar(&downloader.Options.DeletedPolicy, "deleted-policy", "keep", "what to do with items deleted from Google Photos: keep (report only), trash (move to .trash) or mark (mark in the JSON file)")
+	flag.IntVar(&downloader.Options.TrashRetentionDays, "trash-retention", 0, "days to keep items in .trash before removing them (0 keeps them forever)")
+	flag.StringVar(&downloader.Options.Pack, "pack", "", "pack the files of finished folders into one archive per folder, tar or zip (uncompressed), items added later go into further archives of the folder")
+	flag.IntVar(&downloader.Options.PackAfterDays, "pack-after", 31, "with -pack, days after the newest item of a folder was created before the folder is packed")
+	flag.BoolVar(&downloader.Options.KeepMetadataHistory, "metadata-history", false, "keep previous versions of metadata changed in Google Photos in the JSON file")
+	flag.IntVar(&downloader.Options.DeferredRetryDelay, "deferred-retry", 60, "time, in minutes, to wait before fetching again videos still being processed by Google Photos")
 	flag.StringVar(&downloader.Options.CredentialsFile, "credentials-file", "credentials.json", "filepath to where the credentials file can be found")
 	flag.StringVar(&downloader.Options.TokenFile, "token-file", "token.json", "filepath to where the token should be stored")
 	flag.IntVar(&options.loopbackPort, "loopback-port", 8080, "Loopback port for Google authentication process")
 
+	flag.Usage = usage
 	flag.Parse()
 	if options.logfile != "" {
 		log.SetOutput(&lumberjack.Logger{
@@ -188,7 +228,22 @@ func main() {
 		log.Println("This is gitmoo-goog ver", version.Version)
 	}
 
-	err := process(downloader)
+	err := downloader.OpenStorage()
+	if err != nil {
+		log.Println(err)
+		os.Exit(1)
+	}
+	if flag.NArg() > 0 {
+		command, ok := commands[flag.Arg(0)]
+		if !ok {
+			log.Printf("Unknown command '%v'", flag.Arg(0))
+			flag.Usage()
+			os.Exit(2)
+		}
+		err = command.run(downloader, flag.Args()[1:])
+	} else {
+		err = process(downloader)
+	}
 	if err != nil {
 		log.Println(err)
 		os.Exit(1)